@@ -0,0 +1,102 @@
+package conf
+
+import (
+	"fmt"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bradfitz/slice"
+)
+
+// defaultAccept is the preference of notifications with bodyTemplates and no
+// accept.
+const defaultAccept = "application/json"
+
+type mediaRange struct {
+	typ string
+	q   float64
+}
+
+// parseAccept parses v, a list of media ranges with optional q values as in
+// an HTTP Accept header, and returns them most preferred first. Ranges with a
+// q of 0 are dropped.
+func parseAccept(v string) ([]mediaRange, error) {
+	var ranges []mediaRange
+	for _, part := range strings.Split(v, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		typ, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			return nil, err
+		}
+		r := mediaRange{typ: typ, q: 1}
+		if q, ok := params["q"]; ok {
+			if r.q, err = strconv.ParseFloat(q, 64); err != nil || r.q < 0 || r.q > 1 {
+				return nil, fmt.Errorf("bad q value %s", q)
+			}
+		}
+		if r.q > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+	// Ranges with equal q keep their declared order.
+	sort.Stable(slice.SortInterface(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	}))
+	return ranges, nil
+}
+
+func (r mediaRange) matches(contentType string) bool {
+	typ, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case r.typ == "*/*":
+		return true
+	case strings.HasSuffix(r.typ, "/*"):
+		return strings.HasPrefix(typ, r.typ[:len(r.typ)-1])
+	}
+	return typ == r.typ
+}
+
+// negotiateBodyTemplate returns the body template among names whose content
+// type is most preferred by accept.
+func (c *Conf) negotiateBodyTemplate(names []string, accept string) *BodyTemplate {
+	if accept == "" {
+		accept = defaultAccept
+	}
+	ranges, err := parseAccept(accept)
+	if err != nil {
+		c.errorf("bad accept %s: %v", accept, err)
+	}
+	var bts []*BodyTemplate
+	seen := make(map[string]string)
+	for _, name := range names {
+		bt := c.BodyTemplates[name]
+		if bt == nil {
+			c.errorf("unknown bodyTemplate %s", name)
+		}
+		if bt.ContentType == "" {
+			c.errorf("bodyTemplate %s in bodyTemplates has no contentType", name)
+		}
+		typ, _, _ := mime.ParseMediaType(bt.ContentType)
+		if other, ok := seen[typ]; ok {
+			c.errorf("bodyTemplates %s and %s both have contentType %s", other, name, typ)
+		}
+		seen[typ] = name
+		bts = append(bts, bt)
+	}
+	for _, r := range ranges {
+		for _, bt := range bts {
+			if r.matches(bt.ContentType) {
+				return bt
+			}
+		}
+	}
+	c.errorf("no bodyTemplate in bodyTemplates matches accept %s", accept)
+	return nil
+}
@@ -0,0 +1,59 @@
+package conf
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// defaultAckLinkExpiry is how long signed acknowledge links work by default.
+const defaultAckLinkExpiry = 24 * time.Hour
+
+// SignedAckLink returns a link that acknowledges incident id without a login
+// until expires, or "" if ackLinkSecret is not set. The link is signed with
+// an HMAC of the incident and expiry keyed by ackLinkSecret, so it cannot be
+// changed to acknowledge another incident or to work longer.
+func (c *Conf) SignedAckLink(id int64, expires time.Time) string {
+	if c.AckLinkSecret == "" {
+		return ""
+	}
+	exp := expires.Unix()
+	return c.MakeLink("/api/ack/signed", &url.Values{
+		"incident": []string{fmt.Sprint(id)},
+		"expires":  []string{fmt.Sprint(exp)},
+		"sig":      []string{c.ackSignature(id, exp)},
+	})
+}
+
+// VerifyAckLink returns the incident of the query parameters v of a link from
+// SignedAckLink, or an error if the link is invalid or expired at now.
+func (c *Conf) VerifyAckLink(v url.Values, now time.Time) (int64, error) {
+	if c.AckLinkSecret == "" {
+		return 0, fmt.Errorf("signed acknowledge links are disabled")
+	}
+	id, err := strconv.ParseInt(v.Get("incident"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad incident: %q", v.Get("incident"))
+	}
+	exp, err := strconv.ParseInt(v.Get("expires"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad expires: %q", v.Get("expires"))
+	}
+	if !hmac.Equal([]byte(v.Get("sig")), []byte(c.ackSignature(id, exp))) {
+		return 0, fmt.Errorf("bad signature")
+	}
+	if now.Unix() > exp {
+		return 0, fmt.Errorf("link expired at %v", time.Unix(exp, 0).UTC())
+	}
+	return id, nil
+}
+
+func (c *Conf) ackSignature(id, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(c.credential("ackLinkSecret", c.AckLinkSecret)))
+	fmt.Fprintf(mac, "ack:%d:%d", id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,177 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"bosun.org/cmd/bosun/conf/parse"
+)
+
+// diffContext is the number of unchanged lines shown around changes.
+const diffContext = 3
+
+// AlertDiff returns a unified diff of the section of alert name in the
+// configuration and in text, the configuration with the alert edited, so
+// that the edit can be reviewed without the rest of the file. Lines outside
+// the section are not compared, but the hunk headers number lines as in the
+// whole files, so they stay right when edits before the alert or to it move
+// lines. An alert only in one of them is shown as added or removed. The diff
+// is empty if the section is unchanged.
+func (c *Conf) AlertDiff(name, text string) (string, error) {
+	after, err := parse.Parse(c.Name, text)
+	if err != nil {
+		return "", err
+	}
+	aStart, aLines := alertSection(c.tree, c.RawText, name)
+	bStart, bLines := alertSection(after, text, name)
+	if aLines == nil && bLines == nil {
+		return "", fmt.Errorf("unknown alert: %s", name)
+	}
+	ops := diffLines(aLines, bLines)
+	hunks := diffHunks(ops, aStart, bStart)
+	if len(hunks) == 0 {
+		return "", nil
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "--- %s: alert %s\n+++ %s: alert %s (edited)\n", c.Name, name, c.Name, name)
+	for _, h := range hunks {
+		buf.WriteString(h)
+	}
+	return buf.String(), nil
+}
+
+// alertSection returns the lines of the section of alert name in the
+// configuration text parsed as t, and the index of its first line. If there
+// is no such alert, lines is nil and start is the number of lines of text, so
+// that the alert is added or removed at its end.
+func alertSection(t *parse.Tree, text, name string) (start int, lines []string) {
+	for _, n := range t.Root.Nodes {
+		s, ok := n.(*parse.SectionNode)
+		if !ok || s.SectionType.Text != "alert" || s.Name.Text != name {
+			continue
+		}
+		begin := strings.LastIndex(text[:s.Pos], "\n") + 1
+		end := int(s.Pos) + len(s.RawText)
+		if i := strings.Index(text[end:], "\n"); i >= 0 {
+			end += i
+		} else {
+			end = len(text)
+		}
+		return strings.Count(text[:begin], "\n"), strings.Split(text[begin:end], "\n")
+	}
+	if text == "" {
+		return 0, nil
+	}
+	return strings.Count(strings.TrimSuffix(text, "\n"), "\n") + 1, nil
+}
+
+// diffOp is a line of a diff: kept (' '), removed ('-') or added ('+').
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines returns the edits that turn a into b, keeping a longest common
+// subsequence of their lines. Sections are short, so the quadratic table is
+// cheap.
+func diffLines(a, b []string) []diffOp {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	return ops
+}
+
+// diffHunks formats ops as unified diff hunks, with diffContext lines of
+// context, for lines of a and b starting at the indexes aStart and bStart.
+func diffHunks(ops []diffOp, aStart, bStart int) []string {
+	var hunks []string
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// The hunk starts diffContext lines before the change, and ends
+		// once diffContext lines after a change are not followed by
+		// another within 2*diffContext lines.
+		first := i - diffContext
+		if first < 0 {
+			first = 0
+		}
+		last := i
+		for j := i; j < len(ops) && j <= last+2*diffContext; j++ {
+			if ops[j].kind != ' ' {
+				last = j
+			}
+		}
+		end := last + diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		// Line numbers of the first line of the hunk.
+		aLine, bLine := aStart, bStart
+		for _, op := range ops[:first] {
+			if op.kind != '+' {
+				aLine++
+			}
+			if op.kind != '-' {
+				bLine++
+			}
+		}
+		var aCount, bCount int
+		body := new(bytes.Buffer)
+		for _, op := range ops[first:end] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+			fmt.Fprintf(body, "%c%s\n", op.kind, op.line)
+		}
+		hunks = append(hunks, fmt.Sprintf("@@ -%s +%s @@\n%s", hunkRange(aLine, aCount), hunkRange(bLine, bCount), body))
+		i = end
+	}
+	return hunks
+}
+
+// hunkRange formats the range of count lines from the index start as in a
+// unified diff hunk header: 1-based, or the line before an empty range.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
@@ -0,0 +1,91 @@
+package conf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"bosun.org/collect"
+	"bosun.org/metadata"
+	"bosun.org/opentsdb"
+)
+
+func init() {
+	metadata.AddMetricMeta(
+		"bosun.notifications.body_cache_hits", metadata.Counter, metadata.Count,
+		"The number of notification bodies reused instead of rendered again, because another notification of the same dispatch rendered the same body template with the same payload.")
+}
+
+// BodyCache holds the bodies rendered by the notifications of one dispatch,
+// such as the notifications of one incident, so that notifications with the
+// same body template and variables render a payload once between them. A new
+// cache is used for each dispatch, so bodies are never stale.
+type BodyCache struct {
+	mu     sync.Mutex
+	bodies map[string]*cachedBody
+}
+
+type cachedBody struct {
+	once sync.Once
+	out  []byte
+	err  error
+}
+
+func NewBodyCache() *BodyCache {
+	return &BodyCache{bodies: make(map[string]*cachedBody)}
+}
+
+// render returns the body of payload for n: that rendered by another
+// notification with the same body template for the same payload, if there was
+// one, otherwise that of render. Concurrent calls for the same body wait for
+// the first. Failed renders are not shared, so that each notification reports
+// its own error.
+func (b *BodyCache) render(n *Notification, payload []byte, render func() ([]byte, error)) ([]byte, error) {
+	if b == nil || n.bodyKey == "" {
+		return render()
+	}
+	h := sha256.New()
+	h.Write([]byte(n.bodyKey))
+	h.Write(payload)
+	key := string(h.Sum(nil))
+	b.mu.Lock()
+	e := b.bodies[key]
+	if e == nil {
+		e = new(cachedBody)
+		b.bodies[key] = e
+	}
+	b.mu.Unlock()
+	hit := true
+	e.once.Do(func() {
+		hit = false
+		e.out, e.err = render()
+	})
+	if e.err != nil {
+		if hit {
+			return render()
+		}
+		return nil, e.err
+	}
+	if hit {
+		collect.Add("notifications.body_cache_hits", opentsdb.TagSet{"notification": n.Name}, 1)
+	}
+	return e.out, nil
+}
+
+// setBodyKey sets the key under which n's rendered bodies are cached: the
+// source of its body template and the variables it may expand with V, which
+// are all its output depends on besides the payload.
+func (n *Notification) setBodyKey() {
+	if n.Body == nil || n.Body.Tree == nil {
+		n.bodyKey = ""
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString(n.Body.Tree.Root.String())
+	// Maps are printed sorted by key.
+	fmt.Fprintf(&buf, "\x00%v", n.Vars)
+	sum := sha256.Sum256(buf.Bytes())
+	n.bodyKey = hex.EncodeToString(sum[:])
+}
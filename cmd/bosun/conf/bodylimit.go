@@ -0,0 +1,133 @@
+package conf
+
+import (
+	"bytes"
+	"net/url"
+	"unicode/utf8"
+
+	"bosun.org/models"
+	"bosun.org/slog"
+)
+
+// defaultMaxBodyBytes are the body size limits of channels that reject or cut
+// larger messages, used by notifications without maxBodyBytes. Other
+// channels, such as email, have none.
+var defaultMaxBodyBytes = map[string]int{
+	// sms is for notifiers registered under that key: one text message.
+	"sms": 160,
+	// SNS rejects messages over 256 KB.
+	"sns": 256 << 10,
+	// Teams rejects cards over 28 KB, which includes the rest of the card.
+	"teams": 24 << 10,
+	// slack is for posts to Slack webhooks and slackBlocks messages, whose
+	// text Slack cuts after 40,000 characters.
+	"slack": 40000,
+}
+
+// truncatedMarker ends bodies cut to their size limit.
+const truncatedMarker = "[truncated]"
+
+// maxBodyBytes returns the body size limit of n for channel, or 0 if there is
+// none.
+func (n *Notification) maxBodyBytes(channel string) int {
+	if n.maxBodySet {
+		return n.MaxBodyBytes
+	}
+	if channel == "post" && (n.SlackBlocks != nil || n.Post != nil && n.Post.Host == "hooks.slack.com") {
+		channel = "slack"
+	}
+	return defaultMaxBodyBytes[channel]
+}
+
+// LimitBody returns body cut to the size limit of ni's notification for
+// channel as truncateBody does, for notifiers registered with
+// RegisterNotifier that render their own body.
+func (ni *NotificationInstance) LimitBody(channel string, body []byte) []byte {
+	n := ni.Notification
+	max := n.maxBodyBytes(channel)
+	if max == 0 || len(body) <= max {
+		return body
+	}
+	n.logTruncated(channel, ni.AlertKey, len(body), max)
+	return truncateBody(body, max, n.alertLink(ni.AlertKey))
+}
+
+// limitBody returns the output of render for payload, limited to the size
+// limit of n for channel. If the output was rendered by a template, payload
+// is cut and rendered again instead, so that output such as JSON stays well
+// formed; the output itself is only cut if that does not fit it.
+func (n *Notification) limitBody(channel, ak string, payload []byte, render func([]byte) ([]byte, bool, error)) ([]byte, bool, error) {
+	out, rendered, err := render(payload)
+	max := n.maxBodyBytes(channel)
+	if err != nil || max == 0 || len(out) <= max {
+		return out, rendered, err
+	}
+	n.logTruncated(channel, ak, len(out), max)
+	link := n.alertLink(ak)
+	// Templates may escape the payload or add to it, so the payload is cut
+	// in proportion and a few tries may be needed.
+	for i := 0; rendered && i < 3 && len(out) > max; i++ {
+		keep := len(payload) * max / len(out)
+		if keep == 0 {
+			break
+		}
+		payload = truncateBody(payload, keep, link)
+		if out, rendered, err = render(payload); err != nil {
+			return nil, false, err
+		}
+	}
+	if len(out) > max {
+		out = truncateBody(out, max, link)
+	}
+	return out, rendered, nil
+}
+
+func (n *Notification) logTruncated(channel, ak string, size, max int) {
+	slog.Warningf("notification %s: %s body of %d bytes for %s truncated to %d", n.Name, channel, size, ak, max)
+}
+
+// alertLink returns the link to the alert key ak in bosun, or "" if ak is not
+// an alert key.
+func (n *Notification) alertLink(ak string) string {
+	if n.makeLink == nil {
+		return ""
+	}
+	if _, err := models.ParseAlertKey(ak); err != nil {
+		return ""
+	}
+	return n.makeLink("/action", &url.Values{
+		"type": []string{"ack"},
+		"key":  []string{ak},
+	})
+}
+
+// truncateBody returns body cut to at most max bytes and ended with the
+// truncatedMarker and link. It cuts at the last line break or space of the
+// second half of what fits, or else between UTF-8 characters. The link is
+// left out if it would take more than half of max, and the marker too if it
+// still would.
+func truncateBody(body []byte, max int, link string) []byte {
+	if len(body) <= max {
+		return body
+	}
+	marker := "\n" + truncatedMarker
+	if link != "" {
+		marker += " " + link
+	}
+	if len(marker) > max/2 {
+		marker = " " + truncatedMarker
+	}
+	if len(marker) > max/2 {
+		marker = ""
+	}
+	cut := max - len(marker)
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	if i := bytes.LastIndexAny(body[:cut], "\n "); i >= cut/2 {
+		cut = i
+	}
+	out := make([]byte, 0, cut+len(marker))
+	out = append(out, body[:cut]...)
+	return append(out, marker...)
+}
@@ -0,0 +1,126 @@
+package conf
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"bosun.org/slog"
+	"github.com/bradfitz/slice"
+)
+
+// BreakerState describes the circuit breaker of one post or get target.
+// State is "closed" while deliveries are attempted, "open" while they are
+// skipped after too many consecutive failures, and "half-open" once the
+// cool-down has passed and the next delivery will test the target.
+type BreakerState struct {
+	Target    string
+	State     string
+	Failures  int
+	OpenUntil time.Time `json:",omitempty"`
+}
+
+type breaker struct {
+	threshold int
+	failures  int
+	openUntil time.Time
+	trial     bool // a half-open test delivery is in flight
+}
+
+func (b *breaker) state(now time.Time) string {
+	switch {
+	case b.failures < b.threshold:
+		return "closed"
+	case now.Before(b.openUntil):
+		return "open"
+	}
+	return "half-open"
+}
+
+var breakers = struct {
+	sync.Mutex
+	m map[string]*breaker
+}{m: make(map[string]*breaker)}
+
+// breakerTarget returns the name of the circuit of requests with method to u.
+// It is served by /api/notifications/breakers, so any password in u is
+// left out.
+func breakerTarget(method string, u *url.URL) string {
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			c := *u
+			c.User = url.User(u.User.Username())
+			u = &c
+		}
+	}
+	return method + " " + u.String()
+}
+
+// withBreaker calls send unless the circuit of target is open. After
+// c.BreakerFailures consecutive failures the circuit opens for
+// c.BreakerCooldown, during which deliveries are skipped with an error. Then a
+// single delivery is let through: if it succeeds the circuit closes, otherwise
+// it opens again. A BreakerFailures of zero disables the breaker.
+func (c *Conf) withBreaker(target string, send func() error) error {
+	if c.BreakerFailures <= 0 {
+		return send()
+	}
+	breakers.Lock()
+	b := breakers.m[target]
+	if b == nil {
+		b = new(breaker)
+		breakers.m[target] = b
+	}
+	b.threshold = c.BreakerFailures
+	switch b.state(time.Now()) {
+	case "open":
+		breakers.Unlock()
+		err := fmt.Errorf("circuit open for %s after %d consecutive failures, skipping delivery", target, b.failures)
+		slog.Warningln(err)
+		return err
+	case "half-open":
+		if b.trial {
+			breakers.Unlock()
+			return fmt.Errorf("circuit half-open for %s, skipping delivery while testing", target)
+		}
+		b.trial = true
+	}
+	breakers.Unlock()
+	err := send()
+	breakers.Lock()
+	defer breakers.Unlock()
+	b.trial = false
+	if err == nil {
+		b.failures = 0
+		return nil
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(c.BreakerCooldown)
+		slog.Errorf("opening circuit for %s for %v after %d consecutive failures", target, c.BreakerCooldown, b.failures)
+	}
+	return err
+}
+
+// BreakerStates returns the circuit breaker state of every post and get
+// target that has been delivered to, sorted by target.
+func BreakerStates() []BreakerState {
+	breakers.Lock()
+	defer breakers.Unlock()
+	now := time.Now()
+	states := make([]BreakerState, 0, len(breakers.m))
+	for target, b := range breakers.m {
+		bs := BreakerState{
+			Target:   target,
+			State:    b.state(now),
+			Failures: b.failures,
+		}
+		if bs.State != "closed" {
+			bs.OpenUntil = b.openUntil
+		}
+		states = append(states, bs)
+	}
+	slice.Sort(states, func(i, j int) bool { return states[i].Target < states[j].Target })
+	return states
+}
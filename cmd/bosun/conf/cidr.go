@@ -0,0 +1,49 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// TagMatcher matches the values of a tag. Squelches match values with
+// regexps or CIDRs.
+type TagMatcher interface {
+	MatchString(v string) bool
+	String() string
+}
+
+// CIDR matches tag values that are IP addresses within a network, such as
+// 10.1.0.0/16 or 2001:db8::/32. Values that are not IP addresses never match.
+type CIDR struct {
+	*net.IPNet
+}
+
+// MatchString reports whether v is an IP address within c.
+func (c CIDR) MatchString(v string) bool {
+	ip := net.ParseIP(strings.TrimSpace(v))
+	return ip != nil && c.Contains(ip)
+}
+
+func (c CIDR) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// cidrRE matches values written as IPv4 or IPv6 networks in CIDR notation.
+// They are parsed with net.ParseCIDR, so that a malformed one is an error
+// rather than a glob or regexp that matches nothing.
+var cidrRE = regexp.MustCompile(`^(?:[0-9.]+\.[0-9.]+|[0-9A-Fa-f:.]*:[0-9A-Fa-f:.]*)/[0-9]+$`)
+
+// parseCIDR parses a tag value of the form address/prefix. ok is false if s
+// is not written as a CIDR.
+func parseCIDR(s string) (c CIDR, ok bool, err error) {
+	if !cidrRE.MatchString(s) {
+		return c, false, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return c, true, fmt.Errorf("bad CIDR %s: %v", s, err)
+	}
+	return CIDR{n}, true, nil
+}
@@ -1,10 +1,12 @@
 package conf // import "bosun.org/cmd/bosun/conf"
 
 import (
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	htemplate "html/template"
-	"io/ioutil"
+	"mime"
 	"net"
 	"net/http"
 	"net/mail"
@@ -12,6 +14,7 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	ttemplate "text/template"
@@ -25,6 +28,7 @@ import (
 	"bosun.org/opentsdb"
 	"bosun.org/slog"
 	"github.com/MiniProfiler/go/miniprofiler"
+	"github.com/bradfitz/slice"
 	"github.com/influxdata/influxdb/client"
 )
 
@@ -39,10 +43,12 @@ type Conf struct {
 	SMTPHost        string // SMTP address: ny-mail:25
 	SMTPUsername    string // SMTP username
 	SMTPPassword    string // SMTP password
+	SMTPPoolSize    int    // Maximum number of SMTP connections, reused between emails. Zero disables reuse.
 	Ping            bool
 	PingDuration    time.Duration // Duration from now to stop pinging hosts based on time since the host tag was touched
 	EmailFrom       string
 	StateFile       string
+	Environment     string // Name of the environment, such as prod, for email subject prefixes.
 	LedisDir        string
 	LedisBindAddr   string
 
@@ -50,29 +56,70 @@ type Conf struct {
 	RedisDb       int
 	RedisPassword string
 
+	// EmailSubjectPrefix, if set, is rendered with EmailSubjectPrefixData
+	// and prepended to the subject of emails of notifications without one of
+	// their own.
+	EmailSubjectPrefix *ttemplate.Template `json:"-"`
+
 	TimeAndDate      []int // timeanddate.com cities list
 	ResponseLimit    int64
 	SearchSince      opentsdb.Duration
 	UnknownTemplate  *Template
 	UnknownThreshold int
 	Templates        map[string]*Template
+	BodyTemplates    map[string]*BodyTemplate
 	Alerts           map[string]*Alert
 	Notifications    map[string]*Notification `json:"-"`
 	RawText          string
+	Source           RuleSource `json:"-"` // Where RawText was read from; nil unless read with Load.
 	Macros           map[string]*Macro
 	Lookups          map[string]*Lookup
-	Squelch          Squelches `json:"-"`
+	NotificationSets map[string]*NotificationSet
+	Escalations      map[string]*Escalation
+	DerivedTags      []*DerivedTag // In declaration order, the order they are derived in.
+	Squelch          Squelches     `json:"-"`
 	Quiet            bool
 	SkipLast         bool
 	NoSleep          bool
 	ShortURLKey      string
 	InternetProxy    string
 	MinGroupSize     int
+	FormatOnSave     bool            // Normalize rule config text with FormatRawText before it is saved.
+	EnableSave       bool            // Allow /api/config/save to overwrite the rule source.
+	AlertTimeout     time.Duration   // Default evaluation timeout for alerts without one.
+	BodyError        BodyErrorPolicy // Default handling of notification body template errors.
+	UnjoinedOK       bool            // Default unjoinedOk of alerts that do not set it.
+	MaxMacroDepth    int             // Maximum number of macros nested in each other.
+	ContentType      string          // Default Content-Type of post notifications whose body is not JSON.
+	MaxLogFrequency  time.Duration   // Default maxLogFrequency of log alerts without one.
+	BreakerFailures  int             // Consecutive post or get failures that open a target's circuit. Zero disables the breaker.
+	BreakerCooldown  time.Duration   // How long an open circuit skips deliveries.
+	SubjectNewlines  SubjectNewlines // Handling of CR and LF in rendered subjects.
+	TagPolicy        TagPolicy       // Normalization of the tags of squelches and lookups, and of the tags they match.
+	Severities       SeverityPalette // Colors and icons of statuses in notifications.
+	DrainTimeout     time.Duration   // How long shutdown waits for notification deliveries. Zero disables draining.
+	ChainTimeout     time.Duration   // How long each notification of a firstSuccess chain is waited on before the next is tried.
+	JournalRetention time.Duration   // How long queued notifications are replayed after restarts and sent ones remembered. Zero disables the journal.
+	AlertTestDir     string          // Directory of the alert test fixtures, see sched.AlertFixture.
+	StormThreshold   int             // Alert keys becoming critical within StormWindow above which notifications are sent as digests. Zero disables storm mode.
+	StormWindow      time.Duration   // Window in which StormThreshold applies.
+	TimeZone         *time.Location  `json:"-"` // Default time zone of schedules and of alerts' template times.
+	Teams            []string        // If set, the only valid alert owners.
+
+	// WebhookMaxIdleConnsPerHost and WebhookDialTimeout tune the HTTP client
+	// shared by post and get notifications. WebhookTimeout is the request
+	// timeout of those without a requestTimeout.
+	WebhookMaxIdleConnsPerHost int
+	WebhookDialTimeout         time.Duration
+	WebhookTimeout             time.Duration
 
 	TSDBHost             string                    // OpenTSDB relay and query destination: ny-devtsdb04:4242
 	TSDBVersion          *opentsdb.Version         // If set to 2.2 , enable passthrough of wildcards and filters, and add support for groupby
+	TSDBGzip             bool                      // Gzip compress OpenTSDB query requests.
 	GraphiteHost         string                    // Graphite query host: foo.bar.baz
 	GraphiteHeaders      []string                  // extra http headers when querying graphite.
+	GraphiteUsername     string                    // basic auth username when querying graphite.
+	GraphitePassword     string                    // basic auth password when querying graphite.
 	LogstashElasticHosts expr.LogstashElasticHosts // CSV Elastic Hosts (All part of the same cluster) that stores logstash documents, i.e http://ny-elastic01:9200. Only works with elastc pre-v2, and expects the schema to be logstash's default.
 	ElasticHosts         expr.ElasticHosts         // CSV Elastic Hosts (All part of the same cluster), i.e http://ny-elastic01:9200. Only works with elastic v2+, and unlike logstash it is designed to be able to use various elastic schemas.
 	InfluxConfig         client.Config
@@ -80,12 +127,51 @@ type Conf struct {
 	AnnotateElasticHosts []string // CSV of Elastic Hosts, currently the only backend in annotate
 	AnnotateIndex        string   // name of index / table
 
+	// RelayTLS, if set, makes the relay serve HTTPS instead of HTTP.
+	RelayTLS *tls.Config `json:"-"`
+
+	// NotificationSchemes are the URL schemes notifications may post and
+	// get. DenyPrivateURLs rejects notification URLs on loopback, private
+	// and link-local addresses. See checkNotificationURLs.
+	NotificationSchemes []string
+	DenyPrivateURLs     bool
+
+	// RelayBatchSize, if positive, makes relayed puts queue their data points
+	// to be sent to the TSDB in batches of up to that many, at least every
+	// RelayFlushInterval. RelayQueueSize bounds the queue; puts that do not fit
+	// wait for room, or are dropped if RelayDropWhenFull. See checkRelayBatching.
+	RelayBatchSize     int
+	RelayFlushInterval time.Duration
+	RelayQueueSize     int
+	RelayDropWhenFull  bool
+
+	// AckLinkSecret, if set, keys the HMAC of the links from SignedAckLink,
+	// which work for AckLinkExpiry.
+	AckLinkSecret string `json:"-"`
+	AckLinkExpiry time.Duration
+
+	// SecretResolver reads the credentials set to vault("path", "field").
+	// It reads from the Vault server at VaultAddress, rereading secrets
+	// every VaultRefresh if it is positive, or is DefaultSecretResolver.
+	SecretResolver SecretResolver `json:"-"`
+	VaultAddress   string
+	VaultRefresh   time.Duration
+
 	tree            *parse.Tree
 	node            parse.Node
 	unknownTemplate string
 	bodies          *htemplate.Template
 	subjects        *ttemplate.Template
 	squelch         []string
+	trace           *[]nodePair // if set, getPairs appends every pair to it
+
+	relayTLSCert, relayTLSKey, relayTLSClientCA string
+
+	relayBatchKeys []string // relay batching globals that were set
+
+	vaultToken string
+	secrets    map[string]*secretRef // credentials that refer to secrets, by key
+	webhook    *webhookClient
 }
 
 // TSDBContext returns an OpenTSDB context limited to
@@ -94,7 +180,16 @@ func (c *Conf) TSDBContext() opentsdb.Context {
 	if c.TSDBHost == "" {
 		return nil
 	}
-	return opentsdb.NewLimitContext(c.TSDBHost, c.ResponseLimit, *c.TSDBVersion)
+	ctx := opentsdb.NewLimitContext(c.TSDBHost, c.ResponseLimit, *c.TSDBVersion)
+	ctx.Gzip = c.TSDBGzip
+	return ctx
+}
+
+// InfluxClientConfig returns InfluxConfig with the current influxPassword.
+func (c *Conf) InfluxClientConfig() client.Config {
+	ic := c.InfluxConfig
+	ic.Password = c.credential("influxPassword", ic.Password)
+	return ic
 }
 
 // GraphiteContext returns a Graphite context. A nil context is returned if
@@ -103,11 +198,16 @@ func (c *Conf) GraphiteContext() graphite.Context {
 	if c.GraphiteHost == "" {
 		return nil
 	}
-	if len(c.GraphiteHeaders) > 0 {
-		headers := http.Header(make(map[string][]string))
+	if len(c.GraphiteHeaders) > 0 || c.GraphiteUsername != "" {
+		headers := make(http.Header)
 		for _, s := range c.GraphiteHeaders {
-			kv := strings.Split(s, ":")
-			headers.Add(kv[0], kv[1])
+			k, v, _ := parseHeader(s)
+			headers.Add(k, v)
+		}
+		if c.GraphiteUsername != "" {
+			password := c.credential("graphitePassword", c.GraphitePassword)
+			auth := base64.StdEncoding.EncodeToString([]byte(c.GraphiteUsername + ":" + password))
+			headers.Set("Authorization", "Basic "+auth)
 		}
 		return graphite.HostHeader{
 			Host:   c.GraphiteHost,
@@ -117,22 +217,77 @@ func (c *Conf) GraphiteContext() graphite.Context {
 	return graphite.Host(c.GraphiteHost)
 }
 
-type Squelch map[string]*regexp.Regexp
+// parseHeader splits a "key:value" HTTP header. Only the first colon
+// separates the key, so values may themselves contain colons.
+func parseHeader(s string) (key, value string, err error) {
+	kv := strings.SplitN(s, ":", 2)
+	if len(kv) != 2 {
+		return "", "", fmt.Errorf("header must be in key:value form")
+	}
+	key = strings.TrimSpace(kv[0])
+	if key == "" || strings.ContainsAny(key, " \t") {
+		return "", "", fmt.Errorf("invalid header name %q", key)
+	}
+	return key, strings.TrimSpace(kv[1]), nil
+}
+
+// Squelch maps tag keys to the regexps their values must match, or, for
+// values written as networks such as 10.1.0.0/16, the CIDR their IP addresses
+// must be within. A key that contains * is a key pattern, in which * matches
+// any run of characters: it is met by any tag whose key matches the pattern
+// and whose value matches.
+type Squelch map[string]TagMatcher
 
 type Squelches struct {
 	s []Squelch
+	// policy normalizes the tags of squelches as they are added, and the
+	// tags they are matched against.
+	policy TagPolicy
+}
+
+// SquelchError is an invalid regexp or CIDR of a squelch tag.
+type SquelchError struct {
+	Key     string
+	Pattern string
+	Err     error // the error compiling Pattern
+}
+
+func (e *SquelchError) Error() string {
+	return fmt.Sprintf("squelch tag %s: invalid pattern %q: %v", e.Key, e.Pattern, e.Err)
 }
 
+func (e *SquelchError) Unwrap() error { return e.Err }
+
 func (s *Squelches) Add(v string) error {
 	tags, err := opentsdb.ParseTags(v)
 	if tags == nil && err != nil {
 		return err
 	}
+	if s.policy != (TagPolicy{}) {
+		if err := s.policy.ValidateTagSet(tags); err != nil {
+			return err
+		}
+	}
 	sq := make(Squelch)
 	for k, v := range tags {
-		re, err := regexp.Compile(v)
+		if s.policy.LowerKeys {
+			k = strings.ToLower(k)
+		}
+		if cidr, ok, err := parseCIDR(v); ok {
+			if err != nil {
+				return &SquelchError{Key: k, Pattern: v, Err: err}
+			}
+			sq[k] = cidr
+			continue
+		}
+		pattern := v
+		if s.policy.LowerValues {
+			// Lowercasing the pattern could change its escapes.
+			pattern = "(?i)" + v
+		}
+		re, err := regexp.Compile(pattern)
 		if err != nil {
-			return err
+			return &SquelchError{Key: k, Pattern: v, Err: err}
 		}
 		sq[k] = re
 	}
@@ -141,30 +296,97 @@ func (s *Squelches) Add(v string) error {
 }
 
 func (s *Squelches) Squelched(tags opentsdb.TagSet) bool {
+	return s.Matching(tags) != nil
+}
+
+// Matching returns the first squelch that squelches tags, or nil if none does.
+func (s *Squelches) Matching(tags opentsdb.TagSet) Squelch {
+	tags = s.policy.NormalizeTagSet(tags)
 	for _, q := range s.s {
 		if q.Squelched(tags) {
-			return true
+			return q
 		}
 	}
-	return false
+	return nil
 }
 
 func (s Squelch) Squelched(tags opentsdb.TagSet) bool {
 	if len(s) == 0 {
 		return false
 	}
+	// Exact keys are checked first, since key patterns must be matched
+	// against every tag.
+	hasPatterns := false
 	for k, v := range s {
+		if isKeyPattern(k) {
+			hasPatterns = true
+			continue
+		}
 		tagv, ok := tags[k]
 		if !ok || !v.MatchString(tagv) {
 			return false
 		}
 	}
+	if !hasPatterns {
+		return true
+	}
+Patterns:
+	for k, v := range s {
+		if !isKeyPattern(k) {
+			continue
+		}
+		for tagk, tagv := range tags {
+			if matchKeyPattern(k, tagk) && v.MatchString(tagv) {
+				continue Patterns
+			}
+		}
+		return false
+	}
 	return true
 }
 
+func isKeyPattern(k string) bool {
+	return strings.Contains(k, "*")
+}
+
+// matchKeyPattern reports whether key matches pattern, in which * matches any
+// run of characters.
+func matchKeyPattern(pattern, key string) bool {
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(key, parts[0]) {
+		return false
+	}
+	key = key[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(key, part)
+		if i < 0 {
+			return false
+		}
+		key = key[i+len(part):]
+	}
+	return strings.HasSuffix(key, last)
+}
+
+// String returns the squelch as tagk=regexp (or tagk=cidr) pairs sorted by
+// tag key, as it could be written in the configuration.
+func (s Squelch) String() string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = k + "=" + s[k].String()
+	}
+	return strings.Join(keys, ",")
+}
+
+// AlertSquelched returns a function that reports whether tags, with the
+// derived tags added, are squelched globally or by a.
 func (c *Conf) AlertSquelched(a *Alert) func(opentsdb.TagSet) bool {
 	return func(tags opentsdb.TagSet) bool {
-		return c.Squelched(a, tags)
+		return c.Squelched(a, c.Derive(tags))
 	}
 }
 
@@ -172,6 +394,18 @@ func (c *Conf) Squelched(a *Alert, tags opentsdb.TagSet) bool {
 	return c.Squelch.Squelched(tags) || a.Squelch.Squelched(tags)
 }
 
+// SquelchedBy returns the squelch, global or of a, that squelches tags, or ""
+// if tags are not squelched. Global squelches are tried first.
+func (c *Conf) SquelchedBy(a *Alert, tags opentsdb.TagSet) string {
+	if q := c.Squelch.Matching(tags); q != nil {
+		return q.String()
+	}
+	if q := a.Squelch.Matching(tags); q != nil {
+		return q.String()
+	}
+	return ""
+}
+
 // at marks the state to be on node n, for error reporting.
 func (c *Conf) at(node parse.Node) {
 	c.node = node
@@ -185,6 +419,28 @@ func (c *Conf) AnnotateEnabled() bool {
 	return len(c.AnnotateElasticHosts) != 0
 }
 
+// EnabledBackends returns the names of the configured query backends, as
+// used in expr.Backends.Disabled.
+func (c *Conf) EnabledBackends() []string {
+	var backends []string
+	if c.TSDBHost != "" {
+		backends = append(backends, expr.BackendTSDB)
+	}
+	if c.GraphiteHost != "" {
+		backends = append(backends, expr.BackendGraphite)
+	}
+	if c.InfluxConfig.URL.Host != "" {
+		backends = append(backends, expr.BackendInflux)
+	}
+	if len(c.LogstashElasticHosts) != 0 {
+		backends = append(backends, expr.BackendLogstash)
+	}
+	if len(c.ElasticHosts) != 0 {
+		backends = append(backends, expr.BackendElastic)
+	}
+	return backends
+}
+
 // errorf formats the error and terminates processing.
 func (c *Conf) errorf(format string, args ...interface{}) {
 	if c.node == nil {
@@ -217,11 +473,14 @@ type Lookup struct {
 	Name    string
 	Tags    []string
 	Entries []*Entry
+
+	policy TagPolicy
 }
 
 func (lookup *Lookup) ToExpr() *ExprLookup {
 	l := ExprLookup{
-		Tags: lookup.Tags,
+		Tags:   lookup.Tags,
+		policy: lookup.policy,
 	}
 	for _, entry := range lookup.Entries {
 		l.Entries = append(l.Entries, entry.ExprEntry)
@@ -239,6 +498,10 @@ type Macro struct {
 	Text  string
 	Pairs []nodePair
 	Name  string
+
+	// path is the longest chain of macros included by this one, starting
+	// with itself.
+	path []string
 }
 
 type Alert struct {
@@ -259,16 +522,108 @@ type Alert struct {
 	UnjoinedOK       bool `json:",omitempty"`
 	Log              bool
 	RunEvery         int
-	returnType       models.FuncType
+	// ReturnType is the type crit and warn return, a number or a scalar.
+	ReturnType models.FuncType `json:"-"`
+
+	// SuppressOnDependsError holds the alert quiet, instead of erroring, when
+	// its Depends expression cannot be evaluated.
+	SuppressOnDependsError bool `json:",omitempty"`
+	// TestMode evaluates the alert and records state as usual, but never
+	// dispatches notifications. What would have been sent is logged instead.
+	TestMode bool `json:",omitempty"`
+	// Disabled keeps the alert loaded and validated, but it is not checked.
+	// Its alert keys are inactive, as outside of a RunSchedule.
+	Disabled bool `json:",omitempty"`
+	// Downsample, such as 5m-avg, downsamples the OpenTSDB queries of the
+	// alert that do not downsample themselves.
+	Downsample string `json:",omitempty"`
+	// Timeout bounds how long one check of the alert may take. An alert that
+	// exceeds it is marked as errored. Zero means no limit.
+	Timeout time.Duration `json:",omitempty"`
+	// RunSchedule, if set, restricts evaluation to the times it matches.
+	// Outside of it the alert is inactive rather than unknown.
+	RunSchedule *RunSchedule `json:",omitempty"`
+	// TimeZone is the zone RunSchedule is matched in, unless it has its own,
+	// and that templates format times in. It defaults to the global one.
+	TimeZone *time.Location `json:"-"`
+	// NotificationTags is evaluated after crit and warn. The tags of each of
+	// its results beyond those of the alert key it matches are added to the
+	// alert key's tags when notification lookups are resolved.
+	NotificationTags *expr.Expr `json:",omitempty"`
+	// ShadowCrit is evaluated alongside Crit, typically against another
+	// backend, and alert keys where the two disagree are logged. It never
+	// affects the alert's state or notifications.
+	ShadowCrit *expr.Expr `json:",omitempty"`
+	// CritFallback and WarnFallback are evaluated in place of Crit and Warn
+	// when those fail with an error FallbackOn covers.
+	CritFallback *expr.Expr     `json:",omitempty"`
+	WarnFallback *expr.Expr     `json:",omitempty"`
+	FallbackOn   FallbackPolicy `json:",omitempty"`
+	// Cooldown is how long after an alert key recovers that a return to
+	// critical is coalesced into its previous incident instead of opening
+	// and notifying a new one. Zero disables it.
+	Cooldown time.Duration `json:",omitempty"`
+	// WarnToCritAfter is how long an alert key stays warning before it is
+	// treated as critical. Zero disables it.
+	WarnToCritAfter time.Duration `json:",omitempty"`
+	// CritAfter is how many consecutive evaluations an alert key must be
+	// critical for before it is treated as critical. Until then it is the
+	// warning or normal its warn expression makes it. Zero or one treats
+	// the first critical evaluation as critical.
+	CritAfter int `json:",omitempty"`
+	// LogBackoff, if set, doubles the interval between logs of an alert key
+	// from MaxLogFrequency after each log, up to LogBackoff, until the alert
+	// key is normal again.
+	LogBackoff time.Duration `json:",omitempty"`
+	// Runbook is a link to, or text of, the instructions for handling the
+	// alert. Owner is the team responsible for it, unless the alert key or
+	// notification tags have a value for the tag OwnerTag. An alert without
+	// notifications is routed to the notificationSet named after its Owner.
+	Runbook  string `json:",omitempty"`
+	Owner    string `json:",omitempty"`
+	OwnerTag string `json:",omitempty"`
 
 	template string
 	squelch  []string
+
+	// unjoinedDefault is whether UnjoinedOK is the global default, because
+	// the alert does not set it.
+	unjoinedDefault bool
+
+	// notificationOverrides are the alert's copies, by name, of notifications
+	// whose timeout or next it overrides through a notification set.
+	notificationOverrides map[string]*Notification
+
+	runSchedule, scheduleZone string
+
+	// expanded holds every pair of the alert, including variables, after
+	// macro and variable expansion. See ExpandTrace.
+	expanded []nodePair
 }
 
 type Notifications struct {
 	Notifications map[string]*Notification `json:"-"`
 	// Table key -> table
 	Lookups map[string]*Lookup
+	// FirstSuccess sends the notifications one at a time in priority order
+	// (see Ordered), stopping at the first one that is delivered, instead of
+	// sending all of them at once.
+	FirstSuccess bool `json:",omitempty"`
+}
+
+// Ordered returns nots sorted by priority, lowest first, and then by name.
+func Ordered(nots map[string]*Notification) []*Notification {
+	ordered := make([]*Notification, 0, len(nots))
+	for _, n := range nots {
+		ordered = append(ordered, n)
+	}
+	slice.Sort(ordered, func(i, j int) bool {
+		if ordered[i].Priority != ordered[j].Priority {
+			return ordered[i].Priority < ordered[j].Priority
+		}
+		return ordered[i].Name < ordered[j].Name
+	})
+	return ordered
 }
 
 // Get returns the set of notifications based on given tags.
@@ -349,11 +704,56 @@ type Template struct {
 	body, subject string
 }
 
+// SubjectHasNewlines reports whether the text of t's subject template spans
+// several lines.
+func (t *Template) SubjectHasNewlines() bool {
+	return strings.ContainsAny(t.subject, "\r\n")
+}
+
+// SubjectNewlines is what happens when a rendered subject contains a CR or
+// LF, which would allow header injection into emails.
+type SubjectNewlines string
+
+const (
+	// SubjectNewlinesStrip replaces them with spaces, and logs it if the
+	// subject template itself is a single line. It is the default.
+	SubjectNewlinesStrip SubjectNewlines = "strip"
+	// SubjectNewlinesReject fails the subject, so that the template error
+	// notification is sent instead. Subject templates must be one line.
+	SubjectNewlinesReject SubjectNewlines = "reject"
+)
+
+// defaultMaxReminders is the MaxReminders of notifications with a reminder
+// but no maxReminders.
+const defaultMaxReminders = 10
+
+// NextFor returns the notification to escalate to after n for an alert with
+// the given current status: the status specific next if there is one,
+// otherwise Next.
+func (n *Notification) NextFor(status models.Status) *Notification {
+	if next, ok := n.NextByStatus[status]; ok {
+		return next
+	}
+	return n.Next
+}
+
+// BodyTemplate is a POST body shared by notifications that reference it with
+// bodyTemplate. It is parsed separately for each notification so that V
+// expands the variables of the notification using it.
+type BodyTemplate struct {
+	Text string
+	Name string
+	Body string
+	// ContentType, if set, is the Content-Type of posts using the body.
+	ContentType string `json:",omitempty"`
+}
+
 type Notification struct {
 	Text string
 	Vars
 	Name         string
 	Email        []*mail.Address
+	From         *mail.Address
 	Post, Get    *url.URL
 	Body         *ttemplate.Template
 	Print        bool
@@ -362,21 +762,126 @@ type Notification struct {
 	ContentType  string
 	RunOnActions bool
 	UseBody      bool
-
+	BodyError    BodyErrorPolicy
+	Priority     int
+	// PayloadVersion is the schema version of the posted body, sent in
+	// the PayloadVersionHeader header. Zero for unversioned bodies.
+	PayloadVersion int
+	// RequestTimeout bounds each post and get, separately from Timeout, the
+	// time until Next. Zero uses the global webhookTimeout.
+	RequestTimeout time.Duration `json:",omitempty"`
+	// Reminder, if set, resends the notification this often while the
+	// incident it was sent for is open, abnormal and unacknowledged, at
+	// most MaxReminders times. Unlike Next it does not escalate.
+	Reminder     time.Duration `json:",omitempty"`
+	MaxReminders int           `json:",omitempty"`
+	// MaxBodyBytes, if set, limits the size of the body of every channel,
+	// cutting larger ones with a link to the alert (see truncateBody).
+	// Otherwise channels with a known limit have theirs (see
+	// defaultMaxBodyBytes). Zero disables limits.
+	MaxBodyBytes int  `json:",omitempty"`
+	maxBodySet   bool // maxBodyBytes was specified
+	// If, if set, is rendered with the incident state, and the notification
+	// is only sent for incidents for which it is true (see Allows). If
+	// IfStopsChain, a false If also stops the escalation to Next.
+	If           *ttemplate.Template `json:"-"`
+	IfStopsChain bool                `json:",omitempty"`
+
+	BodyTemplateName string
+	// Escalation is the escalation this notification is a step of, for the
+	// copies of notifications made for an alert's escalations.
+	Escalation string `json:",omitempty"`
+	// NextByStatus overrides Next for alerts whose current status is the
+	// key, so that escalation can depend on severity.
+	NextByStatus map[models.Status]*Notification `json:"-"`
+
+	base      string // the notification an escalation step copies
+	bodyKey   string // identifies Body and its variables in a BodyCache
+	webhook   *webhookClient
 	next      string
 	email     string
 	post, get string
 	body      string
+
+	// user and password are sent as basic auth credentials with posts and
+	// gets. They are kept unexported so they are never marshaled or logged.
+	user, password string
+
+	// SNSTopic is the ARN of an SNS topic to publish to. SNSTagAttributes
+	// adds the tags of the alert key as message attributes.
+	SNSTopic         string
+	SNSTagAttributes bool
+
+	sns                                                *snsClient
+	snsRegion, snsEndpoint, snsAccessKey, snsSecretKey string
+
+	// SuccessPointer is a JSON pointer into the response body of posts. If
+	// set, a post only succeeds if the value it points to is SuccessValue.
+	SuccessPointer string      `json:",omitempty"`
+	SuccessValue   interface{} `json:",omitempty"`
+
+	successValue string
+
+	// SlackBlocks renders the Block Kit blocks of a Slack message posted
+	// instead of the body. See executeSlackBlocks.
+	SlackBlocks *ttemplate.Template `json:"-"`
+
+	slackBlocks string
+	makeLink    func(path string, v *url.Values) string
+	severity    func(models.Status) *SeverityMeta
+
+	// Teams is the Microsoft Teams connector webhook URL the notification
+	// posts a MessageCard to. See TeamsCard.
+	Teams *url.URL `json:",omitempty"`
+
+	// Event, if set, sends trigger, acknowledge and resolve events to an
+	// incident management API. See EventData.
+	Event *EventTemplates `json:",omitempty"`
+
+	// Syslog, if set, writes the payload, executed through the body
+	// template, to syslog or journald. See SyslogTarget.
+	Syslog *SyslogTarget `json:",omitempty"`
+
+	// EmailCharset and EmailEncoding are the character set and transfer
+	// encoding of the subject and body of emails. Empty means UTF-8 and
+	// quoted-printable.
+	EmailCharset  string `json:",omitempty"`
+	EmailEncoding string `json:",omitempty"`
+	// EmailSubjectPrefix overrides the global EmailSubjectPrefix.
+	EmailSubjectPrefix *ttemplate.Template `json:"-"`
+
+	noSubjectPrefix bool // emailSubjectPrefix = none
+
+	// SendSchedule, if set, restricts when the notification is sent.
+	// Outside of it OutsideSchedule is sent instead. See SendAt.
+	SendSchedule    *RunSchedule  `json:",omitempty"`
+	OutsideSchedule *Notification `json:"-"`
+
+	sendSchedule, sendScheduleZone string
+
+	// bodyTemplates are alternative bodyTemplate sections, one of which is
+	// chosen as the BodyTemplateName by their contentType and accept.
+	bodyTemplates []string
+	accept        string
+
+	// notifiers are those of the keys registered with RegisterNotifier.
+	notifiers []channelNotifier
+}
+
+// SendAt returns the notification to send at t in place of n: n itself if t
+// is in its sendSchedule, and otherwise the notification outside of the
+// schedule, which may have a schedule of its own.
+func (n *Notification) SendAt(t time.Time) *Notification {
+	for n.SendSchedule != nil && !n.SendSchedule.Matches(t) {
+		n = n.OutsideSchedule
+	}
+	return n
 }
 
 type Vars map[string]string
 
 func ParseFile(fname string) (*Conf, error) {
-	f, err := ioutil.ReadFile(fname)
-	if err != nil {
-		return nil, err
-	}
-	return New(fname, string(f))
+	return Load(&FileSource{Path: fname})
 }
 
 func New(name, text string) (c *Conf, err error) {
@@ -390,19 +895,36 @@ func New(name, text string) (c *Conf, err error) {
 		LedisDir:         "ledis_data",
 		LedisBindAddr:    "127.0.0.1:9565",
 		MinGroupSize:     5,
+		MaxMacroDepth:    10,
+		SMTPPoolSize:     4,
+		ContentType:      "application/x-www-form-urlencoded",
+		BreakerFailures:  5,
+		BreakerCooldown:  5 * time.Minute,
+		DrainTimeout:     30 * time.Second,
+		ChainTimeout:     30 * time.Second,
+		JournalRetention: 24 * time.Hour,
+		StormWindow:      5 * time.Minute,
+		BodyError:        BodyErrorFallback,
+		SubjectNewlines:  SubjectNewlinesStrip,
+		Severities:       defaultSeverities.copy(),
 		PingDuration:     time.Hour * 24,
 		ResponseLimit:    1 << 20, // 1MB
 		SearchSince:      opentsdb.Day * 3,
 		TSDBVersion:      &opentsdb.Version2_1,
 		UnknownThreshold: 5,
+		TimeZone:         time.UTC,
 		Vars:             make(map[string]string),
 		Templates:        make(map[string]*Template),
+		BodyTemplates:    make(map[string]*BodyTemplate),
 		Alerts:           make(map[string]*Alert),
 		Notifications:    make(map[string]*Notification),
 		RawText:          text,
 		bodies:           htemplate.New(name).Funcs(htemplate.FuncMap(defaultFuncs)),
 		subjects:         ttemplate.New(name).Funcs(defaultFuncs),
 		Lookups:          make(map[string]*Lookup),
+		NotificationSets: make(map[string]*NotificationSet),
+		Escalations:      make(map[string]*Escalation),
+		webhook:          new(webhookClient),
 		Macros:           make(map[string]*Macro),
 	}
 	c.tree, err = parse.Parse(name, text)
@@ -422,6 +944,20 @@ func New(name, text string) (c *Conf, err error) {
 			c.errorf("unexpected parse node %s", n)
 		}
 	}
+	c.at(nil)
+	c.loadSecrets()
+	c.loadWebhookClient()
+	c.loadRelayTLS()
+	c.checkRelayBatching()
+	if c.AckLinkExpiry == 0 {
+		c.AckLinkExpiry = defaultAckLinkExpiry
+	}
+	c.checkNotificationURLs()
+	c.checkSubjectPrefixes()
+	if c.GraphitePassword != "" && c.GraphiteUsername == "" {
+		c.at(nil)
+		c.errorf("graphitePassword specified, but no graphiteUsername")
+	}
 	if c.Hostname == "" {
 		c.Hostname = c.HTTPListen
 		if strings.HasPrefix(c.Hostname, ":") {
@@ -468,13 +1004,23 @@ func (c *Conf) loadGlobal(p *parse.PairNode) {
 			c.errorf("error pasing opentsdb minor version number %v: %v", sp[1], err)
 		}
 		c.TSDBVersion = &opentsdb.Version{Major: major, Minor: minor}
+	case "tsdbGzip":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			c.error(err)
+		}
+		c.TSDBGzip = b
 	case "graphiteHost":
 		c.GraphiteHost = v
 	case "graphiteHeader":
-		if !strings.Contains(v, ":") {
-			c.errorf("graphiteHeader must be in key:value form")
+		if _, _, err := parseHeader(v); err != nil {
+			c.errorf("graphiteHeader: %v", err)
 		}
 		c.GraphiteHeaders = append(c.GraphiteHeaders, v)
+	case "graphiteUsername":
+		c.GraphiteUsername = v
+	case "graphitePassword":
+		c.GraphitePassword = c.loadCredential(k, v, func(s string) { c.GraphitePassword = s })
 	case "logstashElasticHosts":
 		c.LogstashElasticHosts = strings.Split(v, ",")
 	case "elasticHosts":
@@ -487,7 +1033,7 @@ func (c *Conf) loadGlobal(p *parse.PairNode) {
 	case "influxUsername":
 		c.InfluxConfig.Username = v
 	case "influxPassword":
-		c.InfluxConfig.Password = v
+		c.InfluxConfig.Password = c.loadCredential(k, v, func(s string) { c.InfluxConfig.Password = s })
 	case "influxTLS":
 		b, err := strconv.ParseBool(v)
 		if err != nil {
@@ -511,14 +1057,83 @@ func (c *Conf) loadGlobal(p *parse.PairNode) {
 		c.Hostname = v
 	case "relayListen":
 		c.RelayListen = v
+	case "relayTLSCert":
+		c.relayTLSCert = v
+	case "relayTLSKey":
+		c.relayTLSKey = v
+	case "relayTLSClientCA":
+		c.relayTLSClientCA = v
+	case "ackLinkSecret":
+		c.AckLinkSecret = c.loadCredential(k, v, func(s string) { c.AckLinkSecret = s })
+	case "ackLinkExpiry":
+		d, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		if d <= 0 {
+			c.errorf("ackLinkExpiry must be positive")
+		}
+		c.AckLinkExpiry = time.Duration(d)
+	case "relayBatchSize":
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			c.error(err)
+		}
+		if i < 0 {
+			c.errorf("relayBatchSize must not be negative")
+		}
+		c.RelayBatchSize = i
+	case "relayFlushInterval":
+		d, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		if d <= 0 {
+			c.errorf("relayFlushInterval must be positive")
+		}
+		c.RelayFlushInterval = time.Duration(d)
+		c.relayBatchKeys = append(c.relayBatchKeys, k)
+	case "relayQueueSize":
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			c.error(err)
+		}
+		if i <= 0 {
+			c.errorf("relayQueueSize must be positive")
+		}
+		c.RelayQueueSize = i
+		c.relayBatchKeys = append(c.relayBatchKeys, k)
+	case "relayQueueFull":
+		switch v {
+		case "block":
+			c.RelayDropWhenFull = false
+		case "drop":
+			c.RelayDropWhenFull = true
+		default:
+			c.errorf("relayQueueFull must be block or drop, not %s", v)
+		}
+		c.relayBatchKeys = append(c.relayBatchKeys, k)
 	case "smtpHost":
 		c.SMTPHost = v
 	case "smtpUsername":
 		c.SMTPUsername = v
 	case "smtpPassword":
-		c.SMTPPassword = v
+		c.SMTPPassword = c.loadCredential(k, v, func(s string) { c.SMTPPassword = s })
+	case "smtpPoolSize":
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			c.error(err)
+		}
+		if i < 0 {
+			c.errorf("smtpPoolSize must be >= 0")
+		}
+		c.SMTPPoolSize = i
 	case "emailFrom":
 		c.EmailFrom = v
+	case "environment":
+		c.Environment = v
+	case "emailSubjectPrefix":
+		c.EmailSubjectPrefix = c.parseSubjectPrefix("emailSubjectPrefix", v)
 	case "stateFile":
 		c.StateFile = v
 	case "ping":
@@ -557,6 +1172,8 @@ func (c *Conf) loadGlobal(p *parse.PairNode) {
 			c.errorf("responseLimit must be > 0")
 		}
 		c.ResponseLimit = i
+	case "alertTimeout":
+		c.AlertTimeout = c.parseTimeout(v)
 	case "defaultRunEvery":
 		var err error
 		c.DefaultRunEvery, err = strconv.Atoi(v)
@@ -595,7 +1212,20 @@ func (c *Conf) loadGlobal(p *parse.PairNode) {
 	case "redisHost":
 		c.RedisHost = v
 	case "redisPassword":
-		c.RedisPassword = v
+		c.RedisPassword = c.loadCredential(k, v, func(s string) { c.RedisPassword = s })
+	case "vaultAddress":
+		c.VaultAddress = v
+	case "vaultToken":
+		c.vaultToken = v
+	case "vaultRefresh":
+		d, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		if d <= 0 {
+			c.errorf("vaultRefresh must be positive")
+		}
+		c.VaultRefresh = time.Duration(d)
 	case "redisDb":
 		i, err := strconv.Atoi(v)
 		if err != nil {
@@ -606,12 +1236,179 @@ func (c *Conf) loadGlobal(p *parse.PairNode) {
 		c.AnnotateElasticHosts = strings.Split(v, ",")
 	case "annotationIndex":
 		c.AnnotateIndex = v
+	case "timeZone":
+		c.TimeZone = c.parseTimeZone(k, v)
+	case "teams":
+		c.Teams = nil
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				c.Teams = append(c.Teams, t)
+			}
+		}
 	case "minGroupSize":
 		i, err := strconv.Atoi(v)
 		if err != nil {
 			c.error(err)
 		}
 		c.MinGroupSize = i
+	case "unjoinedOk":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			c.error(err)
+		}
+		c.UnjoinedOK = b
+	case "formatOnSave":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			c.error(err)
+		}
+		c.FormatOnSave = b
+	case "enableSave":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			c.error(err)
+		}
+		c.EnableSave = b
+	case "bodyError":
+		c.BodyError = c.parseBodyError(v)
+	case "defaultMaxLogFrequency":
+		d, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		if d < 0 {
+			c.errorf("defaultMaxLogFrequency must not be negative")
+		}
+		c.MaxLogFrequency = time.Duration(d)
+	case "breakerFailures":
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			c.error(err)
+		}
+		if i < 0 {
+			c.errorf("breakerFailures must be >= 0")
+		}
+		c.BreakerFailures = i
+	case "breakerCooldown":
+		d, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		if d <= 0 {
+			c.errorf("breakerCooldown must be positive")
+		}
+		c.BreakerCooldown = time.Duration(d)
+	case "notificationSchemes":
+		c.NotificationSchemes = nil
+		for _, scheme := range strings.Split(v, ",") {
+			if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+				c.NotificationSchemes = append(c.NotificationSchemes, scheme)
+			}
+		}
+		if len(c.NotificationSchemes) == 0 {
+			c.errorf("notificationSchemes must list at least one scheme")
+		}
+	case "denyPrivateURLs":
+		c.DenyPrivateURLs = v == "true"
+	case "webhookMaxIdleConnsPerHost":
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			c.error(err)
+		}
+		if i <= 0 {
+			c.errorf("webhookMaxIdleConnsPerHost must be positive")
+		}
+		c.WebhookMaxIdleConnsPerHost = i
+	case "webhookDialTimeout", "webhookTimeout":
+		d, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		if d <= 0 {
+			c.errorf("%s must be positive", k)
+		}
+		if k == "webhookDialTimeout" {
+			c.WebhookDialTimeout = time.Duration(d)
+		} else {
+			c.WebhookTimeout = time.Duration(d)
+		}
+	case "drainTimeout":
+		d, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		if d < 0 {
+			c.errorf("drainTimeout must not be negative")
+		}
+		c.DrainTimeout = time.Duration(d)
+	case "firstSuccessTimeout":
+		d, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		if d <= 0 {
+			c.errorf("firstSuccessTimeout must be positive")
+		}
+		c.ChainTimeout = time.Duration(d)
+	case "notificationJournalRetention":
+		d, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		if d < 0 {
+			c.errorf("notificationJournalRetention must not be negative")
+		}
+		c.JournalRetention = time.Duration(d)
+	case "severityColors", "severityIcons":
+		c.setSeverities(k, v)
+	case "stormThreshold":
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			c.error(err)
+		}
+		if i < 0 {
+			c.errorf("stormThreshold must not be negative")
+		}
+		c.StormThreshold = i
+	case "stormWindow":
+		d, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		if d <= 0 {
+			c.errorf("stormWindow must be positive")
+		}
+		c.StormWindow = time.Duration(d)
+	case "tagNormalization":
+		if len(c.Squelch.s) > 0 || len(c.Lookups) > 0 || len(c.Alerts) > 0 {
+			c.errorf("tagNormalization must be set before squelches, lookups and alerts")
+		}
+		p, err := parseTagPolicy(v)
+		if err != nil {
+			c.error(err)
+		}
+		c.TagPolicy = p
+		c.Squelch.policy = p
+	case "alertTestDir":
+		c.AlertTestDir = v
+	case "defaultContentType":
+		c.ContentType = v
+	case "subjectNewlines":
+		c.SubjectNewlines = SubjectNewlines(v)
+		switch c.SubjectNewlines {
+		case SubjectNewlinesStrip, SubjectNewlinesReject:
+		default:
+			c.errorf("subjectNewlines must be %s or %s", SubjectNewlinesStrip, SubjectNewlinesReject)
+		}
+	case "maxMacroDepth":
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			c.error(err)
+		}
+		if i <= 0 {
+			c.errorf("maxMacroDepth must be > 0")
+		}
+		c.MaxMacroDepth = i
 	default:
 		if !strings.HasPrefix(k, "$") {
 			c.errorf("unknown key %s", k)
@@ -633,11 +1430,66 @@ func (c *Conf) loadSection(s *parse.SectionNode) {
 		c.loadMacro(s)
 	case "lookup":
 		c.loadLookup(s)
+	case "bodyTemplate":
+		c.loadBodyTemplate(s)
+	case "notificationSet":
+		c.loadNotificationSet(s)
+	case "escalation":
+		c.loadEscalation(s)
+	case "derivedTag":
+		c.loadDerivedTag(s)
 	default:
 		c.errorf("unknown section type: %s", s.SectionType.Text)
 	}
 }
 
+// parseTimeout parses an evaluation timeout, which must be positive.
+func (c *Conf) parseTimeout(v string) time.Duration {
+	d, err := opentsdb.ParseDuration(v)
+	if err != nil {
+		c.error(err)
+	}
+	if d <= 0 {
+		c.errorf("timeout must be positive")
+	}
+	return time.Duration(d)
+}
+
+// FallbackPolicy is the kind of evaluation error after which an alert's
+// critFallback and warnFallback expressions are used.
+type FallbackPolicy string
+
+const (
+	// FallbackOnBackendError falls back only when a query to a backend
+	// failed. It is the default.
+	FallbackOnBackendError FallbackPolicy = "backendError"
+	// FallbackOnError falls back on any error, including timeouts and
+	// errors in the expression itself.
+	FallbackOnError FallbackPolicy = "error"
+)
+
+// parseNotificationMode reports whether v selects first-success dispatch.
+func (c *Conf) parseNotificationMode(v string) bool {
+	switch v {
+	case "all":
+		return false
+	case "firstSuccess":
+		return true
+	}
+	c.errorf("notification mode must be all or firstSuccess")
+	return false
+}
+
+func (c *Conf) parseBodyError(v string) BodyErrorPolicy {
+	p := BodyErrorPolicy(v)
+	switch p {
+	case BodyErrorDrop, BodyErrorFallback, BodyErrorDegraded:
+		return p
+	}
+	c.errorf("bodyError must be one of %s, %s or %s", BodyErrorDrop, BodyErrorFallback, BodyErrorDegraded)
+	return ""
+}
+
 func (c *Conf) parseIPs(s string) (nets []*net.IPNet) {
 	rawCIDRs := strings.Split(s, ",")
 	for _, rc := range rawCIDRs {
@@ -651,9 +1503,10 @@ func (c *Conf) parseIPs(s string) (nets []*net.IPNet) {
 }
 
 type nodePair struct {
-	node parse.Node
-	key  string
-	val  string
+	node  parse.Node
+	key   string
+	val   string
+	macro string // innermost macro the pair was included from, if any
 }
 
 type sectionType int
@@ -666,8 +1519,11 @@ const (
 func (c *Conf) getPairs(s *parse.SectionNode, vars Vars, st sectionType) (pairs []nodePair) {
 	saw := make(map[string]bool)
 	ignoreBadExpand := st == sMacro
-	add := func(n parse.Node, k, v string) {
+	add := func(n parse.Node, k, v, macro string) {
 		c.seen(k, saw)
+		if c.trace != nil {
+			*c.trace = append(*c.trace, nodePair{node: n, key: k, val: v, macro: macro})
+		}
 		if vars != nil && strings.HasPrefix(k, "$") {
 			vars[k] = v
 			if st != sMacro {
@@ -675,9 +1531,10 @@ func (c *Conf) getPairs(s *parse.SectionNode, vars Vars, st sectionType) (pairs
 			}
 		} else {
 			pairs = append(pairs, nodePair{
-				node: n,
-				key:  k,
-				val:  v,
+				node:  n,
+				key:   k,
+				val:   v,
+				macro: macro,
 			})
 		}
 	}
@@ -693,10 +1550,14 @@ func (c *Conf) getPairs(s *parse.SectionNode, vars Vars, st sectionType) (pairs
 					c.errorf("macro not found: %s", v)
 				}
 				for _, p := range m.Pairs {
-					add(p.node, p.key, c.Expand(p.val, vars, ignoreBadExpand))
+					macro := p.macro
+					if macro == "" {
+						macro = v
+					}
+					add(p.node, p.key, c.Expand(p.val, vars, ignoreBadExpand), macro)
 				}
 			default:
-				add(n, k, v)
+				add(n, k, v, "")
 			}
 		default:
 			c.errorf("unexpected node")
@@ -711,7 +1572,8 @@ func (c *Conf) loadLookup(s *parse.SectionNode) {
 		c.errorf("duplicate lookup name: %s", name)
 	}
 	l := Lookup{
-		Name: name,
+		Name:   name,
+		policy: c.TagPolicy,
 	}
 	l.Text = s.RawText
 	var lookupTags opentsdb.TagSet
@@ -727,6 +1589,7 @@ func (c *Conf) loadLookup(s *parse.SectionNode) {
 			if tags == nil && err != nil {
 				c.error(err)
 			}
+			tags = c.normalizeTags(tags)
 			if _, ok := saw[tags.String()]; ok {
 				c.errorf("duplicate entry")
 			}
@@ -754,14 +1617,36 @@ func (c *Conf) loadLookup(s *parse.SectionNode) {
 					Values:   make(map[string]string),
 				},
 			}
-			for _, en := range n.Nodes.Nodes {
-				c.at(en)
-				switch en := en.(type) {
-				case *parse.PairNode:
-					e.Values[en.Key.Text] = en.Val.Text
-				default:
-					c.errorf("unexpected node")
+			for k, v := range tags {
+				r, ok, err := parseRange(v)
+				if err != nil {
+					c.error(err)
+				}
+				if !ok {
+					continue
+				}
+				if e.Ranges == nil {
+					e.Ranges = make(map[string]Range)
 				}
+				e.Ranges[k] = r
+			}
+			for k, v := range tags {
+				cidr, ok, err := parseCIDR(v)
+				if err != nil {
+					c.error(err)
+				}
+				if !ok {
+					continue
+				}
+				if e.CIDRs == nil {
+					e.CIDRs = make(map[string]CIDR)
+				}
+				e.CIDRs[k] = cidr
+			}
+			// Values expand variables and include macros like alert
+			// pairs, so both must be defined before the lookup.
+			for _, p := range c.getPairs(n, make(Vars), sNormal) {
+				e.Values[p.key] = p.val
 			}
 			l.Entries = append(l.Entries, &e)
 		default:
@@ -779,16 +1664,68 @@ func (c *Conf) loadMacro(s *parse.SectionNode) {
 	}
 	m := Macro{
 		Name: name,
+		path: []string{name},
 	}
 	m.Text = s.RawText
+	if cycle := c.macroCycle(name); cycle != nil {
+		c.errorf("macro cycle: %s", strings.Join(cycle, " -> "))
+	}
 	pairs := c.getPairs(s, nil, sMacro)
 	for _, p := range pairs {
 		m.Pairs = append(m.Pairs, p)
 	}
+	for _, n := range s.Nodes.Nodes {
+		if p, ok := n.(*parse.PairNode); ok && p.Key.Text == "macro" {
+			inc := c.Macros[c.Expand(p.Val.Text, nil, true)]
+			if len(inc.path) >= len(m.path) {
+				m.path = append([]string{name}, inc.path...)
+			}
+		}
+	}
 	c.at(s)
+	if len(m.path) > c.MaxMacroDepth {
+		c.errorf("macros nested deeper than maxMacroDepth (%d): %s", c.MaxMacroDepth, strings.Join(m.path, " -> "))
+	}
 	c.Macros[name] = &m
 }
 
+// macroCycle returns the names of the macros in a cycle of inclusions from the
+// macro name back to itself, or nil if there is none. Macros must be declared
+// before they are included, so a cycle otherwise only shows up as a macro not
+// being found.
+func (c *Conf) macroCycle(name string) []string {
+	includes := make(map[string][]string)
+	for _, n := range c.tree.Root.Nodes {
+		s, ok := n.(*parse.SectionNode)
+		if !ok || s.SectionType.Text != "macro" {
+			continue
+		}
+		for _, n := range s.Nodes.Nodes {
+			if p, ok := n.(*parse.PairNode); ok && p.Key.Text == "macro" {
+				includes[s.Name.Text] = append(includes[s.Name.Text], p.Val.Text)
+			}
+		}
+	}
+	visited := make(map[string]bool)
+	var walk func(path []string) []string
+	walk = func(path []string) []string {
+		for _, inc := range includes[path[len(path)-1]] {
+			if inc == name {
+				return append(path, inc)
+			}
+			if visited[inc] {
+				continue
+			}
+			visited[inc] = true
+			if cycle := walk(append(path, inc)); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	return walk([]string{name})
+}
+
 var defaultFuncs = ttemplate.FuncMap{
 	"bytes": func(v interface{}) (ByteSize, error) {
 		switch v := v.(type) {
@@ -873,9 +1810,106 @@ func (c *Conf) loadTemplate(s *parse.SectionNode) {
 	if t.Body == nil && t.Subject == nil {
 		c.errorf("neither body or subject specified")
 	}
+	if c.SubjectNewlines == SubjectNewlinesReject && t.SubjectHasNewlines() {
+		c.errorf("subject contains a newline, which subjectNewlines = %s does not allow", SubjectNewlinesReject)
+	}
 	c.Templates[name] = &t
 }
 
+func (c *Conf) loadBodyTemplate(s *parse.SectionNode) {
+	name := s.Name.Text
+	if _, ok := c.BodyTemplates[name]; ok {
+		c.errorf("duplicate bodyTemplate name: %s", name)
+	}
+	t := BodyTemplate{
+		Text: s.RawText,
+		Name: name,
+	}
+	saw := make(map[string]bool)
+	for _, p := range s.Nodes.Nodes {
+		c.at(p)
+		switch p := p.(type) {
+		case *parse.PairNode:
+			c.seen(p.Key.Text, saw)
+			switch k := p.Key.Text; k {
+			case "body":
+				t.Body = p.Val.Text
+				if _, err := ttemplate.New(name).Funcs(notificationFuncs).Parse(t.Body); err != nil {
+					c.error(err)
+				}
+			case "contentType":
+				if _, _, err := mime.ParseMediaType(p.Val.Text); err != nil {
+					c.errorf("bad contentType: %v", err)
+				}
+				t.ContentType = p.Val.Text
+			default:
+				c.errorf("unknown key %s", k)
+			}
+		default:
+			c.errorf("unexpected node")
+		}
+	}
+	c.at(s)
+	if t.Body == "" {
+		c.errorf("no body specified")
+	}
+	c.BodyTemplates[name] = &t
+}
+
+// notificationFuncs are placeholders for the notification body functions,
+// used to check shared body templates before any notification uses them.
+var notificationFuncs = ttemplate.FuncMap{
+	"V":    func(string) string { return "" },
+	"json": func(interface{}) string { return "" },
+}
+
+// checkTemplateBody errors if a notification reachable from a, including
+// lookup notifications and next chains, sends the alert template's body
+// while the template has none, which would otherwise send blank messages.
+// Emails always use the template body; post, print and syslog only with
+// useBody.
+func (c *Conf) checkTemplateBody(a *Alert) {
+	if a.Template == nil || a.Template.Body != nil {
+		return
+	}
+	seen := make(map[*Notification]bool)
+	var check func(n *Notification)
+	check = func(n *Notification) {
+		if n == nil || seen[n] {
+			return
+		}
+		seen[n] = true
+		switch {
+		case n.Email != nil:
+			c.errorf("notification %s sends email, but template %s has no body", n.Name, a.Template.Name)
+		case n.UseBody:
+			c.errorf("notification %s has useBody set, but template %s has no body", n.Name, a.Template.Name)
+		}
+		check(n.Next)
+		check(n.OutsideSchedule)
+		for _, next := range n.NextByStatus {
+			check(next)
+		}
+	}
+	for _, ns := range []*Notifications{a.CritNotification, a.WarnNotification} {
+		for _, n := range ns.Notifications {
+			check(n)
+		}
+		for key, l := range ns.Lookups {
+			for _, e := range l.Entries {
+				v, ok := e.Values[key]
+				if !ok {
+					continue
+				}
+				nots, _ := c.parseNotifications(v)
+				for _, n := range nots {
+					check(n)
+				}
+			}
+		}
+	}
+}
+
 var lookupNotificationRE = regexp.MustCompile(`^lookup\("(.*)", "(.*)"\)$`)
 
 func (c *Conf) loadAlert(s *parse.SectionNode) {
@@ -923,7 +1957,11 @@ func (c *Conf) loadAlert(s *parse.SectionNode) {
 			ns.Notifications[k] = v
 		}
 	}
+	var critSet, warnSet notificationSetRef
+	unjoinedSet := false
+	c.trace = &a.expanded
 	pairs := c.getPairs(s, a.Vars, sNormal)
+	c.trace = nil
 	for _, p := range pairs {
 		c.at(p.node)
 		v := p.val
@@ -941,8 +1979,24 @@ func (c *Conf) loadAlert(s *parse.SectionNode) {
 			a.Warn = c.NewExpr(v)
 		case "depends":
 			a.Depends = c.NewExpr(v)
+		case "notificationTags":
+			a.NotificationTags = c.NewExpr(v)
+		case "shadowCrit":
+			a.ShadowCrit = c.NewExpr(v)
+		case "critFallback":
+			a.CritFallback = c.NewExpr(v)
+		case "warnFallback":
+			a.WarnFallback = c.NewExpr(v)
+		case "fallbackOn":
+			a.FallbackOn = FallbackPolicy(v)
+			switch a.FallbackOn {
+			case FallbackOnBackendError, FallbackOnError:
+			default:
+				c.errorf("fallbackOn must be %s or %s", FallbackOnBackendError, FallbackOnError)
+			}
 		case "squelch":
 			a.squelch = append(a.squelch, v)
+			a.Squelch.policy = c.TagPolicy
 			if err := a.Squelch.Add(v); err != nil {
 				c.error(err)
 			}
@@ -950,6 +2004,18 @@ func (c *Conf) loadAlert(s *parse.SectionNode) {
 			procNotification(v, a.CritNotification)
 		case "warnNotification":
 			procNotification(v, a.WarnNotification)
+		case "critNotificationSet", "critNotificationTimeout", "critNotificationNext":
+			c.parseNotificationSetRef(&critSet, strings.TrimPrefix(p.key, "critNotification"), v)
+		case "warnNotificationSet", "warnNotificationTimeout", "warnNotificationNext":
+			c.parseNotificationSetRef(&warnSet, strings.TrimPrefix(p.key, "warnNotification"), v)
+		case "critEscalation":
+			c.includeEscalation(&a, a.CritNotification, v)
+		case "warnEscalation":
+			c.includeEscalation(&a, a.WarnNotification, v)
+		case "critNotificationMode":
+			a.CritNotification.FirstSuccess = c.parseNotificationMode(v)
+		case "warnNotificationMode":
+			a.WarnNotification.FirstSuccess = c.parseNotificationMode(v)
 		case "unknown":
 			od, err := opentsdb.ParseDuration(v)
 			if err != nil {
@@ -970,8 +2036,68 @@ func (c *Conf) loadAlert(s *parse.SectionNode) {
 				c.errorf("max log frequency must be at least 1s")
 			}
 			a.MaxLogFrequency = d
+		case "logBackoff":
+			od, err := opentsdb.ParseDuration(v)
+			if err != nil {
+				c.error(err)
+			}
+			d := time.Duration(od)
+			if d <= 0 {
+				c.errorf("logBackoff must be positive")
+			}
+			a.LogBackoff = d
+		case "cooldown":
+			od, err := opentsdb.ParseDuration(v)
+			if err != nil {
+				c.error(err)
+			}
+			d := time.Duration(od)
+			if d < 0 {
+				c.errorf("cooldown must not be negative")
+			}
+			a.Cooldown = d
+		case "warnToCritAfter":
+			od, err := opentsdb.ParseDuration(v)
+			if err != nil {
+				c.error(err)
+			}
+			d := time.Duration(od)
+			if d < 0 {
+				c.errorf("warnToCritAfter must not be negative")
+			}
+			a.WarnToCritAfter = d
+		case "critAfter":
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				c.error(err)
+			}
+			if i < 1 {
+				c.errorf("critAfter must be at least 1")
+			}
+			a.CritAfter = i
+		case "runbook":
+			a.Runbook = v
+		case "owner":
+			if !c.isTeam(v) {
+				c.errorf("unknown owner %s, must be one of the teams: %s", v, strings.Join(c.Teams, ","))
+			}
+			a.Owner = v
+		case "ownerTag":
+			a.OwnerTag = v
 		case "unjoinedOk":
-			a.UnjoinedOK = true
+			a.UnjoinedOK = v != "false"
+			unjoinedSet = true
+		case "suppressOnDependsError":
+			a.SuppressOnDependsError = true
+		case "testMode":
+			a.TestMode = true
+		case "disabled":
+			a.Disabled = true
+		case "downsample":
+			if err := opentsdb.ValidDownsample(v, *c.TSDBVersion); err != nil {
+				c.error(err)
+			}
+			a.Downsample = v
 		case "ignoreUnknown":
 			a.IgnoreUnknown = true
 		case "unknownIsNormal":
@@ -984,17 +2110,49 @@ func (c *Conf) loadAlert(s *parse.SectionNode) {
 			if err != nil {
 				c.error(err)
 			}
+		case "timeout":
+			a.Timeout = c.parseTimeout(v)
+		case "runSchedule":
+			a.runSchedule = v
+		case "runScheduleTimeZone":
+			a.scheduleZone = v
+		case "timeZone":
+			a.TimeZone = c.parseTimeZone(p.key, v)
 		default:
 			c.errorf("unknown key %s", p.key)
 		}
 	}
+	c.at(s)
+	if !unjoinedSet {
+		a.UnjoinedOK = c.UnjoinedOK
+		a.unjoinedDefault = true
+	}
+	c.includeNotificationSets(&a, &critSet, &warnSet)
+	c.routeToOwner(&a)
 	if a.MaxLogFrequency != 0 && !a.Log {
 		c.errorf("maxLogFrequency can only be used on alerts with `log = true`.")
 	}
+	if a.Log && a.MaxLogFrequency == 0 {
+		a.MaxLogFrequency = c.MaxLogFrequency
+	}
+	if a.LogBackoff != 0 {
+		if !a.Log || a.MaxLogFrequency == 0 {
+			c.errorf("logBackoff specified, but no maxLogFrequency")
+		}
+		if a.LogBackoff < a.MaxLogFrequency {
+			c.errorf("logBackoff (%v) must be at least maxLogFrequency (%v)", a.LogBackoff, a.MaxLogFrequency)
+		}
+	}
 	c.at(s)
 	if a.Crit == nil && a.Warn == nil {
 		c.errorf("neither crit or warn specified")
 	}
+	if a.WarnToCritAfter > 0 && a.Warn == nil {
+		c.errorf("warnToCritAfter specified, but no warn")
+	}
+	if a.CritAfter > 0 && a.Crit == nil {
+		c.errorf("critAfter specified, but no crit")
+	}
 	var tags eparse.Tags
 	var ret models.FuncType
 	if a.Crit != nil {
@@ -1029,17 +2187,81 @@ func (c *Conf) loadAlert(s *parse.SectionNode) {
 			c.errorf("Depends and crit/warn must share at least one tag.")
 		}
 	}
+	if a.NotificationTags != nil {
+		ntags, err := a.NotificationTags.Root.Tags()
+		if err != nil {
+			c.error(err)
+		}
+		if !tags.Subset(ntags) || len(ntags) == len(tags) {
+			c.errorf("notificationTags tags (%v) must include all crit/warn tags (%v) and at least one more", ntags, tags)
+		}
+	}
+	if a.ShadowCrit != nil {
+		if a.Crit == nil {
+			c.errorf("shadowCrit specified, but no crit")
+		}
+		stags, err := a.ShadowCrit.Root.Tags()
+		if err != nil {
+			c.error(err)
+		}
+		if sret := a.ShadowCrit.Root.Return(); sret != ret {
+			c.errorf("crit and shadowCrit expressions must return same type (%v != %v)", ret, sret)
+		}
+		if !tags.Equal(stags) {
+			c.errorf("crit tags (%v) and shadowCrit tags (%v) must be equal", tags, stags)
+		}
+	}
+	for _, f := range []struct {
+		key               string
+		primary, fallback *expr.Expr
+	}{
+		{"crit", a.Crit, a.CritFallback},
+		{"warn", a.Warn, a.WarnFallback},
+	} {
+		if f.fallback == nil {
+			continue
+		}
+		if f.primary == nil {
+			c.errorf("%sFallback specified, but no %s", f.key, f.key)
+		}
+		ftags, err := f.fallback.Root.Tags()
+		if err != nil {
+			c.error(err)
+		}
+		if fret := f.fallback.Root.Return(); fret != ret {
+			c.errorf("%s and %sFallback expressions must return same type (%v != %v)", f.key, f.key, ret, fret)
+		}
+		if !tags.Equal(ftags) {
+			c.errorf("%s tags (%v) and %sFallback tags (%v) must be equal", f.key, tags, f.key, ftags)
+		}
+	}
+	if a.FallbackOn != "" && a.CritFallback == nil && a.WarnFallback == nil {
+		c.errorf("fallbackOn specified, but no critFallback or warnFallback")
+	}
+	if a.FallbackOn == "" && (a.CritFallback != nil || a.WarnFallback != nil) {
+		a.FallbackOn = FallbackOnBackendError
+	}
+	if a.SuppressOnDependsError && a.Depends == nil {
+		c.errorf("suppressOnDependsError specified, but no depends")
+	}
 	if a.Log {
 		for _, n := range a.CritNotification.Notifications {
-			if n.Next != nil {
+			if n.Next != nil || len(n.NextByStatus) != 0 {
 				c.errorf("cannot use log with a chained notification")
 			}
 		}
 		for _, n := range a.WarnNotification.Notifications {
-			if n.Next != nil {
+			if n.Next != nil || len(n.NextByStatus) != 0 {
 				c.errorf("cannot use log with a chained notification")
 			}
 		}
+		for _, ns := range []*Notifications{a.CritNotification, a.WarnNotification} {
+			for _, n := range ns.Notifications {
+				if n.Reminder > 0 {
+					c.errorf("cannot use log with notification %s, which has a reminder", n.Name)
+				}
+			}
+		}
 		if a.Crit != nil && len(a.CritNotification.Notifications) == 0 {
 			c.errorf("log + crit specified, but no critNotification")
 		}
@@ -1063,10 +2285,23 @@ func (c *Conf) loadAlert(s *parse.SectionNode) {
 			c.errorf("critNotification specified, but no template")
 		}
 	}
+	c.checkTemplateBody(&a)
 	if a.RunEvery == 0 {
 		a.RunEvery = c.DefaultRunEvery
 	}
-	a.returnType = ret
+	if a.Timeout == 0 {
+		a.Timeout = c.AlertTimeout
+	}
+	if a.TimeZone == nil {
+		a.TimeZone = c.TimeZone
+	}
+	if a.scheduleZone != "" && a.runSchedule == "" {
+		c.errorf("runScheduleTimeZone specified, but no runSchedule")
+	}
+	if a.runSchedule != "" {
+		a.RunSchedule = c.parseRunSchedule("runSchedule", a.runSchedule, a.scheduleZone, a.TimeZone)
+	}
+	a.ReturnType = ret
 	c.Alerts[name] = &a
 }
 
@@ -1077,9 +2312,10 @@ func (c *Conf) loadNotification(s *parse.SectionNode) {
 	}
 	n := Notification{
 		Vars:         make(map[string]string),
-		ContentType:  "application/x-www-form-urlencoded",
 		Name:         name,
 		RunOnActions: true,
+		webhook:      c.webhook,
+		makeLink:     c.MakeLink,
 	}
 	n.Text = s.RawText
 	funcs := ttemplate.FuncMap{
@@ -1101,8 +2337,8 @@ func (c *Conf) loadNotification(s *parse.SectionNode) {
 		v := p.val
 		switch k := p.key; k {
 		case "email":
-			if c.SMTPHost == "" || c.EmailFrom == "" {
-				c.errorf("email notifications require both smtpHost and emailFrom to be set")
+			if c.SMTPHost == "" {
+				c.errorf("email notifications require smtpHost")
 			}
 			n.email = v
 			email, err := mail.ParseAddressList(n.email)
@@ -1110,6 +2346,12 @@ func (c *Conf) loadNotification(s *parse.SectionNode) {
 				c.error(err)
 			}
 			n.Email = email
+		case "from":
+			from, err := mail.ParseAddress(v)
+			if err != nil {
+				c.error(err)
+			}
+			n.From = from
 		case "post":
 			n.post = v
 			post, err := url.Parse(n.post)
@@ -1135,12 +2377,72 @@ func (c *Conf) loadNotification(s *parse.SectionNode) {
 				c.errorf("unknown notification %s", n.next)
 			}
 			n.Next = next
+		case "sendSchedule":
+			n.sendSchedule = v
+		case "sendScheduleTimeZone":
+			n.sendScheduleZone = v
+		case "outsideSchedule":
+			outside, ok := c.Notifications[v]
+			if !ok {
+				c.errorf("unknown notification %s", v)
+			}
+			n.OutsideSchedule = outside
+		case "warnNext", "critNext":
+			next, ok := c.Notifications[v]
+			if !ok {
+				c.errorf("unknown notification %s", v)
+			}
+			status := models.StWarning
+			if k == "critNext" {
+				status = models.StCritical
+			}
+			if n.NextByStatus == nil {
+				n.NextByStatus = make(map[models.Status]*Notification)
+			}
+			n.NextByStatus[status] = next
 		case "timeout":
 			d, err := opentsdb.ParseDuration(v)
 			if err != nil {
 				c.error(err)
 			}
 			n.Timeout = time.Duration(d)
+		case "requestTimeout":
+			d, err := opentsdb.ParseDuration(v)
+			if err != nil {
+				c.error(err)
+			}
+			if d <= 0 {
+				c.errorf("requestTimeout must be positive")
+			}
+			n.RequestTimeout = time.Duration(d)
+		case "reminder":
+			d, err := opentsdb.ParseDuration(v)
+			if err != nil {
+				c.error(err)
+			}
+			if d <= 0 {
+				c.errorf("reminder must be positive")
+			}
+			n.Reminder = time.Duration(d)
+		case "maxReminders":
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				c.error(err)
+			}
+			if i < 1 {
+				c.errorf("maxReminders must be at least 1")
+			}
+			n.MaxReminders = i
+		case "maxBodyBytes":
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				c.error(err)
+			}
+			if i < 0 {
+				c.errorf("maxBodyBytes must not be negative")
+			}
+			n.MaxBodyBytes = i
+			n.maxBodySet = true
 		case "body":
 			n.body = v
 			tmpl := ttemplate.New(name).Funcs(funcs)
@@ -1149,18 +2451,290 @@ func (c *Conf) loadNotification(s *parse.SectionNode) {
 				c.error(err)
 			}
 			n.Body = tmpl
+		case "teams":
+			n.Teams = c.parseTeamsURL(v)
+		case "event", "eventBody", "eventSuccess", "eventKey":
+			if n.Event == nil {
+				n.Event = &EventTemplates{}
+			}
+			tmpl := ttemplate.New(name + "." + k).Funcs(funcs)
+			if _, err := tmpl.Parse(v); err != nil {
+				c.errorf("%s: %v", k, err)
+			}
+			switch k {
+			case "event":
+				n.Event.URL = tmpl
+			case "eventBody":
+				n.Event.Body = tmpl
+			case "eventSuccess":
+				n.Event.Success = tmpl
+			case "eventKey":
+				n.Event.Key = tmpl
+			}
+		case "eventMethod":
+			if n.Event == nil {
+				n.Event = &EventTemplates{}
+			}
+			n.Event.Method = strings.ToUpper(v)
+		case "syslog", "syslogFacility", "syslogSeverity", "syslogTag":
+			if n.Syslog == nil {
+				n.Syslog = &SyslogTarget{}
+			}
+			switch k {
+			case "syslog":
+				c.parseSyslogTarget(n.Syslog, v)
+			case "syslogFacility":
+				n.Syslog.Facility = v
+			case "syslogSeverity":
+				c.parseSyslogSeverities(n.Syslog, v)
+			case "syslogTag":
+				n.Syslog.Tag = v
+			}
+		case "slackBlocks":
+			n.slackBlocks = v
+			tmpl := ttemplate.New(name).Funcs(funcs).Funcs(slackFuncs)
+			if _, err := tmpl.Parse(v); err != nil {
+				c.error(err)
+			}
+			n.SlackBlocks = tmpl
+			n.severity = c.Severity
+		case "bodyTemplates":
+			for _, t := range strings.Split(v, ",") {
+				n.bodyTemplates = append(n.bodyTemplates, strings.TrimSpace(t))
+			}
+		case "accept":
+			n.accept = v
+		case "bodyTemplate":
+			n.BodyTemplateName = v
+			bt, ok := c.BodyTemplates[v]
+			if !ok {
+				// Built-in templates are parsed once payloadVersion is known.
+				if _, ok := builtinBodyTemplates[v]; !ok {
+					c.errorf("unknown bodyTemplate %s", v)
+				}
+				break
+			}
+			tmpl := ttemplate.New(name).Funcs(funcs)
+			_, err := tmpl.Parse(bt.Body)
+			if err != nil {
+				c.error(err)
+			}
+			n.Body = tmpl
+		case "payloadVersion":
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				c.error(err)
+			}
+			if i <= 0 {
+				c.errorf("payloadVersion must be > 0")
+			}
+			n.PayloadVersion = i
 		case "runOnActions":
 			n.RunOnActions = v == "true"
+		case "if":
+			tmpl := ttemplate.New(name + ".if").Funcs(funcs)
+			if _, err := tmpl.Parse(v); err != nil {
+				c.errorf("if: %v", err)
+			}
+			n.If = tmpl
+		case "ifFalse":
+			switch v {
+			case "continue":
+				n.IfStopsChain = false
+			case "stop":
+				n.IfStopsChain = true
+			default:
+				c.errorf("ifFalse must be continue or stop, not %s", v)
+			}
 		case "useBody":
 			n.UseBody = v == "true"
+		case "bodyError":
+			n.BodyError = c.parseBodyError(v)
+		case "priority":
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				c.error(err)
+			}
+			n.Priority = i
+		case "sns":
+			n.SNSTopic = v
+		case "snsRegion":
+			n.snsRegion = v
+		case "snsEndpoint":
+			n.snsEndpoint = v
+		case "snsAccessKey":
+			n.snsAccessKey = v
+		case "snsSecretKey":
+			n.snsSecretKey = v
+		case "snsTagAttributes":
+			n.SNSTagAttributes = v == "true"
+		case "successPointer":
+			if !strings.HasPrefix(v, "/") {
+				c.errorf("successPointer must be a JSON pointer starting with /, such as /ok")
+			}
+			n.SuccessPointer = v
+		case "successValue":
+			n.successValue = v
+			if err := json.Unmarshal([]byte(v), &n.SuccessValue); err != nil {
+				c.errorf("successValue must be JSON, such as true or \"ok\": %v", err)
+			}
+		case "emailCharset":
+			n.EmailCharset = c.parseEmailCharset(v)
+		case "emailEncoding":
+			n.EmailEncoding = c.parseEmailEncoding(v)
+		case "emailSubjectPrefix":
+			if v == noSubjectPrefix {
+				n.noSubjectPrefix = true
+				break
+			}
+			n.EmailSubjectPrefix = c.parseSubjectPrefix(name+".emailSubjectPrefix", v)
+		case "user":
+			n.user = v
+		case "password":
+			n.password = v
 		default:
-			c.errorf("unknown key %s", k)
+			if !c.loadNotifier(&n, k, v) {
+				c.errorf("unknown key %s", k)
+			}
 		}
 	}
 	c.at(s)
-	if n.Timeout > 0 && n.Next == nil {
+	if n.IfStopsChain && n.If == nil {
+		c.errorf("ifFalse specified, but no if")
+	}
+	if n.bodyTemplates != nil {
+		if n.body != "" || n.BodyTemplateName != "" || n.SlackBlocks != nil {
+			c.errorf("bodyTemplates and body, bodyTemplate or slackBlocks both specified")
+		}
+		bt := c.negotiateBodyTemplate(n.bodyTemplates, n.accept)
+		n.BodyTemplateName = bt.Name
+		tmpl := ttemplate.New(name).Funcs(funcs)
+		if _, err := tmpl.Parse(bt.Body); err != nil {
+			c.error(err)
+		}
+		n.Body = tmpl
+	} else if n.accept != "" {
+		c.errorf("accept specified, but no bodyTemplates")
+	}
+	if n.Timeout > 0 && n.Next == nil && len(n.NextByStatus) == 0 {
 		c.errorf("timeout specified without next")
 	}
+	if n.MaxReminders > 0 && n.Reminder == 0 {
+		c.errorf("maxReminders specified, but no reminder")
+	}
+	if n.Reminder > 0 && n.MaxReminders == 0 {
+		n.MaxReminders = defaultMaxReminders
+	}
+	if n.Reminder > 0 {
+		repeats := n.Next == &n
+		for _, next := range n.NextByStatus {
+			repeats = repeats || next == &n
+		}
+		if repeats {
+			c.errorf("reminder specified, but notification %s already repeats itself with next", name)
+		}
+	}
+	if n.body != "" && n.BodyTemplateName != "" {
+		c.errorf("body and bodyTemplate both specified")
+	}
+	if n.SlackBlocks != nil {
+		if n.body != "" || n.BodyTemplateName != "" {
+			c.errorf("slackBlocks and body or bodyTemplate both specified")
+		}
+		if n.Post == nil {
+			c.errorf("slackBlocks specified, but notification %s has no post", name)
+		}
+		if n.ContentType == "" {
+			n.ContentType = "application/json"
+		}
+	}
+	if n.BodyError == "" {
+		n.BodyError = c.BodyError
+	}
+	body := n.body
+	if bt := c.BodyTemplates[n.BodyTemplateName]; bt != nil {
+		body = bt.Body
+		if n.ContentType == "" {
+			n.ContentType = bt.ContentType
+		}
+	} else if n.BodyTemplateName != "" {
+		body = c.builtinBodyTemplate(n.BodyTemplateName, n.PayloadVersion)
+		tmpl := ttemplate.New(name).Funcs(funcs)
+		if _, err := tmpl.Parse(body); err != nil {
+			c.error(err)
+		}
+		n.Body = tmpl
+		if n.PayloadVersion == 0 {
+			n.PayloadVersion = PayloadVersion
+		}
+	}
+	if n.PayloadVersion != 0 && n.Body == nil {
+		c.errorf("payloadVersion specified, but no body or bodyTemplate")
+	}
+	n.setBodyKey()
+	if n.Event != nil {
+		if n.Event.URL == nil {
+			c.errorf("eventMethod, eventBody, eventSuccess or eventKey specified, but no event")
+		}
+		c.loadEvent(&n)
+	}
+	if n.Syslog != nil {
+		c.loadSyslog(&n)
+	}
+	if n.ContentType == "" {
+		n.ContentType = n.defaultContentType(body, c.ContentType)
+	}
+	if n.password != "" && n.user == "" {
+		c.errorf("password specified, but no user")
+	}
+	if n.user != "" && n.Post == nil && n.Get == nil && n.Event == nil {
+		c.errorf("user specified, but notification %s has no post, get or event", name)
+	}
+	if n.SNSTopic != "" {
+		m := snsTopicRE.FindStringSubmatch(n.SNSTopic)
+		if m == nil {
+			c.errorf("sns must be an SNS topic ARN, such as arn:aws:sns:us-east-1:123456789012:alerts")
+		}
+		if n.snsRegion == "" {
+			n.snsRegion = m[1]
+		}
+		if (n.snsAccessKey == "") != (n.snsSecretKey == "") {
+			c.errorf("snsAccessKey and snsSecretKey must be specified together")
+		}
+		n.sns = newSNSClient(n.snsRegion, n.snsEndpoint, n.snsAccessKey, n.snsSecretKey)
+	} else if n.snsRegion != "" || n.snsEndpoint != "" || n.snsAccessKey != "" || n.snsSecretKey != "" || n.SNSTagAttributes {
+		c.errorf("sns options specified, but no sns")
+	}
+	if n.SuccessPointer != "" {
+		if n.Post == nil {
+			c.errorf("successPointer specified, but notification %s has no post", name)
+		}
+		if n.successValue == "" {
+			n.SuccessValue = true
+		}
+	} else if n.successValue != "" {
+		c.errorf("successValue specified, but no successPointer")
+	}
+	if n.sendSchedule != "" {
+		if n.OutsideSchedule == nil {
+			c.errorf("sendSchedule specified, but no outsideSchedule")
+		}
+		n.SendSchedule = c.parseRunSchedule("sendSchedule", n.sendSchedule, n.sendScheduleZone, c.TimeZone)
+	} else if n.OutsideSchedule != nil || n.sendScheduleZone != "" {
+		c.errorf("outsideSchedule or sendScheduleTimeZone specified, but no sendSchedule")
+	}
+	if (n.EmailCharset != "" || n.EmailEncoding != "" || n.EmailSubjectPrefix != nil || n.noSubjectPrefix) && n.Email == nil {
+		c.errorf("emailCharset, emailEncoding or emailSubjectPrefix specified, but notification %s has no email", name)
+	}
+	if n.Email != nil && n.From == nil && c.EmailFrom == "" {
+		c.errorf("email notifications require emailFrom or a notification from")
+	}
+	if n.From != nil && n.Email == nil {
+		c.errorf("from specified, but no email")
+	}
+	if n.UseBody && n.Post == nil && n.SNSTopic == "" && !n.Print && n.Syslog == nil {
+		c.errorf("useBody specified, but notification %s has no post, sns, print or syslog", name)
+	}
 }
 
 var exRE = regexp.MustCompile(`\$(?:[\w.]+|\{[\w.]+\})`)
@@ -1190,7 +2764,7 @@ func (c *Conf) Expand(v string, vars map[string]string, ignoreBadExpand bool) st
 func (c *Conf) seen(v string, m map[string]bool) {
 	if m[v] {
 		switch v {
-		case "squelch", "critNotification", "warnNotification", "graphiteHeader":
+		case "squelch", "critNotification", "warnNotification", "critEscalation", "warnEscalation", "graphiteHeader":
 			// ignore
 		default:
 			c.errorf("duplicate key: %s", v)
@@ -1247,18 +2821,30 @@ func nilFunc() {}
 func (c *Conf) NewExpr(s string) *expr.Expr {
 	exp, err := expr.New(s, c.Funcs())
 	if err != nil {
-		c.error(err)
+		c.error(c.ExplainExprError(err))
 	}
-	switch exp.Root.Return() {
-	case models.TypeNumberSet, models.TypeScalar:
-		break
-	default:
-		c.errorf("expression must return a number")
+	if err := CheckNumberExpr(exp); err != nil {
+		c.error(err)
 	}
 	return exp
 }
 
 func (c *Conf) Funcs() map[string]eparse.Func {
+	funcs := c.bosunFuncs()
+	for _, b := range c.funcBackends() {
+		if !b.enabled {
+			continue
+		}
+		for k, v := range b.funcs {
+			funcs[k] = v
+		}
+	}
+	return funcs
+}
+
+// bosunFuncs returns the expression functions that are backed by this
+// configuration, such as alert and lookup.
+func (c *Conf) bosunFuncs() map[string]eparse.Func {
 	lookup := func(e *expr.State, T miniprofiler.Timer, lookup, key string) (results *expr.Results, err error) {
 		results = new(expr.Results)
 		results.IgnoreUnjoined = true
@@ -1368,8 +2954,8 @@ func (c *Conf) Funcs() map[string]eparse.Func {
 		if err != nil {
 			return nil, err
 		}
-		if a.returnType != models.TypeNumberSet {
-			return nil, fmt.Errorf("alert requires a number-returning expression (got %v)", a.returnType)
+		if a.ReturnType != models.TypeNumberSet {
+			return nil, fmt.Errorf("alert requires a number-returning expression (got %v)", a.ReturnType)
 		}
 		return e.Root.Tags()
 	}
@@ -1393,28 +2979,49 @@ func (c *Conf) Funcs() map[string]eparse.Func {
 			Tags:   lookupSeriesTags,
 			F:      lookupSeries,
 		},
+		"alertStatus": {
+			Args:   []models.FuncType{models.TypeString},
+			Return: models.TypeNumberSet,
+			Tags:   c.tagAlertStatus,
+			F:      c.alertStatus,
+		},
 	}
-	merge := func(fs map[string]eparse.Func) {
-		for k, v := range fs {
-			funcs[k] = v
+	return funcs
+}
+
+// AlertDependents returns the names of the alerts with an expression (crit,
+// warn, depends, notificationTags, shadowCrit or a fallback) that references
+// the named alert with alert or alertStatus, sorted by name. Removing an
+// alert breaks its dependents.
+func (c *Conf) AlertDependents(name string) []string {
+	var deps []string
+	for _, a := range c.Alerts {
+		found := false
+		var walk func(n eparse.Node)
+		walk = func(n eparse.Node) {
+			switch n := n.(type) {
+			case *eparse.FuncNode:
+				if n.Name != "alert" && n.Name != "alertStatus" || len(n.Args) == 0 {
+					return
+				}
+				if s, ok := n.Args[0].(*eparse.StringNode); ok && s.Text == name {
+					found = true
+				}
+			case *eparse.ExprNode:
+				eparse.Walk(n.Tree.Root, walk)
+			}
+		}
+		for _, e := range []*expr.Expr{a.Crit, a.Warn, a.Depends, a.NotificationTags, a.ShadowCrit, a.CritFallback, a.WarnFallback} {
+			if e != nil {
+				eparse.Walk(e.Root, walk)
+			}
+		}
+		if found {
+			deps = append(deps, a.Name)
 		}
 	}
-	if c.TSDBHost != "" {
-		merge(expr.TSDB)
-	}
-	if c.GraphiteHost != "" {
-		merge(expr.Graphite)
-	}
-	if len(c.LogstashElasticHosts) != 0 {
-		merge(expr.LogstashElastic)
-	}
-	if len(c.ElasticHosts) != 0 {
-		merge(expr.Elastic)
-	}
-	if c.InfluxConfig.URL.Host != "" {
-		merge(expr.Influx)
-	}
-	return funcs
+	sort.Strings(deps)
+	return deps
 }
 
 func (c *Conf) getAlertExpr(name, key string) (*Alert, *expr.Expr, error) {
@@ -1437,6 +3044,51 @@ func (c *Conf) getAlertExpr(name, key string) (*Alert, *expr.Expr, error) {
 	return a, e, nil
 }
 
+// tagAlertStatus returns the tags of the alert keys of the named alert. Only
+// alerts defined earlier in the config can be referenced, which rules out
+// cycles between alerts reading each other's status.
+func (c *Conf) tagAlertStatus(args []eparse.Node) (eparse.Tags, error) {
+	name := args[0].(*eparse.StringNode).Text
+	a := c.Alerts[name]
+	if a == nil {
+		return nil, fmt.Errorf("alertStatus: unknown alert %s (an alert must be defined before it is referenced)", name)
+	}
+	e := a.Crit
+	if e == nil {
+		e = a.Warn
+	}
+	if e == nil {
+		return nil, fmt.Errorf("alertStatus: alert %s has no crit or warn", name)
+	}
+	return e.Root.Tags()
+}
+
+// alertStatus returns the current status of each alert key of the named
+// alert, as last recorded: 0 for normal, 1 for warning, 2 for critical and 3
+// for unknown.
+func (c *Conf) alertStatus(s *expr.State, T miniprofiler.Timer, name string) (*expr.Results, error) {
+	results := new(expr.Results)
+	if s.History == nil {
+		return results, nil
+	}
+	for ak, st := range s.History.GetAlertStatuses(name) {
+		var v expr.Number
+		switch st {
+		case models.StWarning:
+			v = 1
+		case models.StCritical:
+			v = 2
+		case models.StUnknown:
+			v = 3
+		}
+		results.Results = append(results.Results, &expr.Result{
+			Value: v,
+			Group: ak.Group(),
+		})
+	}
+	return results, nil
+}
+
 func (c *Conf) alert(s *expr.State, T miniprofiler.Timer, name, key string) (results *expr.Results, err error) {
 	_, e, err := c.getAlertExpr(name, key)
 	if err != nil {
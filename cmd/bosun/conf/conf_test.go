@@ -1,13 +1,32 @@
 package conf
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"regexp/syntax"
+	"strings"
 	"testing"
+	"time"
 
+	"bosun.org/graphite"
+	"bosun.org/models"
 	"bosun.org/opentsdb"
+	"github.com/bradfitz/slice"
 )
 
 func TestPrint(t *testing.T) {
@@ -73,6 +92,18 @@ func TestInvalid(t *testing.T) {
 		"depends-no-overlap": `conf: depends-no-overlap:3:0: at <alert broken {\n	dep...>: Depends and crit/warn must share at least one tag.`,
 		"log-no-notification": `conf: log-no-notification:1:0: at <alert a {\n	crit = 1...>: log + crit specified, but no critNotification`,
 		"crit-notification-no-template": `conf: crit-notification-no-template:5:0: at <alert a {\n	crit = 1...>: critNotification specified, but no template`,
+		"suppress-no-depends": `conf: suppress-no-depends:1:0: at <alert a {\n	crit = 1...>: suppressOnDependsError specified, but no depends`,
+		"relay-batch-no-size":    `conf: relay-batch-no-size: relayQueueFull specified, but no relayBatchSize`,
+		"relay-batch-queue-size": `conf: relay-batch-queue-size: relayQueueSize (10) must be at least relayBatchSize (100)`,
+		"warn-to-crit-no-warn": `conf: warn-to-crit-no-warn:1:0: at <alert a {\n	crit = 1...>: warnToCritAfter specified, but no warn`,
+		"notification-unknown-body-template": `conf: notification-unknown-body-template:3:1: at <bodyTemplate = missi...>: unknown bodyTemplate missing`,
+		"macro-cycle-direct":   `conf: macro-cycle-direct:1:0: at <macro a {\n	macro = ...>: macro cycle: a -> a`,
+		"macro-cycle-indirect": `conf: macro-cycle-indirect:1:0: at <macro a {\n	macro = ...>: macro cycle: a -> b -> a`,
+		"macro-too-deep":       `conf: macro-too-deep:11:0: at <macro c {\n	macro = ...>: macros nested deeper than maxMacroDepth (2): c -> b -> a`,
+		"notification-set-unknown": `conf: notification-set-unknown:3:1: at <critNotificationSet ...>: unknown notificationSet missing`,
+		"lookup-unknown-var": `conf: lookup-unknown-var:3:2: at <owner = $team>: unknown variable $team`,
+		"lookup-bad-range": `conf: lookup-bad-range:2:1: at <entry priority=5..1 ...>: bad range 5..1: min is greater than max`,
+		"notification-email-charset": `conf: notification-email-charset:5:1: at <emailCharset = Shift...>: emailCharset must be UTF-8, ISO-8859-1 or US-ASCII, not Shift_JIS`,
 	}
 	for fname, reason := range names {
 		path := filepath.Join("invalid", fname)
@@ -93,12 +124,12 @@ func TestInvalid(t *testing.T) {
 
 func TestSquelch(t *testing.T) {
 	s := Squelches{
-		[]Squelch{
-			map[string]*regexp.Regexp{
+		s: []Squelch{
+			{
 				"x": regexp.MustCompile("ab"),
 				"y": regexp.MustCompile("bc"),
 			},
-			map[string]*regexp.Regexp{
+			{
 				"x": regexp.MustCompile("ab"),
 				"z": regexp.MustCompile("de"),
 			},
@@ -152,3 +183,1847 @@ func TestSquelch(t *testing.T) {
 		}
 	}
 }
+
+func TestSquelchedBy(t *testing.T) {
+	c, err := New("test", `
+		squelch = host=ny-.*
+		alert a {
+			crit = 1
+			squelch = host=web.*,dc=eu
+			squelch = disk=tmp
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := c.Alerts["a"]
+	for _, test := range []struct {
+		tags opentsdb.TagSet
+		by   string
+	}{
+		{opentsdb.TagSet{"host": "ny-web01"}, "host=ny-.*"},
+		{opentsdb.TagSet{"host": "web01", "dc": "eu"}, "dc=eu,host=web.*"},
+		{opentsdb.TagSet{"host": "web01", "disk": "/tmp"}, "disk=tmp"},
+		{opentsdb.TagSet{"host": "web01", "dc": "us"}, ""},
+	} {
+		if by := c.SquelchedBy(a, test.tags); by != test.by {
+			t.Errorf("%v: got %q, expected %q", test.tags, by, test.by)
+		}
+		if squelched := c.Squelched(a, test.tags); squelched != (test.by != "") {
+			t.Errorf("%v: Squelched is %v, but SquelchedBy is %q", test.tags, squelched, test.by)
+		}
+	}
+}
+
+func TestSquelchInvalidPattern(t *testing.T) {
+	var s Squelches
+	err := s.Add("host=web.*,bad=[")
+	se, ok := err.(*SquelchError)
+	if !ok {
+		t.Fatalf("expected a *SquelchError, got %T: %v", err, err)
+	}
+	if se.Key != "bad" || se.Pattern != "[" {
+		t.Errorf("expected tag bad with pattern [, got %s with %s", se.Key, se.Pattern)
+	}
+	if _, ok := se.Unwrap().(*syntax.Error); !ok {
+		t.Errorf("expected the regexp error to be wrapped, got %T", se.Unwrap())
+	}
+	if msg := err.Error(); !strings.Contains(msg, `squelch tag bad: invalid pattern "["`) || !strings.Contains(msg, "missing closing ]") {
+		t.Errorf("unexpected error message: %s", msg)
+	}
+	if len(s.s) != 0 {
+		t.Errorf("expected the invalid squelch not to be added")
+	}
+}
+
+func TestSquelchKeyPattern(t *testing.T) {
+	var s Squelches
+	if err := s.Add("*_id=^9,host=web.*"); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		tags   opentsdb.TagSet
+		expect bool
+	}{
+		{opentsdb.TagSet{"host": "web01", "user_id": "99"}, true},
+		{opentsdb.TagSet{"host": "web01", "user_id": "1", "order_id": "9"}, true},
+		{opentsdb.TagSet{"host": "web01", "user_id": "1"}, false},
+		{opentsdb.TagSet{"host": "db01", "user_id": "99"}, false},
+		{opentsdb.TagSet{"host": "web01", "id": "99"}, false},
+	} {
+		if got := s.Squelched(test.tags); got != test.expect {
+			t.Errorf("for %v got %v, expected %v", test.tags, got, test.expect)
+		}
+	}
+	for _, test := range []struct {
+		pattern, key string
+		expect       bool
+	}{
+		{"*_id", "user_id", true},
+		{"*_id", "_id", true},
+		{"*_id", "user_idx", false},
+		{"req_*", "req_path", true},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "acb", false},
+		{"*", "anything", true},
+	} {
+		if got := matchKeyPattern(test.pattern, test.key); got != test.expect {
+			t.Errorf("%s matching %s: got %v, expected %v", test.pattern, test.key, got, test.expect)
+		}
+	}
+}
+
+func TestGraphiteContextAuth(t *testing.T) {
+	c, err := New("test", `
+		graphiteHost = http://graphite.example.com
+		graphiteHeader = X-Token: a:b
+		graphiteUsername = user
+		graphitePassword = pass
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hh, ok := c.GraphiteContext().(graphite.HostHeader)
+	if !ok {
+		t.Fatalf("expected graphite.HostHeader, got %T", c.GraphiteContext())
+	}
+	if v := hh.Header.Get("X-Token"); v != "a:b" {
+		t.Errorf("bad X-Token header: %q", v)
+	}
+	if v := hh.Header.Get("Authorization"); v != "Basic dXNlcjpwYXNz" {
+		t.Errorf("bad Authorization header: %q", v)
+	}
+	if _, err := New("test", "graphiteHeader = :novalue"); err == nil {
+		t.Error("expected error for header without a name")
+	}
+}
+
+func TestFormatRawText(t *testing.T) {
+	in := "# global\n$z = 1\n$a   =   2\n\n\n\nalert b {   # trailing\n    $y = 3\n  $x = $y\n        crit = `a\n  b`\n\n}\ntemplate t {\nsubject = s \n}"
+	expect := "# global\n$a = 2\n$z = 1\n\nalert b { # trailing\n\t$y = 3\n\t$x = $y\n\tcrit = `a\n  b`\n}\ntemplate t {\n\tsubject = s \n}\n"
+	out, err := FormatRawText(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != expect {
+		t.Fatalf("got:\n%s\nexpected:\n%s", out, expect)
+	}
+	if again, err := FormatRawText(out); err != nil || again != out {
+		t.Errorf("formatting is not idempotent: %q, %v", again, err)
+	}
+	if _, err := FormatRawText("alert a {"); err == nil {
+		t.Error("expected error for unparsable config")
+	}
+}
+
+func TestNotificationBody(t *testing.T) {
+	const globals = `
+		smtpHost = localhost:25
+		emailFrom = bosun@example.com
+		template body {
+			subject = s
+			body = b
+		}
+		template nobody {
+			subject = s
+		}
+	`
+	tests := []struct {
+		notification, template string
+		err                    string
+	}{
+		{"email = a@example.com", "body", ""},
+		{"email = a@example.com", "nobody", "notification n sends email, but template nobody has no body"},
+		{"post = http://example.com", "nobody", ""},
+		{"post = http://example.com\nuseBody = true", "body", ""},
+		{"post = http://example.com\nuseBody = true", "nobody", "notification n has useBody set, but template nobody has no body"},
+		{"print = true\nuseBody = true", "nobody", "notification n has useBody set, but template nobody has no body"},
+		{"post = http://example.com\nnext = e\ntimeout = 1m", "nobody", "notification e sends email, but template nobody has no body"},
+		{"email = a@example.com\nuseBody = true", "body", "useBody specified, but notification n has no post, sns, print or syslog"},
+	}
+	for _, test := range tests {
+		text := globals + `
+			notification e {
+				email = a@example.com
+			}
+			notification n {
+				` + test.notification + `
+			}
+			alert a {
+				crit = 1
+				critNotification = n
+				template = ` + test.template + `
+			}
+		`
+		_, err := New("test", text)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%q with %s: unexpected error: %v", test.notification, test.template, err)
+		case test.err != "" && (err == nil || !strings.HasSuffix(err.Error(), test.err)):
+			t.Errorf("%q with %s: got error %v, expected %q", test.notification, test.template, err, test.err)
+		}
+	}
+}
+
+func TestRunSchedule(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	// 2000-01-03 was a Monday.
+	monday := time.Date(2000, 1, 3, 14, 30, 0, 0, time.UTC)
+	tests := []struct {
+		schedule string
+		loc      *time.Location
+		t        time.Time
+		match    bool
+	}{
+		{"* * * * *", nil, monday, true},
+		{"* 9-17 * * mon-fri", nil, monday, true},
+		{"* 9-17 * * MON-FRI", nil, monday.Add(4 * time.Hour), false},
+		{"* 9-17 * * 1-5", ny, monday, true},
+		{"* 9-17 * * 1-5", ny, monday.Add(-6 * time.Hour), false},
+		{"*/15 * * * *", nil, monday, true},
+		{"*/20 * * * *", nil, monday, false},
+		{"5/5 * * * *", nil, monday, true},
+		{"30 14 * jan 7", nil, monday.Add(-24 * time.Hour), true},
+		{"* * 15 * mon", nil, monday, true},
+		{"* * 3 * sun", nil, monday, true},
+		{"* * 4 * sun", nil, monday, false},
+	}
+	for _, test := range tests {
+		rs, err := ParseRunSchedule(test.schedule, test.loc)
+		if err != nil {
+			t.Errorf("%s: %v", test.schedule, err)
+			continue
+		}
+		if got := rs.Matches(test.t); got != test.match {
+			t.Errorf("%s at %v: got %v, expected %v", test.schedule, test.t, got, test.match)
+		}
+	}
+	for _, bad := range []string{"* * * *", "60 * * * *", "* 5-1 * * *", "* * * foo *", "*/0 * * * *", "* * 0 * *"} {
+		if _, err := ParseRunSchedule(bad, nil); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+	if _, err := New("test", "alert a {\n\tcrit = 1\n\trunSchedule = * 25 * * *\n}"); err == nil || !strings.Contains(err.Error(), `runSchedule: hour field "25": value 25 out of range 0-23`) {
+		t.Errorf("unexpected error for bad runSchedule: %v", err)
+	}
+}
+
+func TestAlertTimeZone(t *testing.T) {
+	c, err := New("test", `
+		timeZone = Asia/Tokyo
+		alert global {
+			crit = 1
+			runSchedule = * 9-17 * * *
+		}
+		alert local {
+			crit = 1
+			timeZone = America/New_York
+			runSchedule = * 9-17 * * *
+		}
+		alert override {
+			crit = 1
+			timeZone = America/New_York
+			runSchedule = * 9-17 * * *
+			runScheduleTimeZone = UTC
+		}
+	`)
+	if err != nil {
+		t.Skip(err)
+	}
+	// 14:00 UTC is 23:00 in Tokyo and 09:00 in New York.
+	at := time.Date(2000, 1, 3, 14, 0, 0, 0, time.UTC)
+	for name, match := range map[string]bool{"global": false, "local": true, "override": true} {
+		a := c.Alerts[name]
+		if got := a.RunSchedule.Matches(at); got != match {
+			t.Errorf("%s: got %v, expected %v", name, got, match)
+		}
+	}
+	if z := c.Alerts["global"].TimeZone.String(); z != "Asia/Tokyo" {
+		t.Errorf("expected global time zone, got %s", z)
+	}
+	if z := c.Alerts["override"].TimeZone.String(); z != "America/New_York" {
+		t.Errorf("expected alert time zone, got %s", z)
+	}
+	if _, err := New("test", "alert a {\n\tcrit = 1\n\ttimeZone = Mars/Olympus\n}"); err == nil || !strings.Contains(err.Error(), "timeZone: unknown time zone Mars/Olympus") {
+		t.Errorf("unexpected error for bad timeZone: %v", err)
+	}
+	c, err = New("test", "alert a {\n\tcrit = 1\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Alerts["a"].TimeZone != time.UTC {
+		t.Errorf("expected UTC by default, got %v", c.Alerts["a"].TimeZone)
+	}
+}
+
+func TestSendSchedule(t *testing.T) {
+	c, err := New("test", `
+		notification chat {
+			print = true
+		}
+		notification email {
+			print = true
+			sendSchedule = * 7-21 * * *
+			outsideSchedule = chat
+		}
+		notification pager {
+			print = true
+			sendSchedule = * 22-23,0-6 * * *
+			sendScheduleTimeZone = America/New_York
+			outsideSchedule = email
+		}
+	`)
+	if err != nil {
+		t.Skip(err)
+	}
+	pager := c.Notifications["pager"]
+	for _, test := range []struct {
+		hour int
+		sent string
+	}{
+		{3, "pager"},  // 22:00 in New York
+		{5, "pager"},  // 00:00
+		{18, "email"}, // 13:00
+		{23, "chat"},  // 18:00, but outside email's UTC schedule
+	} {
+		at := time.Date(2000, 1, 3, test.hour, 0, 0, 0, time.UTC)
+		if n := pager.SendAt(at); n.Name != test.sent {
+			t.Errorf("%v: got %s, expected %s", at, n.Name, test.sent)
+		}
+	}
+	for conf, reason := range map[string]string{
+		"notification a {\n\tprint = true\n\tsendSchedule = * 9-17 * * *\n}":                                                           "sendSchedule specified, but no outsideSchedule",
+		"notification a {\n\tprint = true\n\tsendSchedule = * 9-17 * * *\n\toutsideSchedule = b\n}":                                    "unknown notification b",
+		"notification b {\n\tprint = true\n}\nnotification a {\n\tprint = true\n\toutsideSchedule = b\n}":                              "outsideSchedule or sendScheduleTimeZone specified, but no sendSchedule",
+		"notification b {\n\tprint = true\n}\nnotification a {\n\tprint = true\n\tsendSchedule = * 25 * * *\n\toutsideSchedule = b\n}": `sendSchedule: hour field "25"`,
+	} {
+		if _, err := New("test", conf); err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("expected error %q, got %v", reason, err)
+		}
+	}
+}
+
+func TestFuncsByBackend(t *testing.T) {
+	c, err := New("test", "tsdbHost = localhost:4242")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb := c.FuncsByBackend()
+	if b := fb["opentsdb"]; b == nil || !b.Enabled {
+		t.Fatal("expected opentsdb to be enabled")
+	}
+	if b := fb["graphite"]; b == nil || b.Enabled || b.Setting != "graphiteHost" {
+		t.Fatalf("expected graphite to be disabled: %+v", b)
+	}
+	var q *FuncInfo
+	for i, f := range fb["opentsdb"].Funcs {
+		if f.Name == "q" {
+			q = &fb["opentsdb"].Funcs[i]
+		}
+	}
+	if q == nil || q.Signature != "q(string, string, string) series" {
+		t.Errorf("unexpected q: %+v", q)
+	}
+	if len(fb["bosun"].Funcs) == 0 || len(fb["builtin"].Funcs) == 0 {
+		t.Error("expected bosun and builtin functions")
+	}
+	_, err = New("test", "tsdbHost = localhost:4242\nalert a {\n\tcrit = avg(graphite(\"x\", \"5m\", \"\", \"\"))\n}")
+	if err == nil || !strings.Contains(err.Error(), "graphite is a graphite function, but graphiteHost is not set") {
+		t.Errorf("expected hint about graphiteHost, got %v", err)
+	}
+}
+
+func TestNotificationFrom(t *testing.T) {
+	c, err := New("test", `
+		smtpHost = localhost:25
+		notification db {
+			email = dba@example.com
+			from = DB Team <dbteam@example.com>
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := c.Notifications["db"].From; from == nil || from.Address != "dbteam@example.com" {
+		t.Errorf("unexpected from: %v", from)
+	}
+	for text, expect := range map[string]string{
+		"smtpHost = localhost:25\nnotification n {\n\temail = a@example.com\n}":                          "email notifications require emailFrom or a notification from",
+		"emailFrom = bosun@example.com\nnotification n {\n\temail = a@example.com\n}":                    "email notifications require smtpHost",
+		"smtpHost = localhost:25\nnotification n {\n\temail = a@example.com\n\tfrom = not an address\n}": "mail: ",
+		"notification n {\n\tprint = true\n\tfrom = a@example.com\n}":                                    "from specified, but no email",
+	} {
+		if _, err := New("test", text); err == nil || !strings.Contains(err.Error(), expect) {
+			t.Errorf("%q: got error %v, expected %q", text, err, expect)
+		}
+	}
+}
+
+func TestAlertDependents(t *testing.T) {
+	c, err := New("test", `
+		tsdbHost = localhost:4242
+		alert base {
+			crit = avg(q("avg:m{host=*}", "5m", "")) > 1
+		}
+		alert b {
+			crit = avg(q("avg:m{host=*}", "5m", "")) > 2
+			depends = alert("base", "crit")
+		}
+		alert a {
+			warn = alertStatus("base") > 1
+		}
+		alert other {
+			crit = alert("b", "crit")
+		}
+		alert shadow {
+			crit = avg(q("avg:m{host=*}", "5m", "")) > 3
+			shadowCrit = alert("base", "crit")
+		}
+		alert fallback {
+			warn = avg(q("avg:m{host=*}", "5m", "")) > 3
+			warnFallback = alertStatus("base") > 1
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deps := c.AlertDependents("base"); !reflect.DeepEqual(deps, []string{"a", "b", "fallback", "shadow"}) {
+		t.Errorf("unexpected dependents of base: %v", deps)
+	}
+	if deps := c.AlertDependents("other"); len(deps) != 0 {
+		t.Errorf("expected no dependents of other, got %v", deps)
+	}
+}
+
+func TestLookupRanges(t *testing.T) {
+	c, err := New("test", `
+		lookup team {
+			entry priority=1..3,host=* {
+				owner = low
+			}
+			entry priority=4..5,host=* {
+				owner = high
+			}
+			entry priority=2,host=db* {
+				owner = dba
+			}
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := c.Lookups["team"].ToExpr()
+	for _, test := range []struct {
+		tags  opentsdb.TagSet
+		owner string
+	}{
+		{opentsdb.TagSet{"priority": "1", "host": "web"}, "low"},
+		{opentsdb.TagSet{"priority": "3", "host": "web"}, "low"},
+		{opentsdb.TagSet{"priority": "4.5", "host": "web"}, "high"},
+		{opentsdb.TagSet{"priority": "2", "host": "db1"}, "dba"},
+		{opentsdb.TagSet{"priority": "6", "host": "web"}, ""},
+		{opentsdb.TagSet{"priority": "high", "host": "web"}, ""},
+	} {
+		owner, _ := l.Get("owner", test.tags)
+		if owner != test.owner {
+			t.Errorf("%v: got %q, expected %q", test.tags, owner, test.owner)
+		}
+	}
+}
+
+func TestLookupCIDR(t *testing.T) {
+	c, err := New("test", `
+		squelch = ip=10.1.0.0/16
+		squelch = ip=2001:db8::/32,env=test
+		lookup team {
+			entry ip=10.2.0.0/16 {
+				owner = dc2
+			}
+			entry ip=10.0.0.0/8 {
+				owner = corp
+			}
+			entry ip=2001:db8:1::/48 {
+				owner = v6
+			}
+			entry ip=* {
+				owner = other
+			}
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := c.Lookups["team"].ToExpr()
+	for _, test := range []struct {
+		ip       string
+		owner    string
+		squelch  bool
+		squelch6 bool
+	}{
+		{"10.1.2.3", "corp", true, false},
+		{"10.2.0.1", "dc2", false, false},
+		{"192.168.0.1", "other", false, false},
+		{"2001:db8:1::5", "v6", false, true},
+		{"2001:DB8:2::5", "other", false, true},
+		{"::ffff:10.1.2.3", "corp", true, false},
+		{"web01", "other", false, false},
+		{"10.1.2", "other", false, false},
+	} {
+		tags := opentsdb.TagSet{"ip": test.ip}
+		if owner, _ := l.Get("owner", tags); owner != test.owner {
+			t.Errorf("%s: got owner %q, expected %q", test.ip, owner, test.owner)
+		}
+		if got := c.Squelch.Squelched(tags); got != test.squelch {
+			t.Errorf("%s: got squelched %v, expected %v", test.ip, got, test.squelch)
+		}
+		tags["env"] = "test"
+		if got, expect := c.Squelch.Squelched(tags), test.squelch || test.squelch6; got != expect {
+			t.Errorf("%s, env=test: got squelched %v, expected %v", test.ip, got, expect)
+		}
+	}
+	if got := c.Squelch.s[0].String(); got != "ip=10.1.0.0/16" {
+		t.Errorf("unexpected squelch %s", got)
+	}
+	for _, test := range []struct{ text, err string }{
+		{"squelch = ip=10.1.0.0/33", "bad CIDR 10.1.0.0/33"},
+		{"lookup l {\n\tentry ip=10.300.0.0/16 {\n\t\towner = x\n\t}\n}", "bad CIDR 10.300.0.0/16"},
+	} {
+		if _, err := New("test", test.text); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.text, test.err, err)
+		}
+	}
+}
+
+func TestLookupExpand(t *testing.T) {
+	c, err := New("test", `
+		$dbTeam = dba
+		macro escalation {
+			escalate = ${dbTeam}-oncall
+		}
+		lookup team {
+			entry host=db* {
+				owner = $dbTeam
+				macro = escalation
+			}
+			entry host=* {
+				$team = web
+				owner = $team
+				escalate = $team-oncall
+			}
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := c.Lookups["team"].ToExpr()
+	for _, test := range []struct {
+		host, owner, escalate string
+	}{
+		{"db1", "dba", "dba-oncall"},
+		{"web1", "web", "web-oncall"},
+	} {
+		tags := opentsdb.TagSet{"host": test.host}
+		owner, _ := l.Get("owner", tags)
+		escalate, _ := l.Get("escalate", tags)
+		if owner != test.owner || escalate != test.escalate {
+			t.Errorf("%s: got %q and %q, expected %q and %q", test.host, owner, escalate, test.owner, test.escalate)
+		}
+	}
+	if _, ok := l.Get("$team", opentsdb.TagSet{"host": "web1"}); ok {
+		t.Error("expected entry variable not to be a lookup value")
+	}
+}
+
+func TestExpandTrace(t *testing.T) {
+	c, err := New("test", `macro base {
+	$threshold = 90
+	warn = 1
+}
+macro m {
+	macro = base
+	crit = $threshold
+}
+alert a {
+	$owner = ops
+	macro = m
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.ExpandTrace("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `alert a {
+	$owner = ops	# test:10:1
+	$threshold = 90	# test:2:1, macro base
+	warn = 1	# test:3:1, macro base
+	crit = 90	# test:7:1, macro m
+}
+`
+	if got != expect {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, expect)
+	}
+	if _, err := c.ExpandTrace("missing"); err == nil {
+		t.Error("expected error for unknown alert")
+	}
+}
+
+func TestDefaultMaxLogFrequency(t *testing.T) {
+	c, err := New("test", `
+		defaultMaxLogFrequency = 10m
+		template t {
+			subject = s
+		}
+		notification n {
+			print = true
+		}
+		alert inherit {
+			template = t
+			crit = 1
+			critNotification = n
+			log = true
+		}
+		alert override {
+			template = t
+			crit = 1
+			critNotification = n
+			log = true
+			maxLogFrequency = 1m
+		}
+		alert normal {
+			crit = 1
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expect := range map[string]time.Duration{"inherit": 10 * time.Minute, "override": time.Minute, "normal": 0} {
+		if got := c.Alerts[name].MaxLogFrequency; got != expect {
+			t.Errorf("%s: got %v, expected %v", name, got, expect)
+		}
+	}
+	if _, err := New("test", "defaultMaxLogFrequency = -1m"); err == nil {
+		t.Error("expected error for negative defaultMaxLogFrequency")
+	}
+}
+
+func TestLint(t *testing.T) {
+	diags := LintConfig("test", `template t {
+	$used = x
+	$unused = y
+	subject = {{V "$used"}}
+}
+notification n {
+	print = true
+}
+lookup l {
+	entry host=* {
+		n = a
+	}
+	entry host=ny-web01 {
+		n = b
+	}
+	entry host=ny-* {
+		n = c
+		other = d
+	}
+}
+alert quiet {
+	template = t
+	crit = 1
+}
+alert loud {
+	template = t
+	crit = 1
+	critNotification = n
+}
+lookup m {
+	entry ip=* {
+		n = a
+	}
+	entry ip=10.0.0.0/8 {
+		n = b
+	}
+}`)
+	expect := []Diagnostic{
+		{"warning", "test:1:0", "template t: variable $unused is never used"},
+		{"warning", "test:13:1", "lookup l: entry host=ny-web01 can never match, entry host=* always matches first"},
+		{"warning", "test:21:0", "alert quiet has no notifications"},
+		{"warning", "test:21:0", "alert quiet has no owner"},
+		{"warning", "test:25:0", "alert loud has no owner"},
+		{"warning", "test:34:1", "lookup m: entry ip=10.0.0.0/8 can never match, entry ip=* always matches first"},
+	}
+	if !reflect.DeepEqual(diags, expect) {
+		t.Errorf("got %v, expected %v", diags, expect)
+	}
+	diags = LintConfig("test", `template header {
+	subject = h
+}
+template t {
+	subject = {{template "header" .}}
+}
+template old {
+	subject = o
+}
+notification page {
+	print = true
+}
+notification escalate {
+	print = true
+}
+notification n {
+	print = true
+	next = escalate
+}
+notification stale {
+	print = true
+}
+lookup l {
+	entry host=* {
+		n = page
+	}
+}
+alert a {
+	template = t
+	crit = 1
+	critNotification = n
+	warnNotification = lookup("l", "n")
+}`)
+	expect = []Diagnostic{
+		{"warning", "test:7:0", "template old is not used by any alert"},
+		{"warning", "test:20:0", "notification stale is not used by any alert"},
+		{"warning", "test:28:0", "alert a has no owner"},
+	}
+	if !reflect.DeepEqual(diags, expect) {
+		t.Errorf("got %v, expected %v", diags, expect)
+	}
+	diags = LintConfig("test", "alert a {\n\tcrit = \n}")
+	if len(diags) != 1 || diags[0].Severity != "error" {
+		t.Errorf("expected one error, got %v", diags)
+	}
+}
+
+func TestAlertHash(t *testing.T) {
+	base := `template t {
+	subject = s
+}
+notification n {
+	print = true
+}
+alert a {
+	template = t
+	crit = 1
+	critNotification = n
+}
+alert b {
+	crit = 2
+}
+`
+	hash := func(text string) string {
+		c, err := New("test", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := c.AlertHash("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	h := hash(base)
+	for _, test := range []struct {
+		text string
+		same bool
+	}{
+		{strings.Replace(base, "crit = 2", "crit = 3", 1), true},
+		{strings.Replace(base, "\ttemplate = t\n\tcrit = 1\n", "\tcrit = 1\n\n\ttemplate = t\n", 1), true},
+		{strings.Replace(base, "print = true", "  print = true  ", 1), true},
+		{strings.Replace(base, "crit = 1", "crit = 4", 1), false},
+		{strings.Replace(base, "subject = s", "subject = x", 1), false},
+		{strings.Replace(base, "print = true", "print = true\n\trunOnActions = false", 1), false},
+	} {
+		if got := hash(test.text); (got == h) != test.same {
+			t.Errorf("expected same hash %v for:\n%s", test.same, test.text)
+		}
+	}
+}
+
+func TestAlertDiff(t *testing.T) {
+	base := `alert a {
+	crit = 1
+	warn = 0
+}
+alert b {
+	crit = 2
+}
+`
+	c, err := New("test", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := strings.Replace(base, "crit = 1\n", "crit = 1\n\tsquelch = host=x\n", 1)
+	text = strings.Replace(text, "crit = 2", "crit = 3", 1)
+	for _, test := range []struct {
+		name, text, diff string
+	}{
+		{"a", text, `--- test: alert a
++++ test: alert a (edited)
+@@ -1,4 +1,5 @@
+ alert a {
+ 	crit = 1
++	squelch = host=x
+ 	warn = 0
+ }
+`},
+		{"b", text, `--- test: alert b
++++ test: alert b (edited)
+@@ -5,3 +6,3 @@
+ alert b {
+-	crit = 2
++	crit = 3
+ }
+`},
+		{"b", base, ""},
+	} {
+		diff, err := c.AlertDiff(test.name, test.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff != test.diff {
+			t.Errorf("alert %s: got:\n%s\nexpected:\n%s", test.name, diff, test.diff)
+		}
+	}
+	if _, err := c.AlertDiff("c", text); err == nil {
+		t.Error("expected an error for an unknown alert")
+	}
+}
+
+func TestNotificationSet(t *testing.T) {
+	c, err := New("", `
+		template t {
+			subject = s
+		}
+		notification manager {
+			print = true
+		}
+		notification oncall {
+			print = true
+			next = oncall
+			timeout = 1h
+		}
+		notificationSet paging {
+			notification = oncall
+			mode = firstSuccess
+		}
+		alert plain {
+			template = t
+			crit = 1
+			critNotificationSet = paging
+		}
+		alert tweaked {
+			template = t
+			crit = 1
+			warn = 1
+			critNotificationSet = paging
+			critNotificationTimeout = 10m
+			warnNotificationSet = paging
+			warnNotificationTimeout = 10m
+		}
+		alert escalated {
+			template = t
+			crit = 1
+			critNotificationSet = paging
+			critNotificationNext = manager
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oncall := c.Notifications["oncall"]
+	plain := c.Alerts["plain"].CritNotification
+	if plain.Notifications["oncall"] != oncall || !plain.FirstSuccess {
+		t.Errorf("expected plain to include the set unchanged, got %+v", plain)
+	}
+	if c.AlertNotification("plain", "oncall") != oncall {
+		t.Error("expected plain to send the global notification")
+	}
+	n := c.AlertNotification("tweaked", "oncall")
+	if n == oncall || n.Timeout != 10*time.Minute || n.Next != n {
+		t.Errorf("expected tweaked to repeat every 10m, got timeout %v", n.Timeout)
+	}
+	if c.Alerts["tweaked"].WarnNotification.Notifications["oncall"] != n {
+		t.Error("expected crit and warn of tweaked to share the override")
+	}
+	if oncall.Timeout != time.Hour || oncall.Next != oncall {
+		t.Error("override changed the global notification")
+	}
+	if n := c.AlertNotification("escalated", "oncall"); n.Next != c.Notifications["manager"] || n.Timeout != time.Hour {
+		t.Errorf("expected escalated to escalate to manager, got %v", n.Next.Name)
+	}
+
+	for _, text := range []string{
+		"alert a {\n crit = 1\n critNotificationTimeout = 5m\n}",
+		"notification n {\n print = true\n}\nnotificationSet s {\n notification = n\n}\nalert a {\n crit = 1\n critNotificationSet = s\n critNotificationNext = missing\n}",
+		"notification n {\n print = true\n}\nnotificationSet s {\n notification = n\n}\nalert a {\n crit = 1\n warn = 1\n critNotificationSet = s\n critNotificationTimeout = 5m\n warnNotificationSet = s\n}",
+	} {
+		if _, err := New("", text); err == nil {
+			t.Errorf("expected error for %q", text)
+		}
+	}
+}
+
+func TestGetEffectiveConfig(t *testing.T) {
+	c, err := New("", `
+		tsdbHost = localhost:4242
+		template t {
+			subject = s
+		}
+		notification web {
+			print = true
+		}
+		notification dba {
+			print = true
+		}
+		notification db {
+			print = true
+			next = dba
+			timeout = 1h
+		}
+		lookup team {
+			entry service=web {
+				notification = web
+			}
+			entry service=* {
+				notification = db
+			}
+		}
+		macro m {
+			template = t
+		}
+		alert cpu {
+			macro = m
+			crit = avg(q("avg:os_cpu{host=*,service=*}", "5m", "")) > 90
+			critNotification = lookup("team", "notification")
+		}
+		alert disk {
+			macro = m
+			crit = avg(q("avg:os.disk{host=*,mount=*}", "5m", "")) > 90
+			critNotification = web
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		tags   opentsdb.TagSet
+		chains string
+	}{
+		{opentsdb.TagSet{"host": "a", "service": "web"}, "[[web]]"},
+		{opentsdb.TagSet{"host": "a", "service": "mysql"}, "[[db dba]]"},
+	} {
+		ec := c.GetEffectiveConfig(test.tags)
+		if len(ec.Alerts) != 1 || ec.Alerts[0].Name != "cpu" {
+			t.Fatalf("%v: expected only alert cpu, got %+v", test.tags, ec.Alerts)
+		}
+		a := ec.Alerts[0]
+		if got := fmt.Sprint(a.CritNotifications); got != test.chains {
+			t.Errorf("%v: got notifications %s, expected %s", test.tags, got, test.chains)
+		}
+		if a.Definition[0] != "template = t" || !a.Group.Equal(test.tags) {
+			t.Errorf("%v: unexpected alert %+v", test.tags, a)
+		}
+	}
+	if ec := c.GetEffectiveConfig(opentsdb.TagSet{"host": "a", "mount": "/", "service": "web"}); len(ec.Alerts) != 2 {
+		t.Errorf("expected both alerts, got %d", len(ec.Alerts))
+	}
+}
+
+func TestPreviewNotifications(t *testing.T) {
+	c, err := New("", `
+		tsdbHost = localhost:4242
+		notification chat {
+			print = true
+			priority = 2
+		}
+		notification secondary {
+			print = true
+			timeout = 30m
+			next = secondary
+		}
+		notification oncall {
+			print = true
+			priority = 1
+			timeout = 15m
+			next = chat
+			critNext = secondary
+		}
+		lookup team {
+			entry service=web {
+				notification = oncall,chat
+			}
+		}
+		alert cpu {
+			crit = avg(q("avg:os_cpu{host=*,service=*}", "5m", "")) > 90
+			warn = avg(q("avg:os_cpu{host=*,service=*}", "5m", "")) > 80
+			critNotification = lookup("team", "notification")
+			warnNotification = lookup("team", "notification")
+			squelch = host=test.*
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	format := func(p *NotificationPreview) string {
+		var chains []string
+		for _, chain := range p.Chains {
+			var steps []string
+			for _, s := range chain {
+				step := fmt.Sprintf("%s@%v", s.Notification, s.After)
+				if s.Repeats {
+					step += "..."
+				}
+				steps = append(steps, step)
+			}
+			chains = append(chains, strings.Join(steps, " "))
+		}
+		return strings.Join(chains, "; ")
+	}
+	tags := opentsdb.TagSet{"host": "a", "service": "web"}
+	for _, test := range []struct {
+		status models.Status
+		expect string
+	}{
+		{models.StCritical, "oncall@0s secondary@15m0s...; chat@0s"},
+		{models.StWarning, "oncall@0s chat@15m0s; chat@0s"},
+	} {
+		p, err := c.PreviewNotifications("cpu", tags, test.status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := format(p); got != test.expect || p.Squelched {
+			t.Errorf("%v: got %s (squelched %v), expected %s", test.status, got, p.Squelched, test.expect)
+		}
+	}
+	p, err := c.PreviewNotifications("cpu", opentsdb.TagSet{"host": "test1", "service": "web"}, models.StCritical)
+	if err != nil || !p.Squelched || p.SquelchedBy != "host=test.*" {
+		t.Errorf("expected squelch, got %+v, %v", p, err)
+	}
+	for _, test := range []struct {
+		alert  string
+		tags   opentsdb.TagSet
+		status models.Status
+	}{
+		{"mem", tags, models.StCritical},
+		{"cpu", opentsdb.TagSet{"host": "a"}, models.StCritical},
+		{"cpu", tags, models.StNormal},
+	} {
+		if _, err := c.PreviewNotifications(test.alert, test.tags, test.status); err == nil {
+			t.Errorf("%s %v %v: expected error", test.alert, test.tags, test.status)
+		}
+	}
+}
+
+func TestRelayTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relaytls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "relay"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, typ string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	cert := write("cert.pem", "CERTIFICATE", der)
+	keyFile := write("key.pem", "EC PRIVATE KEY", keyDER)
+
+	c, err := New("", "relayListen = :4243\nrelayTLSCert = "+cert+"\nrelayTLSKey = "+keyFile+"\nrelayTLSClientCA = "+cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RelayTLS == nil || len(c.RelayTLS.Certificates) != 1 || c.RelayTLS.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("unexpected TLS config: %+v", c.RelayTLS)
+	}
+	if c, err := New("", "relayListen = :4243"); err != nil || c.RelayTLS != nil {
+		t.Errorf("expected plain relay by default, got %v %v", c, err)
+	}
+	for _, test := range []struct{ text, err string }{
+		{"relayListen = :4243\nrelayTLSCert = " + cert, "relayTLSCert and relayTLSKey must be specified together"},
+		{"relayListen = :4243\nrelayTLSClientCA = " + cert, "relayTLSClientCA specified, but no relayTLSCert and relayTLSKey"},
+		{"relayListen = :4243\nrelayTLSCert = " + cert + "\nrelayTLSKey = " + cert, "relayTLSCert and relayTLSKey: "},
+		{"relayListen = :4243\nrelayTLSCert = " + cert + "\nrelayTLSKey = " + keyFile + "\nrelayTLSClientCA = " + keyFile, "relayTLSClientCA: no PEM certificates"},
+		{"relayTLSCert = " + cert + "\nrelayTLSKey = " + keyFile, "relayTLSCert specified, but no relayListen"},
+	} {
+		if _, err := New("", test.text); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("expected error %q, got %v", test.err, err)
+		}
+	}
+}
+
+func TestImportPrometheusRules(t *testing.T) {
+	imp, err := ImportPrometheusRules([]byte(`
+groups:
+- name: node
+  rules:
+  - record: job:cpu:avg
+    expr: avg(cpu) by (job)
+  - alert: HighCPU
+    expr: avg by (host) (os_cpu{dc="ny"}) > 90
+    for: 10m
+    labels:
+      severity: warning
+      team: ops
+    annotations:
+      summary: CPU {{ $value }} on {{ $labels.host }}
+      runbook_url: https://wiki.example.com/cpu
+      dashboard: https://grafana.example.com/cpu
+  - alert: Errors
+    expr: sum(rate(http_errors{code=~"500|503"}[5m])) by (service) >= 1
+  - alert: Errors
+    expr: histogram_quantile(0.99, rate(latency_bucket[5m])) > 1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TODO: recording rule job:cpu:avg is not imported",
+		"# TODO: alert HighCPU: annotation dashboard is not imported",
+		"\tsubject = CPU {{ (.Eval .Alert.Vars.value) }} on {{ .Group.host }}",
+		"\ttemplate = HighCPU",
+		"\trunbook = https://wiki.example.com/cpu",
+		"\t$label_team = ops",
+		`	$value = min(q("avg:os_cpu{dc=ny,host=*}", "10m", ""))`,
+		"\twarn = $value > 90",
+		`	$value = avg(q("sum:rate{counter}:http_errors{code=500|503,service=*}", "5m", ""))`,
+		"\tcrit = $value >= 1",
+		"# TODO: alert Errors: unsupported expression: histogram_quantile(0.99, rate(latency_bucket[5m])) > 1",
+		"# expr: histogram_quantile(0.99, rate(latency_bucket[5m])) > 1",
+	} {
+		if !strings.Contains(imp.Config, line+"\n") {
+			t.Errorf("missing line %q in:\n%s", line, imp.Config)
+		}
+	}
+	if len(imp.Warnings) != 3 {
+		t.Errorf("got warnings %q, expected 3", imp.Warnings)
+	}
+	c, err := New("import", "tsdbHost = localhost:4242\n"+imp.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Alerts["HighCPU"] == nil || c.Alerts["Errors"] == nil || c.Alerts["Errors_2"] != nil {
+		t.Errorf("got alerts %v", c.Alerts)
+	}
+}
+
+func TestSignedAckLink(t *testing.T) {
+	c, err := New("test", "hostname = bosun.example.com\nackLinkSecret = s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AckLinkExpiry != defaultAckLinkExpiry {
+		t.Errorf("got ackLinkExpiry %v", c.AckLinkExpiry)
+	}
+	now := time.Unix(1000000, 0)
+	link, err := url.Parse(c.SignedAckLink(42, now.Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Host != "bosun.example.com" || link.Path != "/api/ack/signed" {
+		t.Errorf("unexpected link %s", link)
+	}
+	v := link.Query()
+	if id, err := c.VerifyAckLink(v, now); err != nil || id != 42 {
+		t.Errorf("got %d, %v, expected 42", id, err)
+	}
+	if _, err := c.VerifyAckLink(v, now.Add(2*time.Hour)); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expected expired link, got %v", err)
+	}
+	for _, k := range []string{"incident", "expires"} {
+		tampered := link.Query()
+		tampered.Set(k, tampered.Get(k)+"1")
+		if _, err := c.VerifyAckLink(tampered, now); err == nil {
+			t.Errorf("expected error for changed %s", k)
+		}
+	}
+	other, _ := New("test", "ackLinkSecret = other")
+	if _, err := other.VerifyAckLink(v, now); err == nil {
+		t.Error("expected error for a link signed with another secret")
+	}
+	none, _ := New("test", "")
+	if link := none.SignedAckLink(42, now); link != "" {
+		t.Errorf("expected no link without ackLinkSecret, got %s", link)
+	}
+}
+
+func TestDerivedTags(t *testing.T) {
+	c, err := New("", `
+		tsdbHost = localhost:4242
+		squelch = team=sandbox
+		template t {
+			subject = s
+		}
+		notification payments {
+			print = true
+		}
+		notification platform {
+			print = true
+		}
+		lookup services {
+			entry service=checkout {
+				team = payments
+			}
+			entry service=demo {
+				team = sandbox
+			}
+		}
+		derivedTag team {
+			value = lookup("services", "team")
+			default = platform
+		}
+		lookup teams {
+			entry team=payments {
+				notification = payments
+			}
+			entry team=* {
+				notification = platform
+			}
+		}
+		alert errors {
+			template = t
+			crit = avg(q("sum:errors{service=*}", "5m", "")) > 10
+			critNotification = lookup("teams", "notification")
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived := c.Derive(opentsdb.TagSet{"service": "checkout"})
+	if !derived.Equal(opentsdb.TagSet{"service": "checkout", "team": "payments"}) {
+		t.Errorf("got derived tags %v", derived)
+	}
+	derived = c.Derive(opentsdb.TagSet{"service": "other"})
+	if derived["team"] != "platform" {
+		t.Errorf("expected default team, got %v", derived)
+	}
+	if derived = c.Derive(opentsdb.TagSet{"service": "checkout", "team": "x"}); derived["team"] != "x" {
+		t.Errorf("expected the tag's own value to be kept, got %v", derived)
+	}
+	a := c.Alerts["errors"]
+	if !c.AlertSquelched(a)(opentsdb.TagSet{"service": "demo"}) {
+		t.Error("expected service=demo to be squelched by its derived team")
+	}
+	if c.AlertSquelched(a)(opentsdb.TagSet{"service": "checkout"}) {
+		t.Error("expected service=checkout not to be squelched")
+	}
+	cache := c.NewDerivedTagCache()
+	if derived := cache.Derive(opentsdb.TagSet{"service": "checkout"}); derived["team"] != "payments" {
+		t.Errorf("got cached derived tags %v", derived)
+	}
+	p, err := c.PreviewNotifications("errors", opentsdb.TagSet{"service": "checkout"}, models.StCritical)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Chains) != 1 || p.Chains[0][0].Notification != "payments" {
+		t.Errorf("expected notification payments, got %v", p.Chains)
+	}
+
+	for text, reason := range map[string]string{
+		`derivedTag team {
+			value = lookup("services", "team")
+		}`: "unknown lookup table services",
+		`lookup services {
+			entry service=* {
+				owner = x
+			}
+		}
+		derivedTag team {
+			value = lookup("services", "team")
+		}`: "lookup table services has no key team",
+		`lookup services {
+			entry service=* {
+				team = x
+			}
+		}
+		derivedTag team {
+			value = service
+		}`: `derivedTag value must be lookup("table", "key")`,
+		`lookup owners {
+			entry team=* {
+				owner = x
+			}
+		}
+		derivedTag owner {
+			value = lookup("owners", "owner")
+		}
+		lookup services {
+			entry service=* {
+				team = x
+			}
+		}
+		derivedTag team {
+			value = lookup("services", "team")
+		}`: "derivedTag team is used by derivedTag owner, so must be declared before it",
+	} {
+		_, err := New("", text)
+		if err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("expected error %q, got %v", reason, err)
+		}
+	}
+}
+
+func TestVaultSecrets(t *testing.T) {
+	password := "hunter2"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "tok" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/bosun":
+			fmt.Fprintf(w, `{"data": {"data": {"smtp": %q}, "metadata": {"version": 1}}}`, password)
+		case "/v1/kv/bosun":
+			fmt.Fprint(w, `{"data": {"redis": "r3d1s"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	c, err := New("test", fmt.Sprintf(`
+		vaultAddress = %s
+		vaultToken = tok
+		smtpPassword = vault("secret/data/bosun", "smtp")
+		redisPassword = vault("kv/bosun", "redis")
+		graphiteUsername = bosun
+		graphitePassword = literal
+	`, ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SMTPPassword != "hunter2" || c.RedisPassword != "r3d1s" || c.GraphitePassword != "literal" {
+		t.Errorf("unexpected credentials: %q, %q, %q", c.SMTPPassword, c.RedisPassword, c.GraphitePassword)
+	}
+	for name, conf := range map[string]string{
+		"missing field": "vaultToken = tok\nsmtpPassword = vault(\"kv/bosun\", \"smtp\")",
+		"missing path":  "vaultToken = tok\nsmtpPassword = vault(\"kv/nope\", \"smtp\")",
+		"bad token":     "vaultToken = nope\nsmtpPassword = vault(\"kv/bosun\", \"redis\")",
+	} {
+		_, err := New("test", fmt.Sprintf("vaultAddress = %s\n%s", ts.URL, conf))
+		if err == nil || !strings.Contains(err.Error(), "smtpPassword: ") {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+	if _, err := New("test", `smtpPassword = vault("kv/bosun", "redis")`); err == nil || !strings.Contains(err.Error(), "no vaultAddress") {
+		t.Errorf("unexpected error without vaultAddress: %v", err)
+	}
+
+	v := NewVaultResolver(ts.URL, "tok", time.Nanosecond)
+	if s, err := v.Resolve("secret/data/bosun", "smtp"); err != nil || s != "hunter2" {
+		t.Fatalf("got %q, %v", s, err)
+	}
+	password = "correct horse"
+	if s, err := v.Resolve("secret/data/bosun", "smtp"); err != nil || s != "correct horse" {
+		t.Errorf("expected refreshed secret, got %q, %v", s, err)
+	}
+}
+
+func TestAlertOwner(t *testing.T) {
+	c, err := New("test", `
+		teams = db, web
+		template t {
+			subject = s
+		}
+		notification page {
+			print = true
+		}
+		notification chat {
+			print = true
+		}
+		notificationSet db {
+			notification = page
+		}
+		alert routed {
+			template = t
+			owner = db
+			crit = 1
+			warn = 1
+		}
+		alert explicit {
+			template = t
+			owner = db
+			crit = 1
+			critNotification = chat
+		}
+		alert noset {
+			template = t
+			owner = web
+			crit = 1
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routed := c.Alerts["routed"]
+	if routed.CritNotification.Notifications["page"] == nil || routed.WarnNotification.Notifications["page"] == nil {
+		t.Errorf("expected alert routed to its owner's notificationSet, got %v and %v", routed.CritNotification, routed.WarnNotification)
+	}
+	if ns := c.Alerts["explicit"].CritNotification.Notifications; len(ns) != 1 || ns["chat"] == nil {
+		t.Errorf("expected only the explicit notification, got %v", ns)
+	}
+	if hasNotifications(c.Alerts["noset"].CritNotification) {
+		t.Errorf("expected no notifications without the owner's notificationSet")
+	}
+	owners := c.AlertsByOwner()
+	if !reflect.DeepEqual(owners["db"], []string{"explicit", "routed"}) || !reflect.DeepEqual(owners["web"], []string{"noset"}) {
+		t.Errorf("unexpected owners: %v", owners)
+	}
+	if _, err := New("test", "teams = db\nalert a {\n\tcrit = 1\n\towner = ops\n}"); err == nil || !strings.Contains(err.Error(), "unknown owner ops, must be one of the teams: db") {
+		t.Errorf("unexpected error for unknown owner: %v", err)
+	}
+}
+
+func TestEscalations(t *testing.T) {
+	c, err := New("test", `
+		template t {
+			subject = s
+		}
+		notification page {
+			print = true
+		}
+		notification lead {
+			print = true
+		}
+		notification director {
+			print = true
+		}
+		escalation pager {
+			steps = page, lead
+			timeout = 5m
+			repeat = true
+		}
+		escalation management {
+			steps = lead, director
+			timeout = 1h
+		}
+		alert a {
+			template = t
+			owner = db
+			crit = 1
+			warn = 1
+			critEscalation = pager
+			critEscalation = management
+			warnEscalation = management
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := c.Alerts["a"]
+	chains := GetNotificationChains(c, a.CritNotification.Notifications)
+	slice.Sort(chains, func(i, j int) bool { return chains[i][0] < chains[j][0] })
+	expect := [][]string{
+		{"management/lead", "management/director"},
+		{"pager/page", "pager/lead", "...pager/lead"},
+	}
+	if !reflect.DeepEqual(chains, expect) {
+		t.Errorf("got chains %v, expected %v", chains, expect)
+	}
+	lead := c.AlertNotification("a", "pager/lead")
+	if lead == nil || lead.Timeout != 5*time.Minute || lead.Escalation != "pager" {
+		t.Errorf("unexpected pager/lead: %+v", lead)
+	}
+	if d := c.AlertNotification("a", "management/director"); d == nil || d.Timeout != time.Hour {
+		t.Errorf("unexpected management/director: %+v", d)
+	}
+	if c.Notifications["lead"].Next != nil || c.Notifications["lead"].Timeout != 0 {
+		t.Errorf("escalations must not change the notifications they use")
+	}
+	if a.WarnNotification.Notifications["management/lead"] != a.CritNotification.Notifications["management/lead"] {
+		t.Errorf("expected crit and warn to share the management escalation")
+	}
+	if diags := c.Lint(); len(diags) != 0 {
+		t.Errorf("unexpected lint warnings: %v", diags)
+	}
+	const n = "notification n {\n\tprint = true\n}\n"
+	for _, test := range []struct{ conf, err string }{
+		{n + "escalation e {\n\tsteps = n, n\n\ttimeout = 1m\n}", "escalation e: notification n is a cycle"},
+		{n + "escalation e {\n\tsteps = n\n\trepeat = true\n}", "escalation e has no timeout"},
+		{"alert a {\n\tcrit = 1\n\tcritEscalation = e\n}", "unknown escalation e"},
+		{n + "escalation e {\n\tsteps = n\n}\nalert a {\n\tcrit = 1\n\tcritEscalation = e\n\tcritEscalation = e\n}", "duplicate escalation e"},
+	} {
+		if _, err := New("test", test.conf); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("expected error %q, got %v", test.err, err)
+		}
+	}
+}
+
+func TestSetAlertsEnabled(t *testing.T) {
+	c, err := New("test", `
+		template t {
+			subject = s
+		}
+		macro checkout {
+			$service = checkout
+			owner = web
+		}
+		alert checkout.latency {
+			template = t
+			macro = checkout
+			crit = 1
+		}
+		alert checkout.errors {
+			template = t
+			$service = checkout
+			crit = 1
+		}
+		alert os.cpu {
+			template = t
+			crit = 1
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for selector, want := range map[string][]string{
+		"service=checkout":         {"checkout.errors", "checkout.latency"},
+		"service=check*,owner=web": {"checkout.latency"},
+		"os.*":                     {"os.cpu"},
+		`/\.(cpu|errors)$/`:        {"checkout.errors", "os.cpu"},
+		"service=billing":          nil,
+	} {
+		names, err := c.SelectAlerts(selector)
+		if err != nil {
+			t.Errorf("%s: %v", selector, err)
+		} else if !reflect.DeepEqual(names, want) {
+			t.Errorf("%s: expected %v, got %v", selector, want, names)
+		}
+	}
+	for _, bad := range []string{"", "/(/", "=checkout"} {
+		if _, err := c.SelectAlerts(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+
+	text, count, err := c.SetAlertsEnabled("service=checkout", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 alerts disabled, got %d", count)
+	}
+	disabled, err := New("test", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"checkout.latency": true, "checkout.errors": true, "os.cpu": false} {
+		if disabled.Alerts[name].Disabled != want {
+			t.Errorf("%s: expected disabled %v", name, want)
+		}
+	}
+	if _, count, err := disabled.SetAlertsEnabled("checkout.*", false); err != nil || count != 0 {
+		t.Errorf("expected disabled alerts to be left alone, got %d, %v", count, err)
+	}
+	text, count, err = disabled.SetAlertsEnabled("*", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || text != c.RawText {
+		t.Errorf("expected enabling to restore the text, got %d alerts:\n%s", count, text)
+	}
+	if _, _, err := c.SetAlertsEnabled("billing.*", false); err == nil {
+		t.Error("expected an error when no alerts match")
+	}
+
+	c, err = New("test", "macro off {\n\tdisabled = true\n}\nalert a {\n\tmacro = off\n\tcrit = 1\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.SetAlertsEnabled("a", true); err == nil || !strings.Contains(err.Error(), "disabled by a macro") {
+		t.Errorf("expected an error enabling an alert disabled by a macro, got %v", err)
+	}
+}
+
+func TestRuleSource(t *testing.T) {
+	for location, want := range map[string]string{
+		"dev.conf":                     "dev.conf",
+		"/etc/bosun/bosun.conf":        "/etc/bosun/bosun.conf",
+		"file:///etc/bosun/bosun.conf": "/etc/bosun/bosun.conf",
+		"https://example.com/b.conf":   "https://example.com/b.conf",
+		"s3://rules/prod/bosun.conf":   "https://rules.s3.amazonaws.com/prod/bosun.conf",
+		"gs://rules/prod/bosun.conf":   "https://storage.googleapis.com/rules/prod/bosun.conf",
+	} {
+		src, err := NewRuleSource(location)
+		if err != nil {
+			t.Errorf("%s: %v", location, err)
+		} else if src.Name() != want {
+			t.Errorf("%s: expected %s, got %s", location, want, src.Name())
+		}
+	}
+	if _, err := NewRuleSource("ftp://example.com/bosun.conf"); err == nil {
+		t.Error("expected an error for an unsupported scheme")
+	}
+
+	const text = "alert a {\n\tcrit = 1\n}\n"
+	dir, err := ioutil.TempDir("", "bosun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := &FileSource{Path: filepath.Join(dir, "bosun.conf")}
+	if err := file.Write(text); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Source != file || c.RawText != text || c.Alerts["a"] == nil {
+		t.Errorf("unexpected config loaded from %s: %q", file.Name(), c.RawText)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected only the config in %s, got %d files", dir, len(files))
+	}
+
+	body := text
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bosun.conf" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+	src, err := NewRuleSource(ts.URL + "/bosun.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := src.(RuleWriter); ok {
+		t.Error("expected URLs to be read-only")
+	}
+	if c, err := Load(src); err != nil || c.Alerts["a"] == nil {
+		t.Errorf("expected the config to load from %s, got %v", src.Name(), err)
+	}
+	if _, err := Load(&HTTPSource{URL: ts.URL + "/missing", Client: http.DefaultClient}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a 404 error, got %v", err)
+	}
+	body = "alert a {"
+	if _, err := Load(src); err == nil {
+		t.Error("expected an invalid config not to load")
+	}
+}
+
+func TestUnjoinedOKDefault(t *testing.T) {
+	const alerts = `
+		alert inherits {
+			crit = avg(q("avg:os.cpu{host=*}", "5m", "")) > avg(q("avg:os.cpu.limit{host=*}", "5m", ""))
+			owner = ops
+		}
+		alert overrides {
+			unjoinedOk = false
+			crit = avg(q("avg:os.cpu{host=*}", "5m", "")) > 1
+			owner = ops
+		}
+		alert explicit {
+			unjoinedOk = true
+			crit = avg(q("avg:os.cpu{host=*}", "5m", "")) > avg(q("avg:os.cpu.limit{host=*}", "5m", ""))
+			owner = ops
+		}
+		alert scalar {
+			crit = avg(q("avg:os.cpu{host=*}", "5m", "")) > 1
+			owner = ops
+		}
+	`
+	c, err := New("test", "tsdbHost = localhost:4242\n"+alerts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"inherits": false, "overrides": false, "explicit": true, "scalar": false} {
+		if c.Alerts[name].UnjoinedOK != want {
+			t.Errorf("%s: expected unjoinedOk %v without a default", name, want)
+		}
+	}
+	text := "tsdbHost = localhost:4242\nunjoinedOk = true\n" + alerts
+	c, err = New("test", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"inherits": true, "overrides": false, "explicit": true, "scalar": true} {
+		if c.Alerts[name].UnjoinedOK != want {
+			t.Errorf("%s: expected unjoinedOk %v with a default of true", name, want)
+		}
+	}
+	var warnings []string
+	for _, d := range LintConfig("test", text) {
+		if strings.Contains(d.Message, "unjoinedOk") {
+			warnings = append(warnings, d.Message)
+		}
+	}
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "alert inherits joins tagged sets") {
+		t.Errorf("expected only inherits to be warned about, got %q", warnings)
+	}
+	if _, err := New("test", "unjoinedOk = maybe"); err == nil {
+		t.Error("expected an invalid unjoinedOk to fail")
+	}
+}
+
+func TestAlertDownsample(t *testing.T) {
+	const alert = `
+		alert a {
+			crit = avg(q("avg:os.cpu{host=*}", "1w", "")) > 90
+			downsample = %s
+		}
+	`
+	tests := []struct {
+		version, downsample string
+		error               bool
+	}{
+		{"2.1", "1h-avg", false},
+		{"2.2", "30m-max-zero", false},
+		{"2.1", "30m-max-zero", true},
+		{"2.1", "hourly", true},
+		{"2.2", "1h-avg-fill", true},
+	}
+	for _, test := range tests {
+		text := "tsdbHost = localhost:4242\ntsdbVersion = " + test.version + fmt.Sprintf(alert, test.downsample)
+		c, err := New("test", text)
+		if test.error {
+			if err == nil {
+				t.Errorf("%s %s: expected an error", test.version, test.downsample)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: %v", test.version, test.downsample, err)
+		} else if c.Alerts["a"].Downsample != test.downsample {
+			t.Errorf("%s %s: got downsample %q", test.version, test.downsample, c.Alerts["a"].Downsample)
+		}
+	}
+}
+
+func TestAlertReturnType(t *testing.T) {
+	tests := []struct {
+		alerts string
+		ret    models.FuncType
+		err    string
+	}{
+		{`alert a {
+			crit = avg(series("host=a", 0, 1)) > 1
+		}`, models.TypeNumberSet, ""},
+		{`alert a {
+			crit = 1
+		}`, models.TypeScalar, ""},
+		{`alert a {
+			crit = series("host=a", 0, 1)
+		}`, 0, `series("host=a", 0, 1) returns a series`},
+		{`alert a {
+			crit = series("host=a", 0, 1) > 1
+		}`, 0, `series("host=a", 0, 1) returns a series: reduce it`},
+		{`alert a {
+			crit = avg(series("host=a", 0, 1)) > 1 || -series("host=b", 0, 1) > 1
+		}`, 0, `series("host=b", 0, 1) returns a series`},
+		{`alert a {
+			crit = 1
+			warn = avg(series("host=a", 0, 1)) > 1
+		}`, 0, "crit and warn expressions must return same type"},
+		{`alert a {
+			crit = 1
+		}
+		alert b {
+			crit = alert("a", "crit")
+		}`, 0, "alert requires a number-returning expression"},
+	}
+	for _, test := range tests {
+		c, err := New("test", test.alerts)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.alerts, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.alerts, err)
+		} else if ret := c.Alerts["a"].ReturnType; ret != test.ret {
+			t.Errorf("%s: got return type %v, expected %v", test.alerts, ret, test.ret)
+		}
+	}
+}
+
+func TestTagNormalization(t *testing.T) {
+	const text = `
+		%s
+		squelch = host = Web01 
+		lookup team {
+			entry host=Web01 {
+				owner = ops
+			}
+		}
+		alert a {
+			crit = 1
+			squelch = DC=NY.*
+		}
+	`
+	for _, normalize := range []bool{false, true} {
+		setting := ""
+		if normalize {
+			setting = "tagNormalization = lowercaseKeys,lowercaseValues"
+		}
+		c, err := New("test", fmt.Sprintf(text, setting))
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := c.Alerts["a"]
+		l := c.Lookups["team"].ToExpr()
+		for _, tags := range []opentsdb.TagSet{
+			{"host": "web01"},
+			{"Host": "WEB01"},
+		} {
+			if got := c.Squelched(a, tags); got != normalize {
+				t.Errorf("normalize %v: %v squelched: got %v", normalize, tags, got)
+			}
+			if owner, _ := l.Get("owner", tags); (owner == "ops") != normalize {
+				t.Errorf("normalize %v: %v owner: got %q", normalize, tags, owner)
+			}
+		}
+		if got := c.Squelched(a, opentsdb.TagSet{"host": "db01", "dc": "ny1"}); got != normalize {
+			t.Errorf("normalize %v: alert squelch: got %v", normalize, got)
+		}
+		if !c.Squelched(a, opentsdb.TagSet{"host": "Web01"}) {
+			t.Errorf("normalize %v: expected the tags as written to be squelched", normalize)
+		}
+	}
+	for _, text := range []string{
+		"tagNormalization = uppercase",
+		"squelch = host=a\ntagNormalization = lowercaseKeys",
+		"tagNormalization = lowercaseKeys\nsquelch = host=a,Host=b",
+	} {
+		if _, err := New("test", text); err == nil {
+			t.Errorf("%s: expected an error", text)
+		}
+	}
+}
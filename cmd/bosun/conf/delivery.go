@@ -0,0 +1,200 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeliveryResult is the outcome of sending a notification through one of its
+// channels (email, post, get or print). StatusCode and Response are set when
+// a post or get receives a bad response, and hold its HTTP status and the
+// start of its body.
+type DeliveryResult struct {
+	Notification string
+	Channel      string
+	AlertKey     string
+	Success      bool
+	Error        string `json:",omitempty"`
+	StatusCode   int    `json:",omitempty"`
+	Response     string `json:",omitempty"`
+	Duration     time.Duration
+	Time         time.Time
+}
+
+// maxDeliveryResults is the number of results kept per notification.
+const maxDeliveryResults = 50
+
+var deliveries = struct {
+	sync.Mutex
+	m map[string][]*DeliveryResult
+}{m: make(map[string][]*DeliveryResult)}
+
+// deliver runs send as a delivery on channel and records its result.
+func (n *Notification) deliver(channel, ak string, send func() error) *DeliveryResult {
+	start := time.Now().UTC()
+	err := send()
+	r := &DeliveryResult{
+		Notification: n.Name,
+		Channel:      channel,
+		AlertKey:     ak,
+		Success:      err == nil,
+		Duration:     time.Since(start),
+		Time:         start,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if re, ok := err.(*ResponseError); ok {
+		r.StatusCode = re.StatusCode
+		r.Response = re.Body
+	}
+	recordDelivery(r)
+	return r
+}
+
+// maxResponseBody is the number of bytes of a failed response body kept in
+// a ResponseError.
+const maxResponseBody = 4 << 10
+
+// ResponseError is returned when a post or get notification receives a non
+// 2xx response. Body holds at most maxResponseBody bytes of the response,
+// which usually explains what the endpoint rejected.
+type ResponseError struct {
+	Method     string
+	Status     string
+	StatusCode int
+	Body       string
+	// Mismatch explains why a 2xx response was not a success, for posts
+	// with a success pointer.
+	Mismatch string `json:",omitempty"`
+}
+
+func newResponseError(method string, resp *http.Response) *ResponseError {
+	e := &ResponseError{
+		Method:     method,
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBody+1))
+	if len(b) > maxResponseBody {
+		b = append(b[:maxResponseBody], "..."...)
+	}
+	e.Body = string(b)
+	return e
+}
+
+func (e *ResponseError) Error() string {
+	if e.Mismatch != "" {
+		return fmt.Sprintf("bad response on notification %s: %s: %s: %s", e.Method, e.Status, e.Mismatch, e.Body)
+	}
+	if e.Body == "" {
+		return fmt.Sprintf("bad response on notification %s: %s", e.Method, e.Status)
+	}
+	return fmt.Sprintf("bad response on notification %s: %s: %s", e.Method, e.Status, e.Body)
+}
+
+// maxSuccessBody is the number of bytes of a response body read to check a
+// success pointer.
+const maxSuccessBody = 1 << 20
+
+// checkSuccess returns a ResponseError if the notification has a success
+// pointer and the JSON body of resp does not have its success value there.
+func (n *Notification) checkSuccess(method string, resp *http.Response) error {
+	if n.SuccessPointer == "" {
+		return nil
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSuccessBody+1))
+	if err != nil {
+		return err
+	}
+	e := &ResponseError{
+		Method:     method,
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+	}
+	var doc interface{}
+	if len(b) > maxSuccessBody {
+		e.Mismatch = fmt.Sprintf("body larger than %d bytes", maxSuccessBody)
+	} else if err := json.Unmarshal(b, &doc); err != nil {
+		e.Mismatch = fmt.Sprintf("body is not JSON: %v", err)
+	} else if v, ok := jsonPointer(doc, n.SuccessPointer); !ok {
+		e.Mismatch = fmt.Sprintf("%s not found", n.SuccessPointer)
+	} else if !reflect.DeepEqual(v, n.SuccessValue) {
+		got, _ := json.Marshal(v)
+		want, _ := json.Marshal(n.SuccessValue)
+		e.Mismatch = fmt.Sprintf("%s is %s, expected %s", n.SuccessPointer, got, want)
+	} else {
+		return nil
+	}
+	if len(b) > maxResponseBody {
+		b = append(b[:maxResponseBody], "..."...)
+	}
+	e.Body = string(b)
+	return e
+}
+
+// jsonPointer returns the value in doc, a decoded JSON document, that the
+// RFC 6901 JSON pointer ptr refers to.
+func jsonPointer(doc interface{}, ptr string) (interface{}, bool) {
+	if ptr == "" {
+		return doc, true
+	}
+	for _, tok := range strings.Split(ptr[1:], "/") {
+		tok = strings.Replace(strings.Replace(tok, "~1", "/", -1), "~0", "~", -1)
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if doc, ok = v[tok]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(tok)
+			if err != nil || i < 0 || i >= len(v) || (len(tok) > 1 && tok[0] == '0') {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+func recordDelivery(r *DeliveryResult) {
+	deliveries.Lock()
+	defer deliveries.Unlock()
+	rs := append(deliveries.m[r.Notification], r)
+	if len(rs) > maxDeliveryResults {
+		rs = rs[len(rs)-maxDeliveryResults:]
+	}
+	deliveries.m[r.Notification] = rs
+}
+
+// RecentDeliveries returns the most recent delivery results for the named
+// notification, oldest first.
+func RecentDeliveries(name string) []*DeliveryResult {
+	deliveries.Lock()
+	defer deliveries.Unlock()
+	rs := deliveries.m[name]
+	return append(make([]*DeliveryResult, 0, len(rs)), rs...)
+}
+
+// AllRecentDeliveries returns the most recent delivery results for every
+// notification that has been sent, keyed by notification name.
+func AllRecentDeliveries() map[string][]*DeliveryResult {
+	deliveries.Lock()
+	defer deliveries.Unlock()
+	all := make(map[string][]*DeliveryResult, len(deliveries.m))
+	for name, rs := range deliveries.m {
+		all[name] = append(make([]*DeliveryResult, 0, len(rs)), rs...)
+	}
+	return all
+}
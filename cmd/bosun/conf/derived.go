@@ -0,0 +1,146 @@
+package conf
+
+import (
+	"sync"
+
+	"bosun.org/cmd/bosun/conf/parse"
+	"bosun.org/opentsdb"
+)
+
+// DerivedTag is a tag whose value is looked up from the other tags of an
+// alert key. Derived tags are added before squelches and notification lookups
+// are resolved, so routing by, for example, team need only be written once.
+type DerivedTag struct {
+	Text string
+	Name string
+	// Lookup and Key are the table and key of the tag's value.
+	Lookup string
+	Key    string
+	// Default is the value when no entry of the table matches, or "" for
+	// the tag to be left unset.
+	Default string `json:",omitempty"`
+}
+
+func (c *Conf) loadDerivedTag(s *parse.SectionNode) {
+	name := s.Name.Text
+	for _, d := range c.DerivedTags {
+		if d.Name == name {
+			c.errorf("duplicate derivedTag name: %s", name)
+		}
+	}
+	if !opentsdb.ValidTSDBString(name) {
+		c.errorf("invalid derivedTag name: %s", name)
+	}
+	d := DerivedTag{
+		Text: s.RawText,
+		Name: name,
+	}
+	for _, p := range c.getPairs(s, nil, sNormal) {
+		c.at(p.node)
+		v := p.val
+		switch p.key {
+		case "value":
+			lookup := lookupNotificationRE.FindStringSubmatch(v)
+			if lookup == nil {
+				c.errorf("derivedTag value must be lookup(\"table\", \"key\"), not %s", v)
+			}
+			d.Lookup, d.Key = lookup[1], lookup[2]
+		case "default":
+			if !opentsdb.ValidTSDBString(v) {
+				c.errorf("invalid derivedTag default: %s", v)
+			}
+			d.Default = v
+		default:
+			c.errorf("unknown key %s", p.key)
+		}
+	}
+	c.at(s)
+	if d.Lookup == "" {
+		c.errorf("derivedTag %s has no value", name)
+	}
+	l := c.Lookups[d.Lookup]
+	if l == nil {
+		c.errorf("unknown lookup table %s", d.Lookup)
+	}
+	found := false
+	for _, e := range l.Entries {
+		if v, ok := e.Values[d.Key]; ok {
+			found = true
+			if !opentsdb.ValidTSDBString(v) {
+				c.errorf("lookup %s: invalid tag value %q for %s", d.Lookup, v, d.Key)
+			}
+		}
+	}
+	if !found {
+		c.errorf("lookup table %s has no key %s", d.Lookup, d.Key)
+	}
+	for _, t := range l.Tags {
+		if t == name {
+			c.errorf("derivedTag %s is looked up by its own value", name)
+		}
+	}
+	// Derived tags are computed in the order they are declared, so one may
+	// only be looked up by those declared after it.
+	for _, prev := range c.DerivedTags {
+		for _, t := range c.Lookups[prev.Lookup].Tags {
+			if t == name {
+				c.errorf("derivedTag %s is used by derivedTag %s, so must be declared before it", name, prev.Name)
+			}
+		}
+	}
+	c.DerivedTags = append(c.DerivedTags, &d)
+}
+
+// Derive returns tags with the derived tags it lacks added, in the order they
+// are declared. Tags already in tags are kept. tags is returned as is if no
+// derived tags are declared, and is otherwise not modified.
+func (c *Conf) Derive(tags opentsdb.TagSet) opentsdb.TagSet {
+	if len(c.DerivedTags) == 0 {
+		return tags
+	}
+	derived := tags.Copy()
+	for _, d := range c.DerivedTags {
+		if _, ok := derived[d.Name]; ok {
+			continue
+		}
+		v, ok := c.Lookups[d.Lookup].ToExpr().Get(d.Key, derived)
+		if !ok {
+			v = d.Default
+		}
+		if v != "" {
+			derived[d.Name] = v
+		}
+	}
+	return derived
+}
+
+// DerivedTagCache memoizes Derive by tag set. A new one is used for each check
+// of an alert, so lookups are resolved once per tag set per evaluation.
+type DerivedTagCache struct {
+	c    *Conf
+	mu   sync.Mutex
+	sets map[string]opentsdb.TagSet
+}
+
+func (c *Conf) NewDerivedTagCache() *DerivedTagCache {
+	return &DerivedTagCache{
+		c:    c,
+		sets: make(map[string]opentsdb.TagSet),
+	}
+}
+
+// Derive is like Conf.Derive. The result is shared and must not be modified.
+func (d *DerivedTagCache) Derive(tags opentsdb.TagSet) opentsdb.TagSet {
+	if len(d.c.DerivedTags) == 0 {
+		return tags
+	}
+	key := tags.String()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	derived, ok := d.sets[key]
+	if !ok {
+		derived = d.c.Derive(tags)
+		d.sets[key] = derived
+	}
+	return derived
+}
@@ -0,0 +1,210 @@
+package conf
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"bosun.org/models"
+	"bosun.org/opentsdb"
+	"github.com/bradfitz/slice"
+)
+
+// EffectiveConfig is the configuration as it applies to one tag set.
+type EffectiveConfig struct {
+	Tags   opentsdb.TagSet
+	Alerts []*EffectiveAlert
+}
+
+// EffectiveAlert is an alert that can match a tag set.
+type EffectiveAlert struct {
+	Name string
+	// Group is the alert key group the tag set falls in, and LookupTags the
+	// tags its notification lookups are resolved with.
+	Group      opentsdb.TagSet
+	LookupTags opentsdb.TagSet
+	// Squelched is whether the group is squelched, and SquelchedBy the
+	// squelch that matched it.
+	Squelched   bool
+	SquelchedBy string `json:",omitempty"`
+	// Definition is each key = value pair of the alert after macro and
+	// variable expansion.
+	Definition []string
+	// CritNotifications and WarnNotifications are the notification chains
+	// that would be started for the group, as by GetNotificationChains.
+	CritNotifications [][]string
+	WarnNotifications [][]string
+}
+
+// GetEffectiveConfig returns the alerts whose crit or warn tags are all in
+// tags, with their expanded definitions and the notifications they would send
+// for the group of tags after resolving lookups. Alerts are sorted by name.
+// Tags of notificationTags expressions are used for lookups if they are in
+// tags too. Derived tags are added to the group before squelches are checked,
+// and to the lookup tags.
+func (c *Conf) GetEffectiveConfig(tags opentsdb.TagSet) *EffectiveConfig {
+	ec := &EffectiveConfig{Tags: tags, Alerts: []*EffectiveAlert{}}
+	var names []string
+	for name := range c.Alerts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a := c.Alerts[name]
+		group, lookupTags := a.groupOf(tags)
+		if group == nil {
+			continue
+		}
+		lookupTags = c.Derive(lookupTags)
+		squelchedBy := c.SquelchedBy(a, c.Derive(group))
+		ea := &EffectiveAlert{
+			Name:              name,
+			Group:             group,
+			LookupTags:        lookupTags,
+			Squelched:         squelchedBy != "",
+			SquelchedBy:       squelchedBy,
+			Definition:        make([]string, len(a.expanded)),
+			CritNotifications: sortedChains(c, a.CritNotification.Get(c, lookupTags)),
+			WarnNotifications: sortedChains(c, a.WarnNotification.Get(c, lookupTags)),
+		}
+		for i, p := range a.expanded {
+			ea.Definition[i] = p.key + " = " + p.val
+		}
+		ec.Alerts = append(ec.Alerts, ea)
+	}
+	return ec
+}
+
+// groupOf returns the alert key group of a that tags fall in, or nil if tags
+// lack any of the tags of its crit or warn, and the tags its notification
+// lookups are resolved with: the group, plus the tags of notificationTags
+// that are in tags.
+func (a *Alert) groupOf(tags opentsdb.TagSet) (group, lookupTags opentsdb.TagSet) {
+	e := a.Crit
+	if e == nil {
+		e = a.Warn
+	}
+	atags, err := e.Root.Tags()
+	if err != nil {
+		return nil, nil
+	}
+	group = make(opentsdb.TagSet)
+	for k := range atags {
+		v, ok := tags[k]
+		if !ok {
+			return nil, nil
+		}
+		group[k] = v
+	}
+	lookupTags = group.Copy()
+	if a.NotificationTags != nil {
+		if ntags, err := a.NotificationTags.Root.Tags(); err == nil {
+			for k := range ntags {
+				if v, ok := tags[k]; ok {
+					lookupTags[k] = v
+				}
+			}
+		}
+	}
+	return group, lookupTags
+}
+
+// NotificationPreview is who an alert would notify, and when, for a tag set.
+type NotificationPreview struct {
+	Alert  string
+	Status models.Status
+	// Group and LookupTags are as in EffectiveAlert.
+	Group      opentsdb.TagSet
+	LookupTags opentsdb.TagSet
+	// Nothing is sent if the group is Squelched, and notifications of TestMode
+	// alerts are only logged.
+	Squelched   bool
+	SquelchedBy string `json:",omitempty"`
+	TestMode    bool
+	// FirstSuccess is whether the first notifications of Chains are sent one
+	// at a time, in order, until one is delivered, rather than all at once.
+	FirstSuccess bool
+	// Chains are the escalation chains started for the alert key, in the
+	// order of Ordered.
+	Chains [][]*NotificationStep
+}
+
+// NotificationStep is a notification of an escalation chain.
+type NotificationStep struct {
+	Notification string
+	// After is how long after the incident starts the notification is sent,
+	// if it is not acknowledged.
+	After time.Duration
+	// Repeats is whether the chain escalates to a notification earlier in
+	// the chain after this one, so that it repeats until acknowledged.
+	Repeats bool `json:",omitempty"`
+}
+
+// PreviewNotifications returns the notifications alert would send for the
+// alert key of tags once it becomes status, which must be warning or
+// critical. Lookups are resolved with tags as in GetEffectiveConfig, and each
+// escalation chain is followed, with its timeouts, until it ends or repeats.
+// Nothing is sent.
+func (c *Conf) PreviewNotifications(alert string, tags opentsdb.TagSet, status models.Status) (*NotificationPreview, error) {
+	a := c.Alerts[alert]
+	if a == nil {
+		return nil, fmt.Errorf("unknown alert: %s", alert)
+	}
+	ns := a.CritNotification
+	switch status {
+	case models.StCritical:
+	case models.StWarning:
+		ns = a.WarnNotification
+	default:
+		return nil, fmt.Errorf("status must be warning or critical, not %s", status)
+	}
+	group, lookupTags := a.groupOf(tags)
+	if group == nil {
+		return nil, fmt.Errorf("tags %s do not include every tag of alert %s", tags, alert)
+	}
+	lookupTags = c.Derive(lookupTags)
+	squelchedBy := c.SquelchedBy(a, c.Derive(group))
+	p := &NotificationPreview{
+		Alert:        alert,
+		Status:       status,
+		Group:        group,
+		LookupTags:   lookupTags,
+		Squelched:    squelchedBy != "",
+		SquelchedBy:  squelchedBy,
+		TestMode:     a.TestMode,
+		FirstSuccess: ns.FirstSuccess,
+		Chains:       [][]*NotificationStep{},
+	}
+	for _, n := range Ordered(ns.Get(c, lookupTags)) {
+		var chain []*NotificationStep
+		var after time.Duration
+		seen := make(map[*Notification]bool)
+		for {
+			step := &NotificationStep{Notification: n.Name, After: after}
+			chain = append(chain, step)
+			seen[n] = true
+			next := n.NextFor(status)
+			if next == nil {
+				break
+			}
+			if seen[next] {
+				step.Repeats = true
+				break
+			}
+			after += n.Timeout
+			n = next
+		}
+		p.Chains = append(p.Chains, chain)
+	}
+	return p, nil
+}
+
+// sortedChains returns the notification chains of nots ordered by their first
+// notification.
+func sortedChains(c *Conf, nots map[string]*Notification) [][]string {
+	chains := GetNotificationChains(c, nots)
+	slice.Sort(chains, func(i, j int) bool {
+		return chains[i][0] < chains[j][0]
+	})
+	return chains
+}
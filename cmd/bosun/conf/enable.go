@@ -0,0 +1,173 @@
+package conf
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"bosun.org/cmd/bosun/conf/parse"
+	"github.com/bradfitz/slice"
+)
+
+// SelectAlerts returns the sorted names of the alerts matching selector,
+// which is one of:
+//
+//	a glob of alert names, such as os.*
+//	a regular expression of alert names between slashes, such as /^os\./
+//	comma-separated key=value filters, such as service=checkout,owner=web
+//
+// A key=value filter matches an alert whose variable $key, or whose key, has
+// a value matching the glob value after macro and variable expansion. All
+// the filters must match.
+func (c *Conf) SelectAlerts(selector string) ([]string, error) {
+	match, err := alertMatcher(selector)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name, a := range c.Alerts {
+		if match(a) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func alertMatcher(selector string) (func(*Alert) bool, error) {
+	selector = strings.TrimSpace(selector)
+	switch {
+	case selector == "":
+		return nil, fmt.Errorf("empty alert selector")
+	case len(selector) > 1 && strings.HasPrefix(selector, "/") && strings.HasSuffix(selector, "/"):
+		re, err := regexp.Compile(selector[1 : len(selector)-1])
+		if err != nil {
+			return nil, fmt.Errorf("alert selector %s: %v", selector, err)
+		}
+		return func(a *Alert) bool { return re.MatchString(a.Name) }, nil
+	case strings.Contains(selector, "="):
+		var filters [][2]string
+		for _, f := range strings.Split(selector, ",") {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return nil, fmt.Errorf("alert selector %s: bad filter %q", selector, f)
+			}
+			k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+			if _, err := path.Match(v, ""); err != nil {
+				return nil, fmt.Errorf("alert selector %s: %v", selector, err)
+			}
+			filters = append(filters, [2]string{k, v})
+		}
+		return func(a *Alert) bool {
+			for _, f := range filters {
+				if !a.hasValue(f[0], f[1]) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	default:
+		if _, err := path.Match(selector, ""); err != nil {
+			return nil, fmt.Errorf("alert selector %s: %v", selector, err)
+		}
+		return func(a *Alert) bool {
+			ok, _ := path.Match(selector, a.Name)
+			return ok
+		}, nil
+	}
+}
+
+// hasValue returns whether the variable $key or the key of a has a value
+// matching pattern.
+func (a *Alert) hasValue(key, pattern string) bool {
+	for _, p := range a.expanded {
+		if p.key != key && p.key != "$"+key {
+			continue
+		}
+		if ok, _ := path.Match(pattern, p.val); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAlertsEnabled returns the configuration text with the alerts matching
+// selector (see SelectAlerts) enabled or disabled, by removing or adding
+// `disabled = true` in their sections, and the number of alerts changed.
+// Alerts already in that state are left alone. The text is checked to load
+// with the alerts changed; it is up to the caller to save it.
+func (c *Conf) SetAlertsEnabled(selector string, enabled bool) (text string, count int, err error) {
+	names, err := c.SelectAlerts(selector)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(names) == 0 {
+		return "", 0, fmt.Errorf("no alerts match %s", selector)
+	}
+	change := make(map[string]bool)
+	for _, name := range names {
+		if c.Alerts[name].Disabled == enabled {
+			change[name] = true
+		}
+	}
+	if len(change) == 0 {
+		return c.RawText, 0, nil
+	}
+	type edit struct {
+		start, end int
+		text       string
+	}
+	var edits []edit
+	raw := c.RawText
+	for _, n := range c.tree.Root.Nodes {
+		s, ok := n.(*parse.SectionNode)
+		if !ok || s.SectionType.Text != "alert" || !change[s.Name.Text] {
+			continue
+		}
+		if !enabled {
+			// Add the key after the opening brace.
+			i := int(s.Pos) + strings.Index(s.RawText, "{") + 1
+			pair := "\n\tdisabled = true"
+			if !strings.HasPrefix(raw[i:], "\n") {
+				pair += "\n"
+			}
+			edits = append(edits, edit{i, i, pair})
+			continue
+		}
+		for _, a := range s.Nodes.Nodes {
+			p, ok := a.(*parse.PairNode)
+			if !ok || p.Key.Text != "disabled" {
+				continue
+			}
+			// Remove the line of the pair.
+			start := strings.LastIndex(raw[:p.Pos], "\n") + 1
+			end := int(p.Val.Pos) + len(p.Val.Quoted)
+			if i := strings.Index(raw[end:], "\n"); i >= 0 {
+				end += i + 1
+			} else {
+				end = len(raw)
+			}
+			edits = append(edits, edit{start, end, ""})
+		}
+	}
+	// Apply the edits from the end, so that positions stay valid.
+	slice.Sort(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	for _, e := range edits {
+		raw = raw[:e.start] + e.text + raw[e.end:]
+	}
+	nc, err := New(c.Name, raw)
+	if err != nil {
+		return "", 0, fmt.Errorf("alerts matching %s: %v", selector, err)
+	}
+	for name := range change {
+		if nc.Alerts[name].Disabled == enabled {
+			if enabled {
+				return "", 0, fmt.Errorf("alert %s is disabled by a macro", name)
+			}
+			return "", 0, fmt.Errorf("could not disable alert %s", name)
+		}
+	}
+	return raw, len(change), nil
+}
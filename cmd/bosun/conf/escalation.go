@@ -0,0 +1,124 @@
+package conf
+
+import (
+	"strings"
+	"time"
+
+	"bosun.org/cmd/bosun/conf/parse"
+	"bosun.org/opentsdb"
+)
+
+// Escalation is a named track of notifications that alerts include with
+// critEscalation or warnEscalation. Each step is sent Timeout after the one
+// before it. An alert may include several escalations, which escalate
+// independently of each other and of its other notifications, even if they
+// share notifications.
+type Escalation struct {
+	Text    string
+	Name    string
+	Steps   []string
+	Timeout time.Duration
+	// Repeat sends the last step again every Timeout instead of ending the
+	// escalation there.
+	Repeat bool `json:",omitempty"`
+}
+
+func (c *Conf) loadEscalation(s *parse.SectionNode) {
+	name := s.Name.Text
+	if _, ok := c.Escalations[name]; ok {
+		c.errorf("duplicate escalation name: %s", name)
+	}
+	e := Escalation{
+		Text: s.RawText,
+		Name: name,
+	}
+	for _, p := range c.getPairs(s, nil, sNormal) {
+		c.at(p.node)
+		v := p.val
+		switch p.key {
+		case "steps":
+			seen := make(map[string]bool)
+			for _, step := range strings.Split(v, ",") {
+				step = strings.TrimSpace(step)
+				if c.Notifications[step] == nil {
+					c.errorf("unknown notification %s", step)
+				}
+				if seen[step] {
+					c.errorf("escalation %s: notification %s is a cycle, use repeat to resend the last step", name, step)
+				}
+				seen[step] = true
+				e.Steps = append(e.Steps, step)
+			}
+		case "timeout":
+			d, err := opentsdb.ParseDuration(v)
+			if err != nil {
+				c.error(err)
+			}
+			if d <= 0 {
+				c.errorf("timeout must be positive")
+			}
+			e.Timeout = time.Duration(d)
+		case "repeat":
+			e.Repeat = true
+		default:
+			c.errorf("unknown key %s", p.key)
+		}
+	}
+	c.at(s)
+	if len(e.Steps) == 0 {
+		c.errorf("escalation %s has no steps", name)
+	}
+	if e.Timeout == 0 && (len(e.Steps) > 1 || e.Repeat) {
+		c.errorf("escalation %s has no timeout", name)
+	}
+	c.Escalations[name] = &e
+}
+
+// includeEscalation adds the first step of the escalation name to ns, the
+// crit or warn notifications of a. The steps are copies of their
+// notifications private to a and the escalation, named escalation/step and
+// linked by Next, so that they are queued separately from the notifications
+// themselves and from the other escalations of a.
+func (c *Conf) includeEscalation(a *Alert, ns *Notifications, name string) {
+	e := c.Escalations[name]
+	if e == nil {
+		c.errorf("unknown escalation %s", name)
+	}
+	first := e.Name + "/" + e.Steps[0]
+	if _, ok := ns.Notifications[first]; ok {
+		c.errorf("duplicate escalation %s", name)
+	}
+	if ns.Notifications == nil {
+		ns.Notifications = make(map[string]*Notification)
+	}
+	// Included by both crit and warn: share the steps.
+	if prev := a.notificationOverrides[first]; prev != nil {
+		ns.Notifications[first] = prev
+		return
+	}
+	if a.notificationOverrides == nil {
+		a.notificationOverrides = make(map[string]*Notification)
+	}
+	steps := make([]*Notification, len(e.Steps))
+	for i, step := range e.Steps {
+		o := *c.Notifications[step]
+		o.Name = e.Name + "/" + step
+		o.Escalation = e.Name
+		o.Timeout = e.Timeout
+		o.NextByStatus = nil
+		o.base = step
+		steps[i] = &o
+		a.notificationOverrides[o.Name] = &o
+	}
+	for i, o := range steps {
+		switch {
+		case i+1 < len(steps):
+			o.Next = steps[i+1]
+		case e.Repeat:
+			o.Next = o
+		default:
+			o.Next = nil
+		}
+	}
+	ns.Notifications[first] = steps[0]
+}
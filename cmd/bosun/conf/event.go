@@ -0,0 +1,313 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	ttemplate "text/template"
+
+	"bosun.org/models"
+	"bosun.org/opentsdb"
+	"bosun.org/slog"
+	"golang.org/x/net/context"
+)
+
+// EventAction is what an event notification asks an incident management API
+// to do with the incident of an alert key.
+type EventAction string
+
+const (
+	// EventTrigger opens or updates the incident. It is sent for abnormal
+	// alert keys.
+	EventTrigger EventAction = "trigger"
+	// EventAcknowledge is sent when the alert key is acknowledged.
+	EventAcknowledge EventAction = "acknowledge"
+	// EventResolve is sent when the alert key goes back to normal, or is
+	// closed, forgotten or purged.
+	EventResolve EventAction = "resolve"
+)
+
+// EventData is the data of the event templates of a notification.
+type EventData struct {
+	Action EventAction
+	// DedupKey is the rendered eventKey, which identifies the incident to
+	// the API. It is empty while eventKey itself is rendered.
+	DedupKey string
+	AlertKey string
+	Alert    string
+	Tags     opentsdb.TagSet
+	Status   string
+	Subject  string
+	Body     string
+	// User and Message are those of the action for acknowledge and
+	// resolve events sent by actions.
+	User, Message string
+}
+
+// EventResponse is the data of the eventSuccess template: the response of
+// the API. JSON is the body decoded as JSON, or nil if it is not.
+type EventResponse struct {
+	StatusCode int
+	Status     string
+	Body       string
+	JSON       interface{}
+}
+
+// EventTemplates are the templates of an event notification, which sends
+// incidents to an incident management API. See EventData.
+type EventTemplates struct {
+	// URL is rendered as the URL of the request.
+	URL    *ttemplate.Template `json:"-"`
+	Method string
+	// Body, if set, is rendered as the body of the request.
+	Body *ttemplate.Template `json:"-"`
+	// Success, if set, is rendered with the EventResponse, and the event is
+	// only delivered if it is true. Otherwise any 2xx response is.
+	Success *ttemplate.Template `json:"-"`
+	// Key, if set, is rendered as the DedupKey. Otherwise it is the alert
+	// key.
+	Key *ttemplate.Template `json:"-"`
+
+	contentType string
+	// url is URL rendered with sampleEventData, checked against the
+	// notification URL policy.
+	url *url.URL
+}
+
+var eventMethods = []string{"POST", "PUT", "PATCH", "GET", "DELETE"}
+
+// sampleEventData is the data the event templates are rendered with when the
+// configuration is loaded, to find templates that fail.
+var sampleEventData = &EventData{
+	Action:   EventTrigger,
+	AlertKey: "alert{host=example}",
+	Alert:    "alert",
+	Tags:     opentsdb.TagSet{"host": "example"},
+	Status:   models.StCritical.String(),
+	Subject:  "subject",
+	Body:     "body",
+}
+
+// loadEvent checks the event templates of n, which has an event key, by
+// rendering them with sampleEventData.
+func (c *Conf) loadEvent(n *Notification) {
+	e := n.Event
+	if e.Method == "" {
+		e.Method = "POST"
+	}
+	valid := false
+	for _, m := range eventMethods {
+		valid = valid || e.Method == m
+	}
+	if !valid {
+		c.errorf("eventMethod must be one of %s, not %s", strings.Join(eventMethods, ", "), e.Method)
+	}
+	if e.Body != nil && e.Method == "GET" {
+		c.errorf("eventBody specified, but eventMethod is GET")
+	}
+	data := *sampleEventData
+	if e.Key != nil {
+		key, err := renderEvent(e.Key, &data)
+		if err != nil {
+			c.errorf("eventKey: %v", err)
+		}
+		data.DedupKey = key
+	} else {
+		data.DedupKey = data.AlertKey
+	}
+	u, err := renderEvent(e.URL, &data)
+	if err != nil {
+		c.errorf("event: %v", err)
+	}
+	if e.url, err = url.Parse(u); err != nil {
+		c.errorf("event: %v", err)
+	}
+	if !e.url.IsAbs() || e.url.Host == "" {
+		c.errorf("event must render an absolute URL, not %s", u)
+	}
+	e.contentType = n.ContentType
+	if e.Body != nil {
+		body, err := renderEvent(e.Body, &data)
+		if err != nil {
+			c.errorf("eventBody: %v", err)
+		}
+		if e.contentType == "" {
+			e.contentType = n.defaultContentType(body, "text/plain")
+		}
+		if e.contentType == "application/json" && !json.Valid([]byte(body)) {
+			c.errorf("eventBody must render JSON, use the json function to quote values: rendered %s", body)
+		}
+	}
+}
+
+func renderEvent(t *ttemplate.Template, data interface{}) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// NotifyEvent sends action for the incident st through the event of n
+// alone, with the user and message of the action causing it.
+func (n *Notification) NotifyEvent(action EventAction, st *models.IncidentState, user, message string, c *Conf) <-chan *DeliveryResult {
+	ni := &NotificationInstance{
+		Notification: n,
+		Conf:         c,
+		AlertKey:     string(st.AlertKey),
+		Status:       st.CurrentStatus,
+		Subject:      st.Subject,
+		Body:         st.Body,
+		Event:        action,
+		User:         user,
+		Message:      message,
+	}
+	results := make(chan *DeliveryResult, 1)
+	go func() {
+		results <- n.deliver("event", ni.AlertKey, func() error {
+			return eventNotifier{}.Send(context.Background(), ni)
+		})
+		close(results)
+	}()
+	return results
+}
+
+type eventNotifier struct{}
+
+// Send sends ni to the API of its notification. Instances that are not about
+// a single alert key, such as unknown group notifications, have no incident
+// and are skipped.
+func (eventNotifier) Send(ctx context.Context, ni *NotificationInstance) error {
+	n := ni.Notification
+	ak, err := models.ParseAlertKey(ni.AlertKey)
+	if err != nil {
+		slog.Infof("notification %s: skipping event for %s, which is not an alert key", n.Name, ni.AlertKey)
+		return nil
+	}
+	return ni.Conf.withBreaker("EVENT "+n.Name, func() error {
+		return n.doEvent(ctx, ni, ak)
+	})
+}
+
+func (n *Notification) doEvent(ctx context.Context, ni *NotificationInstance, ak models.AlertKey) error {
+	e := n.Event
+	data := &EventData{
+		Action:   ni.Event,
+		AlertKey: ni.AlertKey,
+		Alert:    ak.Name(),
+		Tags:     ak.Group(),
+		Subject:  ni.Subject,
+		Body:     ni.Body,
+		User:     ni.User,
+		Message:  ni.Message,
+	}
+	if ni.Status != models.StNone {
+		data.Status = ni.Status.String()
+	}
+	if data.Action == "" {
+		data.Action = EventTrigger
+		if ni.Status == models.StNormal {
+			data.Action = EventResolve
+		}
+	}
+	data.DedupKey = ni.AlertKey
+	if e.Key != nil {
+		key, err := renderEvent(e.Key, data)
+		if err != nil {
+			return fmt.Errorf("notification %s: eventKey failed for alert %s: %v", n.Name, ni.AlertKey, err)
+		}
+		data.DedupKey = key
+	}
+	u, err := renderEvent(e.URL, data)
+	if err != nil {
+		return fmt.Errorf("notification %s: event failed for alert %s: %v", n.Name, ni.AlertKey, err)
+	}
+	// The URL may depend on the tags, so the policy checked at load for
+	// the sample data is checked again.
+	pu, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("notification %s: event URL for alert %s: %v", n.Name, ni.AlertKey, err)
+	}
+	if err := ni.Conf.checkURL(pu); err != nil {
+		err = fmt.Errorf("notification %s: event URL for alert %s %v", n.Name, ni.AlertKey, err)
+		slog.Errorln(err)
+		return err
+	}
+	var body io.Reader
+	if e.Body != nil {
+		b, err := renderEvent(e.Body, data)
+		if err != nil {
+			return fmt.Errorf("notification %s: eventBody failed for alert %s: %v", n.Name, ni.AlertKey, err)
+		}
+		body = strings.NewReader(b)
+	}
+	req, err := http.NewRequest(e.Method, u, body)
+	if err != nil {
+		slog.Error(err)
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", e.contentType)
+	}
+	resp, err := n.do(ctx, req)
+	if err != nil {
+		slog.Error(err)
+		return err
+	}
+	defer resp.Body.Close()
+	if err := n.eventSuccess(resp); err != nil {
+		slog.Errorln(err)
+		return err
+	}
+	slog.Infof("event notification %s successful for alert %s. Response code %d.", data.Action, ni.AlertKey, resp.StatusCode)
+	return nil
+}
+
+// eventSuccess returns a ResponseError unless resp is a success: a 2xx
+// response, or one for which the Success template is true.
+func (n *Notification) eventSuccess(resp *http.Response) error {
+	if n.Event.Success == nil {
+		if resp.StatusCode >= 300 {
+			return newResponseError("event", resp)
+		}
+		return nil
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSuccessBody+1))
+	if err != nil {
+		return err
+	}
+	r := &EventResponse{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       string(b),
+	}
+	if len(b) <= maxSuccessBody {
+		json.Unmarshal(b, &r.JSON)
+	}
+	e := &ResponseError{
+		Method:     "event",
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+	}
+	v, err := renderEvent(n.Event.Success, r)
+	if err != nil {
+		e.Mismatch = fmt.Sprintf("eventSuccess failed: %v", err)
+	} else if ok, err := strconv.ParseBool(v); err != nil {
+		e.Mismatch = fmt.Sprintf("eventSuccess rendered %q, not a boolean", v)
+	} else if !ok {
+		e.Mismatch = "eventSuccess is false"
+	} else {
+		return nil
+	}
+	if len(b) > maxResponseBody {
+		b = append(b[:maxResponseBody], "..."...)
+	}
+	e.Body = string(b)
+	return e
+}
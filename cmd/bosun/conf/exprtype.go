@@ -0,0 +1,45 @@
+package conf
+
+import (
+	"fmt"
+
+	"bosun.org/cmd/bosun/expr"
+	eparse "bosun.org/cmd/bosun/expr/parse"
+	"bosun.org/models"
+)
+
+// CheckNumberExpr returns an error unless e returns a number or a scalar, as
+// alert expressions must. The error names the outermost part of e that
+// returns another type, such as a series that is compared to a threshold
+// without being reduced to a number first.
+func CheckNumberExpr(e *expr.Expr) error {
+	if isNumberType(e.Root.Return()) {
+		return nil
+	}
+	n := nonNumberNode(e.Root)
+	if n.Return() == models.TypeSeriesSet {
+		return fmt.Errorf("expression must return a number, but %s returns a series: reduce it with a function such as avg, last or max", n)
+	}
+	return fmt.Errorf("expression must return a number, but %s returns a %v", n, n.Return())
+}
+
+func isNumberType(t models.FuncType) bool {
+	return t == models.TypeNumberSet || t == models.TypeScalar
+}
+
+// nonNumberNode returns the outermost node under n, which does not return a
+// number, whose type is its own rather than that of an argument: the
+// operand of a comparison or arithmetic that makes it return a series, say.
+func nonNumberNode(n eparse.Node) eparse.Node {
+	switch n := n.(type) {
+	case *eparse.BinaryNode:
+		for _, arg := range n.Args {
+			if !isNumberType(arg.Return()) {
+				return nonNumberNode(arg)
+			}
+		}
+	case *eparse.UnaryNode:
+		return nonNumberNode(n.Arg)
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+package conf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"bosun.org/cmd/bosun/conf/parse"
+	"github.com/bradfitz/slice"
+)
+
+// FormatRawText returns the configuration text in canonical form (see
+// parse.Format). Formatting is checked to be purely cosmetic: the formatted
+// text must parse to the same sections, keys and values, and must load
+// whenever the original does. Otherwise an error is returned and the text
+// should be used as is.
+func FormatRawText(text string) (string, error) {
+	const name = "config"
+	before, err := parse.Parse(name, text)
+	if err != nil {
+		return "", err
+	}
+	formatted, err := parse.Format(name, text)
+	if err != nil {
+		return "", err
+	}
+	after, err := parse.Parse(name, formatted)
+	if err != nil {
+		return "", fmt.Errorf("conf: formatted config does not parse: %v", err)
+	}
+	if !sameNodes(before.Root.Nodes, after.Root.Nodes) {
+		return "", fmt.Errorf("conf: formatting would change the config")
+	}
+	if _, err := New(name, text); err == nil {
+		if _, err := New(name, formatted); err != nil {
+			return "", fmt.Errorf("conf: formatted config does not load: %v", err)
+		}
+	}
+	return formatted, nil
+}
+
+// sameNodes reports whether a and b declare the same pairs and sections in
+// the same order, ignoring the order of adjacent variable declarations.
+func sameNodes(a, b []parse.Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = sortedVars(a), sortedVars(b)
+	for i := range a {
+		switch x := a[i].(type) {
+		case *parse.PairNode:
+			y, ok := b[i].(*parse.PairNode)
+			if !ok || x.Key.Text != y.Key.Text || x.Val.Text != y.Val.Text {
+				return false
+			}
+		case *parse.SectionNode:
+			y, ok := b[i].(*parse.SectionNode)
+			if !ok || x.SectionType.Text != y.SectionType.Text || x.Name.Text != y.Name.Text {
+				return false
+			}
+			if !sameNodes(x.Nodes.Nodes, y.Nodes.Nodes) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// sortedVars returns a copy of nodes with each run of adjacent variable
+// declarations stably sorted by name.
+func sortedVars(nodes []parse.Node) []parse.Node {
+	nodes = append([]parse.Node(nil), nodes...)
+	key := func(n parse.Node) string {
+		if p, ok := n.(*parse.PairNode); ok && strings.HasPrefix(p.Key.Text, "$") {
+			return p.Key.Text
+		}
+		return ""
+	}
+	for i := 0; i < len(nodes); {
+		j := i
+		for j < len(nodes) && key(nodes[j]) != "" {
+			j++
+		}
+		if j == i {
+			i++
+			continue
+		}
+		run := nodes[i:j]
+		sort.Stable(slice.SortInterface(run, func(x, y int) bool { return key(run[x]) < key(run[y]) }))
+		i = j
+	}
+	return nodes
+}
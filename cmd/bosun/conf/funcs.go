@@ -0,0 +1,106 @@
+package conf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"bosun.org/cmd/bosun/expr"
+	eparse "bosun.org/cmd/bosun/expr/parse"
+	"github.com/bradfitz/slice"
+)
+
+// funcBackend is a set of expression functions that is only available when
+// its backend is configured by setting.
+type funcBackend struct {
+	name    string
+	setting string
+	enabled bool
+	funcs   map[string]eparse.Func
+}
+
+func (c *Conf) funcBackends() []funcBackend {
+	return []funcBackend{
+		{"opentsdb", "tsdbHost", c.TSDBHost != "", expr.TSDB},
+		{"graphite", "graphiteHost", c.GraphiteHost != "", expr.Graphite},
+		{"logstash", "logstashElasticHosts", len(c.LogstashElasticHosts) != 0, expr.LogstashElastic},
+		{"elastic", "elasticHosts", len(c.ElasticHosts) != 0, expr.Elastic},
+		{"influx", "influxHost", c.InfluxConfig.URL.Host != "", expr.Influx},
+	}
+}
+
+// FuncInfo describes an expression function for tools such as editors.
+type FuncInfo struct {
+	Name      string
+	Signature string
+	Args      []string
+	Return    string
+	VArgs     bool `json:",omitempty"`
+	MapFunc   bool `json:",omitempty"`
+}
+
+// BackendFuncs lists the expression functions provided by one backend.
+type BackendFuncs struct {
+	Enabled bool
+	Setting string `json:",omitempty"`
+	Funcs   []FuncInfo
+}
+
+// FuncsByBackend returns the expression functions of every backend, keyed by
+// backend name, including those of backends that are not configured. The
+// "builtin" and "bosun" backends are always enabled. Funcs returns the
+// merged set of enabled functions that expressions are parsed with.
+func (c *Conf) FuncsByBackend() map[string]*BackendFuncs {
+	m := map[string]*BackendFuncs{
+		"builtin": {Enabled: true, Funcs: funcInfos(expr.Builtins())},
+		"bosun":   {Enabled: true, Funcs: funcInfos(c.bosunFuncs())},
+	}
+	for _, b := range c.funcBackends() {
+		m[b.name] = &BackendFuncs{
+			Enabled: b.enabled,
+			Setting: b.setting,
+			Funcs:   funcInfos(b.funcs),
+		}
+	}
+	return m
+}
+
+func funcInfos(funcs map[string]eparse.Func) []FuncInfo {
+	infos := make([]FuncInfo, 0, len(funcs))
+	for name, f := range funcs {
+		fi := FuncInfo{
+			Name:    name,
+			Return:  f.Return.String(),
+			VArgs:   f.VArgs,
+			MapFunc: f.MapFunc,
+		}
+		for i, a := range f.Args {
+			arg := a.String()
+			if f.VArgs && i == f.VArgsPos {
+				arg += "..."
+			}
+			fi.Args = append(fi.Args, arg)
+		}
+		fi.Signature = fmt.Sprintf("%s(%s) %s", name, strings.Join(fi.Args, ", "), fi.Return)
+		infos = append(infos, fi)
+	}
+	slice.Sort(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+var nonExistentFuncRE = regexp.MustCompile(`non existent function (\w+)`)
+
+// ExplainExprError adds a hint to an expression parse error caused by a
+// function whose backend is not configured.
+func (c *Conf) ExplainExprError(err error) error {
+	m := nonExistentFuncRE.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+	for _, b := range c.funcBackends() {
+		if _, ok := b.funcs[m[1]]; ok && !b.enabled {
+			return fmt.Errorf("%v: %s is a %s function, but %s is not set", err, m[1], b.name, b.setting)
+		}
+	}
+	return err
+}
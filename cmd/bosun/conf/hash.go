@@ -0,0 +1,91 @@
+package conf
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// AlertHash returns a hash of the definition of the named alert that only
+// changes when the alert does. It covers the alert's keys and values after
+// macro and variable expansion, in any order, the text of its template, and
+// the text of every notification it can send, including next chains, and of
+// the lookups used to pick its notifications. Indentation, trailing
+// whitespace and blank lines in that text are ignored. Nothing else in the
+// configuration, such as global settings or unrelated macros, is included.
+func (c *Conf) AlertHash(name string) (string, error) {
+	a := c.Alerts[name]
+	if a == nil {
+		return "", fmt.Errorf("unknown alert: %s", name)
+	}
+	h := sha1.New()
+	pairs := make([]string, len(a.expanded))
+	for i, p := range a.expanded {
+		pairs[i] = p.key + " = " + p.val
+	}
+	sort.Strings(pairs)
+	fmt.Fprintf(h, "alert %s\n%s\n", name, strings.Join(pairs, "\n"))
+	if a.Template != nil {
+		writeSection(h, "template", a.Template.Name, a.Template.Text)
+	}
+	nots := make(map[string]*Notification)
+	lookups := make(map[string]*Lookup)
+	for _, ns := range []*Notifications{a.CritNotification, a.WarnNotification} {
+		if ns == nil {
+			continue
+		}
+		for _, n := range ns.Notifications {
+			collectNotifications(n, nots)
+		}
+		for key, l := range ns.Lookups {
+			lookups[l.Name] = l
+			for _, e := range l.Entries {
+				for _, n := range strings.Split(e.Values[key], ",") {
+					collectNotifications(c.Notifications[strings.TrimSpace(n)], nots)
+				}
+			}
+		}
+	}
+	var names []string
+	for name := range nots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeSection(h, "notification", name, nots[name].Text)
+	}
+	names = names[:0]
+	for name := range lookups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeSection(h, "lookup", name, lookups[name].Text)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// collectNotifications adds n and every notification it escalates to.
+func collectNotifications(n *Notification, nots map[string]*Notification) {
+	if n == nil || nots[n.Name] != nil {
+		return
+	}
+	nots[n.Name] = n
+	collectNotifications(n.Next, nots)
+	for _, next := range n.NextByStatus {
+		collectNotifications(next, nots)
+	}
+}
+
+// writeSection writes text to w without indentation, trailing whitespace or
+// blank lines.
+func writeSection(w io.Writer, kind, name, text string) {
+	fmt.Fprintf(w, "%s %s\n", kind, name)
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
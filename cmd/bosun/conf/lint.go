@@ -0,0 +1,277 @@
+package conf
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"bosun.org/cmd/bosun/conf/parse"
+	"bosun.org/cmd/bosun/expr"
+	eparse "bosun.org/cmd/bosun/expr/parse"
+	"bosun.org/models"
+)
+
+// Diagnostic is a problem found in a configuration. Errors prevent the
+// configuration from loading; warnings are advisory.
+type Diagnostic struct {
+	Severity string // "error" or "warning"
+	Location string `json:",omitempty"` // name:line:col
+	Message  string
+}
+
+// LintConfig checks the configuration text. If it fails to load, the load
+// error is the only diagnostic. Otherwise the warnings of Lint are returned,
+// and none of them would stop the configuration from being used.
+func LintConfig(name, text string) []Diagnostic {
+	c, err := New(name, text)
+	if err != nil {
+		return []Diagnostic{{Severity: "error", Message: err.Error()}}
+	}
+	return c.Lint()
+}
+
+// Lint returns warnings about parts of the configuration that load but are
+// likely mistakes: alerts without notifications or owners, alerts whose joins
+// are hidden by the global unjoinedOk, notifications and templates that no
+// alert uses, template variables that are never used, and lookup entries that
+// can never match. They are in the order of the sections they refer to.
+func (c *Conf) Lint() []Diagnostic {
+	var diags []Diagnostic
+	warn := func(n parse.Node, format string, args ...interface{}) {
+		location, _ := c.tree.ErrorContext(n)
+		diags = append(diags, Diagnostic{
+			Severity: "warning",
+			Location: location,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+	usedNots := c.usedNotifications()
+	usedTemplates := c.usedTemplates()
+	for _, n := range c.tree.Root.Nodes {
+		s, ok := n.(*parse.SectionNode)
+		if !ok {
+			continue
+		}
+		name := s.Name.Text
+		switch s.SectionType.Text {
+		case "alert":
+			a := c.Alerts[name]
+			if a == nil {
+				break
+			}
+			if !hasNotifications(a.CritNotification) && !hasNotifications(a.WarnNotification) {
+				warn(s, "alert %s has no notifications", name)
+			}
+			if a.Owner == "" && a.OwnerTag == "" {
+				warn(s, "alert %s has no owner", name)
+			}
+			if a.UnjoinedOK && a.unjoinedDefault && (joins(a.Crit) || joins(a.Warn)) {
+				warn(s, "alert %s joins tagged sets, but unjoined groups are ignored by the global unjoinedOk: set unjoinedOk on the alert if that is intended", name)
+			}
+		case "notification":
+			if !usedNots[name] {
+				warn(s, "notification %s is not used by any alert", name)
+			}
+		case "template":
+			if !usedTemplates[name] {
+				warn(s, "template %s is not used by any alert", name)
+			}
+			if t := c.Templates[name]; t != nil {
+				for _, v := range unusedVars(t) {
+					warn(s, "template %s: variable %s is never used", name, v)
+				}
+			}
+		case "lookup":
+			if l := c.Lookups[name]; l != nil {
+				var entries []*parse.SectionNode
+				for _, n := range s.Nodes.Nodes {
+					if e, ok := n.(*parse.SectionNode); ok {
+						entries = append(entries, e)
+					}
+				}
+				shadowed := shadowedEntries(l)
+				for i, e := range l.Entries {
+					if j, ok := shadowed[i]; ok {
+						warn(entries[i], "lookup %s: entry %s can never match, entry %s always matches first", name, e.Name, l.Entries[j].Name)
+					}
+				}
+			}
+		}
+	}
+	return diags
+}
+
+// joins returns whether e has an operation between two sets of which at
+// least one is grouped by tags, whose groups may not join.
+func joins(e *expr.Expr) bool {
+	if e == nil {
+		return false
+	}
+	found := false
+	eparse.Walk(e.Root, func(n eparse.Node) {
+		b, ok := n.(*eparse.BinaryNode)
+		if !ok || b.Args[0].Return() == models.TypeScalar || b.Args[1].Return() == models.TypeScalar {
+			return
+		}
+		for _, arg := range b.Args {
+			if tags, err := arg.Tags(); err == nil && len(tags) > 0 {
+				found = true
+			}
+		}
+	})
+	return found
+}
+
+func hasNotifications(n *Notifications) bool {
+	return n != nil && (len(n.Notifications) > 0 || len(n.Lookups) > 0)
+}
+
+// usedNotifications returns the names of the notifications an alert can
+// send: those of its crit and warn notifications and notification sets, those
+// its notification lookups can return, and every notification they escalate
+// or fall back to.
+func (c *Conf) usedNotifications() map[string]bool {
+	used := make(map[string]bool)
+	var walk func(n *Notification)
+	walk = func(n *Notification) {
+		if n == nil || used[n.Name] {
+			return
+		}
+		used[n.Name] = true
+		if n.base != "" {
+			used[n.base] = true
+		}
+		walk(n.Next)
+		walk(n.OutsideSchedule)
+		for _, next := range n.NextByStatus {
+			walk(next)
+		}
+	}
+	for _, a := range c.Alerts {
+		for _, ns := range []*Notifications{a.CritNotification, a.WarnNotification} {
+			if ns == nil {
+				continue
+			}
+			for _, n := range ns.Notifications {
+				walk(n)
+			}
+			for key, l := range ns.Lookups {
+				for _, e := range l.Entries {
+					nots, _ := c.parseNotifications(e.Values[key])
+					for _, n := range nots {
+						walk(n)
+					}
+				}
+			}
+		}
+	}
+	return used
+}
+
+var templateCallRE = regexp.MustCompile(`{{-?\s*template\s+"([^"]+)"`)
+
+// usedTemplates returns the names of the templates of alerts and of
+// unknownTemplate, and of the templates they include with {{template}}.
+func (c *Conf) usedTemplates() map[string]bool {
+	used := make(map[string]bool)
+	var walk func(t *Template)
+	walk = func(t *Template) {
+		if t == nil || used[t.Name] {
+			return
+		}
+		used[t.Name] = true
+		for _, text := range []string{t.body, t.subject} {
+			for _, m := range templateCallRE.FindAllStringSubmatch(text, -1) {
+				walk(c.Templates[m[1]])
+			}
+		}
+	}
+	walk(c.UnknownTemplate)
+	for _, a := range c.Alerts {
+		walk(a.Template)
+	}
+	return used
+}
+
+// unusedVars returns the variables of t, sorted, that are not referenced by
+// its body, its subject or its other variables.
+func unusedVars(t *Template) []string {
+	used := make(map[string]bool)
+	refs := []string{t.body, t.subject}
+	for k, v := range t.Vars {
+		if strings.HasPrefix(k, "$") {
+			refs = append(refs, v)
+		}
+	}
+	for _, ref := range refs {
+		for _, m := range exRE.FindAllString(ref, -1) {
+			if strings.HasPrefix(m, "${") {
+				m = "$" + m[2:len(m)-1]
+			}
+			used[m] = true
+		}
+	}
+	var unused []string
+	for k := range t.Vars {
+		if strings.HasPrefix(k, "$") && !used[k] {
+			unused = append(unused, k)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+// shadowedEntries maps the index of each entry of l that can never be
+// returned by ExprLookup.Get to the index of an earlier entry that matches
+// every tag set it does and has all of its keys. Entries with ranges are
+// only compared with each other, since Get tries them last.
+func shadowedEntries(l *Lookup) map[int]int {
+	shadowed := make(map[int]int)
+	for i, e := range l.Entries {
+		for j, prev := range l.Entries[:i] {
+			if (len(e.Ranges) > 0) != (len(prev.Ranges) > 0) || !covers(prev, e) {
+				continue
+			}
+			shadowed[i] = j
+			break
+		}
+	}
+	return shadowed
+}
+
+// covers reports whether a matches every tag set that b matches and has a
+// value for every key of b.
+func covers(a, b *Entry) bool {
+	for k := range b.Values {
+		if _, ok := a.Values[k]; !ok {
+			return false
+		}
+	}
+	bg := b.AlertKey.Group()
+	for k, av := range a.AlertKey.Group() {
+		if ar, ok := a.Ranges[k]; ok {
+			br, ok := b.Ranges[k]
+			if !ok || br.Min < ar.Min || br.Max > ar.Max {
+				return false
+			}
+			continue
+		}
+		if ac, ok := a.CIDRs[k]; ok {
+			bc, ok := b.CIDRs[k]
+			if !ok {
+				return false
+			}
+			aones, _ := ac.Mask.Size()
+			bones, _ := bc.Mask.Size()
+			if !ac.Contains(bc.IP) || bones < aones {
+				return false
+			}
+			continue
+		}
+		if av != "*" && av != bg[k] {
+			return false
+		}
+	}
+	return true
+}
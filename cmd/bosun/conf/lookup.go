@@ -1,6 +1,10 @@
 package conf
 
 import (
+	"fmt"
+	"regexp"
+	"strconv"
+
 	"bosun.org/cmd/bosun/search"
 	"bosun.org/models"
 	"bosun.org/opentsdb"
@@ -10,34 +14,101 @@ import (
 type ExprLookup struct {
 	Tags    []string
 	Entries []*ExprEntry
+
+	policy TagPolicy
 }
 
 type ExprEntry struct {
 	AlertKey models.AlertKey
 	Values   map[string]string
+	// Ranges holds the tags of AlertKey whose values are numeric ranges,
+	// written min..max. They match numeric tag values within the range
+	// instead of being matched as globs.
+	Ranges map[string]Range `json:",omitempty"`
+	// CIDRs holds the tags of AlertKey whose values are networks, such as
+	// 10.1.0.0/16. They match IP addresses within the network.
+	CIDRs map[string]CIDR `json:",omitempty"`
+}
+
+// Range is an inclusive numeric range.
+type Range struct {
+	Min, Max float64
+}
+
+// Contains reports whether v is a number within r.
+func (r Range) Contains(v string) bool {
+	f, err := strconv.ParseFloat(v, 64)
+	return err == nil && r.Min <= f && f <= r.Max
+}
+
+var rangeRE = regexp.MustCompile(`^(-?[0-9.]+)\.\.(-?[0-9.]+)$`)
+
+// parseRange parses a lookup tag value of the form min..max. ok is false if s
+// is not a range.
+func parseRange(s string) (r Range, ok bool, err error) {
+	m := rangeRE.FindStringSubmatch(s)
+	if m == nil {
+		return r, false, nil
+	}
+	if r.Min, err = strconv.ParseFloat(m[1], 64); err != nil {
+		return r, true, fmt.Errorf("bad range %s: %v", s, err)
+	}
+	if r.Max, err = strconv.ParseFloat(m[2], 64); err != nil {
+		return r, true, fmt.Errorf("bad range %s: %v", s, err)
+	}
+	if r.Min > r.Max {
+		return r, true, fmt.Errorf("bad range %s: min is greater than max", s)
+	}
+	return r, true, nil
 }
 
+// Get returns the value of key from the first entry that matches tag. Entries
+// without ranges are tried before entries with ranges, each in the order they
+// are declared.
 func (lookup *ExprLookup) Get(key string, tag opentsdb.TagSet) (value string, ok bool) {
-	for _, entry := range lookup.Entries {
-		value, ok = entry.Values[key]
-		if !ok {
-			continue
-		}
-		match := true
-		for ak, av := range entry.AlertKey.Group() {
-			matches, err := search.Match(av, []string{tag[ak]})
+	tag = lookup.policy.NormalizeTagSet(tag)
+	for _, ranges := range []bool{false, true} {
+		for _, entry := range lookup.Entries {
+			if (len(entry.Ranges) > 0) != ranges {
+				continue
+			}
+			value, ok = entry.Values[key]
+			if !ok {
+				continue
+			}
+			match, err := entry.match(tag)
 			if err != nil {
 				return "", false
 			}
-			if len(matches) == 0 {
-				match = false
-				break
+			if match {
+				return
+			}
+		}
+	}
+	return "", false
+}
+
+func (entry *ExprEntry) match(tag opentsdb.TagSet) (bool, error) {
+	for ak, av := range entry.AlertKey.Group() {
+		if r, ok := entry.Ranges[ak]; ok {
+			if !r.Contains(tag[ak]) {
+				return false, nil
 			}
+			continue
 		}
-		if !match {
+		if cidr, ok := entry.CIDRs[ak]; ok {
+			if !cidr.MatchString(tag[ak]) {
+				return false, nil
+			}
 			continue
 		}
-		return
+		matches, err := search.Match(av, []string{tag[ak]})
+		if err != nil {
+			return false, err
+		}
+		if len(matches) == 0 {
+			return false, nil
+		}
 	}
-	return "", false
+	return true, nil
 }
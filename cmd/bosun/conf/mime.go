@@ -0,0 +1,185 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"bosun.org/util"
+	"github.com/jordan-wright/email"
+)
+
+// Transfer encodings of email text.
+const (
+	encodingQuotedPrintable = "quoted-printable"
+	encodingBase64          = "base64"
+)
+
+// emailCharsets are the character sets email text can be sent in, by upper
+// case name, with the highest code point each can represent.
+var emailCharsets = map[string]rune{
+	"UTF-8":      utf8.MaxRune,
+	"ISO-8859-1": 0xff,
+	"US-ASCII":   0x7f,
+}
+
+// parseEmailCharset returns the canonical name of charset v.
+func (c *Conf) parseEmailCharset(v string) string {
+	name := strings.ToUpper(v)
+	if _, ok := emailCharsets[name]; !ok {
+		c.errorf("emailCharset must be UTF-8, ISO-8859-1 or US-ASCII, not %s", v)
+	}
+	return name
+}
+
+func (c *Conf) parseEmailEncoding(v string) string {
+	v = strings.ToLower(v)
+	if v != encodingQuotedPrintable && v != encodingBase64 {
+		c.errorf("emailEncoding must be %s or %s", encodingQuotedPrintable, encodingBase64)
+	}
+	return v
+}
+
+// encodeCharset converts UTF-8 text b to charset. Characters the charset
+// cannot represent are replaced with ?.
+func encodeCharset(b []byte, charset string) []byte {
+	max := emailCharsets[charset]
+	if max == utf8.MaxRune {
+		return b
+	}
+	out := make([]byte, 0, len(b))
+	for _, r := range string(b) {
+		if r > max {
+			r = '?'
+		}
+		out = append(out, byte(r))
+	}
+	return out
+}
+
+// emailBytes returns the raw message of e like e.Bytes, but with its subject
+// and text in charset and the transfer encoding encoding.
+func emailBytes(e *email.Email, charset, encoding string) ([]byte, error) {
+	wordEncoder := mime.QEncoding
+	if encoding == encodingBase64 {
+		wordEncoder = mime.BEncoding
+	}
+	h := make(textproto.MIMEHeader)
+	for k, v := range e.Headers {
+		h[k] = v
+	}
+	set := func(k, v string) {
+		if _, ok := h[k]; !ok && v != "" {
+			h.Set(k, v)
+		}
+	}
+	set("To", strings.Join(e.To, ", "))
+	set("Cc", strings.Join(e.Cc, ", "))
+	set("Subject", wordEncoder.Encode(charset, string(encodeCharset([]byte(e.Subject), charset))))
+	set("From", e.From)
+	set("Date", time.Now().Format(time.RFC1123Z))
+	set("Message-Id", fmt.Sprintf("<%d.%d.%d@%s>", time.Now().UnixNano(), os.Getpid(), rand.Int63(), util.Hostname))
+	set("Mime-Version", "1.0")
+
+	buf := new(bytes.Buffer)
+	mixed := multipart.NewWriter(buf)
+	h.Set("Content-Type", "multipart/mixed; boundary="+mixed.Boundary())
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			if k != "Content-Type" && k != "Subject" {
+				v = mime.QEncoding.Encode("UTF-8", v)
+			}
+			fmt.Fprintf(buf, "%s: %s\r\n", k, v)
+		}
+	}
+	buf.WriteString("\r\n")
+	if len(e.Text) > 0 || len(e.HTML) > 0 {
+		alt := new(bytes.Buffer)
+		altWriter := multipart.NewWriter(alt)
+		for _, part := range []struct {
+			contentType string
+			text        []byte
+		}{
+			{"text/plain", e.Text},
+			{"text/html", e.HTML},
+		} {
+			if len(part.text) == 0 {
+				continue
+			}
+			w, err := altWriter.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {part.contentType + "; charset=" + charset},
+				"Content-Transfer-Encoding": {encoding},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if err := writeEncoded(w, encodeCharset(part.text, charset), encoding); err != nil {
+				return nil, err
+			}
+		}
+		if err := altWriter.Close(); err != nil {
+			return nil, err
+		}
+		w, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"multipart/alternative; boundary=" + altWriter.Boundary()},
+		})
+		if err != nil {
+			return nil, err
+		}
+		w.Write(alt.Bytes())
+	}
+	for _, a := range e.Attachments {
+		w, err := mixed.CreatePart(a.Header)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeEncoded(w, a.Content, encodingBase64); err != nil {
+			return nil, err
+		}
+	}
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeEncoded writes b to w in the transfer encoding encoding. Base64 is
+// wrapped at 76 characters.
+func writeEncoded(w io.Writer, b []byte, encoding string) error {
+	if encoding == encodingBase64 {
+		const width = 76
+		s := base64.StdEncoding.EncodeToString(b)
+		for len(s) > 0 {
+			n := width
+			if len(s) < n {
+				n = len(s)
+			}
+			if _, err := io.WriteString(w, s[:n]+"\r\n"); err != nil {
+				return err
+			}
+			s = s[n:]
+		}
+		return nil
+	}
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write(b); err != nil {
+		return err
+	}
+	return qp.Close()
+}
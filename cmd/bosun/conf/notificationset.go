@@ -0,0 +1,161 @@
+package conf
+
+import (
+	"time"
+
+	"bosun.org/cmd/bosun/conf/parse"
+	"bosun.org/opentsdb"
+)
+
+// NotificationSet is a named group of notifications that alerts include with
+// critNotificationSet or warnNotificationSet, so that the same escalation
+// policy need not be repeated in each alert.
+type NotificationSet struct {
+	Text string
+	Name string
+	*Notifications
+}
+
+func (c *Conf) loadNotificationSet(s *parse.SectionNode) {
+	name := s.Name.Text
+	if _, ok := c.NotificationSets[name]; ok {
+		c.errorf("duplicate notificationSet name: %s", name)
+	}
+	set := NotificationSet{
+		Text: s.RawText,
+		Name: name,
+		Notifications: &Notifications{
+			Notifications: make(map[string]*Notification),
+		},
+	}
+	for _, p := range c.getPairs(s, nil, sNormal) {
+		c.at(p.node)
+		v := p.val
+		switch p.key {
+		case "notification":
+			ns, err := c.parseNotifications(v)
+			if err != nil {
+				c.error(err)
+			}
+			for k, n := range ns {
+				set.Notifications.Notifications[k] = n
+			}
+		case "mode":
+			set.FirstSuccess = c.parseNotificationMode(v)
+		default:
+			c.errorf("unknown key %s", p.key)
+		}
+	}
+	c.at(s)
+	if len(set.Notifications.Notifications) == 0 {
+		c.errorf("notificationSet %s has no notifications", name)
+	}
+	c.NotificationSets[name] = &set
+}
+
+// notificationSetRef is an alert's inclusion of a notification set, with the
+// notification fields it overrides for that alert.
+type notificationSetRef struct {
+	set     *NotificationSet
+	timeout *time.Duration
+	next    *Notification
+}
+
+func (c *Conf) parseNotificationSetRef(ref *notificationSetRef, key, v string) {
+	switch key {
+	case "Set":
+		ref.set = c.NotificationSets[v]
+		if ref.set == nil {
+			c.errorf("unknown notificationSet %s", v)
+		}
+	case "Timeout":
+		d, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		if d < 0 {
+			c.errorf("timeout must not be negative")
+		}
+		t := time.Duration(d)
+		ref.timeout = &t
+	case "Next":
+		ref.next = c.Notifications[v]
+		if ref.next == nil {
+			c.errorf("unknown notification %s", v)
+		}
+	}
+}
+
+// includeNotificationSets adds the notifications of the sets crit and warn
+// refer to to the crit and warn notifications of a. Notifications whose
+// timeout or next are overridden are replaced by copies private to a, which
+// must be the same for crit and warn.
+func (c *Conf) includeNotificationSets(a *Alert, crit, warn *notificationSetRef) {
+	c.includeNotificationSet(a, "crit", crit, a.CritNotification)
+	c.includeNotificationSet(a, "warn", warn, a.WarnNotification)
+	for name, o := range a.notificationOverrides {
+		for _, ns := range []*Notifications{a.CritNotification, a.WarnNotification} {
+			if n := ns.Notifications[name]; n != nil && n != o {
+				c.errorf("notification %s must have the same overrides for crit and warn", name)
+			}
+		}
+	}
+}
+
+func (c *Conf) includeNotificationSet(a *Alert, kind string, ref *notificationSetRef, ns *Notifications) {
+	if ref.set == nil {
+		if ref.timeout != nil || ref.next != nil {
+			c.errorf("%[1]sNotificationTimeout and %[1]sNotificationNext require %[1]sNotificationSet", kind)
+		}
+		return
+	}
+	if ns.Notifications == nil {
+		ns.Notifications = make(map[string]*Notification)
+	}
+	if ref.set.FirstSuccess {
+		ns.FirstSuccess = true
+	}
+	for name, n := range ref.set.Notifications.Notifications {
+		if ref.timeout == nil && ref.next == nil {
+			ns.Notifications[name] = n
+			continue
+		}
+		o := *n
+		if ref.timeout != nil {
+			o.Timeout = *ref.timeout
+		}
+		if ref.next != nil {
+			o.Next = ref.next
+			o.NextByStatus = nil
+		}
+		// Keep notifications that repeat themselves on the alert's copy.
+		if o.Next == n {
+			o.Next = &o
+		}
+		if prev := a.notificationOverrides[name]; prev != nil {
+			// Included by crit and warn: share the copy if they agree.
+			if prev.Timeout == o.Timeout && (prev.Next == o.Next || prev.Next == prev && o.Next == &o) {
+				ns.Notifications[name] = prev
+				continue
+			}
+			c.errorf("notification %s must have the same overrides for crit and warn", name)
+		}
+		if a.notificationOverrides == nil {
+			a.notificationOverrides = make(map[string]*Notification)
+		}
+		a.notificationOverrides[name] = &o
+		ns.Notifications[name] = &o
+	}
+}
+
+// AlertNotification returns the notification name as it is sent for alert:
+// the alert's own copy if it overrides the notification through a
+// notification set, otherwise the notification itself.
+func (c *Conf) AlertNotification(alert, name string) *Notification {
+	if a := c.Alerts[alert]; a != nil {
+		if n := a.notificationOverrides[name]; n != nil {
+			return n
+		}
+	}
+	return c.Notifications[name]
+}
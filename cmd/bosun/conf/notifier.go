@@ -0,0 +1,201 @@
+package conf
+
+import (
+	"fmt"
+	"sync"
+
+	"bosun.org/models"
+	"golang.org/x/net/context"
+)
+
+// NotificationInstance is one delivery of a notification about an alert key.
+type NotificationInstance struct {
+	Notification *Notification
+	Conf         *Conf
+	// AlertKey is the alert key notified about, or a description of the
+	// notification for those about several, such as "unknown_treshold".
+	AlertKey string
+	// Status is the current status of the alert key, if known.
+	Status                  models.Status
+	Subject, Body           string
+	EmailSubject, EmailBody []byte
+	Attachments             []*models.Attachment
+	// Event is the action of event notifications. If empty, it is resolve
+	// for normal alert keys and trigger otherwise.
+	Event EventAction
+	// User and Message are those of the action an event is sent for.
+	User, Message string
+
+	cache *BodyCache
+}
+
+// Payload returns the subject or, if the notification uses its body, the
+// body of the instance.
+func (ni *NotificationInstance) Payload() []byte {
+	return ni.Notification.GetPayload(ni.Subject, ni.Body)
+}
+
+// Notifier delivers notifications through one channel, such as email. Send
+// should give up once ctx is done.
+type Notifier interface {
+	Send(ctx context.Context, ni *NotificationInstance) error
+}
+
+// NotifierFactory returns the Notifier of notification n for the value of
+// the key it was registered for, or an error if the value is invalid. It is
+// called while the configuration is loaded, so n may be incomplete.
+type NotifierFactory func(n *Notification, value string) (Notifier, error)
+
+var (
+	notifierMu        sync.RWMutex
+	notifierFactories = make(map[string]NotifierFactory)
+)
+
+// builtinChannels are the channels of the built-in notifiers, which may not
+// be registered.
+var builtinChannels = []string{"email", "post", "get", "sns", "teams", "event", "print", "syslog"}
+
+// RegisterNotifier makes the notification key key deliver through the
+// Notifier f returns for it, for notifiers built into a deployment. The key
+// is also the channel of its DeliveryResults. It must not be a key
+// notifications already have. RegisterNotifier should be called from an
+// init function, and panics if key is registered twice.
+func RegisterNotifier(key string, f NotifierFactory) {
+	notifierMu.Lock()
+	defer notifierMu.Unlock()
+	for _, ch := range builtinChannels {
+		if key == ch {
+			panic("conf: RegisterNotifier of built-in channel " + key)
+		}
+	}
+	if _, dup := notifierFactories[key]; dup {
+		panic("conf: RegisterNotifier called twice for " + key)
+	}
+	notifierFactories[key] = f
+}
+
+func notifierFactory(key string) NotifierFactory {
+	notifierMu.RLock()
+	defer notifierMu.RUnlock()
+	return notifierFactories[key]
+}
+
+// channelNotifier is a notifier and the channel it delivers through.
+type channelNotifier struct {
+	channel string
+	Notifier
+}
+
+// loadNotifier adds the notifier registered for key to n, and returns
+// whether there is one.
+func (c *Conf) loadNotifier(n *Notification, key, v string) bool {
+	f := notifierFactory(key)
+	if f == nil {
+		return false
+	}
+	notifier, err := f(n, v)
+	if err != nil {
+		c.errorf("%s: %v", key, err)
+	}
+	n.notifiers = append(n.notifiers, channelNotifier{key, notifier})
+	return true
+}
+
+// Notifiers returns the channels n delivers through, by name: those of its
+// built-in settings, in a fixed order, then those registered with
+// RegisterNotifier, in the order of their keys.
+func (n *Notification) Notifiers() []string {
+	var channels []string
+	for _, cn := range n.channelNotifiers() {
+		channels = append(channels, cn.channel)
+	}
+	return channels
+}
+
+func (n *Notification) channelNotifiers() []channelNotifier {
+	var ns []channelNotifier
+	if len(n.Email) > 0 {
+		ns = append(ns, channelNotifier{"email", emailNotifier{}})
+	}
+	if n.Post != nil {
+		ns = append(ns, channelNotifier{"post", postNotifier{}})
+	}
+	if n.Get != nil {
+		ns = append(ns, channelNotifier{"get", getNotifier{}})
+	}
+	if n.SNSTopic != "" {
+		ns = append(ns, channelNotifier{"sns", snsNotifier{}})
+	}
+	if n.Teams != nil {
+		ns = append(ns, channelNotifier{"teams", teamsNotifier{}})
+	}
+	if n.Event != nil {
+		ns = append(ns, channelNotifier{"event", eventNotifier{}})
+	}
+	if n.Print {
+		ns = append(ns, channelNotifier{"print", printNotifier{}})
+	}
+	if n.Syslog != nil {
+		ns = append(ns, channelNotifier{"syslog", syslogNotifier{}})
+	}
+	return append(ns, n.notifiers...)
+}
+
+type emailNotifier struct{}
+
+func (emailNotifier) Send(ctx context.Context, ni *NotificationInstance) error {
+	return ni.Notification.doEmail(ctx, ni.emailSubject(), ni.LimitBody("email", ni.EmailBody), ni.Conf, ni.AlertKey, ni.Attachments...)
+}
+
+type postNotifier struct{}
+
+func (postNotifier) Send(ctx context.Context, ni *NotificationInstance) error {
+	n := ni.Notification
+	return ni.Conf.withBreaker(breakerTarget("POST", n.Post), func() error {
+		return n.doPost(ctx, ni.cache, ni.Payload(), ni.AlertKey, ni.Status)
+	})
+}
+
+type getNotifier struct{}
+
+func (getNotifier) Send(ctx context.Context, ni *NotificationInstance) error {
+	n := ni.Notification
+	return ni.Conf.withBreaker(breakerTarget("GET", n.Get), func() error {
+		return n.doGet(ctx, ni.AlertKey)
+	})
+}
+
+type snsNotifier struct{}
+
+func (snsNotifier) Send(ctx context.Context, ni *NotificationInstance) error {
+	n := ni.Notification
+	return ni.Conf.withBreaker("SNS "+n.SNSTopic, func() error {
+		return n.doSNS(ctx, ni.cache, ni.Payload(), ni.AlertKey, ni.Status)
+	})
+}
+
+type teamsNotifier struct{}
+
+func (teamsNotifier) Send(ctx context.Context, ni *NotificationInstance) error {
+	n := ni.Notification
+	return ni.Conf.withBreaker(breakerTarget("POST", n.Teams), func() error {
+		return n.doTeams(ctx, ni)
+	})
+}
+
+type syslogNotifier struct{}
+
+func (syslogNotifier) Send(ctx context.Context, ni *NotificationInstance) error {
+	return ni.Notification.doSyslog(ni)
+}
+
+type printNotifier struct{}
+
+func (printNotifier) Send(ctx context.Context, ni *NotificationInstance) error {
+	payload := ni.Subject
+	if ni.Notification.UseBody {
+		payload = fmt.Sprintf("Subject: %s, Body: %s", ni.Subject, ni.Body)
+	}
+	ni.Notification.DoPrint(payload)
+	return nil
+}
@@ -4,10 +4,15 @@ import (
 	"bytes"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/mail"
 	"net/smtp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"bosun.org/collect"
 	"bosun.org/metadata"
@@ -15,6 +20,7 @@ import (
 	"bosun.org/slog"
 	"bosun.org/util"
 	"github.com/jordan-wright/email"
+	"golang.org/x/net/context"
 )
 
 func init() {
@@ -26,23 +32,84 @@ func init() {
 		"The number of email notifications that Bosun failed to send.")
 }
 
-func (n *Notification) Notify(subject, body string, emailsubject, emailbody []byte, c *Conf, ak string, attachments ...*models.Attachment) {
-	if len(n.Email) > 0 {
-		go n.DoEmail(emailsubject, emailbody, c, ak, attachments...)
+// Notify sends the notification through each of its configured channels
+// concurrently. A DeliveryResult for every channel is recorded (see
+// RecentDeliveries) and sent on the returned channel, which is closed once all
+// deliveries have finished. Callers that don't care about outcomes may ignore
+// it.
+func (n *Notification) Notify(subject, body string, emailsubject, emailbody []byte, c *Conf, ak string, attachments ...*models.Attachment) <-chan *DeliveryResult {
+	return n.NotifyStatus(models.StNone, subject, body, emailsubject, emailbody, c, ak, attachments...)
+}
+
+// NotifyStatus is like Notify for a notification about an alert key whose
+// current status is status, which is passed on to channels that can use it.
+func (n *Notification) NotifyStatus(status models.Status, subject, body string, emailsubject, emailbody []byte, c *Conf, ak string, attachments ...*models.Attachment) <-chan *DeliveryResult {
+	return n.NotifyCached(context.Background(), nil, status, subject, body, emailsubject, emailbody, c, ak, attachments...)
+}
+
+// NotifyCached is like NotifyStatus, but renders the post and SNS body
+// through cache, which may be shared by the notifications of one dispatch,
+// and gives up on the deliveries once ctx is done.
+func (n *Notification) NotifyCached(ctx context.Context, cache *BodyCache, status models.Status, subject, body string, emailsubject, emailbody []byte, c *Conf, ak string, attachments ...*models.Attachment) <-chan *DeliveryResult {
+	return n.Send(ctx, &NotificationInstance{
+		Notification: n,
+		Conf:         c,
+		AlertKey:     ak,
+		Status:       status,
+		Subject:      subject,
+		Body:         body,
+		EmailSubject: emailsubject,
+		EmailBody:    emailbody,
+		Attachments:  attachments,
+		cache:        cache,
+	})
+}
+
+// Send delivers ni through each of the notifiers of n concurrently, as Notify
+// does.
+func (n *Notification) Send(ctx context.Context, ni *NotificationInstance) <-chan *DeliveryResult {
+	notifiers := n.channelNotifiers()
+	results := make(chan *DeliveryResult, len(notifiers))
+	var wg sync.WaitGroup
+	for _, cn := range notifiers {
+		wg.Add(1)
+		go func(cn channelNotifier) {
+			defer wg.Done()
+			results <- n.deliver(cn.channel, ni.AlertKey, func() error {
+				return cn.Send(ctx, ni)
+			})
+		}(cn)
 	}
-	if n.Post != nil {
-		go n.DoPost(n.GetPayload(subject, body), ak)
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// Allows returns whether n is sent for st: whether its If, rendered with st
+// as ".", is true. Output that is empty after trimming spaces is false, and
+// otherwise it must be a boolean as accepted by strconv.ParseBool, such as
+// true, false, 1 or 0. An If that fails or renders anything else allows the
+// notification, so that a broken predicate never loses a page, and the error
+// is returned.
+func (n *Notification) Allows(st *models.IncidentState) (bool, error) {
+	if n.If == nil {
+		return true, nil
 	}
-	if n.Get != nil {
-		go n.DoGet(ak)
+	buf := new(bytes.Buffer)
+	if err := n.If.Execute(buf, st); err != nil {
+		return true, err
 	}
-	if n.Print {
-		if n.UseBody {
-			go n.DoPrint("Subject: " + subject + ", Body: " + body)
-		} else {
-			go n.DoPrint(subject)
-		}
+	v := strings.TrimSpace(buf.String())
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return true, fmt.Errorf("if rendered %q, not a boolean", v)
 	}
+	return b, nil
 }
 
 func (n *Notification) GetPayload(subject, body string) (payload []byte) {
@@ -57,46 +124,165 @@ func (n *Notification) DoPrint(payload string) {
 	slog.Infoln(payload)
 }
 
-func (n *Notification) DoPost(payload []byte, ak string) {
-	if n.Body != nil {
+// jsonWebhookHosts are the hosts of webhook services that only accept JSON.
+var jsonWebhookHosts = []string{
+	"hooks.slack.com",
+	"events.pagerduty.com",
+	"api.opsgenie.com",
+	"outlook.office.com",
+}
+
+// defaultContentType returns the Content-Type for a notification without an
+// explicit contentType: JSON if body is a JSON object or array or the
+// notification posts to a known JSON webhook service, and def otherwise.
+func (n *Notification) defaultContentType(body, def string) string {
+	if b := strings.TrimSpace(body); strings.HasPrefix(b, "{") && !strings.HasPrefix(b, "{{") || strings.HasPrefix(b, "[") {
+		return "application/json"
+	}
+	if n.Post != nil {
+		for _, h := range jsonWebhookHosts {
+			if n.Post.Host == h {
+				return "application/json"
+			}
+		}
+	}
+	return def
+}
+
+// BodyErrorPolicy is what a notification posts when its body template fails
+// to execute.
+type BodyErrorPolicy string
+
+const (
+	// BodyErrorDrop posts nothing and fails the delivery.
+	BodyErrorDrop BodyErrorPolicy = "drop"
+	// BodyErrorFallback posts a plain text message with the template error
+	// and the unrendered payload. It is the default.
+	BodyErrorFallback BodyErrorPolicy = "fallback"
+	// BodyErrorDegraded posts the unrendered payload as if the notification
+	// had no body.
+	BodyErrorDegraded BodyErrorPolicy = "degraded"
+)
+
+// executeBody returns payload executed through the notification's body
+// template, or as a Slack message with its slackBlocks. rendered is false if
+// there is no template, or if it failed and the BodyError policy replaced its
+// output. The template is executed through cache, which may be nil. status is
+// the status of ak, or StNone if it has none.
+func (n *Notification) executeBody(cache *BodyCache, payload []byte, ak string, status models.Status) (out []byte, rendered bool, err error) {
+	if n.SlackBlocks != nil {
+		return n.executeSlackBlocks(payload, ak, status)
+	}
+	return n.executeBodyTemplate(cache, payload, ak)
+}
+
+// executeBodyTemplate is executeBody without slackBlocks: payload executed
+// through the body template alone.
+func (n *Notification) executeBodyTemplate(cache *BodyCache, payload []byte, ak string) (out []byte, rendered bool, err error) {
+	if n.Body == nil {
+		return payload, false, nil
+	}
+	out, err = cache.render(n, payload, func() ([]byte, error) {
 		buf := new(bytes.Buffer)
-		if err := n.Body.Execute(buf, string(payload)); err != nil {
-			slog.Errorln(err)
-			return
+		err := n.Body.Execute(buf, string(payload))
+		return buf.Bytes(), err
+	})
+	if err != nil {
+		slog.Errorf("notification %s: body template failed for alert %s: %v", n.Name, ak, err)
+		switch n.BodyError {
+		case BodyErrorDrop:
+			return nil, false, err
+		case BodyErrorDegraded:
+			return payload, false, nil
 		}
-		payload = buf.Bytes()
+		return []byte(fmt.Sprintf("bosun: body template of notification %s failed for alert %s: %v\n\n%s", n.Name, ak, err, payload)), false, nil
+	}
+	return out, true, nil
+}
+
+func (n *Notification) DoPost(payload []byte, ak string) error {
+	return n.doPost(context.Background(), nil, payload, ak, models.StNone)
+}
+
+func (n *Notification) doPost(ctx context.Context, cache *BodyCache, payload []byte, ak string, status models.Status) error {
+	payload, rendered, err := n.limitBody("post", ak, payload, func(payload []byte) ([]byte, bool, error) {
+		return n.executeBody(cache, payload, ak, status)
+	})
+	if err != nil {
+		return err
+	}
+	contentType := n.ContentType
+	version := 0
+	if rendered {
+		version = n.PayloadVersion
+	} else if n.Body != nil && n.BodyError != BodyErrorDegraded {
+		contentType = "text/plain"
+	}
+	req, err := http.NewRequest("POST", n.Post.String(), bytes.NewBuffer(payload))
+	if err != nil {
+		slog.Error(err)
+		return err
 	}
-	resp, err := http.Post(n.Post.String(), n.ContentType, bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", contentType)
+	if version != 0 {
+		req.Header.Set(PayloadVersionHeader, strconv.Itoa(version))
+	}
+	resp, err := n.do(ctx, req)
 	if resp != nil && resp.Body != nil {
 		defer resp.Body.Close()
 	}
 	if err != nil {
 		slog.Error(err)
-		return
+		return err
 	}
 	if resp.StatusCode >= 300 {
-		slog.Errorln("bad response on notification post:", resp.Status)
-	} else {
-		slog.Infof("post notification successful for alert %s. Response code %d.", ak, resp.StatusCode)
+		err := newResponseError("post", resp)
+		slog.Errorln(err)
+		return err
 	}
+	if err := n.checkSuccess("post", resp); err != nil {
+		slog.Errorln(err)
+		return err
+	}
+	slog.Infof("post notification successful for alert %s. Response code %d.", ak, resp.StatusCode)
+	return nil
+}
+
+func (n *Notification) DoGet(ak string) error {
+	return n.doGet(context.Background(), ak)
 }
 
-func (n *Notification) DoGet(ak string) {
-	resp, err := http.Get(n.Get.String())
+func (n *Notification) doGet(ctx context.Context, ak string) error {
+	req, err := http.NewRequest("GET", n.Get.String(), nil)
 	if err != nil {
 		slog.Error(err)
-		return
+		return err
 	}
+	resp, err := n.do(ctx, req)
+	if err != nil {
+		slog.Error(err)
+		return err
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode >= 300 {
-		slog.Error("bad response on notification get:", resp.Status)
-	} else {
-		slog.Infof("get notification successful for alert %s. Response code %d.", ak, resp.StatusCode)
+		err := newResponseError("get", resp)
+		slog.Errorln(err)
+		return err
 	}
+	slog.Infof("get notification successful for alert %s. Response code %d.", ak, resp.StatusCode)
+	return nil
+}
+
+func (n *Notification) DoEmail(subject, body []byte, c *Conf, ak string, attachments ...*models.Attachment) error {
+	return n.doEmail(context.Background(), subject, body, c, ak, attachments...)
 }
 
-func (n *Notification) DoEmail(subject, body []byte, c *Conf, ak string, attachments ...*models.Attachment) {
+func (n *Notification) doEmail(ctx context.Context, subject, body []byte, c *Conf, ak string, attachments ...*models.Attachment) error {
 	e := email.NewEmail()
 	e.From = c.EmailFrom
+	if n.From != nil {
+		e.From = n.From.String()
+	}
 	for _, a := range n.Email {
 		e.To = append(e.To, a.Address)
 	}
@@ -106,13 +292,14 @@ func (n *Notification) DoEmail(subject, body []byte, c *Conf, ak string, attachm
 		e.Attach(bytes.NewBuffer(a.Data), a.Filename, a.ContentType)
 	}
 	e.Headers.Add("X-Bosun-Server", util.Hostname)
-	if err := Send(e, c.SMTPHost, c.SMTPUsername, c.SMTPPassword); err != nil {
+	if err := c.sendEmail(ctx, e, n.EmailCharset, n.EmailEncoding); err != nil {
 		collect.Add("email.sent_failed", nil, 1)
 		slog.Errorf("failed to send alert %v to %v %v\n", ak, e.To, err)
-		return
+		return err
 	}
 	collect.Add("email.sent", nil, 1)
 	slog.Infof("relayed alert %v to %v sucessfully. Subject: %d bytes. Body: %d bytes.", ak, e.To, len(subject), len(body))
+	return nil
 }
 
 // Send an email using the given host and SMTP auth (optional), returns any
@@ -120,22 +307,43 @@ func (n *Notification) DoEmail(subject, body []byte, c *Conf, ak string, attachm
 // fields and calls the smtp.SendMail function using the Email.Bytes() output as
 // the message.
 func Send(e *email.Email, addr, username, password string) error {
+	from, to, raw, err := emailMessage(e, "", "")
+	if err != nil {
+		return err
+	}
+	return SendMail(addr, username, password, from, to, raw)
+}
+
+// emailMessage returns the envelope sender, the merged To, Cc and Bcc
+// recipients, and the raw message of e. Its text is in charset with the
+// transfer encoding encoding, or UTF-8 and quoted-printable if both are empty.
+func emailMessage(e *email.Email, charset, encoding string) (from string, to []string, raw []byte, err error) {
 	// Merge the To, Cc, and Bcc fields
-	to := make([]string, 0, len(e.To)+len(e.Cc)+len(e.Bcc))
+	to = make([]string, 0, len(e.To)+len(e.Cc)+len(e.Bcc))
 	to = append(append(append(to, e.To...), e.Cc...), e.Bcc...)
 	// Check to make sure there is at least one recipient and one "From" address
 	if e.From == "" || len(to) == 0 {
-		return errors.New("Must specify at least one From address and one To address")
+		return "", nil, nil, errors.New("Must specify at least one From address and one To address")
 	}
-	from, err := mail.ParseAddress(e.From)
+	addr, err := mail.ParseAddress(e.From)
 	if err != nil {
-		return err
+		return "", nil, nil, err
+	}
+	if charset == "" && encoding == "" {
+		raw, err = e.Bytes()
+	} else {
+		if charset == "" {
+			charset = "UTF-8"
+		}
+		if encoding == "" {
+			encoding = encodingQuotedPrintable
+		}
+		raw, err = emailBytes(e, charset, encoding)
 	}
-	raw, err := e.Bytes()
 	if err != nil {
-		return err
+		return "", nil, nil, err
 	}
-	return SendMail(addr, username, password, from.Address, to, raw)
+	return addr.Address, to, raw, nil
 }
 
 // SendMail connects to the server at addr, switches to TLS if
@@ -143,17 +351,46 @@ func Send(e *email.Email, addr, username, password string) error {
 // and then sends an email from address from, to addresses to, with
 // message msg.
 func SendMail(addr, username, password string, from string, to []string, msg []byte) error {
-	c, err := smtp.Dial(addr)
+	return sendMail(time.Time{}, addr, username, password, from, to, msg)
+}
+
+// sendMail is SendMail with a deadline for the whole exchange with the
+// server. A zero deadline means none.
+func sendMail(deadline time.Time, addr, username, password string, from string, to []string, msg []byte) error {
+	c, _, err := dialSMTP(addr, username, password, deadline)
 	if err != nil {
 		return err
 	}
 	defer c.Close()
-	if err = c.Hello("localhost"); err != nil {
+	if err := sendSMTP(c, from, to, msg); err != nil {
 		return err
 	}
+	return c.Quit()
+}
+
+// dialSMTP connects to the server at addr, switches to TLS if possible, and
+// authenticates if a username or password is given. It returns the client
+// and its connection, which has deadline as its deadline.
+func dialSMTP(addr, username, password string, deadline time.Time) (*smtp.Client, net.Conn, error) {
+	conn, err := (&net.Dialer{Deadline: deadline}).Dial("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(deadline)
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err = c.Hello("localhost"); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
 	if ok, _ := c.Extension("STARTTLS"); ok {
 		if err = c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
-			return err
+			c.Close()
+			return nil, nil, err
 		}
 		if len(username) > 0 || len(password) > 0 {
 			hostWithoutPort := strings.Split(addr, ":")[0]
@@ -161,11 +398,16 @@ func SendMail(addr, username, password string, from string, to []string, msg []b
 			c.Auth(auth)
 		}
 	}
-	if err = c.Mail(from); err != nil {
+	return c, conn, nil
+}
+
+// sendSMTP sends one message over the connected client c.
+func sendSMTP(c *smtp.Client, from string, to []string, msg []byte) error {
+	if err := c.Mail(from); err != nil {
 		return err
 	}
 	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
+		if err := c.Rcpt(addr); err != nil {
 			return err
 		}
 	}
@@ -177,9 +419,5 @@ func SendMail(addr, username, password string, from string, to []string, msg []b
 	if err != nil {
 		return err
 	}
-	err = w.Close()
-	if err != nil {
-		return err
-	}
-	return c.Quit()
+	return w.Close()
 }
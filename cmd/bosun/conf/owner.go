@@ -0,0 +1,51 @@
+package conf
+
+import (
+	"sort"
+)
+
+// isTeam returns whether owner may own alerts: any owner may if no teams are
+// declared.
+func (c *Conf) isTeam(owner string) bool {
+	if len(c.Teams) == 0 {
+		return true
+	}
+	for _, t := range c.Teams {
+		if t == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// routeToOwner includes the notificationSet named after the owner of a, if
+// there is one, for a's crit and warn when a has no notifications of its own.
+func (c *Conf) routeToOwner(a *Alert) {
+	if a.Owner == "" || hasNotifications(a.CritNotification) || hasNotifications(a.WarnNotification) {
+		return
+	}
+	set := c.NotificationSets[a.Owner]
+	if set == nil {
+		return
+	}
+	ref := &notificationSetRef{set: set}
+	if a.Crit != nil {
+		c.includeNotificationSet(a, "crit", ref, a.CritNotification)
+	}
+	if a.Warn != nil {
+		c.includeNotificationSet(a, "warn", ref, a.WarnNotification)
+	}
+}
+
+// AlertsByOwner returns the sorted names of the alerts of each owner. Alerts
+// without an owner are under "".
+func (c *Conf) AlertsByOwner() map[string][]string {
+	owners := make(map[string][]string)
+	for name, a := range c.Alerts {
+		owners[a.Owner] = append(owners[a.Owner], name)
+	}
+	for _, names := range owners {
+		sort.Strings(names)
+	}
+	return owners
+}
@@ -0,0 +1,181 @@
+package parse
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Format returns text in canonical form: one tab of indentation per section
+// level, "key = value" pairs, at most one blank line between entries, and
+// runs of adjacent variable declarations sorted by name. Comments are kept.
+// Values are never modified. A run of variables is only sorted if none of
+// them refers to another variable in the same run, since variables are
+// expanded in declaration order.
+func Format(name, text string) (string, error) {
+	if _, err := Parse(name, text); err != nil {
+		return "", err
+	}
+	var items []item
+	l := lex(name, text)
+	for {
+		it := l.nextItem()
+		if it.typ == itemError {
+			return "", fmt.Errorf("parse: %s: %s", name, it.val)
+		}
+		items = append(items, it)
+		if it.typ == itemEOF {
+			break
+		}
+	}
+	f := new(formatter)
+	depth := 0
+	end := 0
+	for i := 0; i < len(items); {
+		it := items[i]
+		if err := f.gap(text[end:it.pos], i == 0); err != nil {
+			return "", err
+		}
+		switch it.typ {
+		case itemEOF:
+			i++
+		case itemRightDelim:
+			depth--
+			f.add(formatLine{depth: depth, text: "}"})
+			end = int(it.pos) + 1
+			i++
+		case itemIdentifier:
+			next, last := items[i+1], items[i+2]
+			if next.typ == itemEqual {
+				line := formatLine{depth: depth, text: it.val + " =", key: it.val, val: last.val}
+				if last.val != "" {
+					line.text += " " + last.val
+				}
+				f.add(line)
+				end = int(last.pos) + len(last.val)
+			} else {
+				if s := text[int(next.pos)+len(next.val) : last.pos]; strings.TrimSpace(s) != "" {
+					return "", fmt.Errorf("parse: %s: cannot format comment in section declaration: %s %s", name, it.val, next.val)
+				}
+				f.add(formatLine{depth: depth, text: it.val + " " + next.val + " {", open: true})
+				depth++
+				end = int(last.pos) + 1
+			}
+			i += 3
+		default:
+			return "", fmt.Errorf("parse: %s: unexpected %s", name, it)
+		}
+	}
+	f.sortVars()
+	var b bytes.Buffer
+	for _, line := range f.lines {
+		if line.text != "" {
+			b.WriteString(strings.Repeat("\t", line.depth))
+			b.WriteString(line.text)
+		}
+		b.WriteString(newLine)
+	}
+	return b.String(), nil
+}
+
+type formatLine struct {
+	depth int
+	text  string
+	open  bool // line opens a section
+
+	// key and val are set for key = value pairs.
+	key, val string
+}
+
+type formatter struct {
+	lines []formatLine
+	blank bool // a blank line is pending
+	depth int
+}
+
+// add appends line, preceded by a single blank line if one is pending and
+// line is neither the first in its section nor the closing brace.
+func (f *formatter) add(line formatLine) {
+	if f.blank && len(f.lines) > 0 && !f.lines[len(f.lines)-1].open && line.text != "}" {
+		f.lines = append(f.lines, formatLine{})
+	}
+	f.blank = false
+	f.depth = line.depth
+	if line.open {
+		f.depth++
+	}
+	f.lines = append(f.lines, line)
+}
+
+// gap processes the text between two tokens, which can only contain
+// whitespace and comments. A comment on the same line as the previous token
+// stays on that line.
+func (f *formatter) gap(s string, first bool) error {
+	lines := strings.Split(s, newLine)
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case i == 0 && !first:
+			if line != "" {
+				f.lines[len(f.lines)-1].text += " " + line
+			}
+		case line == "":
+			if i < len(lines)-1 {
+				f.blank = true
+			}
+		case strings.HasPrefix(line, string(comment)):
+			f.add(formatLine{depth: f.depth, text: line})
+		default:
+			return fmt.Errorf("parse: unexpected text %q", line)
+		}
+	}
+	return nil
+}
+
+// sortVars sorts each run of adjacent variable declarations at the same depth
+// that can be reordered without changing how they expand.
+func (f *formatter) sortVars() {
+	isVar := func(l formatLine) bool { return strings.HasPrefix(l.key, "$") }
+	for i := 0; i < len(f.lines); {
+		if !isVar(f.lines[i]) {
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(f.lines) && isVar(f.lines[j]) && f.lines[j].depth == f.lines[i].depth {
+			j++
+		}
+		if run := byKey(f.lines[i:j]); run.independent() {
+			sort.Stable(run)
+		}
+		i = j
+	}
+}
+
+type byKey []formatLine
+
+func (b byKey) Len() int           { return len(b) }
+func (b byKey) Less(i, j int) bool { return b[i].key < b[j].key }
+func (b byKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// independent reports whether no variable in b is declared twice or is
+// referenced by another. References are matched by prefix, which may reject
+// some runs that could be sorted but never accepts one that cannot.
+func (b byKey) independent() bool {
+	seen := make(map[string]bool)
+	for _, l := range b {
+		if seen[l.key] {
+			return false
+		}
+		seen[l.key] = true
+	}
+	for _, l := range b {
+		for k := range seen {
+			if strings.Contains(l.val, k) || strings.Contains(l.val, "${"+k[1:]) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -241,7 +241,7 @@ Loop:
 }
 
 func isSubsectionChar(r rune) bool {
-	return isVarchar(r) || r == '*' || r == ',' || r == '=' || r == '|'
+	return isVarchar(r) || r == '*' || r == ',' || r == '=' || r == '|' || r == ':'
 }
 
 func lexEqual(l *lexer) stateFn {
@@ -0,0 +1,38 @@
+package conf
+
+// PayloadVersion is the current version of the built-in notification payload
+// schemas. Notifications using a built-in body template get this version
+// unless they pin another with payloadVersion.
+const PayloadVersion = 1
+
+// PayloadVersionHeader is sent with posts whose body has a payload version, so
+// that consumers can tell schemas apart without parsing the body.
+const PayloadVersionHeader = "X-Bosun-Payload-Version"
+
+// builtinBodyTemplates are the versioned bodies of the standard notification
+// types, by name and then payload version. A version, once released, must not
+// change; changes to a payload are made by adding a new version. Sections
+// declared with the same name as a built-in replace it.
+var builtinBodyTemplates = map[string]map[int]string{
+	// webhook is a generic JSON envelope for the alert payload.
+	"webhook": {
+		1: `{"schemaVersion": 1, "message": {{json .}}}`,
+	},
+	// slack is a Slack incoming webhook message.
+	"slack": {
+		1: `{"text": {{json .}}, "bosun_schema_version": 1}`,
+	},
+}
+
+// builtinBodyTemplate returns the body of the built-in template name at
+// version, or the current version if version is zero.
+func (c *Conf) builtinBodyTemplate(name string, version int) string {
+	if version == 0 {
+		version = PayloadVersion
+	}
+	body, ok := builtinBodyTemplates[name][version]
+	if !ok {
+		c.errorf("bodyTemplate %s has no payload version %d (current is %d)", name, version, PayloadVersion)
+	}
+	return body
+}
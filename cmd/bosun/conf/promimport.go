@@ -0,0 +1,298 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	ttemplate "text/template"
+
+	"bosun.org/opentsdb"
+	"gopkg.in/yaml.v1"
+)
+
+// PromImport is the result of importing Prometheus alerting rules.
+type PromImport struct {
+	// Config is the generated configuration text, with an alert (and a
+	// template, if the rule has annotations) per rule.
+	Config string
+	// Warnings describe rules or parts of rules that were not translated
+	// exactly. Each is also in Config as a TODO comment.
+	Warnings []string
+}
+
+type promRuleFile struct {
+	Groups []struct {
+		Name  string
+		Rules []promRule
+	}
+}
+
+type promRule struct {
+	Alert       string            `yaml:",omitempty"`
+	Record      string            `yaml:",omitempty"`
+	Expr        string            `yaml:",omitempty"`
+	For         string            `yaml:",omitempty"`
+	Labels      map[string]string `yaml:",omitempty"`
+	Annotations map[string]string `yaml:",omitempty"`
+}
+
+// ImportPrometheusRules translates a Prometheus alerting rules file into alert
+// and template sections. Translation is best-effort: expressions are
+// supported only in the form
+//
+//	[sum|avg|min|max [by (labels)]] (metric{matchers} | rate(metric{matchers}[range])) op number
+//
+// which becomes an OpenTSDB q() query. Rules that cannot be translated are
+// emitted commented out below a TODO comment, and recording rules are
+// skipped with a TODO comment.
+func ImportPrometheusRules(data []byte) (*PromImport, error) {
+	var f promRuleFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	imp := &PromImport{}
+	var buf bytes.Buffer
+	names := make(map[string]bool)
+	for _, g := range f.Groups {
+		fmt.Fprintf(&buf, "# Imported from Prometheus rule group %s.\n\n", g.Name)
+		for _, r := range g.Rules {
+			if r.Alert == "" {
+				imp.todo(&buf, "recording rule %s is not imported", r.Record)
+				buf.WriteString("\n")
+				continue
+			}
+			name := promSectionName(r.Alert, names)
+			var sb bytes.Buffer
+			todos, err := r.write(&sb, name)
+			if err != nil {
+				imp.todo(&buf, "alert %s: %v", r.Alert, err)
+				for _, line := range strings.SplitAfter(strings.TrimSuffix(r.String(), "\n"), "\n") {
+					buf.WriteString("# " + line)
+				}
+				buf.WriteString("\n\n")
+				continue
+			}
+			for _, t := range todos {
+				imp.todo(&buf, "alert %s: %s", r.Alert, t)
+			}
+			buf.Write(sb.Bytes())
+		}
+	}
+	imp.Config = buf.String()
+	return imp, nil
+}
+
+// todo records a warning and writes it as a TODO comment to w.
+func (imp *PromImport) todo(w *bytes.Buffer, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	imp.Warnings = append(imp.Warnings, msg)
+	fmt.Fprintf(w, "# TODO: %s\n", msg)
+}
+
+// String returns r as YAML, for rules that are emitted commented out.
+func (r promRule) String() string {
+	b, _ := yaml.Marshal(r)
+	return string(b)
+}
+
+// promSectionName returns a section name for the alert named name that is
+// not yet in names, and adds it.
+func promSectionName(name string, names map[string]bool) string {
+	base := opentsdb.MustReplace(name, "_")
+	if base == "" {
+		base = "imported"
+	}
+	n := base
+	for i := 2; names[n]; i++ {
+		n = fmt.Sprintf("%s_%d", base, i)
+	}
+	names[n] = true
+	return n
+}
+
+// write writes the template and alert sections of r, named name, to w. It
+// returns notes on what was approximated, or an error if r cannot be
+// translated.
+func (r promRule) write(w *bytes.Buffer, name string) (todos []string, err error) {
+	value, op, threshold, err := promExpr(r.Expr, r.For)
+	if err != nil {
+		return nil, err
+	}
+	if r.For != "" && (op == "==" || op == "!=") {
+		todos = append(todos, fmt.Sprintf("for: %s cannot be held with %s; the alert fires on the last value", r.For, op))
+	}
+	subject, body := r.Annotations["summary"], r.Annotations["description"]
+	if subject == "" {
+		subject = r.Annotations["message"]
+	}
+	var templ []string
+	for _, kv := range [][2]string{{"subject", subject}, {"body", body}} {
+		if kv[1] == "" {
+			continue
+		}
+		v, err := promTemplate(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("annotation %s: %v", kv[0], err)
+		}
+		templ = append(templ, fmt.Sprintf("\t%s = %s\n", kv[0], v))
+	}
+	var extra []string
+	for k := range r.Annotations {
+		switch k {
+		case "summary", "description", "message", "runbook_url":
+		default:
+			extra = append(extra, k)
+		}
+	}
+	sort.Strings(extra)
+	for _, k := range extra {
+		todos = append(todos, fmt.Sprintf("annotation %s is not imported", k))
+	}
+	if len(templ) > 0 {
+		if subject == "" {
+			templ = append([]string{"\tsubject = {{.Alert.Name}}\n"}, templ...)
+		}
+		fmt.Fprintf(w, "template %s {\n", name)
+		for _, t := range templ {
+			w.WriteString(t)
+		}
+		w.WriteString("}\n\n")
+	}
+	fmt.Fprintf(w, "alert %s {\n", name)
+	if len(templ) > 0 {
+		fmt.Fprintf(w, "\ttemplate = %s\n", name)
+	}
+	if v := r.Annotations["runbook_url"]; v != "" {
+		fmt.Fprintf(w, "\trunbook = %s\n", v)
+	}
+	level := "crit"
+	var labels []string
+	for k := range r.Labels {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	for _, k := range labels {
+		v := r.Labels[k]
+		switch {
+		case k == "severity" && (v == "warning" || v == "warn" || v == "info"):
+			level = "warn"
+		case k == "severity":
+		case strings.ContainsAny(v, "\n`"):
+			todos = append(todos, fmt.Sprintf("label %s is not imported", k))
+		default:
+			fmt.Fprintf(w, "\t$label_%s = %s\n", opentsdb.MustReplace(k, "_"), v)
+		}
+	}
+	fmt.Fprintf(w, "\t$value = %s\n", value)
+	fmt.Fprintf(w, "\t%s = $value %s %s\n", level, op, threshold)
+	w.WriteString("}\n\n")
+	return todos, nil
+}
+
+var (
+	promCompare  = regexp.MustCompile(`^(.*?)\s*(>=|<=|==|!=|>|<)\s*(-?[0-9][0-9.eE+-]*)$`)
+	promAggBy    = regexp.MustCompile(`^(sum|avg|min|max)\s*\((.+)\)\s*by\s*\(([^)]*)\)$`)
+	promAgg      = regexp.MustCompile(`^(sum|avg|min|max)\s*(?:by\s*\(([^)]*)\)\s*)?\((.+)\)$`)
+	promRate     = regexp.MustCompile(`^i?rate\s*\((.+)\[(\d+[smhdw])\]\s*\)$`)
+	promSelector = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)\s*(?:\{(.*)\})?$`)
+	promMatcher  = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!=|!~|=)\s*"((?:[^"\\]|\\.)*)"\s*(?:,|$)`)
+	promAltRE    = regexp.MustCompile(`^[a-zA-Z0-9_./-]+(\|[a-zA-Z0-9_./-]+)*$`)
+	promDuration = regexp.MustCompile(`^\d+[smhdw]$`)
+	promLabelRE  = regexp.MustCompile(`\$labels\.([a-zA-Z_][a-zA-Z0-9_]*)`)
+	promValueRE  = regexp.MustCompile(`\$value\b`)
+)
+
+// promExpr translates the Prometheus alerting expression expr into a bosun
+// expression for its value, and the comparison of that value which fires
+// the alert. A for duration is approximated by reducing over that window
+// with min (or max, for < and <=), so the alert fires only if the condition
+// held for the whole window.
+func promExpr(expr, hold string) (value, op, threshold string, err error) {
+	unsupported := fmt.Errorf("unsupported expression: %s", strings.TrimSpace(expr))
+	m := promCompare.FindStringSubmatch(strings.TrimSpace(expr))
+	if m == nil {
+		return "", "", "", unsupported
+	}
+	e, op, threshold := strings.TrimSpace(m[1]), m[2], m[3]
+	agg, by := "avg", ""
+	if m := promAggBy.FindStringSubmatch(e); m != nil {
+		agg, e, by = m[1], strings.TrimSpace(m[2]), m[3]
+	} else if m := promAgg.FindStringSubmatch(e); m != nil {
+		agg, by, e = m[1], m[2], strings.TrimSpace(m[3])
+	}
+	rate, window := "", "5m"
+	if m := promRate.FindStringSubmatch(e); m != nil {
+		rate, e, window = "rate{counter}:", strings.TrimSpace(m[1]), m[2]
+	}
+	m = promSelector.FindStringSubmatch(e)
+	if m == nil {
+		return "", "", "", unsupported
+	}
+	metric := m[1]
+	if opentsdb.MustReplace(metric, "") != metric {
+		return "", "", "", fmt.Errorf("metric %s is not a valid OpenTSDB metric", metric)
+	}
+	tags := make(opentsdb.TagSet)
+	for rest := m[2]; strings.TrimSpace(rest) != ""; {
+		mm := promMatcher.FindStringSubmatch(rest)
+		if mm == nil {
+			return "", "", "", unsupported
+		}
+		rest = rest[len(mm[0]):]
+		switch k, mop, v := mm[1], mm[2], mm[3]; {
+		case mop == "=" && opentsdb.MustReplace(v, "") == v:
+			tags[k] = v
+		case mop == "=~" && promAltRE.MatchString(v):
+			tags[k] = v
+		default:
+			return "", "", "", fmt.Errorf("unsupported matcher %s%s%q", k, mop, v)
+		}
+	}
+	for _, k := range strings.Split(by, ",") {
+		if k = strings.TrimSpace(k); k != "" && tags[k] == "" {
+			tags[k] = "*"
+		}
+	}
+	reduce := "last"
+	if rate != "" {
+		reduce = "avg"
+	}
+	if hold != "" {
+		if !promDuration.MatchString(hold) {
+			return "", "", "", fmt.Errorf("unsupported for: %s", hold)
+		}
+		window = hold
+		switch op {
+		case ">", ">=":
+			reduce = "min"
+		case "<", "<=":
+			reduce = "max"
+		}
+	}
+	query := agg + ":" + rate + metric
+	if len(tags) > 0 {
+		query += tags.String()
+	}
+	value = fmt.Sprintf(`%s(q("%s", "%s", ""))`, reduce, query, window)
+	return value, op, threshold, nil
+}
+
+// promTemplate translates a Prometheus annotation into a template value:
+// $labels.x becomes .Group.x and $value the value of the alert's $value.
+func promTemplate(s string) (string, error) {
+	s = promLabelRE.ReplaceAllString(s, ".Group.$1")
+	s = promValueRE.ReplaceAllString(s, "(.Eval .Alert.Vars.value)")
+	if _, err := ttemplate.New("").Funcs(defaultFuncs).Parse(s); err != nil {
+		return "", err
+	}
+	if strings.Contains(s, "`") {
+		return "", fmt.Errorf("contains a backtick")
+	}
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "\n") {
+		s = "`" + s + "`"
+	}
+	return s, nil
+}
@@ -0,0 +1,73 @@
+package conf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	defaultRelayFlushInterval = time.Second
+	defaultRelayQueueSize     = 100000
+)
+
+// loadRelayTLS builds RelayTLS from the relayTLSCert, relayTLSKey and
+// relayTLSClientCA globals. The relay stays plain HTTP if none are set.
+func (c *Conf) loadRelayTLS() {
+	if c.relayTLSCert == "" && c.relayTLSKey == "" {
+		if c.relayTLSClientCA != "" {
+			c.errorf("relayTLSClientCA specified, but no relayTLSCert and relayTLSKey")
+		}
+		return
+	}
+	if c.relayTLSCert == "" || c.relayTLSKey == "" {
+		c.errorf("relayTLSCert and relayTLSKey must be specified together")
+	}
+	if c.RelayListen == "" {
+		c.errorf("relayTLSCert specified, but no relayListen")
+	}
+	cert, err := tls.LoadX509KeyPair(c.relayTLSCert, c.relayTLSKey)
+	if err != nil {
+		c.errorf("relayTLSCert and relayTLSKey: %v", err)
+	}
+	c.RelayTLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.relayTLSClientCA == "" {
+		return
+	}
+	pem, err := ioutil.ReadFile(c.relayTLSClientCA)
+	if err != nil {
+		c.errorf("relayTLSClientCA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		c.errorf("relayTLSClientCA: no PEM certificates in %s", c.relayTLSClientCA)
+	}
+	c.RelayTLS.ClientCAs = pool
+	c.RelayTLS.ClientAuth = tls.RequireAndVerifyClientCert
+}
+
+// checkRelayBatching validates the relay batching globals and sets the
+// defaults of those that were not set. Puts wait for room in a full queue
+// unless relayQueueFull = drop, so that a TSDB that falls behind slows its
+// senders, which retry, rather than losing data points.
+func (c *Conf) checkRelayBatching() {
+	if c.RelayBatchSize == 0 {
+		if len(c.relayBatchKeys) > 0 {
+			c.errorf("%s specified, but no relayBatchSize", c.relayBatchKeys[0])
+		}
+		return
+	}
+	if c.RelayFlushInterval == 0 {
+		c.RelayFlushInterval = defaultRelayFlushInterval
+	}
+	if c.RelayQueueSize == 0 {
+		c.RelayQueueSize = defaultRelayQueueSize
+	}
+	if c.RelayQueueSize < c.RelayBatchSize {
+		c.errorf("relayQueueSize (%d) must be at least relayBatchSize (%d)", c.RelayQueueSize, c.RelayBatchSize)
+	}
+}
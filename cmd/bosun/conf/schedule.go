@@ -0,0 +1,160 @@
+package conf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RunSchedule is a cron-like schedule restricting when an alert is
+// evaluated or a notification sent. It has the five standard cron fields: minute, hour, day of month,
+// month and day of week. Each field is *, a value, a range a-b, or a list of
+// these separated by commas, and any of them may have a /step. Months and
+// days of week may also be given by their three letter English names.
+type RunSchedule struct {
+	Text     string
+	Location *time.Location `json:"-"`
+
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+type scheduleField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var scheduleFields = [...]scheduleField{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// parseRunSchedule parses the schedule of key v in the time zone zone, which
+// defaults to loc.
+func (c *Conf) parseRunSchedule(key, v, zone string, loc *time.Location) *RunSchedule {
+	if zone != "" {
+		loc = c.parseTimeZone(key+"TimeZone", zone)
+	}
+	rs, err := ParseRunSchedule(v, loc)
+	if err != nil {
+		c.errorf("%s: %v", key, err)
+	}
+	return rs
+}
+
+// parseTimeZone loads the time zone of key from its IANA name v.
+func (c *Conf) parseTimeZone(key, v string) *time.Location {
+	loc, err := time.LoadLocation(v)
+	if err != nil {
+		c.errorf("%s: %v", key, err)
+	}
+	return loc
+}
+
+// ParseRunSchedule parses the cron expression s. Times are matched in loc,
+// which defaults to UTC.
+func ParseRunSchedule(s string, loc *time.Location) (*RunSchedule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != len(scheduleFields) {
+		return nil, fmt.Errorf("expected 5 fields (minute hour day-of-month month day-of-week), got %d", len(fields))
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	rs := &RunSchedule{
+		Text:     s,
+		Location: loc,
+		domStar:  fields[2] == "*",
+		dowStar:  fields[4] == "*",
+	}
+	sets := [...]*uint64{&rs.minute, &rs.hour, &rs.dom, &rs.month, &rs.dow}
+	for i, f := range fields {
+		set, err := scheduleFields[i].parse(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s field %q: %v", scheduleFields[i].name, f, err)
+		}
+		*sets[i] = set
+	}
+	// Both 0 and 7 are Sunday.
+	if rs.dow&(1<<7) != 0 {
+		rs.dow |= 1
+	}
+	return rs, nil
+}
+
+func (f scheduleField) parse(s string) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step %q", part[i+1:])
+			}
+		}
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if strings.Contains(part, "/") {
+				// a/n means every n from a to the end of the range.
+				hi = f.max
+			}
+			if len(bounds) == 2 {
+				if hi, err = f.value(bounds[1]); err != nil {
+					return 0, err
+				}
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("range %s is backwards", rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (f scheduleField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return i + f.min, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %q", s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+// Matches reports whether the minute containing t is in the schedule. As in
+// cron, if both day of month and day of week are restricted, a day matching
+// either one matches.
+func (rs *RunSchedule) Matches(t time.Time) bool {
+	t = t.In(rs.Location)
+	has := func(set uint64, v int) bool { return set&(1<<uint(v)) != 0 }
+	if !has(rs.minute, t.Minute()) || !has(rs.hour, t.Hour()) || !has(rs.month, int(t.Month())) {
+		return false
+	}
+	dom, dow := has(rs.dom, t.Day()), has(rs.dow, int(t.Weekday()))
+	if rs.domStar || rs.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,178 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"bosun.org/slog"
+)
+
+// SecretResolver reads secrets kept outside of the configuration. A
+// credential set to vault("path", "field") is the field of the secret at
+// path.
+type SecretResolver interface {
+	Resolve(path, field string) (string, error)
+}
+
+// DefaultSecretResolver, if set, resolves secrets when vaultAddress is not
+// set, so that other secret stores may be plugged in.
+var DefaultSecretResolver SecretResolver
+
+var secretRE = regexp.MustCompile(`^vault\("([^"]+)",\s*"([^"]+)"\)$`)
+
+type secretRef struct {
+	path, field string
+	set         func(string)
+}
+
+// loadCredential returns the value v of the credential key. If v refers to
+// a secret, set is called with it once the secrets are resolved by
+// loadSecrets, and "" is returned.
+func (c *Conf) loadCredential(key, v string, set func(string)) string {
+	m := secretRE.FindStringSubmatch(v)
+	if m == nil {
+		return v
+	}
+	if c.secrets == nil {
+		c.secrets = make(map[string]*secretRef)
+	}
+	c.secrets[key] = &secretRef{path: m[1], field: m[2], set: set}
+	return ""
+}
+
+// loadSecrets resolves the credentials that refer to secrets, so that a
+// missing secret or an unreachable store fails validation.
+func (c *Conf) loadSecrets() {
+	if c.VaultAddress != "" {
+		token := c.vaultToken
+		if token == "" {
+			token = os.Getenv("VAULT_TOKEN")
+		}
+		c.SecretResolver = NewVaultResolver(c.VaultAddress, token, c.VaultRefresh)
+	} else if c.VaultRefresh != 0 {
+		c.errorf("vaultRefresh specified, but no vaultAddress")
+	} else {
+		c.SecretResolver = DefaultSecretResolver
+	}
+	if len(c.secrets) == 0 {
+		return
+	}
+	if c.SecretResolver == nil {
+		c.errorf("vault() credentials specified, but no vaultAddress")
+	}
+	for key, ref := range c.secrets {
+		v, err := c.SecretResolver.Resolve(ref.path, ref.field)
+		if err != nil {
+			c.errorf("%s: %v", key, err)
+		}
+		ref.set(v)
+	}
+}
+
+// credential returns the current value of the credential key, whose value
+// at load was v. Credentials that refer to secrets are read from the
+// SecretResolver, which may have refreshed them since.
+func (c *Conf) credential(key, v string) string {
+	ref := c.secrets[key]
+	if ref == nil || c.SecretResolver == nil {
+		return v
+	}
+	s, err := c.SecretResolver.Resolve(ref.path, ref.field)
+	if err != nil {
+		slog.Errorf("%s: %v", key, err)
+		return v
+	}
+	return s
+}
+
+// VaultResolver reads secrets from the key/value secrets engines of a Vault
+// server. Secrets are cached, and reread after refresh if it is positive.
+type VaultResolver struct {
+	Address string
+	Token   string
+	Refresh time.Duration
+	Client  *http.Client
+
+	mu    sync.Mutex
+	cache map[string]*vaultSecret
+}
+
+type vaultSecret struct {
+	fields map[string]interface{}
+	read   time.Time
+}
+
+func NewVaultResolver(address, token string, refresh time.Duration) *VaultResolver {
+	return &VaultResolver{
+		Address: strings.TrimSuffix(address, "/"),
+		Token:   token,
+		Refresh: refresh,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+		cache:   make(map[string]*vaultSecret),
+	}
+}
+
+// Resolve returns the field of the secret at path. If the secret is due to
+// be refreshed but cannot be read, its last value is used and the error
+// logged.
+func (v *VaultResolver) Resolve(path, field string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s := v.cache[path]
+	if s == nil || (v.Refresh > 0 && time.Since(s.read) >= v.Refresh) {
+		fields, err := v.read(path)
+		switch {
+		case err == nil:
+			s = &vaultSecret{fields: fields, read: time.Now()}
+			v.cache[path] = s
+		case s == nil:
+			return "", err
+		default:
+			slog.Errorf("refreshing vault secret %s: %v", path, err)
+		}
+	}
+	f, ok := s.fields[field]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no field %s", path, field)
+	}
+	str, ok := f.(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s: field %s is not a string", path, field)
+	}
+	return str, nil
+}
+
+func (v *VaultResolver) read(path string) (map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", v.Address+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("reading vault secret %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reading vault secret %s: %s", path, resp.Status)
+	}
+	var secret struct {
+		Data map[string]interface{}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("reading vault secret %s: %v", path, err)
+	}
+	// Version 2 of the key/value engine nests the fields with metadata.
+	if data, ok := secret.Data["data"].(map[string]interface{}); ok {
+		if _, ok := secret.Data["metadata"]; ok {
+			return data, nil
+		}
+	}
+	return secret.Data, nil
+}
@@ -0,0 +1,92 @@
+package conf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"bosun.org/models"
+)
+
+// SeverityStyle is how a status is shown by rich notification channels.
+type SeverityStyle struct {
+	// Color is a hex RGB color such as #D9534F.
+	Color string
+	// Icon is an emoji.
+	Icon string
+}
+
+// SeverityPalette is the style of each status, set by the severityColors
+// and severityIcons settings.
+type SeverityPalette map[models.Status]SeverityStyle
+
+// defaultSeverities are the styles of statuses, with the colors of bosun's
+// dashboard.
+var defaultSeverities = SeverityPalette{
+	models.StNormal:   {"#5CB85C", "✅"},
+	models.StWarning:  {"#F0AD4E", "⚠️"},
+	models.StCritical: {"#D9534F", "🔴"},
+	models.StUnknown:  {"#5BC0DE", "❔"},
+}
+
+func (p SeverityPalette) copy() SeverityPalette {
+	c := make(SeverityPalette, len(p))
+	for st, style := range p {
+		c[st] = style
+	}
+	return c
+}
+
+// SeverityMeta describes the status of an alert key to templates and
+// channels, so that they all show it the same way.
+type SeverityMeta struct {
+	// Name is the status, such as critical.
+	Name string
+	// Level orders statuses: 1 for normal, 2 for warning, 3 for critical
+	// and 4 for unknown.
+	Level int
+	SeverityStyle
+}
+
+// Severity returns the SeverityMeta of st, or nil if st is StNone, as it is
+// for notifications about several alert keys.
+func (c *Conf) Severity(st models.Status) *SeverityMeta {
+	if st == models.StNone {
+		return nil
+	}
+	return &SeverityMeta{
+		Name:          st.String(),
+		Level:         int(st),
+		SeverityStyle: c.Severities[st],
+	}
+}
+
+var severityColorRE = regexp.MustCompile(`^#?[0-9a-fA-F]{6}$`)
+
+// setSeverities parses v, a severityColors or severityIcons setting such as
+// critical=#D9534F,warning=#F0AD4E, into the palette. Statuses that v does
+// not list keep their default.
+func (c *Conf) setSeverities(key, v string) {
+	for _, pair := range strings.Split(v, ",") {
+		sp := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(sp) != 2 {
+			c.errorf("%s: expected status=value, got %s", key, pair)
+		}
+		var st models.Status
+		st.UnmarshalJSON([]byte(fmt.Sprintf("%q", strings.TrimSpace(sp[0]))))
+		if st == models.StNone {
+			c.errorf("%s: unknown status %s, must be normal, warning, critical or unknown", key, sp[0])
+		}
+		style := c.Severities[st]
+		value := strings.TrimSpace(sp[1])
+		if key == "severityColors" {
+			if !severityColorRE.MatchString(value) {
+				c.errorf("%s: %s is not a hex color such as #D9534F", key, value)
+			}
+			style.Color = "#" + strings.ToUpper(strings.TrimPrefix(value, "#"))
+		} else {
+			style.Icon = value
+		}
+		c.Severities[st] = style
+	}
+}
@@ -0,0 +1,147 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	ttemplate "text/template"
+
+	"bosun.org/models"
+	"bosun.org/opentsdb"
+	"bosun.org/slog"
+)
+
+// maxSlackBlocks is the number of blocks Slack accepts in a message.
+const maxSlackBlocks = 50
+
+// SlackBlocksData is the data of a notification's slackBlocks template.
+type SlackBlocksData struct {
+	// Payload is the alert's subject, or its body with useBody.
+	Payload  string
+	AlertKey string
+	Alert    string
+	Tags     opentsdb.TagSet
+	// AckURL and SilenceURL link to the pages acknowledging and silencing
+	// the alert key in bosun.
+	AckURL     string
+	SilenceURL string
+	// Severity is the status of the alert key with its color and icon, or
+	// nil for messages about several alert keys.
+	Severity *SeverityMeta
+}
+
+// slackFuncs build common Block Kit blocks as JSON for slackBlocks templates.
+var slackFuncs = ttemplate.FuncMap{
+	"slackSection": func(text string) string {
+		return slackJSON(map[string]interface{}{
+			"type": "section",
+			"text": map[string]string{"type": "mrkdwn", "text": text},
+		})
+	},
+	"slackFields": func(tags opentsdb.TagSet) string {
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		// A section has at most 10 fields.
+		if len(keys) > 10 {
+			keys = keys[:10]
+		}
+		fields := make([]map[string]string, len(keys))
+		for i, k := range keys {
+			fields[i] = map[string]string{"type": "mrkdwn", "text": fmt.Sprintf("*%s*\n%s", k, tags[k])}
+		}
+		return slackJSON(map[string]interface{}{"type": "section", "fields": fields})
+	},
+	"slackButton": func(text, url string) string {
+		return slackJSON(map[string]interface{}{
+			"type": "button",
+			"text": map[string]string{"type": "plain_text", "text": text},
+			"url":  url,
+		})
+	},
+	"slackActions": func(buttons ...string) string {
+		elements := make([]json.RawMessage, len(buttons))
+		for i, b := range buttons {
+			elements[i] = json.RawMessage(b)
+		}
+		return slackJSON(map[string]interface{}{"type": "actions", "elements": elements})
+	},
+	"slackDivider": func() string {
+		return `{"type":"divider"}`
+	},
+}
+
+func slackJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		slog.Errorln(err)
+	}
+	return string(b)
+}
+
+// executeSlackBlocks returns a Slack message with payload as its text and the
+// blocks rendered by the notification's slackBlocks template. If the template
+// fails or does not produce valid blocks, the BodyError policy applies, and
+// the message falls back to the text alone unless it is drop.
+func (n *Notification) executeSlackBlocks(payload []byte, ak string, status models.Status) (out []byte, rendered bool, err error) {
+	data := SlackBlocksData{
+		Payload:  string(payload),
+		AlertKey: ak,
+		Alert:    ak,
+		Severity: n.severity(status),
+	}
+	if key, err := models.ParseAlertKey(ak); err == nil {
+		data.Alert = key.Name()
+		data.Tags = key.Group()
+		data.AckURL = n.makeLink("/action", &url.Values{
+			"type": []string{"ack"},
+			"key":  []string{ak},
+		})
+		data.SilenceURL = n.makeLink("/silence", &url.Values{
+			"alert": []string{data.Alert},
+			"tags":  []string{data.Tags.Tags()},
+		})
+	}
+	msg := struct {
+		Text   string          `json:"text"`
+		Blocks json.RawMessage `json:"blocks,omitempty"`
+	}{Text: data.Payload}
+	buf := new(bytes.Buffer)
+	err = n.SlackBlocks.Execute(buf, &data)
+	if err == nil {
+		err = validSlackBlocks(buf.Bytes())
+	}
+	if err != nil {
+		slog.Errorf("notification %s: slackBlocks failed for alert %s: %v", n.Name, ak, err)
+		if n.BodyError == BodyErrorDrop {
+			return nil, false, err
+		}
+	} else {
+		msg.Blocks = buf.Bytes()
+		rendered = true
+	}
+	out, err = json.Marshal(&msg)
+	return out, rendered, err
+}
+
+// validSlackBlocks returns an error unless b is a JSON array of at most
+// maxSlackBlocks objects that each have a type.
+func validSlackBlocks(b []byte) error {
+	var blocks []map[string]interface{}
+	if err := json.Unmarshal(b, &blocks); err != nil {
+		return fmt.Errorf("blocks are not a JSON array of objects: %v", err)
+	}
+	if len(blocks) == 0 || len(blocks) > maxSlackBlocks {
+		return fmt.Errorf("%d blocks, must be 1 to %d", len(blocks), maxSlackBlocks)
+	}
+	for i, b := range blocks {
+		if t, ok := b["type"].(string); !ok || t == "" {
+			return fmt.Errorf("block %d has no type", i)
+		}
+	}
+	return nil
+}
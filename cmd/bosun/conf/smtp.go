@@ -0,0 +1,127 @@
+package conf
+
+import (
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+
+	"github.com/jordan-wright/email"
+	"golang.org/x/net/context"
+)
+
+// smtpIdleTimeout is how long an unused pooled SMTP connection is kept open.
+const smtpIdleTimeout = 30 * time.Second
+
+// sendEmail sends e through the configured SMTP server. Unless SMTPPoolSize is
+// zero, connections are reused between emails and at most SMTPPoolSize are
+// open at once. The text of e is sent in charset and encoding, as by
+// emailMessage. The exchange with the server must finish before ctx's
+// deadline, if it has one.
+func (c *Conf) sendEmail(ctx context.Context, e *email.Email, charset, encoding string) error {
+	from, to, raw, err := emailMessage(e, charset, encoding)
+	if err != nil {
+		return err
+	}
+	password := c.credential("smtpPassword", c.SMTPPassword)
+	deadline, _ := ctx.Deadline()
+	if c.SMTPPoolSize <= 0 {
+		return sendMail(deadline, c.SMTPHost, c.SMTPUsername, password, from, to, raw)
+	}
+	sc, err := smtpConns.get(ctx, c.SMTPHost, c.SMTPUsername, password, c.SMTPPoolSize)
+	if err != nil {
+		return err
+	}
+	err = sendSMTP(sc.Client, from, to, raw)
+	smtpConns.put(sc, err)
+	return err
+}
+
+// smtpPool holds authenticated SMTP connections for reuse, keyed by server
+// and credentials.
+type smtpPool struct {
+	sync.Mutex
+	idle  map[string][]*smtpConn
+	slots map[string]chan struct{}
+}
+
+type smtpConn struct {
+	*smtp.Client
+	conn      net.Conn
+	key       string
+	slots     chan struct{}
+	idleSince time.Time
+}
+
+var smtpConns = &smtpPool{
+	idle:  make(map[string][]*smtpConn),
+	slots: make(map[string]chan struct{}),
+}
+
+// get returns an open connection to addr, waiting while size connections are
+// in use or until ctx is done. Idle connections are checked with NOOP and RSET
+// before they are reused, and discarded if that fails. The connection has
+// ctx's deadline, if any, until it is put back.
+func (p *smtpPool) get(ctx context.Context, addr, username, password string, size int) (*smtpConn, error) {
+	key := addr + "\x00" + username + "\x00" + password
+	p.Lock()
+	slots := p.slots[key]
+	if cap(slots) != size {
+		slots = make(chan struct{}, size)
+		p.slots[key] = slots
+	}
+	p.Unlock()
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	deadline, _ := ctx.Deadline()
+	for {
+		p.Lock()
+		idle := p.idle[key]
+		if len(idle) == 0 {
+			p.Unlock()
+			break
+		}
+		sc := idle[len(idle)-1]
+		p.idle[key] = idle[:len(idle)-1]
+		p.Unlock()
+		sc.conn.SetDeadline(deadline)
+		if time.Since(sc.idleSince) < smtpIdleTimeout && sc.Noop() == nil && sc.Reset() == nil {
+			sc.slots = slots
+			return sc, nil
+		}
+		sc.Close()
+	}
+	c, conn, err := dialSMTP(addr, username, password, deadline)
+	if err != nil {
+		<-slots
+		return nil, err
+	}
+	return &smtpConn{Client: c, conn: conn, key: key, slots: slots}, nil
+}
+
+// put returns sc to the pool, or closes it if err, the result of using it, is
+// not nil. Connections that have been idle too long are closed.
+func (p *smtpPool) put(sc *smtpConn, err error) {
+	defer func() { <-sc.slots }()
+	if err != nil {
+		sc.Close()
+		return
+	}
+	sc.conn.SetDeadline(time.Time{})
+	sc.idleSince = time.Now()
+	p.Lock()
+	defer p.Unlock()
+	idle := append(p.idle[sc.key], sc)
+	kept := idle[:0]
+	for _, c := range idle {
+		if time.Since(c.idleSince) < smtpIdleTimeout {
+			kept = append(kept, c)
+		} else {
+			c.Close()
+		}
+	}
+	p.idle[sc.key] = kept
+}
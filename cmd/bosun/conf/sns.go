@@ -0,0 +1,169 @@
+package conf
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"bosun.org/models"
+	"bosun.org/slog"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol/query"
+	"github.com/aws/aws-sdk-go/private/signer/v4"
+	"golang.org/x/net/context"
+)
+
+// snsTopicRE matches SNS topic ARNs. The first group is the region.
+var snsTopicRE = regexp.MustCompile(`^arn:aws[a-z-]*:sns:([a-z0-9-]+):[0-9]{12}:[A-Za-z0-9_-]{1,256}$`)
+
+// snsMaxAttributes is the number of message attributes SNS accepts.
+const snsMaxAttributes = 10
+
+// snsClient publishes to SNS with the query protocol. The vendored SDK has no
+// SNS package, so this is the subset of one that bosun needs.
+type snsClient struct {
+	*client.Client
+}
+
+// newSNSClient returns a client for region. Without an access key the default
+// credential chain is used: the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+// environment variables, the shared credentials file, then the EC2 instance
+// role. endpoint overrides the regional endpoint if not empty.
+func newSNSClient(region, endpoint, accessKey, secretKey string) *snsClient {
+	cfg := aws.NewConfig().WithRegion(region)
+	if endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+	if accessKey != "" {
+		cfg = cfg.WithCredentials(credentials.NewStaticCredentials(accessKey, secretKey, ""))
+	}
+	cc := session.New().ClientConfig("sns", cfg)
+	c := client.New(*cc.Config, metadata.ClientInfo{
+		ServiceName:   "sns",
+		SigningRegion: cc.SigningRegion,
+		Endpoint:      cc.Endpoint,
+		APIVersion:    "2010-03-31",
+	}, cc.Handlers)
+	c.Handlers.Sign.PushBack(v4.Sign)
+	c.Handlers.Build.PushBackNamed(query.BuildHandler)
+	c.Handlers.Unmarshal.PushBackNamed(query.UnmarshalHandler)
+	c.Handlers.UnmarshalMeta.PushBackNamed(query.UnmarshalMetaHandler)
+	c.Handlers.UnmarshalError.PushBackNamed(query.UnmarshalErrorHandler)
+	return &snsClient{c}
+}
+
+type snsPublishInput struct {
+	_ struct{} `type:"structure"`
+
+	Message           *string                              `type:"string" required:"true"`
+	MessageAttributes map[string]*snsMessageAttributeValue `locationNameKey:"Name" locationNameValue:"Value" type:"map"`
+	TopicArn          *string                              `type:"string"`
+}
+
+type snsMessageAttributeValue struct {
+	_ struct{} `type:"structure"`
+
+	DataType    *string `type:"string" required:"true"`
+	StringValue *string `type:"string"`
+}
+
+type snsPublishOutput struct {
+	_ struct{} `type:"structure"`
+
+	MessageId *string `type:"string"`
+}
+
+// publish sends in to SNS, giving up once ctx is done.
+func (c *snsClient) publish(ctx context.Context, in *snsPublishInput) (*snsPublishOutput, error) {
+	op := &request.Operation{
+		Name:       "Publish",
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	out := &snsPublishOutput{}
+	req := c.NewRequest(op, in, out)
+	req.HTTPRequest.Cancel = ctx.Done()
+	err := req.Send()
+	return out, err
+}
+
+// snsAttributeRE matches the characters SNS does not allow in message
+// attribute names.
+var snsAttributeRE = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// snsAttributes returns the message attributes of a notification about ak:
+// alert, severity unless status is StNone, and, if tags is true, the tags of
+// ak. Tags beyond the number SNS accepts are dropped in name order.
+func snsAttributes(ak string, status models.Status, tags bool) map[string]*snsMessageAttributeValue {
+	attrs := make(map[string]*snsMessageAttributeValue)
+	add := func(name, value string) {
+		attrs[name] = &snsMessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+	key, err := models.ParseAlertKey(ak)
+	if err != nil {
+		// Unknown and action notifications are not about one alert key.
+		add("alert", ak)
+	} else {
+		add("alert", key.Name())
+	}
+	if status != models.StNone {
+		add("severity", status.String())
+	}
+	if !tags || err != nil {
+		return attrs
+	}
+	group := key.Group()
+	names := make([]string, 0, len(group))
+	for k := range group {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		name := snsAttributeRE.ReplaceAllString(k, "_")
+		if _, ok := attrs[name]; ok {
+			continue
+		}
+		if len(attrs) == snsMaxAttributes {
+			slog.Warningf("sns: dropping tags of %s beyond %d message attributes", ak, snsMaxAttributes)
+			break
+		}
+		add(name, group[k])
+	}
+	return attrs
+}
+
+// DoSNS publishes payload, executed through the notification's body
+// template if it has one, to its SNS topic.
+func (n *Notification) DoSNS(payload []byte, ak string, status models.Status) error {
+	return n.doSNS(context.Background(), nil, payload, ak, status)
+}
+
+func (n *Notification) doSNS(ctx context.Context, cache *BodyCache, payload []byte, ak string, status models.Status) error {
+	payload, _, err := n.limitBody("sns", ak, payload, func(payload []byte) ([]byte, bool, error) {
+		return n.executeBody(cache, payload, ak, status)
+	})
+	if err != nil {
+		return err
+	}
+	out, err := n.sns.publish(ctx, &snsPublishInput{
+		Message:           aws.String(string(payload)),
+		MessageAttributes: snsAttributes(ak, status, n.SNSTagAttributes),
+		TopicArn:          aws.String(n.SNSTopic),
+	})
+	if err != nil {
+		err = fmt.Errorf("sns publish to %s failed: %v", n.SNSTopic, strings.Replace(err.Error(), "\n", " ", -1))
+		slog.Errorln(err)
+		return err
+	}
+	slog.Infof("sns notification successful for alert %s. Message id %s.", ak, aws.StringValue(out.MessageId))
+	return nil
+}
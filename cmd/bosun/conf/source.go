@@ -0,0 +1,189 @@
+package conf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"bosun.org/slog"
+)
+
+// RuleSource is where a configuration is read from.
+type RuleSource interface {
+	// Name identifies the source in errors and logs, such as a path or URL.
+	Name() string
+	// Read returns the text of the configuration.
+	Read() (string, error)
+}
+
+// RuleWriter is implemented by the rule sources configurations can be saved
+// to.
+type RuleWriter interface {
+	Write(text string) error
+}
+
+// NewRuleSource returns the source at location: a local file, an http or
+// https URL, or an object in a public S3 or GCS bucket, as s3://bucket/key or
+// gs://bucket/object. Objects that need credentials can be read through
+// presigned https URLs.
+func NewRuleSource(location string) (RuleSource, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme == "" || filepath.VolumeName(location) != "" {
+		return &FileSource{Path: location}, nil
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "s3":
+		u = &url.URL{Scheme: "https", Host: u.Host + ".s3.amazonaws.com", Path: u.Path}
+	case "gs":
+		u = &url.URL{Scheme: "https", Host: "storage.googleapis.com", Path: "/" + u.Host + u.Path}
+	case "file":
+		return &FileSource{Path: u.Path}, nil
+	default:
+		return nil, fmt.Errorf("conf: unsupported config location %s", location)
+	}
+	return &HTTPSource{
+		URL:    u.String(),
+		Client: &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// Load reads the configuration from src. The configuration keeps src as its
+// Source.
+func Load(src RuleSource) (*Conf, error) {
+	text, err := src.Read()
+	if err != nil {
+		return nil, err
+	}
+	c, err := New(src.Name(), text)
+	if err != nil {
+		return nil, err
+	}
+	c.Source = src
+	return c, nil
+}
+
+// PollRuleSource reads src every interval, and calls changed with its text
+// whenever it differs from the text read before, starting with text. Errors
+// reading src are logged. It never returns.
+func PollRuleSource(src RuleSource, interval time.Duration, text string, changed func(string)) {
+	for range time.Tick(interval) {
+		t, err := src.Read()
+		if err != nil {
+			slog.Errorf("polling config: %v", err)
+			continue
+		}
+		if t != text {
+			text = t
+			changed(t)
+		}
+	}
+}
+
+// ReloadResult is the outcome of an attempt to reload the configuration, on
+// SIGHUP or when polling finds that it changed.
+type ReloadResult struct {
+	Time    time.Time
+	Source  string
+	Success bool
+	// Error is why the configuration was not reloaded, such as the error
+	// loading it.
+	Error string `json:",omitempty"`
+}
+
+var lastReload struct {
+	sync.Mutex
+	result *ReloadResult
+}
+
+// RecordReload records the outcome of reloading the configuration from
+// source at t: err is nil if it was reloaded. Failed reloads are logged.
+func RecordReload(source string, t time.Time, err error) {
+	r := &ReloadResult{Time: t, Source: source, Success: err == nil}
+	if err != nil {
+		r.Error = err.Error()
+		slog.Errorf("not reloading config from %s: %v", source, err)
+	}
+	lastReload.Lock()
+	lastReload.result = r
+	lastReload.Unlock()
+}
+
+// ReloadStatus returns the outcome of the last reload recorded with
+// RecordReload, or nil if the configuration has not been reloaded.
+func ReloadStatus() *ReloadResult {
+	lastReload.Lock()
+	defer lastReload.Unlock()
+	if lastReload.result == nil {
+		return nil
+	}
+	r := *lastReload.result
+	return &r
+}
+
+// FileSource is a configuration in a local file.
+type FileSource struct {
+	Path string
+}
+
+func (f *FileSource) Name() string { return f.Path }
+
+func (f *FileSource) Read() (string, error) {
+	b, err := ioutil.ReadFile(f.Path)
+	return string(b), err
+}
+
+// Write replaces the file with text, through a temporary file in the same
+// directory renamed over it, so that readers never see part of it.
+func (f *FileSource) Write(text string) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(f.Path); err == nil {
+		mode = fi.Mode()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), "."+filepath.Base(f.Path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(text); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// HTTPSource is a configuration read with GET requests to URL. It cannot be
+// written to.
+type HTTPSource struct {
+	URL    string
+	Client *http.Client
+}
+
+func (h *HTTPSource) Name() string { return h.URL }
+
+func (h *HTTPSource) Read() (string, error) {
+	resp, err := h.Client.Get(h.URL)
+	if err != nil {
+		return "", fmt.Errorf("conf: reading %s: %v", h.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("conf: reading %s: %s", h.URL, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("conf: reading %s: %v", h.URL, err)
+	}
+	return string(b), nil
+}
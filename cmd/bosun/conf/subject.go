@@ -0,0 +1,116 @@
+package conf
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	ttemplate "text/template"
+
+	"bosun.org/models"
+	"bosun.org/slog"
+)
+
+// EmailSubjectPrefixData is the data of emailSubjectPrefix templates.
+type EmailSubjectPrefixData struct {
+	// Env is the global environment setting.
+	Env string
+	// Severity is the current status of the alert key, such as critical.
+	// It is empty for emails about several alert keys, such as unknown
+	// group and action notifications.
+	Severity     string
+	Alert        string
+	AlertKey     string
+	Notification string
+}
+
+// noSubjectPrefix is the emailSubjectPrefix of notifications that override
+// the global one with none.
+const noSubjectPrefix = "none"
+
+// parseSubjectPrefix parses the emailSubjectPrefix text v. It is checked
+// once the whole configuration is loaded, by checkSubjectPrefixes.
+func (c *Conf) parseSubjectPrefix(name, v string) *ttemplate.Template {
+	t, err := ttemplate.New(name).Parse(v)
+	if err != nil {
+		c.errorf("emailSubjectPrefix: %v", err)
+	}
+	return t
+}
+
+// checkSubjectPrefixes errors if the global or a notification's
+// emailSubjectPrefix fails for an example alert key, or renders a newline
+// while subjectNewlines is reject.
+func (c *Conf) checkSubjectPrefixes() {
+	data := &EmailSubjectPrefixData{
+		Env:      c.Environment,
+		Severity: models.StCritical.String(),
+		Alert:    "alert",
+		AlertKey: "alert{host=example}",
+	}
+	check := func(what string, t *ttemplate.Template) {
+		if t == nil {
+			return
+		}
+		s, err := renderSubjectPrefix(t, data)
+		if err != nil {
+			c.errorf("%s: emailSubjectPrefix: %v", what, err)
+		}
+		if c.SubjectNewlines == SubjectNewlinesReject && strings.ContainsAny(s, "\r\n") {
+			c.errorf("%s: emailSubjectPrefix renders a newline, which subjectNewlines = %s does not allow", what, SubjectNewlinesReject)
+		}
+	}
+	check("global", c.EmailSubjectPrefix)
+	var names []string
+	for name := range c.Notifications {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		data.Notification = name
+		check("notification "+name, c.Notifications[name].EmailSubjectPrefix)
+	}
+}
+
+func renderSubjectPrefix(t *ttemplate.Template, data *EmailSubjectPrefixData) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// emailSubject returns the email subject of ni: its EmailSubject after the
+// email subject prefix of its notification, or the global one, separated by a
+// space. Newlines in the prefix are replaced with spaces, as in subjects. If
+// the prefix fails, it is logged and the subject is sent without it.
+func (ni *NotificationInstance) emailSubject() []byte {
+	n := ni.Notification
+	t := ni.Conf.EmailSubjectPrefix
+	if n.EmailSubjectPrefix != nil {
+		t = n.EmailSubjectPrefix
+	}
+	if t == nil || n.noSubjectPrefix {
+		return ni.EmailSubject
+	}
+	data := &EmailSubjectPrefixData{
+		Env:          ni.Conf.Environment,
+		AlertKey:     ni.AlertKey,
+		Notification: n.Name,
+	}
+	if ni.Status != models.StNone {
+		data.Severity = ni.Status.String()
+	}
+	if ak, err := models.ParseAlertKey(ni.AlertKey); err == nil {
+		data.Alert = ak.Name()
+	}
+	prefix, err := renderSubjectPrefix(t, data)
+	if err != nil {
+		slog.Errorf("notification %s: emailSubjectPrefix failed for alert %s: %v", n.Name, ni.AlertKey, err)
+		return ni.EmailSubject
+	}
+	prefix = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(prefix)
+	if prefix == "" {
+		return ni.EmailSubject
+	}
+	return []byte(prefix + " " + string(ni.EmailSubject))
+}
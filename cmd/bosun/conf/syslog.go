@@ -0,0 +1,221 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bosun.org/models"
+	"bosun.org/slog"
+)
+
+// syslogFacilities are the syslog facility codes by name.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverities are the syslog severity codes by name.
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3,
+	"warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// defaultSyslogSeverities are the severities of messages by the status of
+// their alert key. Messages about several alert keys, such as unknown group
+// notifications, have StNone.
+var defaultSyslogSeverities = map[models.Status]string{
+	models.StCritical: "crit",
+	models.StWarning:  "warning",
+	models.StUnknown:  "err",
+	models.StNormal:   "notice",
+	models.StNone:     "info",
+}
+
+// journaldSocket is the socket of the native protocol of the local journald.
+var journaldSocket = "/run/systemd/journal/socket"
+
+// SyslogTarget is where a syslog notification writes: the local syslog
+// daemon, a remote one, or the local journald.
+type SyslogTarget struct {
+	// Network and Addr are those of a remote syslog daemon, such as udp and
+	// logs.example.com:514. They are empty for the local daemon.
+	Network, Addr string `json:",omitempty"`
+	Journald      bool   `json:",omitempty"`
+	Facility      string
+	Tag           string
+	// Severities are the severities of messages by the status of their
+	// alert key.
+	Severities map[models.Status]string
+
+	target     string            // syslog
+	severities map[string]string // syslogSeverity, before it is parsed
+}
+
+// parseSyslogTarget parses the syslog key: local, journald, or the URL of a
+// remote syslog daemon such as udp://logs.example.com:514.
+func (c *Conf) parseSyslogTarget(t *SyslogTarget, v string) {
+	t.target = v
+	switch v {
+	case "local":
+		return
+	case "journald":
+		t.Journald = true
+		return
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		c.errorf("syslog: %v", err)
+	}
+	if (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+		c.errorf("syslog must be local, journald, or a udp:// or tcp:// URL such as udp://logs.example.com:514, not %s", v)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		u.Host += ":514"
+	}
+	t.Network, t.Addr = u.Scheme, u.Host
+}
+
+// parseSyslogSeverities parses the syslogSeverity key, such as
+// critical=alert,warning=notice, into t.
+func (c *Conf) parseSyslogSeverities(t *SyslogTarget, v string) {
+	t.severities = make(map[string]string)
+	for _, pair := range strings.Split(v, ",") {
+		sp := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(sp) != 2 {
+			c.errorf("syslogSeverity: expected status=severity, got %s", pair)
+		}
+		t.severities[strings.TrimSpace(sp[0])] = strings.TrimSpace(sp[1])
+	}
+}
+
+// loadSyslog checks the syslog settings of n and sets their defaults.
+func (c *Conf) loadSyslog(n *Notification) {
+	t := n.Syslog
+	if t.target == "" {
+		c.errorf("syslogFacility, syslogSeverity or syslogTag specified, but no syslog")
+	}
+	if t.Facility == "" {
+		t.Facility = "local6"
+	}
+	if _, ok := syslogFacilities[t.Facility]; !ok {
+		c.errorf("syslogFacility must be one of %s, not %s", syslogNames(syslogFacilities), t.Facility)
+	}
+	if t.Tag == "" {
+		t.Tag = "bosun"
+	}
+	t.Severities = make(map[models.Status]string)
+	for st, sev := range defaultSyslogSeverities {
+		t.Severities[st] = sev
+	}
+	for name, sev := range t.severities {
+		st, ok := syslogStatus(name)
+		if !ok {
+			c.errorf("syslogSeverity: unknown status %s, must be normal, warning, critical, unknown or none", name)
+		}
+		if _, ok := syslogSeverities[sev]; !ok {
+			c.errorf("syslogSeverity: %s must be one of %s, not %s", name, syslogNames(syslogSeverities), sev)
+		}
+		t.Severities[st] = sev
+	}
+}
+
+func syslogStatus(name string) (models.Status, bool) {
+	for st := range defaultSyslogSeverities {
+		if st.String() == name {
+			return st, true
+		}
+	}
+	return models.StNone, false
+}
+
+// syslogCode is a facility or severity name and its code.
+type syslogCode struct {
+	name string
+	code int
+}
+
+// syslogCodes sorts syslogCodes by code.
+type syslogCodes []syslogCode
+
+func (s syslogCodes) Len() int           { return len(s) }
+func (s syslogCodes) Less(i, j int) bool { return s[i].code < s[j].code }
+func (s syslogCodes) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func syslogNames(m map[string]int) string {
+	codes := make(syslogCodes, 0, len(m))
+	for name, code := range m {
+		codes = append(codes, syslogCode{name, code})
+	}
+	sort.Sort(codes)
+	names := make([]string, len(codes))
+	for i, c := range codes {
+		names[i] = c.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// doSyslog writes the payload of ni, executed through the body template, to
+// the syslog target of n, with the severity of the status of ni.
+func (n *Notification) doSyslog(ni *NotificationInstance) error {
+	t := n.Syslog
+	msg, _, err := n.limitBody("syslog", ni.AlertKey, ni.Payload(), func(payload []byte) ([]byte, bool, error) {
+		return n.executeBodyTemplate(ni.cache, payload, ni.AlertKey)
+	})
+	if err != nil {
+		return err
+	}
+	facility := syslogFacilities[t.Facility]
+	severity := syslogSeverities[t.Severities[ni.Status]]
+	if t.Journald {
+		err = writeJournald(facility, severity, t.Tag, ni, msg)
+	} else {
+		err = writeSyslog(t.Network, t.Addr, facility, severity, t.Tag, string(msg))
+	}
+	if err != nil {
+		err = fmt.Errorf("notification %s: syslog write failed for %s: %v", n.Name, ni.AlertKey, err)
+		slog.Errorln(err)
+		return err
+	}
+	return nil
+}
+
+// writeJournald sends msg to the local journald with the native protocol,
+// with the alert key and status of ni as fields.
+func writeJournald(facility, severity int, tag string, ni *NotificationInstance, msg []byte) error {
+	buf := new(bytes.Buffer)
+	field := func(k string, v []byte) {
+		if !bytes.ContainsRune(v, '\n') {
+			fmt.Fprintf(buf, "%s=%s\n", k, v)
+			return
+		}
+		// Values with newlines are written as the name, a newline, the
+		// length as a little-endian uint64, and the value.
+		buf.WriteString(k + "\n")
+		binary.Write(buf, binary.LittleEndian, uint64(len(v)))
+		buf.Write(v)
+		buf.WriteByte('\n')
+	}
+	field("MESSAGE", msg)
+	field("PRIORITY", []byte(strconv.Itoa(severity)))
+	field("SYSLOG_FACILITY", []byte(strconv.Itoa(facility)))
+	field("SYSLOG_IDENTIFIER", []byte(tag))
+	field("BOSUN_ALERT_KEY", []byte(ni.AlertKey))
+	if ni.Status != models.StNone {
+		field("BOSUN_STATUS", []byte(ni.Status.String()))
+	}
+	conn, err := net.Dial("unixgram", journaldSocket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,19 @@
+// +build !windows,!nacl,!plan9
+
+package conf
+
+import "log/syslog"
+
+// writeSyslog writes msg to the syslog daemon at addr, or the local one if
+// network is empty.
+func writeSyslog(network, addr string, facility, severity int, tag, msg string) error {
+	w, err := syslog.Dial(network, addr, syslog.Priority(facility<<3|severity), tag)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,7 @@
+package conf
+
+import "fmt"
+
+func writeSyslog(network, addr string, facility, severity int, tag, msg string) error {
+	return fmt.Errorf("syslog is not supported on this platform")
+}
@@ -0,0 +1,94 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+
+	"bosun.org/opentsdb"
+)
+
+// TagPolicy is how tag sets are normalized before squelches and lookups
+// match them, set by the tagNormalization setting. The zero TagPolicy, the
+// default, leaves tags as they are. Tags are always trimmed of surrounding
+// spaces when they are parsed.
+type TagPolicy struct {
+	LowerKeys   bool `json:",omitempty"`
+	LowerValues bool `json:",omitempty"`
+}
+
+// parseTagPolicy parses a tagNormalization setting: none, or a comma-separated
+// list of lowercaseKeys and lowercaseValues.
+func parseTagPolicy(v string) (TagPolicy, error) {
+	var p TagPolicy
+	if v == "none" {
+		return p, nil
+	}
+	for _, s := range strings.Split(v, ",") {
+		switch strings.TrimSpace(s) {
+		case "lowercaseKeys":
+			p.LowerKeys = true
+		case "lowercaseValues":
+			p.LowerValues = true
+		default:
+			return p, fmt.Errorf("tagNormalization must be none or a list of lowercaseKeys and lowercaseValues, not %s", s)
+		}
+	}
+	return p, nil
+}
+
+// NormalizeTagSet returns tags with surrounding spaces trimmed from keys and
+// values, and lowercased as p requires. tags is returned as is if p is the
+// zero TagPolicy.
+func (p TagPolicy) NormalizeTagSet(tags opentsdb.TagSet) opentsdb.TagSet {
+	if p == (TagPolicy{}) || tags == nil {
+		return tags
+	}
+	n := make(opentsdb.TagSet, len(tags))
+	for k, v := range tags {
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if p.LowerKeys {
+			k = strings.ToLower(k)
+		}
+		if p.LowerValues {
+			v = strings.ToLower(v)
+		}
+		n[k] = v
+	}
+	return n
+}
+
+// ValidateTagSet returns an error if tags, as written in the configuration,
+// has an empty key or value, or keys that p makes the same, such as Host and
+// host with lowercaseKeys.
+func (p TagPolicy) ValidateTagSet(tags opentsdb.TagSet) error {
+	seen := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if strings.TrimSpace(k) == "" {
+			return fmt.Errorf("empty tag key")
+		}
+		if strings.TrimSpace(v) == "" {
+			return fmt.Errorf("empty value of tag %s", k)
+		}
+		nk := strings.TrimSpace(k)
+		if p.LowerKeys {
+			nk = strings.ToLower(nk)
+		}
+		if other, ok := seen[nk]; ok {
+			return fmt.Errorf("tags %s and %s are the same once normalized", other, k)
+		}
+		seen[nk] = k
+	}
+	return nil
+}
+
+// normalizeTags validates and normalizes tags, parsed from the configuration,
+// with the tagNormalization policy. Without one, tags are left as they are.
+func (c *Conf) normalizeTags(tags opentsdb.TagSet) opentsdb.TagSet {
+	if c.TagPolicy == (TagPolicy{}) {
+		return tags
+	}
+	if err := c.TagPolicy.ValidateTagSet(tags); err != nil {
+		c.error(err)
+	}
+	return c.TagPolicy.NormalizeTagSet(tags)
+}
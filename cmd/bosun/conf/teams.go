@@ -0,0 +1,186 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"bosun.org/models"
+	"bosun.org/slog"
+	"golang.org/x/net/context"
+)
+
+// maxTeamsCard is the size of the largest message a Teams connector accepts.
+const maxTeamsCard = 28 << 10
+
+// TeamsCard is the MessageCard a teams notification posts to a Microsoft
+// Teams connector.
+type TeamsCard struct {
+	Type            string         `json:"@type"`
+	Context         string         `json:"@context"`
+	Summary         string         `json:"summary"`
+	Title           string         `json:"title,omitempty"`
+	ThemeColor      string         `json:"themeColor,omitempty"`
+	Sections        []TeamsSection `json:"sections,omitempty"`
+	PotentialAction []TeamsAction  `json:"potentialAction,omitempty"`
+}
+
+type TeamsSection struct {
+	ActivityTitle    string      `json:"activityTitle,omitempty"`
+	ActivitySubtitle string      `json:"activitySubtitle,omitempty"`
+	Text             string      `json:"text,omitempty"`
+	Facts            []TeamsFact `json:"facts,omitempty"`
+}
+
+type TeamsFact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// TeamsAction is an OpenUri action, a button opening its targets.
+type TeamsAction struct {
+	Type    string        `json:"@type"`
+	Name    string        `json:"name"`
+	Targets []TeamsTarget `json:"targets"`
+}
+
+type TeamsTarget struct {
+	OS  string `json:"os"`
+	URI string `json:"uri"`
+}
+
+// parseTeamsURL returns the connector webhook URL v of the teams key.
+func (c *Conf) parseTeamsURL(v string) *url.URL {
+	u, err := url.Parse(v)
+	if err != nil {
+		c.errorf("teams: %v", err)
+	}
+	if !u.IsAbs() || u.Host == "" {
+		c.errorf("teams must be the absolute URL of a connector webhook, such as https://example.webhook.office.com/webhookb2/...")
+	}
+	return u
+}
+
+// teamsCard returns the card of ni: its subject as the title, the color of its
+// status from the severityColors as the theme color, its payload
+// executed through the body template as the text, the tags of the alert key
+// as facts, and a button linking to the alert key in bosun. The BodyError
+// policy applies to the body template.
+func (n *Notification) teamsCard(ni *NotificationInstance) (*TeamsCard, error) {
+	text, _, err := n.limitBody("teams", ni.AlertKey, ni.Payload(), func(payload []byte) ([]byte, bool, error) {
+		return n.executeBodyTemplate(ni.cache, payload, ni.AlertKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+	card := &TeamsCard{
+		Type:    "MessageCard",
+		Context: "https://schema.org/extensions",
+		Summary: ni.Subject,
+		Title:   ni.Subject,
+	}
+	if sev := ni.Conf.Severity(ni.Status); sev != nil {
+		card.ThemeColor = strings.TrimPrefix(sev.Color, "#")
+	}
+	section := TeamsSection{
+		ActivityTitle: ni.AlertKey,
+		Text:          string(text),
+	}
+	if ni.Status != models.StNone {
+		section.ActivitySubtitle = ni.Status.String()
+	}
+	if ak, err := models.ParseAlertKey(ni.AlertKey); err == nil {
+		section.ActivityTitle = ak.Name()
+		tags := ak.Group()
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			section.Facts = append(section.Facts, TeamsFact{k, tags[k]})
+		}
+		if n.makeLink != nil {
+			card.PotentialAction = []TeamsAction{{
+				Type: "OpenUri",
+				Name: "View in Bosun",
+				Targets: []TeamsTarget{{
+					OS: "default",
+					URI: n.makeLink("/action", &url.Values{
+						"type": []string{"ack"},
+						"key":  []string{ni.AlertKey},
+					}),
+				}},
+			}}
+		}
+	}
+	card.Sections = []TeamsSection{section}
+	if card.Summary == "" {
+		// Teams rejects cards without a summary or text.
+		card.Summary = section.ActivityTitle
+	}
+	return card, nil
+}
+
+// validTeamsCard returns an error unless b is a MessageCard Teams accepts:
+// a JSON object of at most maxTeamsCard bytes with a type, a context and a
+// summary or text.
+func validTeamsCard(b []byte) error {
+	if len(b) > maxTeamsCard {
+		return fmt.Errorf("card is %d bytes, more than the %d Teams accepts", len(b), maxTeamsCard)
+	}
+	var card map[string]interface{}
+	if err := json.Unmarshal(b, &card); err != nil {
+		return fmt.Errorf("card is not a JSON object: %v", err)
+	}
+	for _, k := range []string{"@type", "@context"} {
+		if s, _ := card[k].(string); s == "" {
+			return fmt.Errorf("card has no %s", k)
+		}
+	}
+	summary, _ := card["summary"].(string)
+	text, _ := card["text"].(string)
+	if summary == "" && text == "" {
+		return fmt.Errorf("card has no summary or text")
+	}
+	return nil
+}
+
+func (n *Notification) doTeams(ctx context.Context, ni *NotificationInstance) error {
+	card, err := n.teamsCard(ni)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(card)
+	if err == nil {
+		err = validTeamsCard(b)
+	}
+	if err != nil {
+		err = fmt.Errorf("notification %s: invalid Teams card for alert %s: %v", n.Name, ni.AlertKey, err)
+		slog.Errorln(err)
+		return err
+	}
+	req, err := http.NewRequest("POST", n.Teams.String(), bytes.NewReader(b))
+	if err != nil {
+		slog.Error(err)
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.do(ctx, req)
+	if err != nil {
+		slog.Error(err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		err := newResponseError("teams", resp)
+		slog.Errorln(err)
+		return err
+	}
+	slog.Infof("teams notification successful for alert %s. Response code %d.", ni.AlertKey, resp.StatusCode)
+	return nil
+}
@@ -0,0 +1,28 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ExpandTrace returns the text of the named alert after macro and variable
+// expansion, as it was loaded. Each line is annotated with the location it was
+// defined at and, if it was included by a macro, the innermost such macro.
+func (c *Conf) ExpandTrace(name string) (string, error) {
+	a := c.Alerts[name]
+	if a == nil {
+		return "", fmt.Errorf("unknown alert: %s", name)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "alert %s {\n", name)
+	for _, p := range a.expanded {
+		loc, _ := c.tree.ErrorContext(p.node)
+		fmt.Fprintf(&b, "\t%s = %s\t# %s", p.key, p.val, loc)
+		if p.macro != "" {
+			fmt.Fprintf(&b, ", macro %s", p.macro)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("}\n")
+	return b.String(), nil
+}
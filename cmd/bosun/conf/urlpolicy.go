@@ -0,0 +1,144 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// defaultNotificationSchemes are the notification URL schemes allowed unless
+// notificationSchemes is set.
+var defaultNotificationSchemes = []string{"http", "https"}
+
+// lookupIP resolves the host of notification URLs for DenyPrivateURLs.
+var lookupIP = net.LookupIP
+
+// checkNotificationURLs errors if a notification posts to, gets, sends
+// Teams cards or sends events to a URL whose scheme is not in NotificationSchemes, or, with
+// DenyPrivateURLs, whose host is or resolves to a loopback, private,
+// link-local or unspecified address.
+// Host names are resolved once, here, so the check is meant to keep less
+// trusted configuration authors honest rather than stop DNS changes made
+// after the configuration is loaded. Event URLs are templates, so doEvent
+// checks each URL it renders again with checkURL.
+func (c *Conf) checkNotificationURLs() {
+	if c.NotificationSchemes == nil {
+		c.NotificationSchemes = defaultNotificationSchemes
+	}
+	var names []string
+	for name := range c.Notifications {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n := c.Notifications[name]
+		var event *url.URL
+		if n.Event != nil {
+			// Event URLs are templates: the URL rendered at load is
+			// checked.
+			event = n.Event.url
+		}
+		for _, u := range []struct {
+			key string
+			url *url.URL
+		}{
+			{"post", n.Post},
+			{"get", n.Get},
+			{"teams", n.Teams},
+			{"event", event},
+		} {
+			if u.url == nil {
+				continue
+			}
+			if err := c.checkURL(u.url); err != nil {
+				c.errorf("notification %s: %s URL %v", name, u.key, err)
+			}
+		}
+	}
+}
+
+// checkURL returns an error if the scheme of u is not in
+// NotificationSchemes, or, with DenyPrivateURLs, if its host is not public.
+func (c *Conf) checkURL(u *url.URL) error {
+	if !c.allowedScheme(u.Scheme) {
+		return fmt.Errorf("scheme %q is not allowed, must be one of %s", u.Scheme, strings.Join(c.NotificationSchemes, ", "))
+	}
+	if c.DenyPrivateURLs {
+		return checkPublicHost(urlHost(u))
+	}
+	return nil
+}
+
+// urlHost returns the host of u without its port or the brackets of an IPv6
+// address.
+func urlHost(u *url.URL) string {
+	if host, _, err := net.SplitHostPort(u.Host); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(u.Host, "["), "]")
+}
+
+func (c *Conf) allowedScheme(scheme string) bool {
+	for _, s := range c.NotificationSchemes {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// privateNets are the private address ranges of RFC 1918 and RFC 4193.
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func isPrivate(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPublicHost returns an error if host is, or resolves to, an address
+// that is not publicly routable.
+func checkPublicHost(host string) error {
+	if h := strings.ToLower(strings.TrimSuffix(host, ".")); h == "localhost" || strings.HasSuffix(h, ".localhost") {
+		return fmt.Errorf("host %s is loopback", host)
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = lookupIP(host); err != nil {
+			return fmt.Errorf("host %s could not be resolved: %v", host, err)
+		}
+	}
+	for _, ip := range ips {
+		var kind string
+		switch {
+		case ip.IsLoopback():
+			kind = "loopback"
+		case isPrivate(ip):
+			kind = "private"
+		case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+			kind = "link-local"
+		case ip.IsUnspecified():
+			kind = "unspecified"
+		default:
+			continue
+		}
+		return fmt.Errorf("host %s has %s address %v", host, kind, ip)
+	}
+	return nil
+}
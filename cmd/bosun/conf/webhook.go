@@ -0,0 +1,95 @@
+package conf
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	defaultWebhookMaxIdleConnsPerHost = 10
+	defaultWebhookDialTimeout         = 30 * time.Second
+	// defaultWebhookTimeout bounds requests so that a hung endpoint does not
+	// leave deliveries in flight forever.
+	defaultWebhookTimeout = 30 * time.Second
+)
+
+// webhookClient is the HTTP client shared by the post and get notifications
+// of a configuration, so that connections to their hosts are kept open and
+// reused between deliveries. It is set up by loadWebhookClient once all the
+// globals are known; notifications, and the copies alerts make of them, point
+// to it from when they are loaded.
+type webhookClient struct {
+	client *http.Client
+	// timeout is the request timeout of notifications without their own.
+	timeout time.Duration
+}
+
+func (c *Conf) loadWebhookClient() {
+	if c.WebhookMaxIdleConnsPerHost == 0 {
+		c.WebhookMaxIdleConnsPerHost = defaultWebhookMaxIdleConnsPerHost
+	}
+	if c.WebhookDialTimeout == 0 {
+		c.WebhookDialTimeout = defaultWebhookDialTimeout
+	}
+	if c.WebhookTimeout == 0 {
+		c.WebhookTimeout = defaultWebhookTimeout
+	}
+	c.webhook.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: (&net.Dialer{
+				Timeout:   c.WebhookDialTimeout,
+				KeepAlive: 30 * time.Second,
+			}).Dial,
+			MaxIdleConnsPerHost: c.WebhookMaxIdleConnsPerHost,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+	c.webhook.timeout = c.WebhookTimeout
+}
+
+// do sends req with the notification's basic auth credentials, if any,
+// through the shared webhook client. The request, including reading the
+// response body, is cancelled when ctx is done or after the notification's
+// request timeout.
+func (n *Notification) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if n.user != "" {
+		req.SetBasicAuth(n.user, n.password)
+	}
+	client := http.DefaultClient
+	timeout := n.RequestTimeout
+	if n.webhook != nil && n.webhook.client != nil {
+		client = n.webhook.client
+		if timeout == 0 {
+			timeout = n.webhook.timeout
+		}
+	}
+	if timeout <= 0 {
+		return ctxhttp.Do(ctx, client, req)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	resp, err := ctxhttp.Do(ctx, client, req)
+	if err != nil {
+		cancel()
+		return resp, err
+	}
+	resp.Body = cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelBody cancels the context of its request once it is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
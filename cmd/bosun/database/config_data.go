@@ -3,17 +3,32 @@ package database
 import (
 	"crypto/md5"
 	"encoding/base64"
+	"encoding/json"
 
+	"github.com/bradfitz/slice"
 	"github.com/garyburd/redigo/redis"
 
 	"bosun.org/collect"
+	"bosun.org/models"
 	"bosun.org/opentsdb"
 	"bosun.org/slog"
 )
 
+/*
+
+ConfigSnapshots : hash of snapshot name - json of snapshot. Snapshots do not expire.
+
+*/
+
+const configSnapshotHash = "ConfigSnapshots"
+
 type ConfigDataAccess interface {
 	SaveTempConfig(text string) (hash string, err error)
 	GetTempConfig(hash string) (text string, err error)
+
+	SaveConfigSnapshot(s *models.ConfigSnapshot) error
+	GetConfigSnapshot(name string) (*models.ConfigSnapshot, error)
+	ListConfigSnapshots() ([]*models.ConfigSnapshot, error)
 }
 
 func (d *dataAccess) Configs() ConfigDataAccess {
@@ -22,6 +37,8 @@ func (d *dataAccess) Configs() ConfigDataAccess {
 
 const configLifetime = 60 * 24 * 14 // 2 weeks
 
+// SaveTempConfig stores text under a hash of its content. Saving text that is
+// already stored does not rewrite it, and only extends its lifetime.
 func (d *dataAccess) SaveTempConfig(text string) (string, error) {
 	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "SaveTempConfig"})()
 	conn := d.GetConnection()
@@ -29,11 +46,16 @@ func (d *dataAccess) SaveTempConfig(text string) (string, error) {
 
 	sig := md5.Sum([]byte(text))
 	b64 := base64.StdEncoding.EncodeToString(sig[0:8])
+	key := "tempConfig:" + b64
+	if existing, err := redis.String(conn.Do("GET", key)); err == nil && existing == text {
+		_, err = conn.Do("EXPIRE", key, configLifetime)
+		return b64, slog.Wrap(err)
+	}
 	if d.isRedis {
-		_, err := conn.Do("SET", "tempConfig:"+b64, text, "EX", configLifetime)
+		_, err := conn.Do("SET", key, text, "EX", configLifetime)
 		return b64, slog.Wrap(err)
 	}
-	_, err := conn.Do("SETEX", "tempConfig:"+b64, configLifetime, text)
+	_, err := conn.Do("SETEX", key, configLifetime, text)
 	return b64, slog.Wrap(err)
 }
 
@@ -50,3 +72,60 @@ func (d *dataAccess) GetTempConfig(hash string) (string, error) {
 	_, err = conn.Do("EXPIRE", key, configLifetime)
 	return dat, slog.Wrap(err)
 }
+
+// SaveConfigSnapshot stores s under its name, replacing any snapshot of the
+// same name.
+func (d *dataAccess) SaveConfigSnapshot(s *models.ConfigSnapshot) error {
+	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "SaveConfigSnapshot"})()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	dat, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("HSET", configSnapshotHash, s.Name, dat)
+	return slog.Wrap(err)
+}
+
+// GetConfigSnapshot returns the snapshot called name, or nil if there is none.
+func (d *dataAccess) GetConfigSnapshot(name string) (*models.ConfigSnapshot, error) {
+	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "GetConfigSnapshot"})()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	dat, err := redis.Bytes(conn.Do("HGET", configSnapshotHash, name))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, slog.Wrap(err)
+	}
+	s := &models.ConfigSnapshot{}
+	if err := json.Unmarshal(dat, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ListConfigSnapshots returns every snapshot, most recent first.
+func (d *dataAccess) ListConfigSnapshots() ([]*models.ConfigSnapshot, error) {
+	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "ListConfigSnapshots"})()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	m, err := redis.StringMap(conn.Do("HGETALL", configSnapshotHash))
+	if err != nil {
+		return nil, slog.Wrap(err)
+	}
+	snapshots := make([]*models.ConfigSnapshot, 0, len(m))
+	for _, j := range m {
+		s := &models.ConfigSnapshot{}
+		if err := json.Unmarshal([]byte(j), s); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+	slice.Sort(snapshots, func(i, j int) bool { return snapshots[i].Time.After(snapshots[j].Time) })
+	return snapshots, nil
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -19,10 +20,16 @@ pendingNotifications: ZSET timestamp ak:notification
 
 notsByAlert:alert SET of notifications possible per alert. used to clear alerts by alert key
 
+notificationJournal: HASH entry key -> JSON NotificationJournalEntry of notifications queued but not yet sent
+
+notificationsSent: ZSET timestamp entry key of notifications sent, trimmed to the journal retention
+
 */
 
 const (
 	pendingNotificationsKey = "pendingNotifications"
+	notificationJournalKey  = "notificationJournal"
+	notificationsSentKey    = "notificationsSent"
 )
 
 func notsByAlertKeyKey(ak models.AlertKey) string {
@@ -41,6 +48,22 @@ type NotificationDataAccess interface {
 	ClearNotifications(ak models.AlertKey) error
 
 	GetNextNotificationTime() (time.Time, error)
+
+	// JournalNotification records that the notification of e is owed until
+	// MarkNotificationSent is called for it.
+	JournalNotification(e *models.NotificationJournalEntry) error
+	// MarkNotificationSent removes e from the journal and records that its
+	// notification was sent, or deliberately not sent, at t.
+	MarkNotificationSent(e *models.NotificationJournalEntry, t time.Time) error
+	// GetJournaledNotifications returns the entries not yet marked sent.
+	GetJournaledNotifications() ([]*models.NotificationJournalEntry, error)
+	// GetNotificationSentTime returns when the notification of e was last
+	// sent, or the zero time if it was not sent since the journal was
+	// last pruned.
+	GetNotificationSentTime(e *models.NotificationJournalEntry) (time.Time, error)
+	// PruneNotificationJournal removes the entries queued and the sent
+	// records made before t.
+	PruneNotificationJournal(t time.Time) error
 }
 
 func (d *dataAccess) Notifications() NotificationDataAccess {
@@ -131,3 +154,90 @@ func (d *dataAccess) GetNextNotificationTime() (time.Time, error) {
 	}
 	return t, nil
 }
+
+func (d *dataAccess) JournalNotification(e *models.NotificationJournalEntry) error {
+	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "JournalNotification"})()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return slog.Wrap(err)
+	}
+	_, err = conn.Do("HSET", notificationJournalKey, e.Key(), b)
+	return slog.Wrap(err)
+}
+
+func (d *dataAccess) MarkNotificationSent(e *models.NotificationJournalEntry, t time.Time) error {
+	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "MarkNotificationSent"})()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	// The sent record is added first: an entry left in the journal by a
+	// crash in between is then known to have been sent.
+	if _, err := conn.Do("ZADD", notificationsSentKey, t.UTC().Unix(), e.Key()); err != nil {
+		return slog.Wrap(err)
+	}
+	_, err := conn.Do("HDEL", notificationJournalKey, e.Key())
+	return slog.Wrap(err)
+}
+
+func (d *dataAccess) GetJournaledNotifications() ([]*models.NotificationJournalEntry, error) {
+	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "GetJournaledNotifications"})()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	m, err := redis.StringMap(conn.Do("HGETALL", notificationJournalKey))
+	if err != nil {
+		return nil, slog.Wrap(err)
+	}
+	entries := make([]*models.NotificationJournalEntry, 0, len(m))
+	for key, v := range m {
+		e := &models.NotificationJournalEntry{}
+		if err := json.Unmarshal([]byte(v), e); err != nil {
+			slog.Errorf("bad notification journal entry %s: %v", key, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (d *dataAccess) GetNotificationSentTime(e *models.NotificationJournalEntry) (time.Time, error) {
+	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "GetNotificationSentTime"})()
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	ts, err := redis.Int64(conn.Do("ZSCORE", notificationsSentKey, e.Key()))
+	if err == redis.ErrNil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, slog.Wrap(err)
+	}
+	return time.Unix(ts, 0).UTC(), nil
+}
+
+func (d *dataAccess) PruneNotificationJournal(t time.Time) error {
+	defer collect.StartTimer("redis", opentsdb.TagSet{"op": "PruneNotificationJournal"})()
+	entries, err := d.GetJournaledNotifications()
+	if err != nil {
+		return err
+	}
+	conn := d.GetConnection()
+	defer conn.Close()
+
+	args := []interface{}{notificationJournalKey}
+	for _, e := range entries {
+		if e.Time.Before(t) {
+			args = append(args, e.Key())
+		}
+	}
+	if len(args) > 1 {
+		if _, err := conn.Do("HDEL", args...); err != nil {
+			return slog.Wrap(err)
+		}
+	}
+	_, err = conn.Do("ZREMRANGEBYSCORE", notificationsSentKey, 0, t.UTC().Unix()-1)
+	return slog.Wrap(err)
+}
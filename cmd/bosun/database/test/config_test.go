@@ -1,6 +1,11 @@
 package dbtest
 
-import "testing"
+import (
+	"testing"
+	"time"
+
+	"bosun.org/models"
+)
 
 func TestConfigSave(t *testing.T) {
 	cd := testData.Configs()
@@ -13,4 +18,38 @@ func TestConfigSave(t *testing.T) {
 	if recoverd != "test123" {
 		t.Fatalf("Loaded config doesn't match: %s", recoverd)
 	}
+
+	again, err := cd.SaveTempConfig("test123")
+	check(t, err)
+	if again != hash {
+		t.Fatalf("Saving identical config gave hash %s, expected %s", again, hash)
+	}
+}
+
+func TestConfigSnapshots(t *testing.T) {
+	cd := testData.Configs()
+
+	missing, err := cd.GetConfigSnapshot("missing")
+	check(t, err)
+	if missing != nil {
+		t.Fatalf("Expected no snapshot, got %v", missing)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	first := &models.ConfigSnapshot{Name: "good", User: "u", Time: now.Add(-time.Hour), Text: "a"}
+	second := &models.ConfigSnapshot{Name: "better", User: "u", Time: now, Text: "b"}
+	check(t, cd.SaveConfigSnapshot(first))
+	check(t, cd.SaveConfigSnapshot(second))
+
+	got, err := cd.GetConfigSnapshot("good")
+	check(t, err)
+	if got == nil || got.Text != "a" || !got.Time.Equal(first.Time) {
+		t.Fatalf("Loaded snapshot doesn't match: %v", got)
+	}
+
+	list, err := cd.ListConfigSnapshots()
+	check(t, err)
+	if len(list) < 2 || list[0].Name != "better" {
+		t.Fatalf("Expected most recent snapshot first, got %v", list)
+	}
 }
@@ -62,6 +62,12 @@ var Elastic = map[string]parse.Func{
 		Return: models.TypeESIndexer,
 		F:      ESLS,
 	},
+	"espattern": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString},
+		Return: models.TypeESIndexer,
+		F:      ESPattern,
+		Check:  esPatternCheck,
+	},
 
 	// Funcs for generate elastic queries (ESQuery Type) to further filter results
 	"esall": {
@@ -301,6 +307,9 @@ func (r *ElasticRequest) CacheKey() (string, error) {
 // timeESRequest execute the elasticsearch query (which may set or hit cache) and returns
 // the search results.
 func timeESRequest(e *State, T miniprofiler.Timer, req *ElasticRequest) (resp *elastic.SearchResult, err error) {
+	if err := e.checkEnabled(BackendElastic); err != nil {
+		return nil, err
+	}
 	e.elasticQueries = append(e.elasticQueries, *req.Source)
 	var source interface{}
 	source, err = req.Source.Source()
@@ -318,6 +327,7 @@ func timeESRequest(e *State, T miniprofiler.Timer, req *ElasticRequest) (resp *e
 		var val interface{}
 		val, err = e.Cache.Get(string(b), getFn)
 		resp = val.(*elastic.SearchResult)
+		e.backendFailed = e.backendFailed || err != nil
 	})
 	return
 }
@@ -339,6 +349,67 @@ func ESLS(e *State, T miniprofiler.Timer, indexRoot string) (*Results, error) {
 	return ESDaily(e, T, "@timestamp", indexRoot+"-", "2006.01.02")
 }
 
+// ESPattern returns an indexer that expands pattern, an index name with a Go
+// time layout between braces such as "logstash-{2006.01.02}", into one index
+// per period of the query's time range. Unlike esdaily it does not list the
+// indices of the cluster, so indices that don't exist are passed through to
+// elastic.
+func ESPattern(e *State, T miniprofiler.Timer, timeField, pattern string) (*Results, error) {
+	var r Results
+	prefix, layout, suffix, err := parseIndexPattern(pattern)
+	if err != nil {
+		return &r, err
+	}
+	indexer := ESIndexer{}
+	indexer.TimeField = timeField
+	indexer.Generate = func(start, end *time.Time) ([]string, error) {
+		return expandIndexPattern(prefix, layout, suffix, *start, *end), nil
+	}
+	r.Results = append(r.Results, &Result{Value: indexer})
+	return &r, nil
+}
+
+func esPatternCheck(t *parse.Tree, f *parse.FuncNode) error {
+	if n, ok := f.Args[1].(*parse.StringNode); ok {
+		if _, _, _, err := parseIndexPattern(n.Text); err != nil {
+			return fmt.Errorf("expr: espattern: %v", err)
+		}
+	}
+	return nil
+}
+
+// parseIndexPattern splits pattern around its single {layout} element.
+func parseIndexPattern(pattern string) (prefix, layout, suffix string, err error) {
+	i := strings.Index(pattern, "{")
+	j := strings.Index(pattern, "}")
+	if i < 0 || j < i || strings.Count(pattern, "{") != 1 || strings.Count(pattern, "}") != 1 {
+		return "", "", "", fmt.Errorf("index pattern %q must contain exactly one {layout} element", pattern)
+	}
+	prefix, layout, suffix = pattern[:i], pattern[i+1:j], pattern[j+1:]
+	// A layout without any time elements formats to itself.
+	if time.Date(2001, 3, 4, 5, 6, 7, 0, time.UTC).Format(layout) == layout {
+		return "", "", "", fmt.Errorf("index pattern %q: layout %q has no time elements", pattern, layout)
+	}
+	return prefix, layout, suffix, nil
+}
+
+// expandIndexPattern returns the distinct index names that cover the UTC time
+// range [start, end], in order. Names are generated hourly, which covers any
+// layout down to hourly indices.
+func expandIndexPattern(prefix, layout, suffix string, start, end time.Time) []string {
+	var indices []string
+	seen := make(map[string]bool)
+	end = end.UTC()
+	for t := start.UTC().Truncate(time.Hour); !t.After(end); t = t.Add(time.Hour) {
+		index := prefix + t.Format(layout) + suffix
+		if !seen[index] {
+			seen[index] = true
+			indices = append(indices, index)
+		}
+	}
+	return indices
+}
+
 func ESDaily(e *State, T miniprofiler.Timer, timeField, indexRoot, layout string) (*Results, error) {
 	var r Results
 	err := e.ElasticHosts.InitClient()
@@ -0,0 +1,41 @@
+package expr
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExpandIndexPattern(t *testing.T) {
+	start := time.Date(2016, time.January, 30, 22, 30, 0, 0, time.UTC)
+	tests := []struct {
+		pattern string
+		dur     time.Duration
+		expect  []string // nil for a pattern error
+	}{
+		{"logstash-{2006.01.02}", time.Hour, []string{"logstash-2016.01.30"}},
+		{"logstash-{2006.01.02}", 3 * 24 * time.Hour, []string{"logstash-2016.01.30", "logstash-2016.01.31", "logstash-2016.02.01", "logstash-2016.02.02"}},
+		{"logs-{2006.01}-v2", 3 * 24 * time.Hour, []string{"logs-2016.01-v2", "logs-2016.02-v2"}},
+		{"logs-{2006.01.02.15}", 2 * time.Hour, []string{"logs-2016.01.30.22", "logs-2016.01.30.23", "logs-2016.01.31.00"}},
+		{"logstash", time.Hour, nil},
+		{"logstash-{day}", time.Hour, nil},
+		{"logstash-{2006}-{01}", time.Hour, nil},
+	}
+	for _, test := range tests {
+		prefix, layout, suffix, err := parseIndexPattern(test.pattern)
+		if test.expect == nil {
+			if err == nil {
+				t.Errorf("%v: expected error", test.pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.pattern, err)
+			continue
+		}
+		got := expandIndexPattern(prefix, layout, suffix, start, start.Add(test.dur))
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("%v: expected %v, got %v", test.pattern, test.expect, got)
+		}
+	}
+}
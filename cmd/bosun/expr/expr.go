@@ -20,15 +20,18 @@ import (
 	"github.com/MiniProfiler/go/miniprofiler"
 	"github.com/influxdata/influxdb/client"
 	elasticOld "github.com/olivere/elastic"
+	"golang.org/x/net/context"
 	elastic "gopkg.in/olivere/elastic.v3"
 )
 
 type State struct {
 	*Expr
+	ctx                context.Context
 	now                time.Time
 	enableComputations bool
 	unjoinedOk         bool
 	autods             int
+	downsample         string
 	vValue             float64
 
 	*Backends
@@ -44,6 +47,9 @@ type State struct {
 	elasticQueries []elastic.SearchSource
 	// OpenTSDB
 	tsdbQueries []opentsdb.Request
+
+	// backendFailed is set when a query to any backend returns an error.
+	backendFailed bool
 }
 
 type Backends struct {
@@ -52,6 +58,27 @@ type Backends struct {
 	LogstashHosts   LogstashElasticHosts
 	ElasticHosts    ElasticHosts
 	InfluxConfig    client.Config
+
+	// Disabled holds the reason each backend, by name, is in maintenance.
+	// Queries to these backends fail with a *BackendDisabledError.
+	Disabled map[string]string
+}
+
+// Names of the query backends, as used in Backends.Disabled.
+const (
+	BackendTSDB     = "tsdb"
+	BackendGraphite = "graphite"
+	BackendInflux   = "influx"
+	BackendLogstash = "logstash"
+	BackendElastic  = "elastic"
+)
+
+// checkEnabled returns a *BackendDisabledError if backend is in maintenance.
+func (b *Backends) checkEnabled(backend string) error {
+	if reason, ok := b.Disabled[backend]; ok {
+		return &BackendDisabledError{Backend: backend, Reason: reason}
+	}
+	return nil
 }
 
 type BosunProviders struct {
@@ -65,10 +92,33 @@ type BosunProviders struct {
 // This facilitates alerts referencing other alerts, even when they go unknown or unevaluated.
 type AlertStatusProvider interface {
 	GetUnknownAndUnevaluatedAlertKeys(alertName string) (unknown, unevaluated []models.AlertKey)
+	GetAlertStatuses(alertName string) map[models.AlertKey]models.Status
 }
 
 var ErrUnknownOp = fmt.Errorf("expr: unknown op type")
 
+// BackendError is the error of an evaluation during which a query to a
+// backend failed, as opposed to one that failed because of the expression or
+// the data returned. Err is the error that stopped evaluation.
+type BackendError struct {
+	Err error
+}
+
+func (b *BackendError) Error() string {
+	return b.Err.Error()
+}
+
+// BackendDisabledError is the error of a query to a backend that is in
+// maintenance. The query is not sent.
+type BackendDisabledError struct {
+	Backend string
+	Reason  string
+}
+
+func (b *BackendDisabledError) Error() string {
+	return fmt.Sprintf("backend %s in maintenance: %s", b.Backend, b.Reason)
+}
+
 type Expr struct {
 	*parse.Tree
 }
@@ -93,6 +143,20 @@ func New(expr string, funcs ...map[string]parse.Func) (*Expr, error) {
 // Execute applies a parse expression to the specified OpenTSDB context, and
 // returns one result per group. T may be nil to ignore timings.
 func (e *Expr) Execute(backends *Backends, providers *BosunProviders, T miniprofiler.Timer, now time.Time, autods int, unjoinedOk bool) (r *Results, queries []opentsdb.Request, err error) {
+	return e.ExecuteContext(context.Background(), backends, providers, T, now, autods, unjoinedOk)
+}
+
+// ExecuteContext is like Execute, but stops evaluation with an error once ctx
+// is done. Cancellation is checked between nodes of the expression, so a
+// query that is already running is not interrupted.
+func (e *Expr) ExecuteContext(ctx context.Context, backends *Backends, providers *BosunProviders, T miniprofiler.Timer, now time.Time, autods int, unjoinedOk bool) (r *Results, queries []opentsdb.Request, err error) {
+	return e.ExecuteDownsampled(ctx, backends, providers, T, now, autods, unjoinedOk, "")
+}
+
+// ExecuteDownsampled is like ExecuteContext, but downsamples the OpenTSDB
+// queries of the expression that do not specify a downsample themselves with
+// downsample, such as 5m-avg. Other backends are not affected.
+func (e *Expr) ExecuteDownsampled(ctx context.Context, backends *Backends, providers *BosunProviders, T miniprofiler.Timer, now time.Time, autods int, unjoinedOk bool, downsample string) (r *Results, queries []opentsdb.Request, err error) {
 	if providers.Squelched == nil {
 		providers.Squelched = func(tags opentsdb.TagSet) bool {
 			return false
@@ -100,8 +164,10 @@ func (e *Expr) Execute(backends *Backends, providers *BosunProviders, T miniprof
 	}
 	s := &State{
 		Expr:           e,
+		ctx:            ctx,
 		now:            now,
 		autods:         autods,
+		downsample:     downsample,
 		unjoinedOk:     unjoinedOk,
 		Backends:       backends,
 		BosunProviders: providers,
@@ -110,7 +176,15 @@ func (e *Expr) Execute(backends *Backends, providers *BosunProviders, T miniprof
 }
 
 func (e *Expr) ExecuteState(s *State, T miniprofiler.Timer) (r *Results, queries []opentsdb.Request, err error) {
+	defer func() {
+		if err != nil && s.backendFailed {
+			err = &BackendError{err}
+		}
+	}()
 	defer errRecover(&err)
+	if s.ctx == nil {
+		s.ctx = context.Background()
+	}
 	if T == nil {
 		T = new(miniprofiler.Profile)
 	} else {
@@ -457,6 +531,9 @@ func (e *State) union(a, b *Results, expression string) []*Union {
 }
 
 func (e *State) walk(node parse.Node, T miniprofiler.Timer) *Results {
+	if err := e.ctx.Err(); err != nil {
+		panic(fmt.Errorf("expr: evaluation stopped: %v", err))
+	}
 	var res *Results
 	switch node := node.(type) {
 	case *parse.NumberNode:
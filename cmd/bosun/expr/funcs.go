@@ -73,6 +73,12 @@ func tagRename(args []parse.Node) (parse.Tags, error) {
 	return tags, nil
 }
 
+// Builtins returns the expression functions that are available regardless of
+// which backends are configured.
+func Builtins() map[string]parse.Func {
+	return builtins
+}
+
 var builtins = map[string]parse.Func{
 	// Reduction functions
 
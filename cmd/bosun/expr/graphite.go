@@ -210,6 +210,9 @@ func graphiteTagQuery(args []parse.Node) (parse.Tags, error) {
 }
 
 func timeGraphiteRequest(e *State, T miniprofiler.Timer, req *graphite.Request) (resp graphite.Response, err error) {
+	if err := e.checkEnabled(BackendGraphite); err != nil {
+		return resp, err
+	}
 	e.graphiteQueries = append(e.graphiteQueries, *req)
 	b, _ := json.MarshalIndent(req, "", "  ")
 	T.StepCustomTiming("graphite", "query", string(b), func() {
@@ -220,6 +223,7 @@ func timeGraphiteRequest(e *State, T miniprofiler.Timer, req *graphite.Request)
 		var val interface{}
 		val, err = e.Cache.Get(key, getFn)
 		resp = val.(graphite.Response)
+		e.backendFailed = e.backendFailed || err != nil
 	})
 	return
 }
@@ -188,6 +188,9 @@ func influxQueryDuration(now time.Time, query, start, end, groupByInterval strin
 }
 
 func timeInfluxRequest(e *State, T miniprofiler.Timer, db, query, startDuration, endDuration, groupByInterval string) (s []influxModels.Row, err error) {
+	if err := e.checkEnabled(BackendInflux); err != nil {
+		return nil, err
+	}
 	q, err := influxQueryDuration(e.now, query, startDuration, endDuration, groupByInterval)
 	if err != nil {
 		return nil, err
@@ -217,6 +220,7 @@ func timeInfluxRequest(e *State, T miniprofiler.Timer, db, query, startDuration,
 		var val interface{}
 		var ok bool
 		val, err = e.Cache.Get(q, getFn)
+		e.backendFailed = e.backendFailed || err != nil
 		if s, ok = val.([]influxModels.Row); !ok {
 			err = fmt.Errorf("influx: did not get a valid result from InfluxDB")
 		}
@@ -103,6 +103,9 @@ func (r *LogstashRequest) CacheKey() string {
 // timeLSRequest execute the elasticsearch query (which may set or hit cache) and returns
 // the search results.
 func timeLSRequest(e *State, T miniprofiler.Timer, req *LogstashRequest) (resp *elastic.SearchResult, err error) {
+	if err := e.checkEnabled(BackendLogstash); err != nil {
+		return nil, err
+	}
 	e.logstashQueries = append(e.logstashQueries, *req.Source)
 	b, _ := json.MarshalIndent(req.Source.Source(), "", "  ")
 	T.StepCustomTiming("logstash", "query", string(b), func() {
@@ -112,6 +115,7 @@ func timeLSRequest(e *State, T miniprofiler.Timer, req *LogstashRequest) (resp *
 		var val interface{}
 		val, err = e.Cache.Get(string(b), getFn)
 		resp = val.(*elastic.SearchResult)
+		e.backendFailed = e.backendFailed || err != nil
 	})
 	return
 }
@@ -64,6 +64,16 @@ var TSDB = map[string]parse.Func{
 const tsdbMaxTries = 3
 
 func timeTSDBRequest(e *State, T miniprofiler.Timer, req *opentsdb.Request) (s opentsdb.ResponseSet, err error) {
+	if err := e.checkEnabled(BackendTSDB); err != nil {
+		return nil, err
+	}
+	if e.downsample != "" {
+		for _, q := range req.Queries {
+			if q.Downsample == "" {
+				q.Downsample = e.downsample
+			}
+		}
+	}
 	e.tsdbQueries = append(e.tsdbQueries, *req)
 	if e.autods > 0 {
 		for _, q := range req.Queries {
@@ -92,6 +102,7 @@ func timeTSDBRequest(e *State, T miniprofiler.Timer, req *opentsdb.Request) (s o
 		slog.Errorf("Error on tsdb query %d: %s", tries, err.Error())
 		tries++
 	}
+	e.backendFailed = e.backendFailed || err != nil
 	return
 }
 
@@ -10,10 +10,12 @@ import (
 	_ "net/http/pprof"
 	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -61,7 +63,8 @@ func init() {
 }
 
 var (
-	flagConf     = flag.String("c", "dev.conf", "config file location")
+	flagConf     = flag.String("c", "dev.conf", "config location: a file, an http(s) URL, or s3://bucket/key or gs://bucket/object")
+	flagPoll     = flag.Duration("poll", 0, "reread the config from its location this often, and reload when it changes; 0 disables polling")
 	flagTest     = flag.Bool("t", false, "test for valid config; exits with 0 on success, else 1")
 	flagWatch    = flag.Bool("w", false, "watch .go files below current directory and exit; also build typescript files on change")
 	flagReadonly = flag.Bool("r", false, "readonly-mode: don't write or relay any OpenTSDB metrics")
@@ -84,10 +87,17 @@ func main() {
 		m()
 	}
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	c, err := conf.ParseFile(*flagConf)
+	source, err := conf.NewRuleSource(*flagConf)
 	if err != nil {
 		slog.Fatal(err)
 	}
+	c, err := conf.Load(source)
+	if err != nil {
+		slog.Fatal(err)
+	}
+	if t, err := time.Parse(time.RFC3339Nano, os.Getenv(reloadedEnv)); err == nil {
+		conf.RecordReload(source.Name(), t, nil)
+	}
 	if *flagTest {
 		os.Exit(0)
 	}
@@ -112,8 +122,12 @@ func main() {
 			mux := http.NewServeMux()
 			mux.Handle("/api/", util.NewSingleHostProxy(httpListen))
 			s := &http.Server{
-				Addr:    c.RelayListen,
-				Handler: mux,
+				Addr:      c.RelayListen,
+				Handler:   mux,
+				TLSConfig: c.RelayTLS,
+			}
+			if c.RelayTLS != nil {
+				slog.Fatal(s.ListenAndServeTLS("", ""))
 			}
 			slog.Fatal(s.ListenAndServe())
 		}()
@@ -122,6 +136,12 @@ func main() {
 		if err := collect.Init(httpListen, "bosun"); err != nil {
 			slog.Fatal(err)
 		}
+		collect.Set("config.reload_failed", nil, func() interface{} {
+			if r := conf.ReloadStatus(); r != nil && !r.Success {
+				return 1
+			}
+			return 0
+		})
 		tsdbHost := &url.URL{
 			Scheme: "http",
 			Host:   c.TSDBHost,
@@ -173,6 +193,18 @@ func main() {
 			}()
 		}
 	}()
+	go func() {
+		sc := make(chan os.Signal, 1)
+		signal.Notify(sc, syscall.SIGHUP)
+		for range sc {
+			reload(source)
+		}
+	}()
+	if *flagPoll > 0 {
+		go conf.PollRuleSource(source, *flagPoll, c.RawText, func(string) {
+			reload(source)
+		})
+	}
 	if *flagWatch {
 		watch(".", "*.go", quit)
 		watch(filepath.Join("web", "static", "templates"), "*.html", web.RunEsc)
@@ -186,6 +218,46 @@ func quit() {
 	os.Exit(0)
 }
 
+var reloading sync.Mutex
+
+// reloadedEnv is the environment variable reload passes the time of a
+// successful reload in, so that the new process can record it.
+const reloadedEnv = "BOSUN_RELOADED"
+
+func init() {
+	metadata.AddMetricMeta("bosun.config.reload_failed", metadata.Gauge, metadata.Bool,
+		"1 if the last attempt to reload the config failed, so that bosun is still running the config it had before.")
+}
+
+// reload restarts bosun with the configuration at source if it loads, by
+// closing the schedule as an interrupt does and executing bosun again with
+// the same arguments. Otherwise the error is recorded (see conf.ReloadStatus)
+// and bosun keeps running.
+func reload(source conf.RuleSource) {
+	reloading.Lock()
+	defer reloading.Unlock()
+	now := time.Now().UTC()
+	if _, err := conf.Load(source); err != nil {
+		conf.RecordReload(source.Name(), now, fmt.Errorf("config does not load: %v", err))
+		return
+	}
+	exe, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		conf.RecordReload(source.Name(), now, err)
+		return
+	}
+	slog.Infoln("Reload: closing down...")
+	sched.Close()
+	slog.Infoln("reloading config from", source.Name())
+	env := []string{reloadedEnv + "=" + now.Format(time.RFC3339Nano)}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, reloadedEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	slog.Fatal(syscall.Exec(exe, os.Args, env))
+}
+
 func watch(root, pattern string, f func()) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -18,6 +18,7 @@ func (s *Schedule) Run() error {
 	if s.Conf.Ping {
 		go s.PingHosts()
 	}
+	s.replayNotifications()
 	go s.dispatchNotifications()
 	go s.updateCheckContext()
 	for _, a := range s.Conf.Alerts {
@@ -45,6 +46,9 @@ func (s *Schedule) RunAlert(a *conf.Alert) {
 }
 
 func (s *Schedule) checkAlert(a *conf.Alert) {
+	if s.isDraining() {
+		return
+	}
 	checkTime := s.ctx.runTime
 	checkCache := s.ctx.checkCache
 	rh := s.NewRunHistory(checkTime, checkCache)
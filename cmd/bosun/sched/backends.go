@@ -0,0 +1,114 @@
+package sched
+
+import (
+	"fmt"
+	"time"
+
+	"bosun.org/cmd/bosun/conf"
+	"bosun.org/cmd/bosun/expr"
+	"bosun.org/collect"
+	"bosun.org/metadata"
+	"bosun.org/opentsdb"
+	"bosun.org/slog"
+	"github.com/bradfitz/slice"
+)
+
+func init() {
+	metadata.AddMetricMeta(
+		"bosun.alerts.backend_maintenance", metadata.Counter, metadata.Alert,
+		"The number of alert checks skipped because a backend they query was in maintenance.")
+}
+
+// BackendMaintenance is a backend that is not queried, for example while it
+// is upgraded. Alerts that query it are not evaluated: their alert keys are
+// marked unevaluated rather than going unknown or recording errors.
+type BackendMaintenance struct {
+	Backend string
+	Since   time.Time
+	User    string
+	Message string
+}
+
+// DisableBackend puts backend, one of the configured backends, in
+// maintenance until EnableBackend is called. user and message are required
+// and recorded for audit. The configuration is not reloaded.
+func (s *Schedule) DisableBackend(backend, user, message string) (*BackendMaintenance, error) {
+	if !isEnabledBackend(s.Conf, backend) {
+		return nil, fmt.Errorf("unknown backend %q", backend)
+	}
+	if user == "" || message == "" {
+		return nil, fmt.Errorf("backend maintenance requires a user and a message")
+	}
+	m := &BackendMaintenance{
+		Backend: backend,
+		Since:   utcNow(),
+		User:    user,
+		Message: message,
+	}
+	s.backendLock.Lock()
+	defer s.backendLock.Unlock()
+	if s.disabledBackends == nil {
+		s.disabledBackends = make(map[string]*BackendMaintenance)
+	}
+	s.disabledBackends[backend] = m
+	slog.Infof("backend %s put in maintenance by %s: %s", backend, user, message)
+	c := *m
+	return &c, nil
+}
+
+// EnableBackend ends the maintenance of backend.
+func (s *Schedule) EnableBackend(backend, user string) error {
+	if user == "" {
+		return fmt.Errorf("enabling a backend requires a user")
+	}
+	s.backendLock.Lock()
+	defer s.backendLock.Unlock()
+	if _, ok := s.disabledBackends[backend]; !ok {
+		return fmt.Errorf("backend %s is not in maintenance", backend)
+	}
+	delete(s.disabledBackends, backend)
+	slog.Infof("backend %s enabled by %s", backend, user)
+	return nil
+}
+
+// DisabledBackends returns copies of the backends in maintenance, sorted by
+// name.
+func (s *Schedule) DisabledBackends() []*BackendMaintenance {
+	s.backendLock.Lock()
+	defer s.backendLock.Unlock()
+	list := make([]*BackendMaintenance, 0, len(s.disabledBackends))
+	for _, m := range s.disabledBackends {
+		c := *m
+		list = append(list, &c)
+	}
+	slice.Sort(list, func(i, j int) bool { return list[i].Backend < list[j].Backend })
+	return list
+}
+
+// DisabledBackendReasons returns the reason each backend in maintenance is
+// disabled, for expr.Backends.Disabled.
+func (s *Schedule) DisabledBackendReasons() map[string]string {
+	s.backendLock.Lock()
+	defer s.backendLock.Unlock()
+	reasons := make(map[string]string, len(s.disabledBackends))
+	for b, m := range s.disabledBackends {
+		reasons[b] = fmt.Sprintf("set by %s: %s", m.User, m.Message)
+	}
+	return reasons
+}
+
+// skipForBackend marks every known alert key of a as unevaluated because a
+// query to a backend in maintenance failed with err.
+func (s *Schedule) skipForBackend(r *RunHistory, a *conf.Alert, err *expr.BackendDisabledError) int {
+	collect.Add("alerts.backend_maintenance", opentsdb.TagSet{"alert": a.Name, "backend": err.Backend}, 1)
+	return s.markAllUnevaluated(r, a)
+}
+
+func isEnabledBackend(c *conf.Conf, backend string) bool {
+	for _, b := range c.EnabledBackends() {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
@@ -3,6 +3,7 @@ package sched
 import (
 	"fmt"
 	"math"
+	"sort"
 	"time"
 
 	"bosun.org/cmd/bosun/cache"
@@ -14,6 +15,8 @@ import (
 	"bosun.org/opentsdb"
 	"bosun.org/slog"
 	"github.com/MiniProfiler/go/miniprofiler"
+	"github.com/bradfitz/slice"
+	"golang.org/x/net/context"
 )
 
 func init() {
@@ -33,6 +36,12 @@ func init() {
 		"The number of alerts by acknowledgement status and notification. Does not reflect escalation chains.")
 	metadata.AddMetricMeta("alerts.oldest_unacked_by_notification", metadata.Gauge, metadata.Second,
 		"How old the oldest unacknowledged notification is by notification.. Does not reflect escalation chains.")
+	metadata.AddMetricMeta("bosun.alerts.fallback", metadata.Counter, metadata.Alert,
+		"The number of times an alert's crit or warn expression failed and its fallback was used.")
+	metadata.AddMetricMeta("bosun.alerts.cooldown_coalesced", metadata.Counter, metadata.Alert,
+		"The number of times an alert key returned to critical within its alert's cooldown and its previous incident was reopened.")
+	metadata.AddMetricMeta("bosun.alerts.shadow_divergence", metadata.Gauge, metadata.Alert,
+		"The number of alert keys whose status by shadowCrit differed from crit in the last check.")
 	collect.AggregateMeta("bosun.template.render", metadata.MilliSecond, "The amount of time it takes to render the specified alert template.")
 }
 
@@ -52,6 +61,12 @@ type RunHistory struct {
 	Backends *expr.Backends
 	Events   map[models.AlertKey]*models.Event
 	schedule *Schedule
+
+	// DerivedTags caches the derived tags of the tag sets seen in the check.
+	DerivedTags *conf.DerivedTagCache
+
+	// ctx bounds evaluation of the alert being checked; nil means no limit.
+	ctx context.Context
 }
 
 // AtTime creates a new RunHistory starting at t with the same context and
@@ -71,10 +86,12 @@ func (s *Schedule) NewRunHistory(start time.Time, cache *cache.Cache) *RunHistor
 		Backends: &expr.Backends{
 			TSDBContext:     s.Conf.TSDBContext(),
 			GraphiteContext: s.Conf.GraphiteContext(),
-			InfluxConfig:    s.Conf.InfluxConfig,
+			InfluxConfig:    s.Conf.InfluxClientConfig(),
 			LogstashHosts:   s.Conf.LogstashElasticHosts,
 			ElasticHosts:    s.Conf.ElasticHosts,
+			Disabled:        s.DisabledBackendReasons(),
 		},
+		DerivedTags: s.Conf.NewDerivedTagCache(),
 	}
 	return r
 }
@@ -105,6 +122,7 @@ func (s *Schedule) runHistory(r *RunHistory, ak models.AlertKey, event *models.E
 	if a.UnknownsNormal && event.Status == models.StUnknown {
 		event.Status = models.StNormal
 	}
+	s.holdCrit(a, ak, event)
 
 	data := s.DataAccess.State()
 	err = data.TouchAlertKey(ak, utcNow())
@@ -130,6 +148,9 @@ func (s *Schedule) runHistory(r *RunHistory, ak models.AlertKey, event *models.E
 	}()
 	// If nothing is out of the ordinary we are done
 	if event.Status <= models.StNormal && incident == nil {
+		if a.LogBackoff > 0 && event.Status == models.StNormal {
+			s.resetLogBackoff(ak)
+		}
 		return
 	}
 
@@ -140,13 +161,23 @@ func (s *Schedule) runHistory(r *RunHistory, ak models.AlertKey, event *models.E
 	if event.Unevaluated {
 		return
 	}
+	escalateWarn(a, incident, event)
 
 	shouldNotify := false
 	newIncident := false
 	if incident == nil {
-		incident = NewIncident(ak)
-		newIncident = true
-		shouldNotify = true
+		if prev := s.cooldownIncident(a, ak, event); prev != nil {
+			// Reopen the recovered incident rather than paging again for a flap.
+			slog.Infof("%s returned to %s within cooldown of its recovery, reopening incident %d", ak, event.Status, prev.Id)
+			collect.Add("alerts.cooldown_coalesced", opentsdb.TagSet{"alert": a.Name}, 1)
+			incident = prev
+			incident.Open = true
+			incident.End = nil
+		} else {
+			incident = NewIncident(ak)
+			newIncident = true
+			shouldNotify = true
+		}
 	}
 	// set state.Result according to event result
 	if event.Status == models.StCritical {
@@ -166,7 +197,19 @@ func (s *Schedule) runHistory(r *RunHistory, ak models.AlertKey, event *models.E
 	if event.Status != incident.CurrentStatus {
 		incident.Events = append(incident.Events, *event)
 	}
+	recovered := event.Status == models.StNormal && incident.CurrentStatus > models.StNormal
+	if event.Status == models.StCritical && incident.CurrentStatus != models.StCritical && !a.Log && !a.TestMode {
+		s.recordCritical(utcNow())
+	}
 	incident.CurrentStatus = event.Status
+	if event.NotificationTags != nil {
+		incident.NotificationTags = event.NotificationTags
+	}
+	// Derived tags are resolved once per incident, and again when its
+	// notification tags change.
+	if newIncident || event.NotificationTags != nil {
+		s.deriveNotificationTags(r, incident)
+	}
 
 	//run a preliminary save on new incidents to get an id
 	if newIncident {
@@ -195,12 +238,22 @@ func (s *Schedule) runHistory(r *RunHistory, ak models.AlertKey, event *models.E
 		if a.Log {
 			lastLogTime := s.lastLogTimes[ak]
 			now := utcNow()
-			if now.Before(lastLogTime.Add(a.MaxLogFrequency)) {
+			if now.Before(lastLogTime.Add(s.logInterval(a, ak))) {
 				return
 			}
 			s.lastLogTimes[ak] = now
+			s.backOffLog(a, ak)
+		}
+		nots := ns.Get(s.Conf, incident.NotificationGroup())
+		if a.TestMode {
+			s.testModeNotify(incident, nots)
+			return
+		}
+		if ns.FirstSuccess && len(nots) > 1 {
+			s.NotifyFirstSuccess(incident, conf.Ordered(nots))
+			checkNotify = true
+			return
 		}
-		nots := ns.Get(s.Conf, incident.AlertKey.Group())
 		for _, n := range nots {
 			s.Notify(incident, n)
 			checkNotify = true
@@ -231,6 +284,9 @@ func (s *Schedule) runHistory(r *RunHistory, ak models.AlertKey, event *models.E
 		}
 		notifyCurrent()
 	}
+	if recovered && !a.Log && !a.TestMode {
+		s.resolveEvents(a, incident)
+	}
 
 	// finally close an open alert with silence once it goes back to normal.
 	if si := silenced(ak); si != nil && event.Status == models.StNormal {
@@ -246,6 +302,74 @@ func (s *Schedule) runHistory(r *RunHistory, ak models.AlertKey, event *models.E
 	return checkNotify, nil
 }
 
+// cooldownIncident returns the latest incident of ak if event takes ak back to
+// critical within the alert's cooldown of that incident recovering, or nil.
+func (s *Schedule) cooldownIncident(a *conf.Alert, ak models.AlertKey, event *models.Event) *models.IncidentState {
+	if a.Cooldown <= 0 || a.Log || event.Status != models.StCritical {
+		return nil
+	}
+	prev, err := s.DataAccess.State().GetLatestIncident(ak)
+	if err != nil {
+		slog.Errorf("getting latest incident of %s for cooldown: %v", ak, err)
+		return nil
+	}
+	if prev == nil || prev.Open || len(prev.Events) == 0 {
+		return nil
+	}
+	last := prev.Events[len(prev.Events)-1]
+	if last.Status != models.StNormal || event.Time.Sub(last.Time) >= a.Cooldown {
+		return nil
+	}
+	return prev
+}
+
+// escalateWarn makes event, a warning, critical if its alert key has been
+// warning for the alert's WarnToCritAfter. The time it has been escalated
+// counts as warning, so it stays critical until the warning clears.
+func escalateWarn(a *conf.Alert, incident *models.IncidentState, event *models.Event) {
+	if a.WarnToCritAfter <= 0 || incident == nil || event.Status != models.StWarning {
+		return
+	}
+	var since time.Time
+	for i := len(incident.Events) - 1; i >= 0; i-- {
+		e := incident.Events[i]
+		if e.Status != models.StWarning && !e.Escalated {
+			break
+		}
+		since = e.Time
+	}
+	if since.IsZero() || event.Time.Sub(since) < a.WarnToCritAfter {
+		return
+	}
+	event.Status = models.StCritical
+	event.Crit = event.Warn
+	event.Escalated = true
+}
+
+// holdCrit counts the consecutive critical evaluations of ak, and until there
+// have been a's critAfter of them, treats event as the warning or normal it
+// would be without its crit expression. Any other evaluation resets the count.
+// Unevaluated events neither count nor reset it.
+func (s *Schedule) holdCrit(a *conf.Alert, ak models.AlertKey, event *models.Event) {
+	if a.CritAfter <= 1 || event.Unevaluated {
+		return
+	}
+	s.critCountLock.Lock()
+	defer s.critCountLock.Unlock()
+	if event.Status != models.StCritical {
+		delete(s.critCounts, ak)
+		return
+	}
+	s.critCounts[ak]++
+	if s.critCounts[ak] >= a.CritAfter {
+		return
+	}
+	event.Status = models.StNormal
+	if event.Warn != nil && event.Warn.Value != 0 {
+		event.Status = models.StWarning
+	}
+}
+
 func silencedOrIgnored(a *conf.Alert, event *models.Event, si *models.Silence) bool {
 	if a.IgnoreUnknown && event.Status == models.StUnknown {
 		return true
@@ -478,6 +602,32 @@ func (s *Schedule) GetUnknownAndUnevaluatedAlertKeys(alert string) (unknown, une
 	return unknown, uneval
 }
 
+// GetAlertStatuses returns the current status of every known alert key of
+// alert. Keys without an open incident are normal.
+func (s *Schedule) GetAlertStatuses(alert string) map[models.AlertKey]models.Status {
+	data := s.DataAccess.State()
+	aks, err := data.GetUntouchedSince(alert, utcNow().Unix())
+	if err != nil {
+		slog.Errorf("Error getting alert keys for alert %s: %s", alert, err)
+		return nil
+	}
+	statuses := make(map[models.AlertKey]models.Status, len(aks))
+	for _, ak := range aks {
+		statuses[ak] = models.StNormal
+	}
+	incidents, err := data.GetAllOpenIncidents()
+	if err != nil {
+		slog.Errorf("Error getting open incidents for alert %s: %s", alert, err)
+		return statuses
+	}
+	for _, incident := range incidents {
+		if incident.AlertKey.Name() == alert {
+			statuses[incident.AlertKey] = incident.CurrentStatus
+		}
+	}
+	return statuses
+}
+
 var bosunStartupTime = utcNow()
 
 func (s *Schedule) findUnknownAlerts(now time.Time, alert string) []models.AlertKey {
@@ -511,11 +661,36 @@ func (s *Schedule) findUnknownAlerts(now time.Time, alert string) []models.Alert
 func (s *Schedule) CheckAlert(T miniprofiler.Timer, r *RunHistory, a *conf.Alert) {
 	slog.Infof("check alert %v start", a.Name)
 	start := utcNow()
+	if a.Disabled {
+		inactive := s.markAllUnevaluated(r, a)
+		slog.Infof("check alert %v done (%s): disabled, %v alert keys inactive", a.Name, time.Since(start), inactive)
+		return
+	}
+	if a.RunSchedule != nil && !a.RunSchedule.Matches(r.Start) {
+		inactive := s.markAllUnevaluated(r, a)
+		slog.Infof("check alert %v done (%s): outside run schedule, %v alert keys inactive", a.Name, time.Since(start), inactive)
+		return
+	}
 	for _, ak := range s.findUnknownAlerts(r.Start, a.Name) {
 		r.Events[ak] = &models.Event{Status: models.StUnknown}
 	}
 	var warns, crits models.AlertKeys
+	if a.Timeout > 0 {
+		var cancel context.CancelFunc
+		r.ctx, cancel = context.WithTimeout(context.Background(), a.Timeout)
+		defer cancel()
+	}
 	d, err := s.executeExpr(T, r, a, a.Depends)
+	if err != nil && a.SuppressOnDependsError {
+		// Suppressing is how the alert handles the failure, so its check
+		// succeeded.
+		suppressed := s.suppressForDependency(r, a, err)
+		s.markAlertSuccessful(a.Name)
+		collect.Put("check.duration", opentsdb.TagSet{"name": a.Name}, time.Since(start).Seconds())
+		slog.Infof("check alert %v done (%s): suppressed %v alert keys because depends failed: %v", a.Name, time.Since(start), suppressed, err)
+		return
+	}
+	s.clearDependencySuppression(a.Name)
 	var deps expr.ResultSlice
 	if err == nil {
 		deps = filterDependencyResults(d)
@@ -523,14 +698,24 @@ func (s *Schedule) CheckAlert(T miniprofiler.Timer, r *RunHistory, a *conf.Alert
 		if err == nil {
 			warns, err = s.CheckExpr(T, r, a, a.Warn, models.StWarning, crits)
 		}
+		if err == nil {
+			s.setNotificationTags(T, r, a)
+			s.checkShadow(T, r, a, crits)
+		}
 	}
-	unevalCount, unknownCount := markDependenciesUnevaluated(r.Events, deps, a.Name)
+	if bErr, ok := err.(*expr.BackendDisabledError); ok {
+		skipped := s.skipForBackend(r, a, bErr)
+		slog.Infof("check alert %v done (%s): %v alert keys unevaluated: %v", a.Name, time.Since(start), skipped, err)
+		return
+	}
+	unevalCount, unknownCount, why := markDependenciesUnevaluated(r.Events, deps, a.Name)
 	if err != nil {
 		slog.Errorf("Error checking alert %s: %s", a.Name, err.Error())
 		removeUnknownEvents(r.Events, a.Name)
 		s.markAlertError(a.Name, err)
 	} else {
 		s.markAlertSuccessful(a.Name)
+		s.explainDependencies(r, a, why)
 	}
 	collect.Put("check.duration", opentsdb.TagSet{"name": a.Name}, time.Since(start).Seconds())
 	slog.Infof("check alert %v done (%s): %v crits, %v warns, %v unevaluated, %v unknown", a.Name, time.Since(start), len(crits), len(warns), unevalCount, unknownCount)
@@ -566,7 +751,11 @@ func filterDependencyResults(results *expr.Results) expr.ResultSlice {
 	return filtered
 }
 
-func markDependenciesUnevaluated(events map[models.AlertKey]*models.Event, deps expr.ResultSlice, alert string) (unevalCount, unknownCount int) {
+// markDependenciesUnevaluated marks the events of alert whose alert keys
+// overlap a result of deps as unevaluated. why holds the result each of them
+// overlapped first.
+func markDependenciesUnevaluated(events map[models.AlertKey]*models.Event, deps expr.ResultSlice, alert string) (unevalCount, unknownCount int, why map[models.AlertKey]*expr.Result) {
+	why = make(map[models.AlertKey]*expr.Result)
 	for ak, ev := range events {
 		if ak.Name() != alert {
 			continue
@@ -575,27 +764,64 @@ func markDependenciesUnevaluated(events map[models.AlertKey]*models.Event, deps
 			if dep.Group.Overlaps(ak.Group()) {
 				ev.Unevaluated = true
 				unevalCount++
+				if why[ak] == nil {
+					why[ak] = dep
+				}
 			}
 			if ev.Status == models.StUnknown {
 				unknownCount++
 			}
 		}
 	}
-	return unevalCount, unknownCount
+	return unevalCount, unknownCount, why
 }
 
 func (s *Schedule) executeExpr(T miniprofiler.Timer, rh *RunHistory, a *conf.Alert, e *expr.Expr) (*expr.Results, error) {
 	if e == nil {
 		return nil, nil
 	}
-	providers := &expr.BosunProviders{
-		Cache:     rh.Cache,
-		Search:    s.Search,
-		Squelched: s.Conf.AlertSquelched(a),
-		History:   s,
+	if rh.ctx == nil {
+		results, _, err := e.ExecuteDownsampled(context.Background(), rh.Backends, s.providers(rh, a), T, rh.Start, 0, a.UnjoinedOK, a.Downsample)
+		return results, err
+	}
+	// Evaluate in the background so a query that is blocked on a slow backend
+	// does not hold up the check past the deadline. The abandoned evaluation
+	// stops at its next expression node. Until then it may still be running
+	// once the check has moved on, so it has its own copy of rh and its own
+	// profile, and its time is added to T only if it finishes.
+	type result struct {
+		results *expr.Results
+		err     error
+	}
+	done := make(chan result, 1)
+	grh := *rh
+	start := time.Now()
+	go func() {
+		results, _, err := e.ExecuteDownsampled(grh.ctx, grh.Backends, s.providers(&grh, a), new(miniprofiler.Profile), grh.Start, 0, a.UnjoinedOK, a.Downsample)
+		done <- result{results, err}
+	}()
+	select {
+	case r := <-done:
+		if T != nil {
+			T.AddCustomTiming("expr", "execute", start, time.Now(), e.String())
+		}
+		return r.results, r.err
+	case <-rh.ctx.Done():
+		return nil, fmt.Errorf("evaluation timed out after %v", a.Timeout)
+	}
+}
+
+// providers returns the providers of the evaluation of the expressions of a
+// in the check rh.
+func (s *Schedule) providers(rh *RunHistory, a *conf.Alert) *expr.BosunProviders {
+	return &expr.BosunProviders{
+		Cache:  rh.Cache,
+		Search: s.Search,
+		Squelched: func(tags opentsdb.TagSet) bool {
+			return s.squelched(rh, a, tags)
+		},
+		History: s,
 	}
-	results, _, err := e.Execute(rh.Backends, providers, T, rh.Start, 0, a.UnjoinedOK)
-	return results, err
 }
 
 func (s *Schedule) CheckExpr(T miniprofiler.Timer, rh *RunHistory, a *conf.Alert, e *expr.Expr, checkStatus models.Status, ignore models.AlertKeys) (alerts models.AlertKeys, err error) {
@@ -610,12 +836,28 @@ func (s *Schedule) CheckExpr(T miniprofiler.Timer, rh *RunHistory, a *conf.Alert
 		slog.Errorln(err)
 	}()
 	results, err := s.executeExpr(T, rh, a, e)
+	if fallback := fallbackFor(a, checkStatus, err); fallback != nil {
+		slog.Warningf("alert %s: %v expression failed, using fallback: %v", a.Name, checkStatus, err)
+		collect.Add("alerts.fallback", opentsdb.TagSet{"alert": a.Name}, 1)
+		e = fallback
+		frh := rh
+		if rh.ctx != nil && rh.ctx.Err() != nil {
+			// The alert ran out of time, so its fallback gets a deadline of
+			// its own.
+			c := *rh
+			var cancel context.CancelFunc
+			c.ctx, cancel = context.WithTimeout(context.Background(), a.Timeout)
+			defer cancel()
+			frh = &c
+		}
+		results, err = s.executeExpr(T, frh, a, e)
+	}
 	if err != nil {
 		return nil, err
 	}
 Loop:
 	for _, r := range results.Results {
-		if s.Conf.Squelched(a, r.Group) {
+		if s.squelched(rh, a, r.Group) {
 			continue
 		}
 		ak := models.NewAlertKey(a.Name, r.Group)
@@ -661,6 +903,266 @@ Loop:
 	return
 }
 
+// fallbackFor returns the expression to evaluate in place of a's crit or warn
+// expression, selected by checkStatus, after it failed with err. It is nil if
+// err is nil, a has no such fallback, or its fallbackOn does not cover err.
+func fallbackFor(a *conf.Alert, checkStatus models.Status, err error) *expr.Expr {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*expr.BackendError); !ok && a.FallbackOn != conf.FallbackOnError {
+		return nil
+	}
+	switch checkStatus {
+	case models.StCritical:
+		return a.CritFallback
+	case models.StWarning:
+		return a.WarnFallback
+	}
+	return nil
+}
+
+// setNotificationTags evaluates a's notificationTags expression and records,
+// on each of the alert's events, the tags of the first result that matches the
+// event's alert key but are not part of it. An evaluation error is logged and
+// leaves notifications to be resolved from the alert key alone.
+func (s *Schedule) setNotificationTags(T miniprofiler.Timer, r *RunHistory, a *conf.Alert) {
+	if a.NotificationTags == nil {
+		return
+	}
+	results, err := s.executeExpr(T, r, a, a.NotificationTags)
+	if err != nil {
+		slog.Errorf("alert %s: notificationTags: %v", a.Name, err)
+		return
+	}
+	for ak, event := range r.Events {
+		if ak.Name() != a.Name {
+			continue
+		}
+		group := ak.Group()
+		for _, res := range results.Results {
+			if !res.Group.Subset(group) {
+				continue
+			}
+			tags := make(opentsdb.TagSet)
+			for k, v := range res.Group {
+				if _, ok := group[k]; !ok {
+					tags[k] = v
+				}
+			}
+			event.NotificationTags = tags
+			break
+		}
+	}
+}
+
+// checkShadow evaluates a's shadowCrit expression and logs the alert keys on
+// whose status it disagrees with crit, which found crits critical. Errors and
+// divergences are only logged and counted; they never affect the alert's
+// events or notifications.
+func (s *Schedule) checkShadow(T miniprofiler.Timer, r *RunHistory, a *conf.Alert, crits models.AlertKeys) {
+	if a.ShadowCrit == nil {
+		return
+	}
+	results, err := s.executeExpr(T, r, a, a.ShadowCrit)
+	if err != nil {
+		slog.Errorf("alert %s: shadowCrit: %v", a.Name, err)
+		return
+	}
+	var shadows models.AlertKeys
+	for _, res := range results.Results {
+		if s.squelched(r, a, res.Group) {
+			continue
+		}
+		n, err := valueToFloat(res.Value)
+		if err != nil {
+			slog.Errorf("alert %s: shadowCrit: %v", a.Name, err)
+			return
+		}
+		// As with crit, NaN is critical.
+		if n != 0 {
+			shadows = append(shadows, models.NewAlertKey(a.Name, res.Group))
+		}
+	}
+	onlyCrit, onlyShadow := diffAlertKeys(crits, shadows)
+	for _, ak := range onlyCrit {
+		slog.Warningf("alert %s: shadow divergence: %s is critical by crit but not by shadowCrit", a.Name, ak)
+	}
+	for _, ak := range onlyShadow {
+		slog.Warningf("alert %s: shadow divergence: %s is critical by shadowCrit but not by crit", a.Name, ak)
+	}
+	collect.Put("alerts.shadow_divergence", opentsdb.TagSet{"alert": a.Name}, len(onlyCrit)+len(onlyShadow))
+}
+
+// diffAlertKeys returns, sorted, the alert keys only in a and only in b.
+func diffAlertKeys(a, b models.AlertKeys) (onlyA, onlyB models.AlertKeys) {
+	inA := make(map[models.AlertKey]bool, len(a))
+	for _, ak := range a {
+		inA[ak] = true
+	}
+	inB := make(map[models.AlertKey]bool, len(b))
+	for _, ak := range b {
+		inB[ak] = true
+		if !inA[ak] {
+			onlyB = append(onlyB, ak)
+		}
+	}
+	for _, ak := range a {
+		if !inB[ak] {
+			onlyA = append(onlyA, ak)
+		}
+	}
+	sort.Sort(onlyA)
+	sort.Sort(onlyB)
+	return onlyA, onlyB
+}
+
+// EvalResult is one result of an expression evaluated by EvalAlertExpr.
+type EvalResult struct {
+	*expr.Result
+	// Triggered is whether an alert with the expression as its crit or warn
+	// would be abnormal for the result's group.
+	Triggered bool
+}
+
+// EvalAlertExpr evaluates text once as a crit or warn expression would be at
+// time at, using the configured backends, and returns its results. Global
+// variables in text are expanded. Nothing is cached between calls, and no
+// state is changed and no notifications are sent.
+func (s *Schedule) EvalAlertExpr(text string, at time.Time) (results []*EvalResult, err error) {
+	defer func() {
+		if pan := recover(); pan != nil {
+			results = nil
+			err = fmt.Errorf("%v", pan)
+		}
+	}()
+	e, err := expr.New(s.Conf.Expand(text, nil, false), s.Conf.Funcs())
+	if err != nil {
+		return nil, s.Conf.ExplainExprError(err)
+	}
+	if err := conf.CheckNumberExpr(e); err != nil {
+		return nil, err
+	}
+	rh := s.NewRunHistory(at, cache.New(0))
+	providers := &expr.BosunProviders{
+		Cache:   rh.Cache,
+		Search:  s.Search,
+		History: s,
+	}
+	res, _, err := e.Execute(rh.Backends, providers, new(miniprofiler.Profile), at, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range res.Results {
+		if r.Computations == nil {
+			r.Computations = make(models.Computations, 0)
+		}
+		n, err := valueToFloat(r.Value)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, &EvalResult{Result: r, Triggered: n != 0})
+	}
+	return results, nil
+}
+
+// maxEvalDiffRange bounds the time between the evaluations of DiffAlertExpr,
+// so that it is not used to scan through history.
+const maxEvalDiffRange = 24 * time.Hour
+
+// EvalDiff is the change in the results of an expression between two
+// evaluations. Results are matched by group, and each list is sorted by it.
+type EvalDiff struct {
+	From, To time.Time
+	// Appeared are the results at To of groups without a result at From,
+	// and Disappeared those at From of groups without one at To.
+	Appeared, Disappeared []*EvalResult
+	// Triggered are the groups that were not triggered at From but are at
+	// To, and Cleared the other way around.
+	Triggered, Cleared []*EvalResultChange
+	// Changed are the groups whose value changed without crossing the
+	// threshold, and Unchanged the number of groups whose value did not.
+	Changed   []*EvalResultChange
+	Unchanged int
+}
+
+// EvalResultChange is the result of a group at both evaluations of an
+// EvalDiff.
+type EvalResultChange struct {
+	Group    opentsdb.TagSet
+	From, To *EvalResult
+}
+
+// DiffAlertExpr evaluates text as EvalAlertExpr does at from and at to, and
+// returns how its results changed, to show why an alert flapped. to must be
+// after from, and at most maxEvalDiffRange later.
+func (s *Schedule) DiffAlertExpr(text string, from, to time.Time) (*EvalDiff, error) {
+	if !to.After(from) {
+		return nil, fmt.Errorf("the second evaluation must be after the first")
+	}
+	if to.Sub(from) > maxEvalDiffRange {
+		return nil, fmt.Errorf("evaluations may be at most %v apart", maxEvalDiffRange)
+	}
+	before, err := s.EvalAlertExpr(text, from)
+	if err != nil {
+		return nil, err
+	}
+	after, err := s.EvalAlertExpr(text, to)
+	if err != nil {
+		return nil, err
+	}
+	d := diffEvalResults(before, after)
+	d.From, d.To = from, to
+	return d, nil
+}
+
+func diffEvalResults(before, after []*EvalResult) *EvalDiff {
+	d := &EvalDiff{}
+	prev := make(map[string]*EvalResult, len(before))
+	for _, r := range before {
+		prev[r.Group.String()] = r
+	}
+	for _, r := range after {
+		g := r.Group.String()
+		p := prev[g]
+		delete(prev, g)
+		if p == nil {
+			d.Appeared = append(d.Appeared, r)
+			continue
+		}
+		c := &EvalResultChange{Group: r.Group, From: p, To: r}
+		pv, _ := valueToFloat(p.Value)
+		v, _ := valueToFloat(r.Value)
+		switch {
+		case !p.Triggered && r.Triggered:
+			d.Triggered = append(d.Triggered, c)
+		case p.Triggered && !r.Triggered:
+			d.Cleared = append(d.Cleared, c)
+		case pv != v && !(math.IsNaN(pv) && math.IsNaN(v)):
+			d.Changed = append(d.Changed, c)
+		default:
+			d.Unchanged++
+		}
+	}
+	for _, r := range before {
+		if prev[r.Group.String()] != nil {
+			d.Disappeared = append(d.Disappeared, r)
+		}
+	}
+	sortResults := func(rs []*EvalResult) {
+		slice.Sort(rs, func(i, j int) bool { return rs[i].Group.String() < rs[j].Group.String() })
+	}
+	sortChanges := func(cs []*EvalResultChange) {
+		slice.Sort(cs, func(i, j int) bool { return cs[i].Group.String() < cs[j].Group.String() })
+	}
+	sortResults(d.Appeared)
+	sortResults(d.Disappeared)
+	sortChanges(d.Triggered)
+	sortChanges(d.Cleared)
+	sortChanges(d.Changed)
+	return d
+}
+
 func valueToFloat(val expr.Value) (float64, error) {
 	var n float64
 	switch v := val.(type) {
@@ -673,3 +1175,75 @@ func valueToFloat(val expr.Value) (float64, error) {
 	}
 	return n, nil
 }
+
+// derive returns tags with the derived tags added, cached for r's check.
+func (s *Schedule) derive(r *RunHistory, tags opentsdb.TagSet) opentsdb.TagSet {
+	if r.DerivedTags == nil {
+		return s.Conf.Derive(tags)
+	}
+	return r.DerivedTags.Derive(tags)
+}
+
+// squelched returns whether tags, with the derived tags added, are squelched
+// globally or by a.
+func (s *Schedule) squelched(r *RunHistory, a *conf.Alert, tags opentsdb.TagSet) bool {
+	return s.Conf.Squelched(a, s.derive(r, tags))
+}
+
+// deriveNotificationTags adds the derived tags of incident's alert key and
+// notification tags to its notification tags, so that notification lookups
+// see them.
+func (s *Schedule) deriveNotificationTags(r *RunHistory, incident *models.IncidentState) {
+	if len(s.Conf.DerivedTags) == 0 {
+		return
+	}
+	group := incident.Group()
+	tags := make(opentsdb.TagSet)
+	for k, v := range s.derive(r, incident.NotificationGroup()) {
+		if _, ok := group[k]; !ok {
+			tags[k] = v
+		}
+	}
+	incident.NotificationTags = tags
+}
+
+// logInterval returns how long after its last log alert key ak of log alert a
+// is throttled for.
+func (s *Schedule) logInterval(a *conf.Alert, ak models.AlertKey) time.Duration {
+	if a.LogBackoff == 0 {
+		return a.MaxLogFrequency
+	}
+	s.logBackoffLock.Lock()
+	defer s.logBackoffLock.Unlock()
+	if d, ok := s.logIntervals[ak]; ok {
+		return d
+	}
+	return a.MaxLogFrequency
+}
+
+// backOffLog doubles the log interval of ak, up to a's logBackoff, after ak
+// was logged. The interval after the first log is maxLogFrequency.
+func (s *Schedule) backOffLog(a *conf.Alert, ak models.AlertKey) {
+	if a.LogBackoff == 0 {
+		return
+	}
+	s.logBackoffLock.Lock()
+	defer s.logBackoffLock.Unlock()
+	d, ok := s.logIntervals[ak]
+	switch {
+	case !ok:
+		d = a.MaxLogFrequency
+	case d*2 > a.LogBackoff:
+		d = a.LogBackoff
+	default:
+		d *= 2
+	}
+	s.logIntervals[ak] = d
+}
+
+// resetLogBackoff restarts the log interval of ak from maxLogFrequency.
+func (s *Schedule) resetLogBackoff(ak models.AlertKey) {
+	s.logBackoffLock.Lock()
+	defer s.logBackoffLock.Unlock()
+	delete(s.logIntervals, ak)
+}
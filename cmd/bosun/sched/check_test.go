@@ -2,14 +2,19 @@ package sched
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"bosun.org/cmd/bosun/cache"
 	"bosun.org/cmd/bosun/conf"
+	"bosun.org/cmd/bosun/expr"
 	"bosun.org/models"
 	"bosun.org/opentsdb"
 )
@@ -441,3 +446,690 @@ Loop:
 		}
 	}
 }
+
+func TestLogBackoff(t *testing.T) {
+	defer setup()()
+	c, err := conf.New("", `
+		template t {
+			subject = s
+		}
+		notification n {
+			print = true
+		}
+		alert a {
+			template = t
+			crit = 1
+			critNotification = n
+			log = true
+			maxLogFrequency = 1m
+			logBackoff = 5m
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := initSched(c)
+	a := c.Alerts["a"]
+	ak := models.NewAlertKey("a", nil)
+	var got []time.Duration
+	for i := 0; i < 5; i++ {
+		got = append(got, s.logInterval(a, ak))
+		s.backOffLog(a, ak)
+	}
+	expect := []time.Duration{time.Minute, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("got log intervals %v, expected %v", got, expect)
+	}
+	s.resetLogBackoff(ak)
+	if d := s.logInterval(a, ak); d != time.Minute {
+		t.Errorf("expected interval of 1m after reset, got %v", d)
+	}
+	for _, text := range []string{
+		"template t {\n subject = s\n}\nnotification n {\n print = true\n}\nalert a {\n template = t\n crit = 1\n critNotification = n\n logBackoff = 5m\n}",
+		"template t {\n subject = s\n}\nnotification n {\n print = true\n}\nalert a {\n template = t\n crit = 1\n critNotification = n\n log = true\n maxLogFrequency = 10m\n logBackoff = 5m\n}",
+	} {
+		if _, err := conf.New("", text); err == nil || !strings.Contains(err.Error(), "logBackoff") {
+			t.Errorf("expected logBackoff error for %q, got %v", text, err)
+		}
+	}
+}
+
+func TestCheckAlertTimeout(t *testing.T) {
+	defer setup()()
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		alertTimeout = 1h
+		alert a {
+			crit = avg(q("avg:m{host=*}", "5m", ""))
+			timeout = 100ms
+		}
+		alert b {
+			crit = 1
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := c.Alerts["b"].Timeout; d != time.Hour {
+		t.Errorf("expected default timeout of 1h, got %v", d)
+	}
+	s, _ := initSched(c)
+	start := time.Now()
+	s.CheckAlert(nil, s.NewRunHistory(start, cache.New(0)), c.Alerts["a"])
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("check took %v, expected it to time out", d)
+	}
+	if s.AlertSuccessful("a") {
+		t.Error("expected alert a to be marked as errored")
+	}
+	// b finishes before its deadline, without a profiler.
+	s.CheckAlert(nil, s.NewRunHistory(time.Now(), cache.New(0)), c.Alerts["b"])
+	if !s.AlertSuccessful("b") {
+		t.Error("expected alert b to be marked as successful")
+	}
+}
+
+func TestCheckBackendMaintenance(t *testing.T) {
+	defer setup()()
+	queried := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queried = true
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		alert a {
+			crit = avg(q("avg:m{host=*}", "5m", ""))
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := initSched(c)
+	if _, err := s.DisableBackend("graphite", "user", "upgrade"); err == nil {
+		t.Error("expected error disabling a backend that is not configured")
+	}
+	if _, err := s.DisableBackend("tsdb", "user", ""); err == nil {
+		t.Error("expected error disabling a backend without a message")
+	}
+	if _, err := s.DisableBackend("tsdb", "user", "upgrade"); err != nil {
+		t.Fatal(err)
+	}
+	s.CheckAlert(nil, s.NewRunHistory(time.Now(), cache.New(0)), c.Alerts["a"])
+	if queried {
+		t.Error("expected no query to a backend in maintenance")
+	}
+	if !s.AlertSuccessful("a") {
+		t.Error("expected alert a not to be marked as errored")
+	}
+	if d := s.DisabledBackends(); len(d) != 1 || d[0].Backend != "tsdb" {
+		t.Errorf("got disabled backends %v", d)
+	}
+	if err := s.EnableBackend("tsdb", "user"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableBackend("tsdb", "user"); err == nil {
+		t.Error("expected error enabling a backend that is not in maintenance")
+	}
+	s.CheckAlert(nil, s.NewRunHistory(time.Now(), cache.New(0)), c.Alerts["a"])
+	if !queried {
+		t.Error("expected a query once the backend is enabled")
+	}
+}
+
+func TestCheckRunSchedule(t *testing.T) {
+	defer setup()()
+	// queryTime is a Saturday at noon UTC.
+	testSched(t, &schedTest{
+		conf: `alert weekdays {
+			crit = avg(q("avg:m{a=*}", "5m", "")) > 0
+			runSchedule = * * * * mon-fri
+		}
+		alert weekends {
+			crit = avg(q("avg:m{a=*}", "5m", "")) > 0
+			runSchedule = * 9-17 * * sat,sun
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:m{a=*}", ` + window5Min + `)`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+		},
+		state: map[schedState]bool{
+			schedState{"weekends{a=b}", "critical"}: true,
+		},
+	})
+}
+
+func TestCheckAlertStatus(t *testing.T) {
+	defer setup()()
+	testSched(t, &schedTest{
+		conf: `alert a {
+			warn = avg(q("avg:m{host=*}", "5m", "")) > 0
+			crit = avg(q("avg:m{host=*}", "5m", "")) > 1
+		}
+		alert b {
+			crit = alertStatus("a") == 1
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:m{host=*}", ` + window5Min + `)`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"host": "w"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"host": "c"},
+					DPS:    map[string]opentsdb.Point{"0": 2},
+				},
+			},
+		},
+		state: map[schedState]bool{
+			schedState{"a{host=w}", "warning"}:  true,
+			schedState{"a{host=c}", "critical"}: true,
+			schedState{"b{host=w}", "critical"}: true,
+		},
+	})
+	if _, err := conf.New("", `alert a {
+		crit = alertStatus("b")
+	}
+	alert b {
+		crit = alertStatus("a")
+	}`); err == nil || !strings.Contains(err.Error(), "alertStatus: unknown alert b") {
+		t.Errorf("expected error referencing an alert defined later, got %v", err)
+	}
+}
+
+type panicTemplate struct{}
+
+func (panicTemplate) Execute(io.Writer, interface{}) error {
+	var m map[string]int
+	m["x"]++
+	return nil
+}
+
+func TestExecuteTemplatePanic(t *testing.T) {
+	err := executeTemplate("t", panicTemplate{}, ioutil.Discard, nil)
+	if err == nil || !strings.Contains(err.Error(), "template t: panic during execution") {
+		t.Errorf("expected template panic as an error, got %v", err)
+	}
+}
+
+func TestTemplateAlertMetadata(t *testing.T) {
+	defer setup()()
+	c, err := conf.New("test", `
+		template t {
+			subject = {{.Name}} {{.Severity}} owner={{.Owner}} runbook={{.Runbook}} alert={{.Alert.Name}}
+		}
+		alert disk {
+			template = t
+			crit = 1
+			runbook = https://wiki.example.com/disk
+			owner = ops
+			ownerTag = team
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := initSched(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := c.Alerts["disk"]
+	for _, test := range []struct {
+		st      *models.IncidentState
+		subject string
+	}{
+		{
+			&models.IncidentState{AlertKey: "disk{host=a}", CurrentStatus: models.StCritical},
+			"disk critical owner=ops runbook=https://wiki.example.com/disk alert=disk",
+		},
+		{
+			&models.IncidentState{AlertKey: "disk{host=a,team=dba}", CurrentStatus: models.StWarning},
+			"disk warning owner=dba runbook=https://wiki.example.com/disk alert=disk",
+		},
+		{
+			&models.IncidentState{
+				AlertKey:         "disk{host=a}",
+				CurrentStatus:    models.StCritical,
+				NotificationTags: opentsdb.TagSet{"team": "web"},
+			},
+			"disk critical owner=web runbook=https://wiki.example.com/disk alert=disk",
+		},
+	} {
+		subject, err := s.ExecuteSubject(nil, a, test.st, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(subject) != test.subject {
+			t.Errorf("%s: got %q, expected %q", test.st.AlertKey, subject, test.subject)
+		}
+	}
+}
+
+func TestCheckShadow(t *testing.T) {
+	defer setup()()
+	testSched(t, &schedTest{
+		conf: `alert a {
+			crit = avg(q("avg:m{a=*}", "5m", "")) > 5
+			shadowCrit = avg(q("avg:m{a=*}", "5m", "")) > 0
+		}
+		alert b {
+			crit = avg(q("avg:m{a=*}", "5m", "")) > 0
+			shadowCrit = avg(q("avg:m{a=*}", "5m", "")) > 5
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:m{a=*}", ` + window5Min + `)`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+		},
+		state: map[schedState]bool{
+			schedState{"b{a=b}", "critical"}: true,
+		},
+	})
+	onlyA, onlyB := diffAlertKeys(models.AlertKeys{"a{a=c}", "a{a=b}"}, models.AlertKeys{"a{a=b}", "a{a=d}"})
+	if !reflect.DeepEqual(onlyA, models.AlertKeys{"a{a=c}"}) || !reflect.DeepEqual(onlyB, models.AlertKeys{"a{a=d}"}) {
+		t.Errorf("unexpected diff: %v, %v", onlyA, onlyB)
+	}
+}
+
+func TestCheckFallback(t *testing.T) {
+	defer setup()()
+	testSched(t, &schedTest{
+		conf: `alert a {
+			crit = avg(q("avg:m{a=*}", "5m", "")) > 0
+			critFallback = avg(q("avg:fallback{a=*}", "5m", "")) > 0
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			// A nil response makes the query fail.
+			`q("avg:m{a=*}", ` + window5Min + `)`: nil,
+			`q("avg:fallback{a=*}", ` + window5Min + `)`: {
+				{
+					Metric: "fallback",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+		},
+		state: map[schedState]bool{
+			schedState{"a{a=b}", "critical"}: true,
+		},
+	})
+	a := &conf.Alert{CritFallback: new(expr.Expr), FallbackOn: conf.FallbackOnBackendError}
+	if fallbackFor(a, models.StCritical, fmt.Errorf("bad data")) != nil {
+		t.Error("expected no fallback for a non-backend error")
+	}
+	if fallbackFor(a, models.StCritical, &expr.BackendError{Err: fmt.Errorf("down")}) == nil {
+		t.Error("expected fallback for a backend error")
+	}
+	a.FallbackOn = conf.FallbackOnError
+	if fallbackFor(a, models.StCritical, fmt.Errorf("bad data")) == nil {
+		t.Error("expected fallback for any error with fallbackOn = error")
+	}
+	if fallbackFor(a, models.StWarning, fmt.Errorf("bad data")) != nil {
+		t.Error("expected no fallback without warnFallback")
+	}
+}
+
+func TestCheckFallbackTimeout(t *testing.T) {
+	defer setup()()
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if !strings.Contains(string(body), "fallback") {
+			<-release
+			return
+		}
+		fmt.Fprintf(w, `[{"metric": "fallback", "tags": {"host": "h1"}, "aggregateTags": [], "dps": {"%d": 1}}]`, time.Now().Unix())
+	}))
+	defer ts.Close()
+	defer close(release)
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("", fmt.Sprintf(`
+		tsdbHost = %s
+		alert a {
+			crit = avg(q("avg:m{host=*}", "5m", ""))
+			critFallback = avg(q("avg:fallback{host=*}", "5m", ""))
+			fallbackOn = error
+			timeout = 100ms
+		}
+	`, u.Host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := initSched(c)
+	rh := s.NewRunHistory(time.Now(), cache.New(0))
+	s.CheckAlert(nil, rh, c.Alerts["a"])
+	if ev := rh.Events["a{host=h1}"]; ev == nil || ev.Status != models.StCritical {
+		t.Errorf("expected the fallback to make a{host=h1} critical, got %+v", ev)
+	}
+}
+
+func TestContextTimeline(t *testing.T) {
+	start := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	crit := &models.Result{Value: 95}
+	c := &Context{
+		IncidentState: &models.IncidentState{
+			Events: []models.Event{
+				{Status: models.StWarning, Time: start},
+				{Status: models.StCritical, Time: start.Add(5 * time.Minute), Crit: crit},
+			},
+		},
+		runHistory: &RunHistory{Start: start.Add(17*time.Minute + 30*time.Second)},
+	}
+	tr := c.Transitions()
+	if len(tr) != 2 || tr[0].Status != models.StCritical || tr[0].Result != crit || tr[1].Duration != 5*time.Minute {
+		t.Errorf("unexpected transitions: %+v", tr)
+	}
+	if got, expect := c.Timeline(0), "critical for 12m30s, warning for 5m before"; got != expect {
+		t.Errorf("got %q, expected %q", got, expect)
+	}
+	if got, expect := c.Timeline(1), "critical for 12m30s"; got != expect {
+		t.Errorf("got %q, expected %q", got, expect)
+	}
+}
+
+func TestExecuteSubjectNewlines(t *testing.T) {
+	defer setup()()
+	for _, policy := range []string{"strip", "reject"} {
+		c, err := conf.New("", `
+			subjectNewlines = `+policy+`
+			template t {
+				$inj = `+"`a\r\nBcc: victim@example.com`"+`
+				subject = {{V "$inj"}}
+			}
+			alert a {
+				template = t
+				crit = 1
+			}
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, _ := initSched(c)
+		a := c.Alerts["a"]
+		st := NewIncident(models.NewAlertKey("a", nil))
+		subject, err := s.ExecuteSubject(s.NewRunHistory(time.Now(), nil), a, st, true)
+		switch policy {
+		case "strip":
+			if err != nil || string(subject) != "a Bcc: victim@example.com" {
+				t.Errorf("strip: got %q, %v", subject, err)
+			}
+		case "reject":
+			if err == nil || subject != nil {
+				t.Errorf("reject: expected error, got %q", subject)
+			}
+		}
+	}
+	_, err := conf.New("", "subjectNewlines = reject\ntemplate t {\n\tsubject = `a\nb`\n}")
+	if err == nil || !strings.Contains(err.Error(), "subject contains a newline") {
+		t.Errorf("expected load error for multi-line subject, got %v", err)
+	}
+}
+
+func TestCheckCooldown(t *testing.T) {
+	defer setup()()
+	c, err := conf.New("", `
+		alert a {
+			crit = 1
+			cooldown = 10m
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := initSched(c)
+	ak := models.NewAlertKey("a", nil)
+	start := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	r := &RunHistory{
+		Events: map[models.AlertKey]*models.Event{
+			ak: {},
+		},
+	}
+	// run sets the status of ak at start+offset.
+	run := func(offset time.Duration, status models.Status) {
+		r.Start = start.Add(offset)
+		r.Events[ak].Status = status
+		s.RunHistory(r)
+	}
+	expect := func(id int64) {
+		incident, err := s.DataAccess.State().GetLatestIncident(ak)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if incident.Id != id || !incident.Open {
+			t.Fatalf("expected open incident %d, got %d (open %v)", id, incident.Id, incident.Open)
+		}
+	}
+	closeIncident := func() {
+		if err := s.ActionByAlertKey("", "", models.ActionClose, ak); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(0, models.StCritical)
+	expect(1)
+	run(5*time.Minute, models.StNormal)
+	closeIncident()
+
+	// Refiring within the cooldown reopens the recovered incident.
+	run(10*time.Minute, models.StCritical)
+	expect(1)
+	run(20*time.Minute, models.StNormal)
+	closeIncident()
+
+	// Refiring after the cooldown opens a new incident.
+	run(30*time.Minute, models.StCritical)
+	expect(2)
+}
+
+func TestCheckWarnToCrit(t *testing.T) {
+	defer setup()()
+	c, err := conf.New("", `
+		alert a {
+			warn = 1
+			warnToCritAfter = 30m
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := initSched(c)
+	ak := models.NewAlertKey("a", nil)
+	start := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	r := &RunHistory{
+		Events: map[models.AlertKey]*models.Event{
+			ak: {},
+		},
+	}
+	for i, test := range []struct {
+		offset time.Duration
+		status models.Status
+		expect models.Status
+	}{
+		{0, models.StWarning, models.StWarning},
+		{29 * time.Minute, models.StWarning, models.StWarning},
+		{30 * time.Minute, models.StWarning, models.StCritical},
+		{35 * time.Minute, models.StWarning, models.StCritical},
+		{40 * time.Minute, models.StNormal, models.StNormal},
+		{45 * time.Minute, models.StWarning, models.StWarning},
+		{74 * time.Minute, models.StWarning, models.StWarning},
+		{75 * time.Minute, models.StWarning, models.StCritical},
+	} {
+		r.Start = start.Add(test.offset)
+		r.Events[ak] = &models.Event{Status: test.status}
+		s.RunHistory(r)
+		incident, err := s.DataAccess.State().GetLatestIncident(ak)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if incident.CurrentStatus != test.expect {
+			t.Errorf("%d: at %v got %v, expected %v", i, test.offset, incident.CurrentStatus, test.expect)
+		}
+	}
+	incident, err := s.DataAccess.State().GetLatestIncident(ak)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := incident.Events[len(incident.Events)-1]; !last.Escalated || last.Status != models.StCritical {
+		t.Errorf("expected escalated event, got %+v", last)
+	}
+}
+
+func TestCheckCritAfter(t *testing.T) {
+	defer setup()()
+	c, err := conf.New("", `
+		alert a {
+			warn = 1
+			crit = 1
+			critAfter = 3
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := initSched(c)
+	ak := models.NewAlertKey("a", nil)
+	start := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+	r := &RunHistory{
+		Events: map[models.AlertKey]*models.Event{
+			ak: {},
+		},
+	}
+	warn := &models.Result{Value: 1}
+	for i, test := range []struct {
+		status models.Status
+		expect models.Status
+	}{
+		{models.StCritical, models.StWarning},
+		{models.StCritical, models.StWarning},
+		{models.StCritical, models.StCritical},
+		{models.StCritical, models.StCritical},
+		{models.StWarning, models.StWarning},
+		{models.StCritical, models.StWarning},
+		{models.StCritical, models.StWarning},
+		{models.StCritical, models.StCritical},
+	} {
+		r.Start = start.Add(time.Duration(i) * time.Minute)
+		r.Events[ak] = &models.Event{Status: test.status, Warn: warn}
+		s.RunHistory(r)
+		incident, err := s.DataAccess.State().GetLatestIncident(ak)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if incident.CurrentStatus != test.expect {
+			t.Errorf("%d: got %v, expected %v", i, incident.CurrentStatus, test.expect)
+		}
+	}
+
+	// Without a warning, held critical evaluations are normal.
+	other := models.NewAlertKey("a", opentsdb.TagSet{"host": "b"})
+	r.Events = map[models.AlertKey]*models.Event{other: {Status: models.StCritical}}
+	s.RunHistory(r)
+	if incident, err := s.DataAccess.State().GetLatestIncident(other); err != nil || incident != nil {
+		t.Errorf("expected no incident, got %+v (%v)", incident, err)
+	}
+}
+
+func TestEvalAlertExpr(t *testing.T) {
+	defer setup()()
+	c, err := conf.New("", `
+		$threshold = 2
+		alert a {
+			crit = 1
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := initSched(c)
+	results, err := s.EvalAlertExpr(`last(merge(series("host=a", 0, 1), series("host=b", 0, 3))) > $threshold`, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	triggered := make(map[string]bool)
+	for _, r := range results {
+		triggered[r.Group.String()] = r.Triggered
+	}
+	if len(triggered) != 2 || triggered["{host=a}"] || !triggered["{host=b}"] {
+		t.Errorf("unexpected results: %v", triggered)
+	}
+	if _, err := s.EvalAlertExpr(`series("host=a", 0, 1)`, time.Now()); err == nil {
+		t.Error("expected error for a series expression")
+	}
+	incidents, err := s.DataAccess.State().GetAllOpenIncidents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(incidents) != 0 {
+		t.Errorf("expected no incidents, got %d", len(incidents))
+	}
+}
+
+func TestDiffAlertExpr(t *testing.T) {
+	defer setup()()
+	c, err := conf.New("", `
+		alert a {
+			crit = 1
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := initSched(c)
+	// The threshold is the seconds after 1000: 0, then 2.
+	text := `last(merge(series("host=a", 0, 1), series("host=b", 0, 3))) > epoch() - 1000`
+	from, to := time.Unix(1000, 0).UTC(), time.Unix(1002, 0).UTC()
+	d, err := s.DiffAlertExpr(text, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Cleared) != 1 || d.Cleared[0].Group.String() != "{host=a}" {
+		t.Errorf("expected host=a to clear, got %+v", d.Cleared)
+	}
+	if d.Unchanged != 1 || len(d.Triggered) != 0 || len(d.Changed) != 0 || len(d.Appeared) != 0 || len(d.Disappeared) != 0 {
+		t.Errorf("expected host=b to be unchanged, got %+v", d)
+	}
+	if _, err := s.DiffAlertExpr(text, to, from); err == nil {
+		t.Error("expected an error for evaluations out of order")
+	}
+	if _, err := s.DiffAlertExpr(text, from, from.Add(48*time.Hour)); err == nil {
+		t.Error("expected an error for evaluations too far apart")
+	}
+
+	d = diffEvalResults([]*EvalResult{
+		{Result: &expr.Result{Value: expr.Number(1), Group: opentsdb.TagSet{"host": "a"}}},
+		{Result: &expr.Result{Value: expr.Number(2), Group: opentsdb.TagSet{"host": "b"}}},
+	}, []*EvalResult{
+		{Result: &expr.Result{Value: expr.Number(3), Group: opentsdb.TagSet{"host": "b"}}},
+		{Result: &expr.Result{Value: expr.Number(1), Group: opentsdb.TagSet{"host": "c"}}, Triggered: true},
+	})
+	if len(d.Appeared) != 1 || d.Appeared[0].Group["host"] != "c" || len(d.Disappeared) != 1 || d.Disappeared[0].Group["host"] != "a" || len(d.Changed) != 1 {
+		t.Errorf("unexpected diff: %+v", d)
+	}
+}
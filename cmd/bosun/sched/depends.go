@@ -0,0 +1,208 @@
+package sched
+
+import (
+	"time"
+
+	"bosun.org/cmd/bosun/conf"
+	"bosun.org/cmd/bosun/expr"
+	"bosun.org/models"
+	"bosun.org/opentsdb"
+	"bosun.org/slog"
+	"github.com/bradfitz/slice"
+)
+
+// DependencySuppression describes an alert that is being held quiet because
+// its depends expression could not be evaluated. Suppressed alerts neither
+// fire nor go unknown; their alert keys are marked unevaluated until the
+// dependency can be evaluated again.
+type DependencySuppression struct {
+	Alert string
+	Since time.Time
+	Error string
+}
+
+// suppressForDependency marks every known alert key of a as unevaluated and
+// records why. It is only used for alerts with suppressOnDependsError set.
+func (s *Schedule) suppressForDependency(r *RunHistory, a *conf.Alert, depErr error) int {
+	s.suppressionLock.Lock()
+	if s.dependencySuppressed == nil {
+		s.dependencySuppressed = make(map[string]*DependencySuppression)
+	}
+	ds := s.dependencySuppressed[a.Name]
+	if ds == nil {
+		ds = &DependencySuppression{
+			Alert: a.Name,
+			Since: utcNow(),
+		}
+		s.dependencySuppressed[a.Name] = ds
+	}
+	ds.Error = depErr.Error()
+	s.suppressionLock.Unlock()
+	n := s.markAllUnevaluated(r, a)
+	why := make(map[models.AlertKey]*DependencyExplanation)
+	for ak, ev := range r.Events {
+		if ak.Name() == a.Name && ev.Unevaluated {
+			why[ak] = &DependencyExplanation{Error: ds.Error}
+		}
+	}
+	s.setDependencyExplanations(r, a, why)
+	return n
+}
+
+// DependencyExplanation is why an alert key was held quiet by the depends
+// expression of its alert at its last check: the result of Depends for Group
+// was the non-zero Value, or, with suppressOnDependsError, Depends failed
+// with Error. Since is when the alert key began to be held quiet.
+type DependencyExplanation struct {
+	AlertKey models.AlertKey
+	Depends  string
+	Group    opentsdb.TagSet `json:",omitempty"`
+	Value    float64
+	Error    string `json:",omitempty"`
+	Since    time.Time
+	Time     time.Time
+}
+
+// explainDependencies records why the alert keys of a in why were held quiet
+// by a's depends expression: the result they overlapped.
+func (s *Schedule) explainDependencies(r *RunHistory, a *conf.Alert, why map[models.AlertKey]*expr.Result) {
+	explanations := make(map[models.AlertKey]*DependencyExplanation, len(why))
+	for ak, dep := range why {
+		e := &DependencyExplanation{Group: dep.Group}
+		switch v := dep.Value.(type) {
+		case expr.Number:
+			e.Value = float64(v)
+		case expr.Scalar:
+			e.Value = float64(v)
+		}
+		explanations[ak] = e
+	}
+	s.setDependencyExplanations(r, a, explanations)
+}
+
+// setDependencyExplanations replaces the explanations of the alert keys of a
+// checked in r with why, logging the alert keys newly held quiet. Alert keys
+// of a checked but not in why are no longer held quiet.
+func (s *Schedule) setDependencyExplanations(r *RunHistory, a *conf.Alert, why map[models.AlertKey]*DependencyExplanation) {
+	s.suppressionLock.Lock()
+	defer s.suppressionLock.Unlock()
+	if s.dependencyExplanations == nil {
+		s.dependencyExplanations = make(map[models.AlertKey]*DependencyExplanation)
+	}
+	depends := ""
+	if a.Depends != nil {
+		depends = a.Depends.Text
+	}
+	for ak := range r.Events {
+		if ak.Name() != a.Name {
+			continue
+		}
+		e := why[ak]
+		if e == nil {
+			delete(s.dependencyExplanations, ak)
+			continue
+		}
+		e.AlertKey = ak
+		e.Depends = depends
+		e.Since = r.Start
+		e.Time = r.Start
+		if prev := s.dependencyExplanations[ak]; prev != nil {
+			e.Since = prev.Since
+		} else if e.Error != "" {
+			slog.Infof("%s held quiet: depends %s failed: %s", ak, depends, e.Error)
+		} else {
+			slog.Infof("%s held quiet by depends %s: %v for %s", ak, depends, e.Value, e.Group)
+		}
+		s.dependencyExplanations[ak] = e
+	}
+}
+
+// DependencyExplanations returns why the alert keys of alert whose tags
+// include tags, which may be empty, were held quiet by its depends
+// expression at their last check, sorted by alert key.
+func (s *Schedule) DependencyExplanations(alert string, tags opentsdb.TagSet) []*DependencyExplanation {
+	s.suppressionLock.Lock()
+	defer s.suppressionLock.Unlock()
+	list := []*DependencyExplanation{}
+	for ak, e := range s.dependencyExplanations {
+		if ak.Name() != alert || !ak.Group().Subset(tags) {
+			continue
+		}
+		c := *e
+		list = append(list, &c)
+	}
+	slice.Sort(list, func(i, j int) bool { return list[i].AlertKey < list[j].AlertKey })
+	return list
+}
+
+// markAllUnevaluated adds an unevaluated event to r for every known alert key
+// of a. This keeps the keys from going unknown while a is not evaluated.
+func (s *Schedule) markAllUnevaluated(r *RunHistory, a *conf.Alert) int {
+	aks, err := s.DataAccess.State().GetUntouchedSince(a.Name, r.Start.UTC().Unix())
+	if err != nil {
+		slog.Errorf("Error getting alert keys for alert %s: %s", a.Name, err)
+		return 0
+	}
+	for _, ak := range aks {
+		r.Events[ak] = &models.Event{Unevaluated: true}
+	}
+	return len(aks)
+}
+
+// pruneDependencySuppressions drops the suppressions and explanations of
+// alerts that are not in c, so alerts removed from the config are no longer
+// reported as held quiet. Those of alerts still in c are kept until their
+// next check.
+func (s *Schedule) pruneDependencySuppressions(c *conf.Conf) {
+	s.suppressionLock.Lock()
+	defer s.suppressionLock.Unlock()
+	if s.dependencySuppressed == nil {
+		s.dependencySuppressed = make(map[string]*DependencySuppression)
+	}
+	if s.dependencyExplanations == nil {
+		s.dependencyExplanations = make(map[models.AlertKey]*DependencyExplanation)
+	}
+	for alert := range s.dependencySuppressed {
+		if c.Alerts[alert] == nil {
+			delete(s.dependencySuppressed, alert)
+		}
+	}
+	for ak := range s.dependencyExplanations {
+		if c.Alerts[ak.Name()] == nil {
+			delete(s.dependencyExplanations, ak)
+		}
+	}
+}
+
+// clearDependencySuppression removes any suppression recorded for alert.
+func (s *Schedule) clearDependencySuppression(alert string) {
+	s.suppressionLock.Lock()
+	defer s.suppressionLock.Unlock()
+	delete(s.dependencySuppressed, alert)
+}
+
+// DependencySuppressed returns the suppression recorded for alert, or nil if
+// the alert is not currently suppressed by its dependency.
+func (s *Schedule) DependencySuppressed(alert string) *DependencySuppression {
+	s.suppressionLock.Lock()
+	defer s.suppressionLock.Unlock()
+	if ds, ok := s.dependencySuppressed[alert]; ok {
+		c := *ds
+		return &c
+	}
+	return nil
+}
+
+// DependencySuppressions returns all alerts currently suppressed by their
+// dependency, sorted by alert name.
+func (s *Schedule) DependencySuppressions() []*DependencySuppression {
+	s.suppressionLock.Lock()
+	defer s.suppressionLock.Unlock()
+	list := make([]*DependencySuppression, 0, len(s.dependencySuppressed))
+	for _, ds := range s.dependencySuppressed {
+		c := *ds
+		list = append(list, &c)
+	}
+	slice.Sort(list, func(i, j int) bool { return list[i].Alert < list[j].Alert })
+	return list
+}
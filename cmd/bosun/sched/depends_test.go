@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"bosun.org/cmd/bosun/conf"
 	"bosun.org/models"
 	"bosun.org/opentsdb"
 )
@@ -304,3 +305,111 @@ alert c {
 		},
 	})
 }
+
+// Depends errors with suppressOnDependsError: the crit is not raised, the
+// stale key does not go unknown, and the alert is recorded as suppressed.
+func TestDependency_SuppressOnError(t *testing.T) {
+	defer setup()()
+	s := testSched(t, &schedTest{
+		conf: `alert a {
+			crit = avg(q("avg:c{a=*}", "5m", "")) > 0
+			depends = avg(q("avg:d{a=*}", "5m", "")) > 0
+			suppressOnDependsError = true
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:c{a=*}", ` + window5Min + `)`: {
+				{
+					Metric: "c",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+			`q("avg:d{a=*}", ` + window5Min + `)`: nil,
+		},
+		state: map[schedState]bool{},
+		touched: map[models.AlertKey]time.Time{
+			"a{a=b}": queryTime.Add(-10 * time.Minute),
+		},
+	})
+	if !s.AlertSuccessful("a") {
+		t.Error("expected suppressed alert a not to be marked as failing")
+	}
+	if ds := s.DependencySuppressed("a"); ds == nil || ds.Error == "" {
+		t.Errorf("expected alert a to be suppressed by dependency, got %v", ds)
+	}
+	_, uneval := s.GetUnknownAndUnevaluatedAlertKeys("a")
+	if len(uneval) != 1 || uneval[0] != "a{a=b}" {
+		t.Errorf("expected a{a=b} to be unevaluated, got %v", uneval)
+	}
+	if why := s.DependencyExplanations("a", nil); len(why) != 1 || why[0].AlertKey != "a{a=b}" || why[0].Error == "" {
+		t.Errorf("expected a{a=b} to be explained by the depends error, got %v", why)
+	}
+	// A reload keeps the suppression of a while a is configured, and drops it
+	// once a is removed.
+	if err := s.Init(s.Conf); err != nil {
+		t.Fatal(err)
+	}
+	if s.DependencySuppressed("a") == nil {
+		t.Error("expected alert a to stay suppressed across a reload")
+	}
+	c, err := conf.New("", "alert b {\n crit = 1\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Init(c); err != nil {
+		t.Fatal(err)
+	}
+	if ds := s.DependencySuppressed("a"); ds != nil {
+		t.Errorf("expected removed alert a not to be suppressed, got %v", ds)
+	}
+	if why := s.DependencyExplanations("a", nil); len(why) != 0 {
+		t.Errorf("expected no explanations for removed alert a, got %v", why)
+	}
+}
+
+// The alert key held quiet by depends is explained by the depends result it
+// overlapped, and the one that fired is not.
+func TestDependency_Explanations(t *testing.T) {
+	defer setup()()
+	s := testSched(t, &schedTest{
+		conf: `alert a {
+			crit = avg(q("avg:c{a=*}", "5m", "")) > 0
+			depends = avg(q("avg:d{a=*}", "5m", "")) > 0
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:c{a=*}", ` + window5Min + `)`: {
+				{
+					Metric: "c",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+				{
+					Metric: "c",
+					Tags:   opentsdb.TagSet{"a": "c"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+			`q("avg:d{a=*}", ` + window5Min + `)`: {
+				{
+					Metric: "d",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+		},
+		state: map[schedState]bool{
+			schedState{"a{a=c}", "critical"}: true,
+		},
+	})
+	why := s.DependencyExplanations("a", nil)
+	if len(why) != 1 {
+		t.Fatalf("expected one explanation, got %v", why)
+	}
+	e := why[0]
+	if e.AlertKey != "a{a=b}" || e.Depends != `avg(q("avg:d{a=*}", "5m", "")) > 0` || e.Group.String() != "{a=b}" || e.Value != 1 || e.Error != "" {
+		t.Errorf("unexpected explanation: %+v", e)
+	}
+	if why := s.DependencyExplanations("a", opentsdb.TagSet{"a": "c"}); len(why) != 0 {
+		t.Errorf("expected no explanation for a{a=c}, got %v", why)
+	}
+}
@@ -0,0 +1,84 @@
+package sched
+
+import (
+	"time"
+
+	"bosun.org/cmd/bosun/conf"
+	"bosun.org/models"
+	"bosun.org/slog"
+)
+
+// inflightDelivery is a notification of an alert key that is being
+// delivered.
+type inflightDelivery struct {
+	ak models.AlertKey
+	n  *conf.Notification
+}
+
+// track records the delivery of n for ak until all of its results have been
+// received, and returns a channel with the same results.
+func (s *Schedule) track(ak models.AlertKey, n *conf.Notification, results <-chan *conf.DeliveryResult) <-chan *conf.DeliveryResult {
+	d := &inflightDelivery{ak, n}
+	s.drainLock.Lock()
+	if s.inflight == nil {
+		s.inflight = make(map[*inflightDelivery]bool)
+	}
+	s.inflight[d] = true
+	s.drainLock.Unlock()
+	// results holds every result without blocking, so out does too.
+	out := make(chan *conf.DeliveryResult, cap(results))
+	go func() {
+		for r := range results {
+			out <- r
+		}
+		s.drainLock.Lock()
+		delete(s.inflight, d)
+		s.drainLock.Unlock()
+		close(out)
+	}()
+	return out
+}
+
+func (s *Schedule) isDraining() bool {
+	s.drainLock.Lock()
+	defer s.drainLock.Unlock()
+	return s.draining
+}
+
+// Drain prepares for shutdown. It stops alert checks and the notification
+// dispatcher, sends the notifications that are due or pending, and waits up to
+// timeout for deliveries to finish. Notifications still being delivered after
+// that are queued again, so they are retried after a restart. It returns the
+// number of those.
+func (s *Schedule) Drain(timeout time.Duration) int {
+	s.drainLock.Lock()
+	s.draining = true
+	s.drainLock.Unlock()
+	slog.Infoln("draining notifications")
+	s.checkNotifications()
+	s.sendUnknownNotifications()
+	deadline := time.Now().Add(timeout)
+	for {
+		s.drainLock.Lock()
+		var left []*inflightDelivery
+		for d := range s.inflight {
+			left = append(left, d)
+		}
+		chains := s.chains
+		s.drainLock.Unlock()
+		if len(left) == 0 && chains == 0 {
+			slog.Infoln("all notifications delivered")
+			return 0
+		}
+		if time.Now().After(deadline) {
+			for _, d := range left {
+				slog.Infof("notification %s for %s still in flight, queueing it for retry", d.n.Name, d.ak)
+				if err := s.DataAccess.Notifications().InsertNotification(d.ak, d.n.Name, utcNow()); err != nil {
+					slog.Error(err)
+				}
+			}
+			return len(left)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,382 @@
+package sched
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"bosun.org/cmd/bosun/cache"
+	"bosun.org/cmd/bosun/conf"
+	"bosun.org/cmd/bosun/expr"
+	"bosun.org/models"
+	"bosun.org/opentsdb"
+	"github.com/MiniProfiler/go/miniprofiler"
+	"github.com/bradfitz/slice"
+	"golang.org/x/net/context"
+)
+
+// AlertFixture is a test of an alert's crit and warn expressions: the
+// OpenTSDB series their queries return, and the status expected of each
+// group when they are evaluated at Time.
+type AlertFixture struct {
+	// Name defaults to the name of the fixture's file.
+	Name   string               `json:"name"`
+	Alert  string               `json:"alert"`
+	Time   time.Time            `json:"time"`
+	Series opentsdb.ResponseSet `json:"series"`
+	// Expect is the status, such as critical, of groups, such as
+	// {host=web1}. Groups that are not listed are expected to be normal.
+	Expect map[string]string `json:"expect"`
+}
+
+// AlertTestResult is the outcome of a fixture.
+type AlertTestResult struct {
+	Fixture string
+	Alert   string
+	Passed  bool
+	// Error is why the fixture could not be evaluated, if it could not.
+	Error      string               `json:",omitempty"`
+	Mismatches []*AlertTestMismatch `json:",omitempty"`
+}
+
+// AlertTestMismatch is a group whose status is not the expected one, with
+// the results of the expressions for it and the fixture series of the group.
+type AlertTestMismatch struct {
+	Group            opentsdb.TagSet
+	Expected, Actual models.Status
+	Crit, Warn       *expr.Result         `json:",omitempty"`
+	Series           opentsdb.ResponseSet `json:",omitempty"`
+}
+
+// LoadAlertFixtures reads the fixtures of the alert named alert, or of all
+// alerts if it is empty, from the .json files of the alertTestDir.
+func (s *Schedule) LoadAlertFixtures(alert string) ([]*AlertFixture, error) {
+	if s.Conf.AlertTestDir == "" {
+		return nil, fmt.Errorf("alertTestDir is not set")
+	}
+	files, err := filepath.Glob(filepath.Join(s.Conf.AlertTestDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []*AlertFixture
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		f := &AlertFixture{}
+		if err := json.Unmarshal(b, f); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if f.Name == "" {
+			f.Name = strings.TrimSuffix(filepath.Base(file), ".json")
+		}
+		if alert == "" || f.Alert == alert {
+			fixtures = append(fixtures, f)
+		}
+	}
+	return fixtures, nil
+}
+
+// RunAlertTests evaluates the fixtures of the alert named alert, or of all
+// alerts if it is empty. See TestAlert.
+func (s *Schedule) RunAlertTests(alert string) ([]*AlertTestResult, error) {
+	if alert != "" && s.Conf.Alerts[alert] == nil {
+		return nil, fmt.Errorf("unknown alert %s", alert)
+	}
+	fixtures, err := s.LoadAlertFixtures(alert)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*AlertTestResult, 0, len(fixtures))
+	for _, f := range fixtures {
+		results = append(results, s.TestAlert(f))
+	}
+	slice.Sort(results, func(i, j int) bool { return results[i].Fixture < results[j].Fixture })
+	return results, nil
+}
+
+// TestAlert evaluates the crit and warn of the alert of f at its time, as
+// EvalAlertExpr does but with OpenTSDB queries answered from the fixture's
+// series instead of the backend, and compares the status of each group to
+// the expected one. Other backends are not available. Nothing is cached, no
+// state is changed and no notifications are sent.
+func (s *Schedule) TestAlert(f *AlertFixture) *AlertTestResult {
+	r := &AlertTestResult{Fixture: f.Name, Alert: f.Alert}
+	fail := func(format string, args ...interface{}) *AlertTestResult {
+		r.Error = fmt.Sprintf(format, args...)
+		return r
+	}
+	a := s.Conf.Alerts[f.Alert]
+	if a == nil {
+		return fail("unknown alert %s", f.Alert)
+	}
+	if f.Time.IsZero() {
+		return fail("fixture has no time")
+	}
+	expect := make(map[string]models.Status)
+	for g, v := range f.Expect {
+		tags, err := opentsdb.ParseTags(strings.Trim(g, "{}"))
+		if g == "{}" || g == "" {
+			tags, err = opentsdb.TagSet{}, nil
+		}
+		if err != nil {
+			return fail("expected group %s: %v", g, err)
+		}
+		var status models.Status
+		if err := status.UnmarshalJSON([]byte(strconv.Quote(v))); err != nil || status == models.StNone {
+			return fail("expected status %s of %s must be normal, warning, critical or unknown", v, g)
+		}
+		expect[tags.String()] = status
+	}
+	crit, err := s.evalFixture(a, a.Crit, f)
+	if err != nil {
+		return fail("crit: %v", err)
+	}
+	warn, err := s.evalFixture(a, a.Warn, f)
+	if err != nil {
+		return fail("warn: %v", err)
+	}
+	actual := make(map[string]models.Status)
+	groups := make(map[string]opentsdb.TagSet)
+	set := func(results map[string]*expr.Result, status models.Status) {
+		for g, res := range results {
+			groups[g] = res.Group
+			if n, _ := valueToFloat(res.Value); n != 0 {
+				actual[g] = status
+			} else if actual[g] == models.StNone {
+				actual[g] = models.StNormal
+			}
+		}
+	}
+	set(warn, models.StWarning)
+	set(crit, models.StCritical)
+	for g := range expect {
+		if _, ok := groups[g]; !ok {
+			tags, _ := opentsdb.ParseTags(strings.Trim(g, "{}"))
+			groups[g] = tags
+		}
+	}
+	for g, tags := range groups {
+		want, ok := expect[g]
+		if !ok {
+			want = models.StNormal
+		}
+		got, ok := actual[g]
+		if !ok {
+			// Groups without results are unknown, as they would be for
+			// an alert whose series stopped.
+			got = models.StUnknown
+		}
+		if got == want {
+			continue
+		}
+		m := &AlertTestMismatch{
+			Group:    tags,
+			Expected: want,
+			Actual:   got,
+			Crit:     crit[g],
+			Warn:     warn[g],
+		}
+		for _, series := range f.Series {
+			if series.Tags.Subset(tags) {
+				m.Series = append(m.Series, series)
+			}
+		}
+		r.Mismatches = append(r.Mismatches, m)
+	}
+	slice.Sort(r.Mismatches, func(i, j int) bool { return r.Mismatches[i].Group.String() < r.Mismatches[j].Group.String() })
+	r.Passed = len(r.Mismatches) == 0
+	return r
+}
+
+// evalFixture evaluates e, an expression of alert a, against the series of
+// f, and returns its results by group.
+func (s *Schedule) evalFixture(a *conf.Alert, e *expr.Expr, f *AlertFixture) (map[string]*expr.Result, error) {
+	if e == nil {
+		return nil, nil
+	}
+	backends := &expr.Backends{
+		TSDBContext: &fixtureTSDB{f.Series},
+		Disabled: map[string]string{
+			expr.BackendGraphite: "not available in alert tests",
+			expr.BackendInflux:   "not available in alert tests",
+			expr.BackendLogstash: "not available in alert tests",
+			expr.BackendElastic:  "not available in alert tests",
+		},
+	}
+	providers := &expr.BosunProviders{
+		Cache:  cache.New(0),
+		Search: s.Search,
+		Squelched: func(tags opentsdb.TagSet) bool {
+			return s.Conf.Squelched(a, s.Conf.Derive(tags))
+		},
+		History: s,
+	}
+	res, _, err := e.ExecuteDownsampled(context.Background(), backends, providers, new(miniprofiler.Profile), f.Time, 0, a.UnjoinedOK, a.Downsample)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]*expr.Result, len(res.Results))
+	for _, r := range res.Results {
+		if _, err := valueToFloat(r.Value); err != nil {
+			return nil, err
+		}
+		results[r.Group.String()] = r
+	}
+	return results, nil
+}
+
+// fixtureTSDB is an OpenTSDB context that answers queries with the series of
+// a fixture, as OpenTSDB 2.2 would: the series of the metric matching the
+// query's filters, grouped by its group by tags and aggregated with its
+// aggregator. Points are aggregated by timestamp, without interpolation.
+// Downsampling and rates are not applied: fixtures hold the points the query
+// would return.
+type fixtureTSDB struct {
+	series opentsdb.ResponseSet
+}
+
+func (f *fixtureTSDB) Version() opentsdb.Version {
+	return opentsdb.Version2_2
+}
+
+func (f *fixtureTSDB) Query(r *opentsdb.Request) (opentsdb.ResponseSet, error) {
+	start, err := opentsdb.ParseTime(r.Start)
+	if err != nil {
+		return nil, err
+	}
+	end := time.Now()
+	if r.End != nil {
+		if end, err = opentsdb.ParseTime(r.End); err != nil {
+			return nil, err
+		}
+	}
+	var rs opentsdb.ResponseSet
+	for _, q := range r.Queries {
+		groups := make(map[string]*opentsdb.Response)
+		points := make(map[string]map[string][]float64)
+		for _, series := range f.series {
+			if series.Metric != q.Metric {
+				continue
+			}
+			match, err := fixtureMatches(q.Filters, series.Tags)
+			if err != nil {
+				return nil, err
+			}
+			if !match {
+				continue
+			}
+			tags := make(opentsdb.TagSet)
+			for _, f := range q.Filters {
+				if f.GroupBy {
+					tags[f.TagK] = series.Tags[f.TagK]
+				}
+			}
+			g := tags.String()
+			if groups[g] == nil {
+				groups[g] = &opentsdb.Response{Metric: q.Metric, Tags: tags, DPS: make(map[string]opentsdb.Point)}
+				points[g] = make(map[string][]float64)
+			}
+			for ts, v := range series.DPS {
+				i, err := strconv.ParseInt(ts, 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				if i < start.Unix() || i > end.Unix() {
+					continue
+				}
+				points[g][ts] = append(points[g][ts], float64(v))
+			}
+		}
+		for g, res := range groups {
+			for ts, vs := range points[g] {
+				v, err := aggregateFixture(q.Aggregator, vs)
+				if err != nil {
+					return nil, err
+				}
+				res.DPS[ts] = opentsdb.Point(v)
+			}
+			rs = append(rs, res)
+		}
+	}
+	return rs, nil
+}
+
+// fixtureMatches returns whether tags match all filters.
+func fixtureMatches(filters []opentsdb.Filter, tags opentsdb.TagSet) (bool, error) {
+	for _, f := range filters {
+		v, ok := tags[f.TagK]
+		if !ok {
+			return false, nil
+		}
+		var match bool
+		switch f.Type {
+		case "literal_or", "not_literal_or":
+			for _, s := range strings.Split(f.Filter, "|") {
+				match = match || s == v
+			}
+		case "iliteral_or", "not_iliteral_or":
+			for _, s := range strings.Split(f.Filter, "|") {
+				match = match || strings.EqualFold(s, v)
+			}
+		case "wildcard", "iwildcard":
+			pattern := "^" + strings.Replace(regexp.QuoteMeta(f.Filter), `\*`, ".*", -1) + "$"
+			if f.Type == "iwildcard" {
+				pattern = "(?i)" + pattern
+			}
+			match = regexp.MustCompile(pattern).MatchString(v)
+		case "regexp":
+			re, err := regexp.Compile(f.Filter)
+			if err != nil {
+				return false, err
+			}
+			match = re.MatchString(v)
+		default:
+			return false, fmt.Errorf("filter %s is not supported in alert tests", f.Type)
+		}
+		if strings.HasPrefix(f.Type, "not_") {
+			match = !match
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func aggregateFixture(aggregator string, vs []float64) (float64, error) {
+	v := vs[0]
+	switch aggregator {
+	case "sum", "zimsum", "avg":
+		for _, x := range vs[1:] {
+			v += x
+		}
+		if aggregator == "avg" {
+			v /= float64(len(vs))
+		}
+	case "min", "mimmin":
+		for _, x := range vs[1:] {
+			v = math.Min(v, x)
+		}
+	case "max", "mimmax":
+		for _, x := range vs[1:] {
+			v = math.Max(v, x)
+		}
+	case "count":
+		v = float64(len(vs))
+	case "none":
+		if len(vs) > 1 {
+			return 0, fmt.Errorf("aggregator none with several series in a group")
+		}
+	default:
+		return 0, fmt.Errorf("aggregator %s is not supported in alert tests", aggregator)
+	}
+	return v, nil
+}
@@ -0,0 +1,77 @@
+package sched
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bosun.org/cmd/bosun/conf"
+	"bosun.org/models"
+)
+
+func TestRunAlertTests(t *testing.T) {
+	defer setup()()
+	dir, err := ioutil.TempDir("", "bosun-alert-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := conf.New("", `
+		tsdbHost = localhost:4242
+		tsdbVersion = 2.2
+		alertTestDir = `+dir+`
+		alert cpu {
+			$q = avg(q("avg:os.cpu{host=*}", "5m", ""))
+			crit = $q > 90
+			warn = $q > 80
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := initSched(c)
+	fixture := func(name, expect string) {
+		err := ioutil.WriteFile(filepath.Join(dir, name+".json"), []byte(`{
+			"alert": "cpu",
+			"time": "2016-01-01T00:10:00Z",
+			"series": [
+				{"metric": "os.cpu", "tags": {"host": "a", "core": "0"}, "dps": {"1451606700": 90, "1451606760": 100}},
+				{"metric": "os.cpu", "tags": {"host": "a", "core": "1"}, "dps": {"1451606700": 100, "1451606760": 100}},
+				{"metric": "os.cpu", "tags": {"host": "b"}, "dps": {"1451606700": 85}},
+				{"metric": "os.cpu", "tags": {"host": "c"}, "dps": {"1451606700": 10}},
+				{"metric": "os.cpu", "tags": {"host": "d"}, "dps": {"1451600000": 100}}
+			],
+			"expect": `+expect+`
+		}`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fixture("pass", `{"{host=a}": "critical", "{host=b}": "warning"}`)
+	fixture("fail", `{"{host=a}": "critical", "{host=c}": "warning"}`)
+	results, err := s.RunAlertTests("cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	fail, pass := results[0], results[1]
+	if !pass.Passed || pass.Error != "" {
+		t.Errorf("expected pass to pass, got %+v", pass)
+	}
+	if fail.Passed || fail.Error != "" || len(fail.Mismatches) != 2 {
+		t.Fatalf("expected fail to fail with 2 mismatches, got %+v", fail)
+	}
+	mb, mc := fail.Mismatches[0], fail.Mismatches[1]
+	if mb.Group.String() != "{host=b}" || mb.Expected != models.StNormal || mb.Actual != models.StWarning {
+		t.Errorf("unexpected mismatch %+v", mb)
+	}
+	if mc.Group.String() != "{host=c}" || mc.Expected != models.StWarning || mc.Actual != models.StNormal || len(mc.Series) != 1 {
+		t.Errorf("unexpected mismatch %+v", mc)
+	}
+	if _, err := s.RunAlertTests("nope"); err == nil {
+		t.Error("expected an error for an unknown alert")
+	}
+}
@@ -1,7 +1,12 @@
 package sched
 
 import (
+	"bytes"
+	"sort"
+	"strings"
 	"testing"
+	"text/template"
+	"time"
 
 	"bosun.org/models"
 	"bosun.org/opentsdb"
@@ -72,3 +77,62 @@ func TestGroupSets_ByAlert(t *testing.T) {
 		t.Fatalf("Expected 1 unique group, but found %d.", len(groups))
 	}
 }
+
+func TestUnknownDataMembers(t *testing.T) {
+	states := States{}
+	for i, host := range []string{"a", "b", "c", "d"} {
+		ak := models.AlertKey("x{host=" + host + "}")
+		states[ak] = &models.IncidentState{
+			AlertKey:           ak,
+			Alert:              ak.Name(),
+			Tags:               ak.Group().Tags(),
+			LastAbnormalStatus: models.StCritical,
+			Result:             &models.Result{Value: models.Float(i + 1)},
+		}
+	}
+	s := &Schedule{}
+	body := template.Must(template.New("").Parse(`{{range .Members}}{{.Tags.host}}={{.Value}} {{end}}`))
+	render := func(name string, group models.AlertKeys) (*unknownContext, string) {
+		data := s.unknownData(time.Now(), name, group, states)
+		buf := new(bytes.Buffer)
+		if err := body.Execute(buf, data); err != nil {
+			t.Fatal(err)
+		}
+		return data, buf.String()
+	}
+
+	groups := states.GroupSets(4)
+	if len(groups) != 1 {
+		t.Fatalf("Expected 1 unique group, but found %d.", len(groups))
+	}
+	for name, group := range groups {
+		sort.Sort(group)
+		data, out := render(name, group)
+		if len(data.Members) != 4 {
+			t.Fatalf("Expected 4 members, but found %d.", len(data.Members))
+		}
+		for _, m := range data.Members {
+			if m.LastStatus != models.StCritical {
+				t.Errorf("%s: expected last status critical, got %s", m.AlertKey, m.LastStatus)
+			}
+		}
+		if expected := "a=1 b=2 c=3 d=4 "; out != expected {
+			t.Errorf("Expected %q, got %q.", expected, out)
+		}
+	}
+
+	// Ungrouped notifications have a single member.
+	groups = states.GroupSets(5)
+	if len(groups) != 4 {
+		t.Fatalf("Expected 4 unique groups, but found %d.", len(groups))
+	}
+	for name, group := range groups {
+		data, out := render(name, group)
+		if len(data.Members) != 1 || data.Members[0].AlertKey != group[0] {
+			t.Fatalf("%s: expected a single member %s, got %v", name, group[0], data.Members)
+		}
+		if expected := data.Members[0].Tags["host"] + "="; !strings.HasPrefix(out, expected) {
+			t.Errorf("%s: expected %q to start with %q", name, out, expected)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package sched
+
+import (
+	"time"
+
+	"bosun.org/cmd/bosun/conf"
+	"bosun.org/models"
+	"bosun.org/slog"
+	"github.com/bradfitz/slice"
+)
+
+// journalEntry returns the journal entry of nots, a notification or a first
+// success chain, for st.
+func journalEntry(st *models.IncidentState, nots []*conf.Notification) *models.NotificationJournalEntry {
+	e := &models.NotificationJournalEntry{
+		AlertKey:     st.AlertKey,
+		Notification: nots[0].Name,
+		IncidentId:   st.Id,
+		Status:       st.CurrentStatus,
+		Time:         utcNow(),
+	}
+	if len(nots) > 1 {
+		for _, n := range nots {
+			e.Chain = append(e.Chain, n.Name)
+		}
+	}
+	return e
+}
+
+// journal records that nots are owed to st, so that they are sent after a
+// restart if bosun stops before sending them.
+func (s *Schedule) journal(st *models.IncidentState, nots ...*conf.Notification) {
+	if s.Conf.JournalRetention == 0 {
+		return
+	}
+	if err := s.DataAccess.Notifications().JournalNotification(journalEntry(st, nots)); err != nil {
+		slog.Errorf("journaling notification %s for %s: %v", nots[0].Name, st.AlertKey, err)
+	}
+}
+
+// journalSent marks the pending notifications as sent in the journal. They
+// may have been skipped instead, for example because the alert key was
+// silenced, which a replay would do again. First success chains that were
+// sent are marked by finishChain once they are done instead.
+func (s *Schedule) journalSent() {
+	now := utcNow()
+	for n, states := range s.pendingNotifications {
+		for _, st := range states {
+			s.journalMarkSent(st, []*conf.Notification{n}, now)
+		}
+	}
+	for _, c := range s.pendingChains {
+		if len(c.nots) > 0 {
+			s.journalMarkSent(c.st, c.nots, now)
+		}
+	}
+}
+
+// journalMarkSent marks nots, a notification or a first success chain, as
+// sent to st at t in the journal.
+func (s *Schedule) journalMarkSent(st *models.IncidentState, nots []*conf.Notification, t time.Time) {
+	if s.Conf.JournalRetention == 0 {
+		return
+	}
+	if err := s.DataAccess.Notifications().MarkNotificationSent(journalEntry(st, nots), t); err != nil {
+		slog.Errorf("journaling notification %s for %s as sent: %v", nots[0].Name, st.AlertKey, err)
+	}
+}
+
+// sentSince returns whether the journal records n as sent to st at or after
+// t, such as by replayNotifications.
+func (s *Schedule) sentSince(st *models.IncidentState, n *conf.Notification, t time.Time) bool {
+	if s.Conf.JournalRetention == 0 {
+		return false
+	}
+	sent, err := s.DataAccess.Notifications().GetNotificationSentTime(journalEntry(st, []*conf.Notification{n}))
+	if err != nil {
+		slog.Errorln(err)
+		return false
+	}
+	return !sent.IsZero() && sent.Unix() >= t.Unix()
+}
+
+// replayNotifications queues the journaled notifications that bosun did not
+// send before it last stopped, so that the dispatcher sends them. Those that
+// were sent after they were queued, are older than the journal retention, or
+// whose incident or notification no longer exists are dropped.
+func (s *Schedule) replayNotifications() {
+	if s.Conf.JournalRetention == 0 {
+		return
+	}
+	nd := s.DataAccess.Notifications()
+	since := utcNow().Add(-s.Conf.JournalRetention)
+	entries, err := nd.GetJournaledNotifications()
+	if err != nil {
+		slog.Errorf("reading the notification journal: %v", err)
+		return
+	}
+	slice.Sort(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	drop := func(e *models.NotificationJournalEntry, why string) {
+		slog.Infof("not replaying notification %s for %s queued at %v: %s", e.Notification, e.AlertKey, e.Time, why)
+		if err := nd.MarkNotificationSent(e, utcNow()); err != nil {
+			slog.Errorln(err)
+		}
+	}
+	s.Lock("ReplayNotifications")
+	defer s.Unlock()
+	for _, e := range entries {
+		if e.Time.Before(since) {
+			slog.Infof("not replaying notification %s for %s queued at %v: older than notificationJournalRetention", e.Notification, e.AlertKey, e.Time)
+			continue
+		}
+		sent, err := nd.GetNotificationSentTime(e)
+		if err != nil {
+			slog.Errorln(err)
+			continue
+		}
+		if !sent.IsZero() && sent.Unix() >= e.Time.Unix() {
+			drop(e, "already sent")
+			continue
+		}
+		st, err := s.DataAccess.State().GetIncidentState(e.IncidentId)
+		if err != nil {
+			slog.Errorln(err)
+			continue
+		}
+		if st == nil || st.AlertKey != e.AlertKey {
+			drop(e, "incident not found")
+			continue
+		}
+		names := e.Chain
+		if names == nil {
+			names = []string{e.Notification}
+		}
+		var nots []*conf.Notification
+		for _, name := range names {
+			if n := s.Conf.AlertNotification(e.AlertKey.Name(), name); n != nil {
+				nots = append(nots, n)
+			}
+		}
+		switch len(nots) {
+		case 0:
+			drop(e, "notification not found")
+			continue
+		case 1:
+			s.Notify(st, nots[0])
+		default:
+			s.NotifyFirstSuccess(st, nots)
+		}
+		slog.Infof("replaying notification %s for %s queued at %v", e.Notification, e.AlertKey, e.Time)
+	}
+	if err := nd.PruneNotificationJournal(since); err != nil {
+		slog.Errorf("pruning the notification journal: %v", err)
+	}
+}
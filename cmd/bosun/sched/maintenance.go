@@ -0,0 +1,153 @@
+package sched
+
+import (
+	"fmt"
+	"time"
+
+	"bosun.org/cmd/bosun/conf"
+	"bosun.org/collect"
+	"bosun.org/metadata"
+	"bosun.org/models"
+	"bosun.org/slog"
+)
+
+func init() {
+	metadata.AddMetricMeta(
+		"bosun.alerts.maintenance_suppressed", metadata.Counter, metadata.Alert,
+		"The number of notifications not sent because bosun was in maintenance mode.")
+}
+
+// maxMaintenance is the longest maintenance window that can be set at once,
+// so that maintenance mode is never left on by accident.
+const maxMaintenance = 24 * time.Hour
+
+// maxMaintenanceHistory is the number of maintenance windows kept for audit.
+const maxMaintenanceHistory = 100
+
+// Maintenance is a window during which no notifications are sent. Alerts are
+// still checked and their incidents recorded, but notifications that come due
+// are logged and dropped.
+type Maintenance struct {
+	Start   time.Time
+	End     time.Time
+	User    string
+	Message string
+	// Cleared is when and by whom the window was ended before End.
+	Cleared   *time.Time `json:",omitempty"`
+	ClearedBy string     `json:",omitempty"`
+	// Suppressed is the number of notifications not sent during the window.
+	Suppressed int64
+}
+
+// Active returns whether notifications are suppressed at t.
+func (m *Maintenance) Active(t time.Time) bool {
+	return m.Cleared == nil && !t.Before(m.Start) && t.Before(m.End)
+}
+
+// SetMaintenance starts maintenance mode for d, replacing the current window
+// if there is one. user and message are required and recorded for audit.
+func (s *Schedule) SetMaintenance(d time.Duration, user, message string) (*Maintenance, error) {
+	if d <= 0 || d > maxMaintenance {
+		return nil, fmt.Errorf("maintenance duration must be between 0 and %v", maxMaintenance)
+	}
+	if user == "" || message == "" {
+		return nil, fmt.Errorf("maintenance requires a user and a message")
+	}
+	now := utcNow()
+	m := &Maintenance{
+		Start:   now,
+		End:     now.Add(d),
+		User:    user,
+		Message: message,
+	}
+	s.maintenanceLock.Lock()
+	defer s.maintenanceLock.Unlock()
+	s.clearMaintenance(now, user)
+	s.maintenance = append(s.maintenance, m)
+	if len(s.maintenance) > maxMaintenanceHistory {
+		s.maintenance = s.maintenance[len(s.maintenance)-maxMaintenanceHistory:]
+	}
+	slog.Infof("maintenance mode set by %s until %v: %s", user, m.End, message)
+	return m, nil
+}
+
+// ClearMaintenance ends the current maintenance window early.
+func (s *Schedule) ClearMaintenance(user string) error {
+	if user == "" {
+		return fmt.Errorf("clearing maintenance requires a user")
+	}
+	s.maintenanceLock.Lock()
+	defer s.maintenanceLock.Unlock()
+	if !s.clearMaintenance(utcNow(), user) {
+		return fmt.Errorf("maintenance mode is not active")
+	}
+	slog.Infof("maintenance mode cleared by %s", user)
+	return nil
+}
+
+// clearMaintenance marks the active window cleared by user at t, and returns
+// whether there was one. maintenanceLock must be held.
+func (s *Schedule) clearMaintenance(t time.Time, user string) bool {
+	m := s.activeMaintenance(t)
+	if m == nil {
+		return false
+	}
+	m.Cleared = &t
+	m.ClearedBy = user
+	return true
+}
+
+func (s *Schedule) activeMaintenance(t time.Time) *Maintenance {
+	if len(s.maintenance) == 0 {
+		return nil
+	}
+	if m := s.maintenance[len(s.maintenance)-1]; m.Active(t) {
+		return m
+	}
+	return nil
+}
+
+// ActiveMaintenance returns a copy of the current maintenance window, or nil
+// if notifications are not suppressed.
+func (s *Schedule) ActiveMaintenance() *Maintenance {
+	s.maintenanceLock.Lock()
+	defer s.maintenanceLock.Unlock()
+	if m := s.activeMaintenance(utcNow()); m != nil {
+		c := *m
+		return &c
+	}
+	return nil
+}
+
+// MaintenanceHistory returns copies of the recent maintenance windows, most
+// recent first.
+func (s *Schedule) MaintenanceHistory() []*Maintenance {
+	s.maintenanceLock.Lock()
+	defer s.maintenanceLock.Unlock()
+	history := make([]*Maintenance, len(s.maintenance))
+	for i, m := range s.maintenance {
+		c := *m
+		history[len(history)-1-i] = &c
+	}
+	return history
+}
+
+// suppressForMaintenance returns a copy of the active maintenance window after
+// counting the n notifications it prevents, or nil if there is none.
+func (s *Schedule) suppressForMaintenance(n int) *Maintenance {
+	s.maintenanceLock.Lock()
+	defer s.maintenanceLock.Unlock()
+	m := s.activeMaintenance(utcNow())
+	if m == nil {
+		return nil
+	}
+	m.Suppressed += int64(n)
+	collect.Add("alerts.maintenance_suppressed", nil, int64(n))
+	c := *m
+	return &c
+}
+
+// logSuppressed logs that notification n for ak was not sent because of m.
+func (m *Maintenance) logSuppressed(n *conf.Notification, ak models.AlertKey) {
+	slog.Infof("maintenance mode prevented notification %s for %s (set by %s until %v: %s)", n.Name, ak, m.User, m.End, m.Message)
+}
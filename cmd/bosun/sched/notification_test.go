@@ -2,11 +2,20 @@ package sched
 
 import (
 	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"bosun.org/cmd/bosun/conf"
+	"bosun.org/cmd/bosun/database"
 	"bosun.org/models"
+	"bosun.org/opentsdb"
+	"github.com/garyburd/redigo/redis"
 )
 
 func TestActionNotificationTemplates(t *testing.T) {
@@ -145,3 +154,717 @@ func TestActionNotificationGrouping(t *testing.T) {
 	expect("n2", acrit, bwarn, cA)
 	expect("n3", bcrit, cB)
 }
+
+func TestTestModeDoesNotNotify(t *testing.T) {
+	defer setup()()
+	s := testSched(t, &schedTest{
+		conf: `
+		template t {
+			subject = 1
+		}
+		notification n {
+			print = true
+		}
+		alert a {
+			template = t
+			critNotification = n
+			crit = avg(q("avg:m{a=b}", "5m", "")) > 0
+			testMode = true
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:m{a=b}", ` + window5Min + `)`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+		},
+		state: map[schedState]bool{
+			schedState{"a{a=b}", "critical"}: true,
+		},
+	})
+	if len(s.pendingNotifications) != 0 {
+		t.Errorf("expected no pending notifications, got %v", s.pendingNotifications)
+	}
+	if c := s.WouldNotifyCounts()["a"]; c != 1 {
+		t.Errorf("expected 1 would-be notification for a, got %d", c)
+	}
+}
+
+func TestNextByStatus(t *testing.T) {
+	defer setup()()
+	s := testSched(t, &schedTest{
+		conf: `
+		template t {
+			subject = 1
+		}
+		notification chat {
+			print = true
+		}
+		notification pager {
+			print = true
+		}
+		notification n {
+			print = true
+			next = chat
+			critNext = pager
+		}
+		alert a {
+			template = t
+			critNotification = n
+			crit = avg(q("avg:m{a=b}", "5m", "")) > 0
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:m{a=b}", ` + window5Min + `)`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+		},
+		state: map[schedState]bool{
+			schedState{"a{a=b}", "critical"}: true,
+		},
+	})
+	s.sendNotifications(func(models.AlertKey) *models.Silence { return nil })
+	due, err := s.DataAccess.Notifications().GetDueNotifications()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nots := due[models.AlertKey("a{a=b}")]
+	if _, ok := nots["pager"]; !ok || len(nots) != 1 {
+		t.Errorf("expected only pager to be queued for a critical alert, got %v", nots)
+	}
+	if n := s.Conf.Notifications["n"]; n.NextFor(models.StWarning) != s.Conf.Notifications["chat"] {
+		t.Errorf("expected warnings to fall back to next")
+	}
+}
+
+func TestNotificationTags(t *testing.T) {
+	defer setup()()
+	s := testSched(t, &schedTest{
+		conf: `
+		template t {
+			subject = 1
+		}
+		notification ops {
+			print = true
+		}
+		notification dba {
+			print = true
+		}
+		lookup byTeam {
+			entry team=db {
+				n = dba
+			}
+			entry team=* {
+				n = ops
+			}
+		}
+		alert a {
+			template = t
+			critNotification = lookup("byTeam", "n")
+			crit = avg(q("avg:m{host=*}", "5m", "")) > 0
+			notificationTags = avg(q("avg:owner{host=*,team=*}", "5m", ""))
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:m{host=*}", ` + window5Min + `)`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"host": "db1"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"host": "web1"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+			`q("avg:owner{host=*,team=*}", ` + window5Min + `)`: {
+				{
+					Metric: "owner",
+					Tags:   opentsdb.TagSet{"host": "db1", "team": "db"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+				{
+					Metric: "owner",
+					Tags:   opentsdb.TagSet{"host": "web1", "team": "web"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+		},
+		state: map[schedState]bool{
+			schedState{"a{host=db1}", "critical"}:  true,
+			schedState{"a{host=web1}", "critical"}: true,
+		},
+	})
+	routed := make(map[string]models.AlertKey)
+	for n, states := range s.pendingNotifications {
+		for _, st := range states {
+			routed[n.Name] = st.AlertKey
+		}
+	}
+	if routed["dba"] != "a{host=db1}" || routed["ops"] != "a{host=web1}" || len(routed) != 2 {
+		t.Errorf("unexpected routing: %v", routed)
+	}
+}
+
+func TestNotifyFirstSuccess(t *testing.T) {
+	for primaryStatus, expect := range map[int]string{
+		http.StatusOK:                  "/primary",
+		http.StatusInternalServerError: "/primary /secondary",
+	} {
+		func() {
+			defer setup()()
+			var hits []string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits = append(hits, r.URL.Path)
+				if r.URL.Path == "/primary" {
+					w.WriteHeader(primaryStatus)
+				}
+			}))
+			defer ts.Close()
+			s := testSched(t, &schedTest{
+				conf: `
+				template t {
+					subject = 1
+				}
+				notification primary {
+					post = ` + ts.URL + `/primary
+					priority = 1
+				}
+				notification ticket {
+					post = ` + ts.URL + `/secondary
+					priority = 2
+				}
+				alert a {
+					template = t
+					critNotification = primary,ticket
+					critNotificationMode = firstSuccess
+					crit = avg(q("avg:m{a=b}", "5m", "")) > 0
+				}`,
+				queries: map[string]opentsdb.ResponseSet{
+					`q("avg:m{a=b}", ` + window5Min + `)`: {
+						{
+							Metric: "m",
+							Tags:   opentsdb.TagSet{"a": "b"},
+							DPS:    map[string]opentsdb.Point{"0": 1},
+						},
+					},
+				},
+				state: map[schedState]bool{
+					schedState{"a{a=b}", "critical"}: true,
+				},
+			})
+			s.sendNotifications(func(models.AlertKey) *models.Silence { return nil })
+			waitChains(t, s)
+			if got := strings.Join(hits, " "); got != expect {
+				t.Errorf("primary status %d: got %q, expected %q", primaryStatus, got, expect)
+			}
+		}()
+	}
+}
+
+// A delivery that does not finish neither holds up sendNotifications nor
+// stops the chain: the next notification is tried after firstSuccessTimeout.
+func TestNotifyFirstSuccessTimeout(t *testing.T) {
+	defer setup()()
+	release := make(chan struct{})
+	hits := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits <- r.URL.Path
+		if r.URL.Path == "/primary" {
+			<-release
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+	s := testSched(t, &schedTest{
+		conf: `
+		firstSuccessTimeout = 100ms
+		template t {
+			subject = 1
+		}
+		notification primary {
+			post = ` + ts.URL + `/primary
+			priority = 1
+		}
+		notification ticket {
+			post = ` + ts.URL + `/secondary
+			priority = 2
+		}
+		alert a {
+			template = t
+			critNotification = primary,ticket
+			critNotificationMode = firstSuccess
+			crit = avg(q("avg:m{a=b}", "5m", "")) > 0
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:m{a=b}", ` + window5Min + `)`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+		},
+		state: map[schedState]bool{
+			schedState{"a{a=b}", "critical"}: true,
+		},
+	})
+	start := time.Now()
+	s.sendNotifications(func(models.AlertKey) *models.Silence { return nil })
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("sendNotifications took %v, expected it not to wait for the chain", d)
+	}
+	waitChains(t, s)
+	for _, expect := range []string{"/primary", "/secondary"} {
+		select {
+		case got := <-hits:
+			if got != expect {
+				t.Errorf("got %s, expected %s", got, expect)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a post to %s", expect)
+		}
+	}
+}
+
+// waitChains waits for the first success chains of s being sent in the
+// background.
+func waitChains(t *testing.T, s *Schedule) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.drainLock.Lock()
+		n := s.chains
+		s.drainLock.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d notification chains still being sent", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	defer setup()()
+	posts := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		posts <- string(b)
+	}))
+	defer ts.Close()
+	s := testSched(t, &schedTest{
+		conf: `
+		template t {
+			subject = down
+		}
+		notification n {
+			post = ` + ts.URL + `
+		}
+		alert a {
+			template = t
+			critNotification = n
+			crit = avg(q("avg:m{a=b}", "5m", "")) > 0
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:m{a=b}", ` + window5Min + `)`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+		},
+		state: map[schedState]bool{
+			schedState{"a{a=b}", "critical"}: true,
+		},
+	})
+	if _, err := s.SetMaintenance(48*time.Hour, "ops", "datacenter move"); err == nil {
+		t.Error("expected error for maintenance longer than maxMaintenance")
+	}
+	if _, err := s.SetMaintenance(time.Hour, "", "datacenter move"); err == nil {
+		t.Error("expected error for maintenance without a user")
+	}
+	if _, err := s.SetMaintenance(time.Hour, "ops", "datacenter move"); err != nil {
+		t.Fatal(err)
+	}
+	s.sendNotifications(s.Silenced())
+	select {
+	case p := <-posts:
+		t.Fatalf("expected no notification during maintenance, got %s", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+	m := s.ActiveMaintenance()
+	if m == nil || m.Suppressed != 1 || m.User != "ops" {
+		t.Fatalf("expected active maintenance by ops with 1 suppressed notification, got %+v", m)
+	}
+
+	// An expired window no longer suppresses notifications.
+	s.maintenance[0].End = utcNow().Add(-time.Minute)
+	if m := s.ActiveMaintenance(); m != nil {
+		t.Fatalf("expected expired maintenance, got %+v", m)
+	}
+	if err := s.ClearMaintenance("ops"); err == nil {
+		t.Error("expected error clearing inactive maintenance")
+	}
+	s.sendNotifications(s.Silenced())
+	select {
+	case p := <-posts:
+		if p != "down" {
+			t.Errorf("expected notification down, got %s", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected notification after maintenance expired")
+	}
+
+	s.SetMaintenance(time.Hour, "ops", "again")
+	if err := s.ClearMaintenance("oncall"); err != nil {
+		t.Fatal(err)
+	}
+	h := s.MaintenanceHistory()
+	if len(h) != 2 || h[0].Message != "again" || h[0].ClearedBy != "oncall" || h[1].Suppressed != 1 {
+		t.Errorf("unexpected maintenance history %+v", h)
+	}
+}
+
+func TestAlertStorm(t *testing.T) {
+	defer setup()()
+	posts := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		posts <- string(b)
+	}))
+	defer ts.Close()
+	s := testSched(t, &schedTest{
+		conf: `
+		stormThreshold = 1
+		template t {
+			subject = down
+		}
+		notification n {
+			post = ` + ts.URL + `
+		}
+		alert a {
+			template = t
+			critNotification = n
+			crit = avg(q("avg:m{a=*}", "5m", "")) > 0
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:m{a=*}", ` + window5Min + `)`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"a": "c"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+		},
+		state: map[schedState]bool{
+			schedState{"a{a=b}", "critical"}: true,
+			schedState{"a{a=c}", "critical"}: true,
+		},
+	})
+	storm := s.ActiveStorm()
+	if storm == nil || storm.Peak != 2 {
+		t.Fatalf("expected an alert storm with a peak of 2, got %+v", storm)
+	}
+	s.sendNotifications(s.Silenced())
+	select {
+	case p := <-posts:
+		if p != "bosun alert storm: 2 notifications suppressed" {
+			t.Errorf("expected a digest, got %s", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a digest during the storm")
+	}
+	select {
+	case p := <-posts:
+		t.Fatalf("expected only the digest during the storm, got %s", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The storm passes once the critical transitions leave the window.
+	s.criticalTimes = []time.Time{utcNow().Add(-time.Hour)}
+	if storm := s.ActiveStorm(); storm != nil {
+		t.Fatalf("expected the storm to be over, got %+v", storm)
+	}
+	h := s.StormHistory()
+	if len(h) != 1 || h[0].End == nil || h[0].Suppressed != 2 {
+		t.Errorf("unexpected storm history %+v", h)
+	}
+	s.sendNotifications(s.Silenced())
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-posts:
+			if p != "down" {
+				t.Errorf("expected notification down, got %s", p)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected notifications after the storm")
+		}
+	}
+}
+
+func TestNotificationReminder(t *testing.T) {
+	defer setup()()
+	posts := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		posts <- string(b)
+	}))
+	defer ts.Close()
+	s := testSched(t, &schedTest{
+		conf: `
+		template t {
+			subject = down
+		}
+		notification n {
+			post = ` + ts.URL + `
+			reminder = 2h
+			maxReminders = 2
+			runOnActions = false
+		}
+		alert a {
+			template = t
+			critNotification = n
+			crit = avg(q("avg:m{a=b}", "5m", "")) > 0
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:m{a=b}", ` + window5Min + `)`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+		},
+		state: map[schedState]bool{
+			schedState{"a{a=b}", "critical"}: true,
+		},
+	})
+	ak := models.AlertKey("a{a=b}")
+	nd := s.DataAccess.Notifications()
+	expectPost := func(what string) {
+		select {
+		case p := <-posts:
+			if p != "down" {
+				t.Errorf("expected %s down, got %s", what, p)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %s", what)
+		}
+	}
+	expectQueued := func(what string, expect ...string) {
+		got := queuedNotifications(t, ak)
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("%s: expected %v queued, got %v", what, expect, got)
+		}
+	}
+	// The check of testSched queued the notification. Sending it queues the
+	// first reminder.
+	s.checkNotifications()
+	expectPost("notification")
+	expectQueued("after the notification", "n#reminder1")
+
+	// The last reminder is sent, but queues no other.
+	if err := nd.ClearNotifications(ak); err != nil {
+		t.Fatal(err)
+	}
+	if err := nd.InsertNotification(ak, "n#reminder2", utcNow().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	s.checkNotifications()
+	expectPost("reminder")
+	expectQueued("after the last reminder")
+
+	// Acknowledged incidents are not reminded of.
+	if err := nd.InsertNotification(ak, "n#reminder1", utcNow().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ActionByAlertKey("", "", models.ActionAcknowledge, ak); err != nil {
+		t.Fatal(err)
+	}
+	s.checkNotifications()
+	select {
+	case p := <-posts:
+		t.Fatalf("expected no reminder after the acknowledgement, got %s", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+	expectQueued("after the acknowledgement")
+}
+
+// queuedNotifications returns the names of the notifications queued for ak,
+// due or not, sorted.
+func queuedNotifications(t *testing.T, ak models.AlertKey) []string {
+	conn := db.(database.Connector).GetConnection()
+	defer conn.Close()
+	keys, err := redis.Strings(conn.Do("ZRANGE", "pendingNotifications", 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, k := range keys {
+		if strings.HasPrefix(k, string(ak)+":") {
+			names = append(names, strings.TrimPrefix(k, string(ak)+":"))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDrain(t *testing.T) {
+	defer setup()()
+	release := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer ts.Close()
+	s := testSched(t, &schedTest{
+		conf: `
+		template t {
+			subject = down
+		}
+		notification n {
+			post = ` + ts.URL + `
+		}
+		alert a {
+			template = t
+			critNotification = n
+			crit = avg(q("avg:m{a=b}", "5m", "")) > 0
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:m{a=b}", ` + window5Min + `)`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+		},
+		state: map[schedState]bool{
+			schedState{"a{a=b}", "critical"}: true,
+		},
+	})
+	if n := s.Drain(100 * time.Millisecond); n != 1 {
+		t.Fatalf("expected 1 notification left in flight, got %d", n)
+	}
+	due, err := s.DataAccess.Notifications().GetDueNotifications()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := due["a{a=b}"]["n"]; !ok {
+		t.Errorf("expected notification n for a{a=b} to be queued for retry, got %v", due)
+	}
+	// Checks and dispatch stop while draining.
+	s.CheckNotifications()
+	if due, _ := s.DataAccess.Notifications().GetDueNotifications(); len(due) == 0 {
+		t.Error("expected queued notification to be left for after restart")
+	}
+	close(release)
+	if n := s.Drain(5 * time.Second); n != 0 {
+		t.Errorf("expected all notifications delivered, got %d left", n)
+	}
+}
+
+func TestNotificationJournal(t *testing.T) {
+	defer setup()()
+	posts := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		posts <- string(b)
+	}))
+	defer ts.Close()
+	s := testSched(t, &schedTest{
+		conf: `
+		template t {
+			subject = down
+		}
+		notification n {
+			post = ` + ts.URL + `
+		}
+		alert a {
+			template = t
+			critNotification = n
+			crit = avg(q("avg:m{a=b}", "5m", "")) > 0
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:m{a=b}", ` + window5Min + `)`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+		},
+		state: map[schedState]bool{
+			schedState{"a{a=b}", "critical"}: true,
+		},
+	})
+	nd := s.DataAccess.Notifications()
+	entries, err := nd.GetJournaledNotifications()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Notification != "n" || entries[0].AlertKey != "a{a=b}" || entries[0].Status != models.StCritical {
+		t.Fatalf("unexpected journal: %+v", entries)
+	}
+	e := entries[0]
+
+	// Bosun stops before sending the notification, and replays it after
+	// restarting.
+	s.pendingNotifications = nil
+	s.replayNotifications()
+	s.checkNotifications()
+	select {
+	case p := <-posts:
+		if p != "down" {
+			t.Errorf("expected notification down, got %s", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the replayed notification")
+	}
+	if entries, _ := nd.GetJournaledNotifications(); len(entries) != 0 {
+		t.Fatalf("expected the sent notification to leave the journal, got %+v", entries)
+	}
+
+	// An entry sent after it was queued is not sent again.
+	e.Time = utcNow().Add(-time.Minute)
+	if err := nd.JournalNotification(e); err != nil {
+		t.Fatal(err)
+	}
+	s.replayNotifications()
+	if len(s.pendingNotifications) != 0 {
+		t.Errorf("expected a sent notification not to be replayed, got %v", s.pendingNotifications)
+	}
+
+	// Nor is one older than the retention.
+	e.Time = utcNow().Add(-48 * time.Hour)
+	e.IncidentId = -1
+	if err := nd.JournalNotification(e); err != nil {
+		t.Fatal(err)
+	}
+	s.replayNotifications()
+	if len(s.pendingNotifications) != 0 {
+		t.Errorf("expected an old notification not to be replayed, got %v", s.pendingNotifications)
+	}
+	if entries, _ := nd.GetJournaledNotifications(); len(entries) != 0 {
+		t.Errorf("expected old entries to be pruned, got %+v", entries)
+	}
+	select {
+	case p := <-posts:
+		t.Errorf("expected no other notification, got %s", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -4,13 +4,18 @@ import (
 	"bytes"
 	"fmt"
 	htemplate "html/template"
+	"sort"
 	"strings"
 	ttemplate "text/template"
 	"time"
 
 	"bosun.org/cmd/bosun/conf"
+	"bosun.org/collect"
+	"bosun.org/metadata"
 	"bosun.org/models"
+	"bosun.org/opentsdb"
 	"bosun.org/slog"
+	"golang.org/x/net/context"
 )
 
 func (s *Schedule) dispatchNotifications() {
@@ -42,10 +47,69 @@ func (s *Schedule) Notify(st *models.IncidentState, n *conf.Notification) {
 		s.pendingNotifications = make(map[*conf.Notification][]*models.IncidentState)
 	}
 	s.pendingNotifications[n] = append(s.pendingNotifications[n], st)
+	s.journal(st, n)
+}
+
+// notificationChain is a list of notifications to try in order until one is
+// delivered.
+type notificationChain struct {
+	st   *models.IncidentState
+	nots []*conf.Notification
+}
+
+// NotifyFirstSuccess queues nots to be sent to st one at a time, in order,
+// until one of them is delivered successfully.
+func (s *Schedule) NotifyFirstSuccess(st *models.IncidentState, nots []*conf.Notification) {
+	s.pendingChains = append(s.pendingChains, notificationChain{st, nots})
+	s.journal(st, nots...)
+}
+
+func init() {
+	metadata.AddMetricMeta(
+		"bosun.alerts.would_notify", metadata.Counter, metadata.Alert,
+		"The number of notifications alerts in test mode would have sent.")
+}
+
+// testModeNotify logs and counts the notifications a test mode alert would
+// have sent, instead of queueing them.
+func (s *Schedule) testModeNotify(st *models.IncidentState, nots map[string]*conf.Notification) {
+	if len(nots) == 0 {
+		return
+	}
+	names := make([]string, 0, len(nots))
+	for name := range nots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	slog.Infof("test mode: alert %s (%s) would have notified %s", st.AlertKey, st.CurrentStatus, strings.Join(names, ", "))
+	s.wouldNotifyLock.Lock()
+	s.wouldNotify[st.AlertKey.Name()] += int64(len(nots))
+	s.wouldNotifyLock.Unlock()
+	collect.Add("alerts.would_notify", opentsdb.TagSet{"alert": st.AlertKey.Name()}, int64(len(nots)))
+}
+
+// WouldNotifyCounts returns, by alert name, the number of notifications test
+// mode alerts would have sent since bosun started.
+func (s *Schedule) WouldNotifyCounts() map[string]int64 {
+	s.wouldNotifyLock.Lock()
+	defer s.wouldNotifyLock.Unlock()
+	counts := make(map[string]int64, len(s.wouldNotify))
+	for name, c := range s.wouldNotify {
+		counts[name] = c
+	}
+	return counts
 }
 
 // CheckNotifications processes past notification events. It returns the next time a notification is needed.
+// Once the schedule is draining it does nothing, as Drain sends them itself.
 func (s *Schedule) CheckNotifications() time.Time {
+	if s.isDraining() {
+		return utcNow().Add(time.Minute)
+	}
+	return s.checkNotifications()
+}
+
+func (s *Schedule) checkNotifications() time.Time {
 	silenced := s.Silenced()
 	s.Lock("CheckNotifications")
 	defer s.Unlock()
@@ -61,8 +125,9 @@ func (s *Schedule) CheckNotifications() time.Time {
 			continue
 		}
 		for name, t := range ns {
-			n, present := s.Conf.Notifications[name]
-			if !present {
+			base, i, isReminder := parseReminder(name)
+			n := s.Conf.AlertNotification(ak.Name(), base)
+			if n == nil {
 				continue
 			}
 			//If alert is currently unevaluated because of a dependency,
@@ -76,6 +141,10 @@ func (s *Schedule) CheckNotifications() time.Time {
 				}
 			}
 			if unevaluated {
+				if isReminder {
+					s.DataAccess.Notifications().InsertNotification(ak, name, t.Add(time.Minute))
+					continue
+				}
 				s.QueueNotification(ak, n, t.Add(time.Minute))
 				continue
 			}
@@ -87,11 +156,22 @@ func (s *Schedule) CheckNotifications() time.Time {
 			if st == nil {
 				continue
 			}
+			if isReminder {
+				s.pendingReminders = append(s.pendingReminders, reminder{st, n, i})
+				continue
+			}
+			if s.sentSince(st, n, t) {
+				slog.Infof("notification %s for %s was already sent, not sending it again", n.Name, ak)
+				continue
+			}
 			s.Notify(st, n)
 		}
 	}
 	s.sendNotifications(silenced)
+	s.journalSent()
 	s.pendingNotifications = nil
+	s.pendingChains = nil
+	s.pendingReminders = nil
 	err = s.DataAccess.Notifications().ClearNotificationsBefore(latestTime)
 	if err != nil {
 		slog.Error("Error clearing notifications", err)
@@ -110,40 +190,197 @@ func (s *Schedule) sendNotifications(silenced SilenceTester) {
 		slog.Infoln("quiet mode prevented", len(s.pendingNotifications), "notifications")
 		return
 	}
-	for n, states := range s.pendingNotifications {
-		for _, st := range states {
-			ak := st.AlertKey
-			alert := s.Conf.Alerts[ak.Name()]
-			if alert == nil {
-				continue
+	n := len(s.pendingChains) + len(s.pendingReminders)
+	for _, states := range s.pendingNotifications {
+		n += len(states)
+	}
+	if m := s.suppressForMaintenance(n); m != nil {
+		for n, states := range s.pendingNotifications {
+			for _, st := range states {
+				m.logSuppressed(n, st.AlertKey)
 			}
-			silenced := silenced(ak) != nil
-			if st.CurrentStatus == models.StUnknown {
-				if silenced {
-					slog.Infoln("silencing unknown", ak)
-					continue
-				}
-				s.pendingUnknowns[n] = append(s.pendingUnknowns[n], st)
-			} else if silenced {
-				slog.Infof("silencing %s", ak)
-				continue
-			} else if !alert.Log && (!st.Open || !st.NeedAck) {
-				slog.Errorf("Cannot notify acked or closed alert %s. Clearing.", ak)
-				if err := s.DataAccess.Notifications().ClearNotifications(ak); err != nil {
-					slog.Error(err)
-				}
-				continue
-			} else {
-				s.notify(st, n)
+		}
+		for _, c := range s.pendingChains {
+			if len(c.nots) > 0 {
+				m.logSuppressed(c.nots[0], c.st.AlertKey)
 			}
-			if n.Next != nil {
-				s.QueueNotification(ak, n.Next, utcNow())
+		}
+		for _, r := range s.pendingReminders {
+			m.logSuppressed(r.n, r.st.AlertKey)
+		}
+		return
+	}
+	// Notifications of the same incident share rendered bodies.
+	s.bodyCaches = make(map[*models.IncidentState]*conf.BodyCache)
+	defer func() { s.bodyCaches = nil }()
+	// During an alert storm, notifications are collected into digests.
+	storm := s.currentStorm()
+	if storm != nil {
+		s.stormDigests = make(map[*conf.Notification][]*models.IncidentState)
+		defer func() { s.stormDigests = nil }()
+	}
+	for n, states := range s.pendingNotifications {
+		for _, st := range states {
+			s.sendNotification(context.Background(), silenced, st, n)
+		}
+	}
+	for _, c := range s.pendingChains {
+		s.sendChain(silenced, c)
+	}
+	// finishChain marks the chains as sent in the journal once they are done.
+	s.pendingChains = nil
+	for _, r := range s.pendingReminders {
+		s.sendReminder(r)
+	}
+	if storm != nil {
+		s.sendStormDigests(storm)
+	}
+}
+
+// sendNotification sends n for st unless st is silenced, acknowledged or
+// closed, or n's If is false for it, or adds st to n's digest during an alert
+// storm, and queues n's next notification if it
+// was sent or only skipped for its If (unless IfStopsChain), and its first
+// reminder if it was sent. Outside of n's
+// sendSchedule, the notification it names is sent in its place, but the
+// escalation still follows n. It returns the results of the delivery if
+// n was sent, or whether st needs no other notification if it was not: it
+// was not sent for one of those reasons. Unknown states are batched (see
+// sendUnknownNotifications), so they have no results. The delivery gives up
+// once ctx is done.
+func (s *Schedule) sendNotification(ctx context.Context, silenced SilenceTester, st *models.IncidentState, n *conf.Notification) (results <-chan *conf.DeliveryResult, done bool) {
+	ak := st.AlertKey
+	alert := s.Conf.Alerts[ak.Name()]
+	if alert == nil {
+		return nil, true
+	}
+	isSilenced := silenced(ak) != nil
+	send := n.SendAt(utcNow())
+	if send != n {
+		slog.Infof("notification %s is outside its sendSchedule for %s, sending %s instead", n.Name, ak, send.Name)
+	}
+	if st.CurrentStatus == models.StUnknown {
+		if isSilenced {
+			slog.Infoln("silencing unknown", ak)
+			return nil, true
+		}
+		s.pendingUnknowns[send] = append(s.pendingUnknowns[send], st)
+		done = true
+	} else if isSilenced {
+		slog.Infof("silencing %s", ak)
+		return nil, true
+	} else if !alert.Log && (!st.Open || !st.NeedAck) {
+		slog.Errorf("Cannot notify acked or closed alert %s. Clearing.", ak)
+		if err := s.DataAccess.Notifications().ClearNotifications(ak); err != nil {
+			slog.Error(err)
+		}
+		return nil, true
+	} else if allowed, err := n.Allows(st); !allowed {
+		slog.Infof("notification %s: if is false for %s, not sending", n.Name, ak)
+		if n.IfStopsChain {
+			return nil, false
+		}
+	} else {
+		if err != nil {
+			slog.Errorf("notification %s: sending to %s despite if error: %v", n.Name, ak, err)
+		}
+		if s.stormDigests != nil {
+			s.stormDigests[send] = append(s.stormDigests[send], st)
+			done = true
+		} else {
+			results = s.notify(ctx, st, send)
+		}
+		s.queueReminder(ak, n, 1)
+	}
+	if next := n.NextFor(st.CurrentStatus); next != nil {
+		s.QueueNotification(ak, next, utcNow())
+	}
+	return results, done
+}
+
+// sendChain sends the first notification of c, and then waits for its
+// delivery and tries the rest of c in order in the background, until one is
+// delivered. The schedule is only locked to send each notification, not
+// while waiting, so a slow delivery does not hold up the schedule. c is
+// marked as sent in the journal once it is done.
+func (s *Schedule) sendChain(silenced SilenceTester, c notificationChain) {
+	if len(c.nots) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.Conf.ChainTimeout)
+	results, done := s.sendNotification(ctx, silenced, c.st, c.nots[0])
+	s.drainLock.Lock()
+	s.chains++
+	s.drainLock.Unlock()
+	go s.finishChain(ctx, cancel, c, results, done)
+}
+
+// finishChain waits for results, the delivery of the first notification of
+// c sent with ctx, and sends the rest of c one at a time until one is
+// delivered or st needs no other notification. Each delivery is given
+// firstSuccessTimeout; one that takes longer is abandoned and counts as
+// failed. Once the schedule is draining, the rest of c is left for the
+// journal to replay after a restart.
+func (s *Schedule) finishChain(ctx context.Context, cancel context.CancelFunc, c notificationChain, results <-chan *conf.DeliveryResult, done bool) {
+	defer func() {
+		s.drainLock.Lock()
+		s.chains--
+		s.drainLock.Unlock()
+	}()
+	for i := 0; ; i++ {
+		if results != nil {
+			done = s.waitDelivered(ctx, c.st.AlertKey, c.nots[i], results)
+		}
+		cancel()
+		if done || i == len(c.nots)-1 {
+			break
+		}
+		if s.isDraining() {
+			slog.Infof("notification %s failed for %s, not trying %s while draining", c.nots[i].Name, c.st.AlertKey, c.nots[i+1].Name)
+			return
+		}
+		slog.Infof("notification %s failed for %s, trying %s", c.nots[i].Name, c.st.AlertKey, c.nots[i+1].Name)
+		silenced := s.Silenced()
+		ctx, cancel = context.WithTimeout(context.Background(), s.Conf.ChainTimeout)
+		s.Lock("NotificationChain")
+		results, done = s.sendNotification(ctx, silenced, c.st, c.nots[i+1])
+		s.Unlock()
+	}
+	s.journalMarkSent(c.st, c.nots, utcNow())
+}
+
+// waitDelivered returns whether every one of results, the delivery of n for
+// ak sent with ctx, succeeded. It gives up once ctx is done.
+func (s *Schedule) waitDelivered(ctx context.Context, ak models.AlertKey, n *conf.Notification, results <-chan *conf.DeliveryResult) bool {
+	delivered := true
+	for {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				return delivered
 			}
+			delivered = delivered && r.Success
+		case <-ctx.Done():
+			slog.Errorf("notification %s for %s not delivered within %v", n.Name, ak, s.Conf.ChainTimeout)
+			return false
 		}
 	}
 }
 
 func (s *Schedule) sendUnknownNotifications() {
+	n := 0
+	for _, states := range s.pendingUnknowns {
+		n += len(states)
+	}
+	if m := s.suppressForMaintenance(n); m != nil {
+		for n, states := range s.pendingUnknowns {
+			for _, st := range states {
+				m.logSuppressed(n, st.AlertKey)
+			}
+		}
+		s.pendingUnknowns = make(map[*conf.Notification][]*models.IncidentState)
+		return
+	}
 	slog.Info("Batching and sending unknown notifications")
 	defer slog.Info("Done sending unknown notifications")
 	for n, states := range s.pendingUnknowns {
@@ -160,13 +397,13 @@ func (s *Schedule) sendUnknownNotifications() {
 			if c >= s.Conf.UnknownThreshold && s.Conf.UnknownThreshold > 0 {
 				if !tHit && len(groupSets) == 0 {
 					// If the threshold is hit but only 1 email remains, just send the normal unknown
-					s.unotify(name, group, n)
+					s.unotify(name, group, ustates, n)
 					break
 				}
 				tHit = true
 				oTSets[name] = group
 			} else {
-				s.unotify(name, group, n)
+				s.unotify(name, group, ustates, n)
 			}
 		}
 		if len(oTSets) > 0 {
@@ -193,14 +430,30 @@ var unknownMultiGroup = ttemplate.Must(ttemplate.New("unknownMultiGroup").Parse(
 	</ul>
 	`))
 
-func (s *Schedule) notify(st *models.IncidentState, n *conf.Notification) {
+// notify sends n for st, giving up on the delivery once ctx is done.
+func (s *Schedule) notify(ctx context.Context, st *models.IncidentState, n *conf.Notification) <-chan *conf.DeliveryResult {
 	if len(st.EmailSubject) == 0 {
 		st.EmailSubject = []byte(st.Subject)
 	}
 	if len(st.EmailBody) == 0 {
 		st.EmailBody = []byte(st.Body)
 	}
-	n.Notify(st.Subject, st.Body, st.EmailSubject, st.EmailBody, s.Conf, string(st.AlertKey), st.Attachments...)
+	results := n.NotifyCached(ctx, s.bodyCache(st), st.CurrentStatus, st.Subject, st.Body, st.EmailSubject, st.EmailBody, s.Conf, string(st.AlertKey), st.Attachments...)
+	return s.track(st.AlertKey, n, results)
+}
+
+// bodyCache returns the BodyCache of the notifications of st being sent, or
+// nil outside of sendNotifications.
+func (s *Schedule) bodyCache(st *models.IncidentState) *conf.BodyCache {
+	if s.bodyCaches == nil {
+		return nil
+	}
+	c := s.bodyCaches[st]
+	if c == nil {
+		c = conf.NewBodyCache()
+		s.bodyCaches[st] = c
+	}
+	return c
 }
 
 // utnotify is single notification for N unknown groups into a single notification
@@ -238,7 +491,9 @@ var defaultUnknownTemplate = &conf.Template{
 	Subject: ttemplate.Must(ttemplate.New("").Parse(`{{.Name}}: {{.Group | len}} unknown alerts`)),
 }
 
-func (s *Schedule) unotify(name string, group models.AlertKeys, n *conf.Notification) {
+// unotify sends the unknown notification of group, whose incident states are
+// in states.
+func (s *Schedule) unotify(name string, group models.AlertKeys, states States, n *conf.Notification) {
 	subject := new(bytes.Buffer)
 	body := new(bytes.Buffer)
 	now := utcNow()
@@ -247,7 +502,7 @@ func (s *Schedule) unotify(name string, group models.AlertKeys, n *conf.Notifica
 	if t == nil {
 		t = defaultUnknownTemplate
 	}
-	data := s.unknownData(now, name, group)
+	data := s.unknownData(now, name, group, states)
 	if t.Body != nil {
 		if err := t.Body.Execute(body, &data); err != nil {
 			slog.Infoln("unknown template error:", err)
@@ -315,10 +570,49 @@ func (s *Schedule) ActionNotify(at models.ActionType, user, message string, aks
 		}
 
 		notification.Notify(subject, buf.String(), []byte(subject), buf.Bytes(), s.Conf, "actionNotification")
+		if action, ok := eventActions[at]; ok && notification.Event != nil {
+			for _, st := range states {
+				notification.NotifyEvent(action, st, user, message, s.Conf)
+			}
+		}
 	}
 	return nil
 }
 
+// eventActions are the events sent to the event notifications of alert keys
+// for actions on them.
+var eventActions = map[models.ActionType]conf.EventAction{
+	models.ActionAcknowledge: conf.EventAcknowledge,
+	models.ActionClose:       conf.EventResolve,
+	models.ActionForget:      conf.EventResolve,
+	models.ActionPurge:       conf.EventResolve,
+}
+
+// resolveEvents sends resolve events to the event notifications of alert a
+// for st, an incident that went back to normal.
+func (s *Schedule) resolveEvents(a *conf.Alert, st *models.IncidentState) {
+	for _, n := range s.incidentNotifications(a, st) {
+		if n.Event != nil {
+			n.NotifyEvent(conf.EventResolve, st, "", "", s.Conf)
+		}
+	}
+}
+
+// incidentNotifications returns the notifications of alert a for st: the
+// critical ones, unless st has only been warning or a has none, by name.
+func (s *Schedule) incidentNotifications(a *conf.Alert, st *models.IncidentState) map[string]*conf.Notification {
+	var n *conf.Notifications
+	if st.WorstStatus == models.StWarning || a.CritNotification == nil {
+		n = a.WarnNotification
+	} else {
+		n = a.CritNotification
+	}
+	if n == nil {
+		return nil
+	}
+	return n.Get(s.Conf, st.NotificationGroup())
+}
+
 func (s *Schedule) groupActionNotifications(aks []models.AlertKey) (map[*conf.Notification][]*models.IncidentState, error) {
 	groupings := make(map[*conf.Notification][]*models.IncidentState)
 	for _, ak := range aks {
@@ -327,20 +621,10 @@ func (s *Schedule) groupActionNotifications(aks []models.AlertKey) (map[*conf.No
 		if err != nil {
 			return nil, err
 		}
-		if alert == nil || status == nil {
-			continue
-		}
-		var n *conf.Notifications
-		if status.WorstStatus == models.StWarning || alert.CritNotification == nil {
-			n = alert.WarnNotification
-		} else {
-			n = alert.CritNotification
-		}
-		if n == nil {
+		if alert == nil || status == nil || alert.TestMode {
 			continue
 		}
-		nots := n.Get(s.Conf, ak.Group())
-		for _, not := range nots {
+		for _, not := range s.incidentNotifications(alert, status) {
 			if !not.RunOnActions {
 				continue
 			}
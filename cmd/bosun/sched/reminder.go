@@ -0,0 +1,91 @@
+package sched
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"bosun.org/cmd/bosun/conf"
+	"bosun.org/collect"
+	"bosun.org/metadata"
+	"bosun.org/models"
+	"bosun.org/opentsdb"
+	"bosun.org/slog"
+	"golang.org/x/net/context"
+)
+
+func init() {
+	metadata.AddMetricMeta(
+		"bosun.alerts.reminders", metadata.Counter, metadata.Alert,
+		"The number of reminders of notifications sent.")
+}
+
+// reminderRE matches the names reminders are queued under: the name of the
+// notification, #reminder, and the number of the reminder. Notification names
+// cannot contain #, so they are not mistaken for reminders.
+var reminderRE = regexp.MustCompile(`^(.+)#reminder([0-9]+)$`)
+
+func reminderName(n *conf.Notification, i int) string {
+	return fmt.Sprintf("%s#reminder%d", n.Name, i)
+}
+
+// parseReminder returns the notification and number of the reminder queued
+// under name. ok is false if name is that of a notification.
+func parseReminder(name string) (notification string, i int, ok bool) {
+	m := reminderRE.FindStringSubmatch(name)
+	if m == nil {
+		return name, 0, false
+	}
+	i, err := strconv.Atoi(m[2])
+	if err != nil {
+		return name, 0, false
+	}
+	return m[1], i, true
+}
+
+// reminder is the ith reminder of n for st.
+type reminder struct {
+	st *models.IncidentState
+	n  *conf.Notification
+	i  int
+}
+
+// queueReminder queues the ith reminder of n for ak, n's reminder interval
+// from now, unless n has no reminder or already sent its maxReminders.
+func (s *Schedule) queueReminder(ak models.AlertKey, n *conf.Notification, i int) {
+	if n.Reminder == 0 || i > n.MaxReminders {
+		return
+	}
+	if err := s.DataAccess.Notifications().InsertNotification(ak, reminderName(n, i), utcNow().Add(n.Reminder)); err != nil {
+		slog.Errorf("queueing reminder %d of notification %s for %s: %v", i, n.Name, ak, err)
+	}
+}
+
+// sendReminder resends the notification of r and queues its next reminder,
+// unless its incident is no longer open, abnormal and unacknowledged, or the
+// If of the notification is false for it. Reminders do not escalate: the
+// Next of the notification was queued when it was first sent.
+func (s *Schedule) sendReminder(r reminder) {
+	st, n := r.st, r.n
+	switch {
+	case !st.Open || !st.NeedAck:
+		slog.Infof("not sending reminder %d of notification %s for acked or closed alert %s", r.i, n.Name, st.AlertKey)
+		return
+	case st.CurrentStatus == models.StNormal || st.CurrentStatus == models.StUnknown:
+		slog.Infof("not sending reminder %d of notification %s for %s alert %s", r.i, n.Name, st.CurrentStatus, st.AlertKey)
+		return
+	}
+	if allowed, _ := n.Allows(st); !allowed {
+		slog.Infof("notification %s: if is false for %s, not sending reminder %d", n.Name, st.AlertKey, r.i)
+		return
+	}
+	send := n.SendAt(utcNow())
+	slog.Infof("sending reminder %d of %d of notification %s for %s", r.i, n.MaxReminders, send.Name, st.AlertKey)
+	if s.stormDigests != nil {
+		s.stormDigests[send] = append(s.stormDigests[send], st)
+	} else {
+		s.notify(context.Background(), st, send)
+	}
+	collect.Add("alerts.reminders", opentsdb.TagSet{"alert": st.AlertKey.Name()}, 1)
+	s.queueReminder(st.AlertKey, n, r.i+1)
+}
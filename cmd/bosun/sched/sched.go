@@ -50,6 +50,14 @@ type Schedule struct {
 	nc chan interface{}
 	//notifications to be sent immediately
 	pendingNotifications map[*conf.Notification][]*models.IncidentState
+	//notifications to be sent immediately, one at a time until one succeeds
+	pendingChains []notificationChain
+	//reminders of notifications to be sent immediately
+	pendingReminders []reminder
+	//bodies rendered by the notifications being sent, by incident
+	bodyCaches map[*models.IncidentState]*conf.BodyCache
+	//incidents of the digests of the notifications being sent during an alert storm
+	stormDigests map[*conf.Notification][]*models.IncidentState
 
 	//unknown states that need to be notified about. Collected and sent in batches.
 	pendingUnknowns map[*conf.Notification][]*models.IncidentState
@@ -59,6 +67,46 @@ type Schedule struct {
 	lastLogTimes map[models.AlertKey]time.Time
 	LastCheck    time.Time
 
+	//interval until the next log of alert keys of alerts with logBackoff.
+	logIntervals   map[models.AlertKey]time.Duration
+	logBackoffLock sync.Mutex
+
+	//consecutive critical evaluations of alert keys of alerts with critAfter.
+	critCounts    map[models.AlertKey]int
+	critCountLock sync.Mutex
+
+	//alerts held quiet because their depends expression failed to evaluate.
+	dependencySuppressed map[string]*DependencySuppression
+	suppressionLock      sync.Mutex
+	//why alert keys were last held quiet by depends, also under suppressionLock.
+	dependencyExplanations map[models.AlertKey]*DependencyExplanation
+
+	//number of notifications test mode alerts would have sent, by alert.
+	wouldNotify     map[string]int64
+	wouldNotifyLock sync.Mutex
+
+	//maintenance windows, oldest first. Only the last can be active.
+	maintenance     []*Maintenance
+	maintenanceLock sync.Mutex
+
+	//alert storms, oldest first. Only the last can be active. criticalTimes
+	//are when alert keys became critical within the storm window.
+	storms        []*AlertStorm
+	criticalTimes []time.Time
+	stormLock     sync.Mutex
+
+	//backends in maintenance, by name. They are not queried.
+	disabledBackends map[string]*BackendMaintenance
+	backendLock      sync.Mutex
+
+	//set once shutdown has begun; see Drain. inflight holds the
+	//notifications being delivered, and chains counts the first success
+	//chains being sent in the background.
+	draining  bool
+	inflight  map[*inflightDelivery]bool
+	chains    int
+	drainLock sync.Mutex
+
 	ctx *checkContext
 
 	DataAccess database.DataAccess
@@ -74,6 +122,10 @@ func (s *Schedule) Init(c *conf.Conf) error {
 	s.Group = make(map[time.Time]models.AlertKeys)
 	s.pendingUnknowns = make(map[*conf.Notification][]*models.IncidentState)
 	s.lastLogTimes = make(map[models.AlertKey]time.Time)
+	s.logIntervals = make(map[models.AlertKey]time.Duration)
+	s.critCounts = make(map[models.AlertKey]int)
+	s.pruneDependencySuppressions(c)
+	s.wouldNotify = make(map[string]int64)
 	s.LastCheck = utcNow()
 	s.ctx = &checkContext{utcNow(), cache.New(0)}
 	if s.DataAccess == nil {
@@ -349,6 +401,10 @@ type StateGroup struct {
 	Ago           string                `json:",omitempty"`
 	State         *models.IncidentState `json:",omitempty"`
 	Children      []*StateGroup         `json:",omitempty"`
+
+	// DependencySuppressed is true when the alert is held quiet because its
+	// depends expression could not be evaluated.
+	DependencySuppressed bool `json:",omitempty"`
 }
 
 type StateGroups struct {
@@ -443,6 +499,8 @@ func (s *Schedule) MarshalGroups(T miniprofiler.Timer, filter string) (*StateGro
 							Ago:      marshalTime(st.Last().Time),
 							State:    st,
 							IsError:  !s.AlertSuccessful(ak.Name()),
+
+							DependencySuppressed: s.DependencySuppressed(ak.Name()) != nil,
 						})
 					}
 					if len(g.Children) == 1 && g.Children[0].Subject != "" {
@@ -520,6 +578,9 @@ func Close() {
 }
 
 func (s *Schedule) Close() {
+	if s.Conf.DrainTimeout > 0 {
+		s.Drain(s.Conf.DrainTimeout)
+	}
 	if s.Conf.SkipLast {
 		return
 	}
@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sort"
 	"testing"
 	"time"
@@ -356,3 +358,43 @@ func TestUnknownsAreNormal(t *testing.T) {
 		},
 	})
 }
+
+func TestSaveRules(t *testing.T) {
+	defer setup()()
+	dir, err := ioutil.TempDir("", "bosun-save")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bosun.conf")
+	for _, test := range []struct {
+		text  string
+		saved bool
+	}{
+		{"hostname = a", false},
+		{"hostname = a\nenableSave = true", true},
+	} {
+		if err := ioutil.WriteFile(path, []byte(test.text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := conf.Load(&conf.FileSource{Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := initSched(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.SaveRules("hostname = b")
+		if (err == nil) != test.saved {
+			t.Errorf("%q: expected saved %v, got %v", test.text, test.saved, err)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b) == "hostname = b"; got != test.saved {
+			t.Errorf("%q: expected saved %v, file has %q", test.text, test.saved, b)
+		}
+	}
+}
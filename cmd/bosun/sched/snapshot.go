@@ -0,0 +1,107 @@
+package sched
+
+import (
+	"fmt"
+
+	"bosun.org/cmd/bosun/conf"
+	"bosun.org/models"
+	"bosun.org/slog"
+)
+
+// SaveConfigText stores configuration text that has been validated, as the
+// rule editor saves it: formatted with conf.FormatRawText if formatOnSave is
+// set. It returns the hash the text can be loaded by.
+func (s *Schedule) SaveConfigText(text string) (string, error) {
+	if s.Conf.FormatOnSave {
+		var err error
+		if text, err = conf.FormatRawText(text); err != nil {
+			return "", err
+		}
+	}
+	return s.DataAccess.Configs().SaveTempConfig(text)
+}
+
+// SaveRules writes text, once it is checked to load, to the source the
+// running configuration was read from, formatted as SaveConfigText does. It
+// takes effect when bosun reloads. It returns an error unless enableSave is
+// set, and for sources that cannot be written to, such as URLs.
+func (s *Schedule) SaveRules(text string) error {
+	if !s.Conf.EnableSave {
+		return fmt.Errorf("saving the config is disabled; set enableSave = true to allow it")
+	}
+	w, ok := s.Conf.Source.(conf.RuleWriter)
+	if !ok {
+		name := s.Conf.Name
+		if s.Conf.Source != nil {
+			name = s.Conf.Source.Name()
+		}
+		return fmt.Errorf("config %s cannot be saved to", name)
+	}
+	if s.Conf.FormatOnSave {
+		var err error
+		if text, err = conf.FormatRawText(text); err != nil {
+			return err
+		}
+	}
+	if _, err := conf.New(s.Conf.Source.Name(), text); err != nil {
+		return err
+	}
+	if err := w.Write(text); err != nil {
+		return err
+	}
+	slog.Infof("config saved to %s", s.Conf.Source.Name())
+	return nil
+}
+
+// BulkSetEnabled enables or disables the alerts of the running
+// configuration matching selector (see conf.SelectAlerts), and saves the
+// changed configuration as SaveConfigText does. It returns how many alerts
+// changed and the hash the configuration can be loaded by.
+func (s *Schedule) BulkSetEnabled(selector string, enabled bool) (count int, hash string, err error) {
+	text, count, err := s.Conf.SetAlertsEnabled(selector, enabled)
+	if err != nil {
+		return 0, "", err
+	}
+	if hash, err = s.SaveConfigText(text); err != nil {
+		return 0, "", err
+	}
+	slog.Infof("alerts matching %s: %d set enabled=%v", selector, count, enabled)
+	return count, hash, nil
+}
+
+// SnapshotConfig saves the text of the running configuration as the snapshot
+// called name, replacing any snapshot of that name. user is required and
+// recorded with the time.
+func (s *Schedule) SnapshotConfig(name, user string) (*models.ConfigSnapshot, error) {
+	if name == "" || user == "" {
+		return nil, fmt.Errorf("config snapshots require a name and a user")
+	}
+	snap := &models.ConfigSnapshot{
+		Name: name,
+		User: user,
+		Time: utcNow(),
+		Text: s.Conf.RawText,
+	}
+	if err := s.DataAccess.Configs().SaveConfigSnapshot(snap); err != nil {
+		return nil, err
+	}
+	slog.Infof("config snapshot %s taken by %s", name, user)
+	return snap, nil
+}
+
+// RestoreSnapshot saves the text of the snapshot called name as SaveConfigText
+// does, after checking that it still loads, and returns the hash it can be
+// loaded by. The running configuration is not changed.
+func (s *Schedule) RestoreSnapshot(name string) (string, error) {
+	snap, err := s.DataAccess.Configs().GetConfigSnapshot(name)
+	if err != nil {
+		return "", err
+	}
+	if snap == nil {
+		return "", fmt.Errorf("no config snapshot named %s", name)
+	}
+	if _, err := conf.New(name, snap.Text); err != nil {
+		return "", fmt.Errorf("config snapshot %s no longer loads: %v", name, err)
+	}
+	return s.SaveConfigText(snap.Text)
+}
@@ -0,0 +1,171 @@
+package sched
+
+import (
+	"bytes"
+	"fmt"
+	htemplate "html/template"
+	"time"
+
+	"bosun.org/collect"
+	"bosun.org/metadata"
+	"bosun.org/models"
+	"bosun.org/slog"
+)
+
+func init() {
+	metadata.AddMetricMeta(
+		"bosun.alerts.storm_suppressed", metadata.Counter, metadata.Alert,
+		"The number of notifications replaced by alert storm digests.")
+}
+
+// maxStormHistory is the number of alert storms kept for audit.
+const maxStormHistory = 100
+
+// AlertStorm is a period during which more alert keys became critical within
+// the stormWindow than the stormThreshold allows. Instead of a notification
+// per incident, each notification sends a digest of the incidents it would
+// have notified at every notification check. Alerts are still checked, and
+// their incidents recorded and escalated, as usual.
+type AlertStorm struct {
+	Start time.Time
+	// End is when the storm passed: when no more alert keys than the
+	// threshold had become critical within the window.
+	End *time.Time `json:",omitempty"`
+	// Peak is the most alert keys that became critical within the window
+	// during the storm.
+	Peak int
+	// Suppressed is the number of notifications replaced by digests.
+	Suppressed int64
+}
+
+// recordCritical records that an alert key became critical at t, and starts
+// an alert storm if too many have within the storm window.
+func (s *Schedule) recordCritical(t time.Time) {
+	if s.Conf.StormThreshold == 0 {
+		return
+	}
+	s.stormLock.Lock()
+	defer s.stormLock.Unlock()
+	s.criticalTimes = append(s.criticalTimes, t)
+	n := s.pruneCriticalTimes(t)
+	storm := s.activeStorm(t)
+	if storm == nil && n > s.Conf.StormThreshold {
+		storm = &AlertStorm{Start: t}
+		s.storms = append(s.storms, storm)
+		if len(s.storms) > maxStormHistory {
+			s.storms = s.storms[len(s.storms)-maxStormHistory:]
+		}
+		slog.Warningf("alert storm: %d alert keys became critical within %v, sending digests instead of notifications", n, s.Conf.StormWindow)
+	}
+	if storm != nil && n > storm.Peak {
+		storm.Peak = n
+	}
+}
+
+// pruneCriticalTimes drops the times before the storm window ending at t, and
+// returns the number left. stormLock must be held.
+func (s *Schedule) pruneCriticalTimes(t time.Time) int {
+	since := t.Add(-s.Conf.StormWindow)
+	i := 0
+	for i < len(s.criticalTimes) && s.criticalTimes[i].Before(since) {
+		i++
+	}
+	s.criticalTimes = s.criticalTimes[i:]
+	return len(s.criticalTimes)
+}
+
+// activeStorm returns the alert storm at t, or nil if there is none. A storm
+// ends once no more alert keys than the threshold became critical within the
+// window. stormLock must be held.
+func (s *Schedule) activeStorm(t time.Time) *AlertStorm {
+	if len(s.storms) == 0 {
+		return nil
+	}
+	storm := s.storms[len(s.storms)-1]
+	if storm.End != nil {
+		return nil
+	}
+	if s.Conf.StormThreshold > 0 && s.pruneCriticalTimes(t) > s.Conf.StormThreshold {
+		return storm
+	}
+	storm.End = &t
+	slog.Infof("alert storm over after %v: %d notifications were sent as digests", t.Sub(storm.Start), storm.Suppressed)
+	return nil
+}
+
+// ActiveStorm returns a copy of the current alert storm, or nil if
+// notifications are sent as usual.
+func (s *Schedule) ActiveStorm() *AlertStorm {
+	s.stormLock.Lock()
+	defer s.stormLock.Unlock()
+	if storm := s.activeStorm(utcNow()); storm != nil {
+		c := *storm
+		return &c
+	}
+	return nil
+}
+
+// StormHistory returns copies of the recent alert storms, most recent first.
+func (s *Schedule) StormHistory() []*AlertStorm {
+	s.stormLock.Lock()
+	defer s.stormLock.Unlock()
+	s.activeStorm(utcNow())
+	history := make([]*AlertStorm, len(s.storms))
+	for i, storm := range s.storms {
+		c := *storm
+		history[len(history)-1-i] = &c
+	}
+	return history
+}
+
+var stormDigest = htemplate.Must(htemplate.New("stormDigest").Parse(`
+	<p><b>Alert storm in progress since {{.Start.Format "2006-01-02 15:04:05 MST"}}.</b>
+	More than {{.Threshold}} alert keys became critical within {{.Window}}, so
+	individual notifications are replaced by digests until the storm passes.
+	<p>{{len .States}} notifications suppressed:
+	<ul>
+	{{range .States}}
+		<li>{{.AlertKey}} ({{.CurrentStatus}}): {{.Subject}}</li>
+	{{end}}
+	</ul>
+	`))
+
+// currentStorm returns the alert storm, not a copy, or nil if there is none.
+func (s *Schedule) currentStorm() *AlertStorm {
+	s.stormLock.Lock()
+	defer s.stormLock.Unlock()
+	return s.activeStorm(utcNow())
+}
+
+// sendStormDigests sends each notification of s.stormDigests a digest of the
+// incidents it would have notified during storm.
+func (s *Schedule) sendStormDigests(storm *AlertStorm) {
+	var total int64
+	for n, states := range s.stormDigests {
+		total += int64(len(states))
+		subject := fmt.Sprintf("bosun alert storm: %d notifications suppressed", len(states))
+		body := new(bytes.Buffer)
+		if err := stormDigest.Execute(body, struct {
+			Start     time.Time
+			Threshold int
+			Window    time.Duration
+			States    []*models.IncidentState
+		}{
+			storm.Start,
+			s.Conf.StormThreshold,
+			s.Conf.StormWindow,
+			states,
+		}); err != nil {
+			slog.Errorln(err)
+		}
+		slog.Infof("alert storm: sending notification %s a digest of %d incidents", n.Name, len(states))
+		s.track("alert_storm", n, n.Notify(subject, body.String(), []byte(subject), body.Bytes(), s.Conf, "alert_storm"))
+	}
+	if total == 0 {
+		return
+	}
+	collect.Add("alerts.storm_suppressed", nil, total)
+	s.stormLock.Lock()
+	storm.Suppressed += total
+	s.stormLock.Unlock()
+}
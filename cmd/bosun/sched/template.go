@@ -6,10 +6,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"math"
 	"net/http"
 	"net/url"
+	"runtime/debug"
 	"strings"
 	"time"
 
@@ -47,19 +49,84 @@ type unknownContext struct {
 	Time  time.Time
 	Name  string
 	Group models.AlertKeys
+	// Members has an entry for each alert key of Group, in the same order.
+	Members []*unknownMember
 
 	schedule *Schedule
 }
 
-func (s *Schedule) unknownData(t time.Time, name string, group models.AlertKeys) *unknownContext {
+// unknownMember is an alert instance of a group of unknown alerts.
+type unknownMember struct {
+	AlertKey models.AlertKey
+	Alert    string
+	Tags     opentsdb.TagSet
+	Start    time.Time
+	// LastStatus and Value are the status and value of the instance's last
+	// abnormal check before it went unknown. Value is 0 if it has none.
+	LastStatus models.Status
+	Value      models.Float
+}
+
+func (s *Schedule) unknownData(t time.Time, name string, group models.AlertKeys, states States) *unknownContext {
+	members := make([]*unknownMember, 0, len(group))
+	for _, ak := range group {
+		m := &unknownMember{
+			AlertKey: ak,
+			Alert:    ak.Name(),
+			Tags:     ak.Group(),
+		}
+		if st := states[ak]; st != nil {
+			m.Start = st.Start
+			m.LastStatus = st.LastAbnormalStatus
+			if st.Result != nil {
+				m.Value = st.Result.Value
+			}
+		}
+		members = append(members, m)
+	}
 	return &unknownContext{
 		Time:     t,
 		Group:    group,
+		Members:  members,
 		Name:     name,
 		schedule: s,
 	}
 }
 
+// Name returns the name of the alert.
+func (c *Context) Name() string {
+	return c.Alert.Name
+}
+
+// Severity returns the current status of the incident, such as critical or
+// warning.
+func (c *Context) Severity() string {
+	return c.CurrentStatus.String()
+}
+
+// SeverityMeta returns the current status of the incident with its color and
+// icon, as rich notification channels show it.
+func (c *Context) SeverityMeta() *conf.SeverityMeta {
+	return c.schedule.Conf.Severity(c.CurrentStatus)
+}
+
+// Runbook returns the alert's runbook.
+func (c *Context) Runbook() string {
+	return c.Alert.Runbook
+}
+
+// Owner returns the team responsible for the alert key: the value of the
+// alert's ownerTag in its notification group if there is one, and otherwise
+// the alert's owner.
+func (c *Context) Owner() string {
+	if c.Alert.OwnerTag != "" {
+		if v := c.NotificationGroup()[c.Alert.OwnerTag]; v != "" {
+			return v
+		}
+	}
+	return c.Alert.Owner
+}
+
 // Ack returns the URL to acknowledge an alert.
 func (c *Context) Ack() string {
 	return c.schedule.Conf.MakeLink("/action", &url.Values{
@@ -68,6 +135,12 @@ func (c *Context) Ack() string {
 	})
 }
 
+// SignedAck returns a link that acknowledges the incident without a login
+// for the global ackLinkExpiry, or "" if ackLinkSecret is not set.
+func (c *Context) SignedAck() string {
+	return c.schedule.Conf.SignedAckLink(c.Id, utcNow().Add(c.schedule.Conf.AckLinkExpiry))
+}
+
 // HostView returns the URL to the host view page.
 func (c *Context) HostView(host string) string {
 	return c.schedule.Conf.MakeLink("/host", &url.Values{
@@ -84,6 +157,88 @@ func (c *Context) Last() interface{} {
 	}{c.IncidentState.Last(), c.Id}
 }
 
+// Transition is a change of status during an incident, as returned by
+// Context.Transitions.
+type Transition struct {
+	Status models.Status
+	Time   time.Time
+	// Duration is how long the status lasted: until the next transition,
+	// or until the check being rendered for the most recent one.
+	Duration time.Duration
+	// Result is the crit or warn result that caused the transition, or nil
+	// for normal and unknown.
+	Result *models.Result
+}
+
+// LocalTime returns t in the alert's time zone, for formatting with its
+// Format method, such as {{(.LocalTime .Start).Format "Mon 15:04 MST"}}.
+func (c *Context) LocalTime(t time.Time) time.Time {
+	if c.Alert == nil || c.Alert.TimeZone == nil {
+		return t
+	}
+	return t.In(c.Alert.TimeZone)
+}
+
+// Transitions returns the status changes of the incident, most recent first.
+// It is computed only when a template calls it.
+func (c *Context) Transitions() []Transition {
+	now := utcNow()
+	if c.runHistory != nil {
+		now = c.runHistory.Start
+	}
+	events := c.IncidentState.Events
+	transitions := make([]Transition, len(events))
+	for i, ev := range events {
+		end := now
+		if i+1 < len(events) {
+			end = events[i+1].Time
+		}
+		t := Transition{
+			Status:   ev.Status,
+			Time:     ev.Time,
+			Duration: end.Sub(ev.Time),
+		}
+		switch ev.Status {
+		case models.StCritical:
+			t.Result = ev.Crit
+		case models.StWarning:
+			t.Result = ev.Warn
+		}
+		transitions[len(events)-1-i] = t
+	}
+	return transitions
+}
+
+// Timeline summarizes Transitions, such as "critical for 12m, warning for 5m
+// before". At most n transitions are included; n <= 0 includes them all.
+func (c *Context) Timeline(n int) string {
+	transitions := c.Transitions()
+	if n > 0 && len(transitions) > n {
+		transitions = transitions[:n]
+	}
+	parts := make([]string, len(transitions))
+	for i, t := range transitions {
+		parts[i] = fmt.Sprintf("%s for %s", t.Status, shortDuration(t.Duration))
+	}
+	s := strings.Join(parts, ", ")
+	if len(parts) > 1 {
+		s += " before"
+	}
+	return s
+}
+
+// shortDuration formats d to the second, without zero trailing units.
+func shortDuration(d time.Duration) string {
+	s := (d - d%time.Second).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
 // Expr takes an expression in the form of a string, changes the tags to
 // match the context of the alert, and returns a link to the expression page.
 func (c *Context) Expr(v string) string {
@@ -121,6 +276,24 @@ func (c *Context) Incident() string {
 	})
 }
 
+type executer interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// executeTemplate executes t with data into w. A panic during execution is
+// returned as an error naming the template, so that a bad template cannot
+// take down the check or notification that renders it.
+func executeTemplate(name string, t executer, w io.Writer, data interface{}) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("template %s: panic during execution: %v", name, p)
+			slog.Errorln(err)
+			slog.Infof("%s\n%s", err, debug.Stack())
+		}
+	}()
+	return t.Execute(w, data)
+}
+
 func (s *Schedule) ExecuteBody(rh *RunHistory, a *conf.Alert, st *models.IncidentState, isEmail bool) ([]byte, []*models.Attachment, error) {
 	t := a.Template
 	if t == nil || t.Body == nil {
@@ -128,7 +301,7 @@ func (s *Schedule) ExecuteBody(rh *RunHistory, a *conf.Alert, st *models.Inciden
 	}
 	c := s.Data(rh, st, a, isEmail)
 	buf := new(bytes.Buffer)
-	if err := t.Body.Execute(buf, c); err != nil {
+	if err := executeTemplate(t.Name, t.Body, buf, c); err != nil {
 		return nil, nil, err
 	}
 	if inline, err := inliner.Inline(buf.String()); err == nil {
@@ -145,7 +318,14 @@ func (s *Schedule) ExecuteSubject(rh *RunHistory, a *conf.Alert, st *models.Inci
 		return nil, nil
 	}
 	buf := new(bytes.Buffer)
-	err := t.Subject.Execute(buf, s.Data(rh, st, a, isEmail))
+	err := executeTemplate(t.Name, t.Subject, buf, s.Data(rh, st, a, isEmail))
+	if bytes.ContainsAny(buf.Bytes(), "\r\n") && !t.SubjectHasNewlines() {
+		if s.Conf.SubjectNewlines == conf.SubjectNewlinesReject {
+			return nil, fmt.Errorf("template %s: rendered subject for %s contains a newline", t.Name, st.AlertKey)
+		}
+		slog.Warningf("template %s: replaced newlines in rendered subject for %s", t.Name, st.AlertKey)
+	}
+	// Collapsing whitespace also removes any CR and LF.
 	return bytes.Join(bytes.Fields(buf.Bytes()), []byte(" ")), err
 }
 
@@ -183,7 +363,7 @@ func (s *Schedule) ExecuteBadTemplate(errs []error, rh *RunHistory, a *conf.Aler
 		Context: s.Data(rh, st, a, true),
 	}
 	buf := new(bytes.Buffer)
-	error_body.Execute(buf, c)
+	executeTemplate(error_body.Name(), error_body, buf, c)
 	return []byte(sub), buf.Bytes(), nil
 }
 
@@ -199,10 +379,12 @@ func (c *Context) evalExpr(e *expr.Expr, filter bool, series bool, autods int) (
 		return nil, "", fmt.Errorf("need a series, got %T (%v)", e, e)
 	}
 	providers := &expr.BosunProviders{
-		Cache:     c.runHistory.Cache,
-		Search:    c.schedule.Search,
-		Squelched: c.schedule.Conf.AlertSquelched(c.Alert),
-		History:   c.schedule,
+		Cache:  c.runHistory.Cache,
+		Search: c.schedule.Search,
+		Squelched: func(tags opentsdb.TagSet) bool {
+			return c.schedule.squelched(c.runHistory, c.Alert, tags)
+		},
+		History: c.schedule,
 	}
 	res, _, err := e.Execute(c.runHistory.Backends, providers, nil, c.runHistory.Start, autods, c.Alert.UnjoinedOK)
 	if err != nil {
@@ -63,8 +63,8 @@ type IncidentSummaryView struct {
 }
 
 func MakeIncidentSummary(c *conf.Conf, s SilenceTester, is *models.IncidentState) IncidentSummaryView {
-	warnNotifications := c.Alerts[is.AlertKey.Name()].WarnNotification.Get(c, is.AlertKey.Group())
-	critNotifications := c.Alerts[is.AlertKey.Name()].CritNotification.Get(c, is.AlertKey.Group())
+	warnNotifications := c.Alerts[is.AlertKey.Name()].WarnNotification.Get(c, is.NotificationGroup())
+	critNotifications := c.Alerts[is.AlertKey.Name()].CritNotification.Get(c, is.NotificationGroup())
 	eventSummaries := []EventSummary{}
 	nonNormalNonUnknownCount := 0
 	for _, event := range is.Events {
@@ -239,9 +239,10 @@ func ExprGraph(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (in
 	backends := &expr.Backends{
 		TSDBContext:     schedule.Conf.TSDBContext(),
 		GraphiteContext: schedule.Conf.GraphiteContext(),
-		InfluxConfig:    schedule.Conf.InfluxConfig,
+		InfluxConfig:    schedule.Conf.InfluxClientConfig(),
 		LogstashHosts:   schedule.Conf.LogstashElasticHosts,
 		ElasticHosts:    schedule.Conf.ElasticHosts,
+		Disabled:        schedule.DisabledBackendReasons(),
 	}
 	providers := &expr.BosunProviders{
 		Cache:     cacheObj,
@@ -65,7 +65,7 @@ func Expr(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (v inter
 	}
 	e, err := expr.New(expression, schedule.Conf.Funcs())
 	if err != nil {
-		return nil, err
+		return nil, schedule.Conf.ExplainExprError(err)
 	}
 	now, err := getTime(r)
 	if err != nil {
@@ -75,9 +75,10 @@ func Expr(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (v inter
 	backends := &expr.Backends{
 		TSDBContext:     schedule.Conf.TSDBContext(),
 		GraphiteContext: schedule.Conf.GraphiteContext(),
-		InfluxConfig:    schedule.Conf.InfluxConfig,
+		InfluxConfig:    schedule.Conf.InfluxClientConfig(),
 		LogstashHosts:   schedule.Conf.LogstashElasticHosts,
 		ElasticHosts:    schedule.Conf.ElasticHosts,
+		Disabled:        schedule.DisabledBackendReasons(),
 	}
 	providers := &expr.BosunProviders{
 		Cache:     cacheObj,
@@ -111,6 +112,58 @@ func Expr(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (v inter
 	return ret, nil
 }
 
+// ExprEval evaluates the crit or warn expression in the request body once, at
+// the time given by the date and time parameters or now, and returns each
+// result and whether it would trigger. It does not change any alert.
+func ExprEval(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	text, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	now, err := getTime(r)
+	if err != nil {
+		return nil, err
+	}
+	results, err := schedule.EvalAlertExpr(strings.TrimSpace(string(text)), now)
+	if err != nil {
+		return nil, err
+	}
+	if results == nil {
+		results = []*sched.EvalResult{}
+	}
+	return results, nil
+}
+
+// ExprDiff evaluates the crit or warn expression in the request body at the
+// time given by the date and time parameters or now, and the interval before
+// it (the check frequency unless the since parameter is set, such as 10m),
+// and returns how its results changed between the two.
+func ExprDiff(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	text, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	to, err := getTime(r)
+	if err != nil {
+		return nil, err
+	}
+	since := schedule.Conf.CheckFrequency
+	if v := r.FormValue("since"); v != "" {
+		d, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		since = time.Duration(d)
+	}
+	return schedule.DiffAlertExpr(strings.TrimSpace(string(text)), to.Add(-since), to)
+}
+
+// AlertTests runs the alert test fixtures of the alert given by the alert
+// parameter, or of all alerts if it is not set.
+func AlertTests(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return schedule.RunAlertTests(r.FormValue("alert"))
+}
+
 func getTime(r *http.Request) (now time.Time, err error) {
 	now = time.Now().UTC()
 	if fd := r.FormValue("date"); len(fd) > 0 {
@@ -140,6 +193,7 @@ func procRule(t miniprofiler.Timer, c *conf.Conf, a *conf.Alert, now time.Time,
 		return nil, err
 	}
 	rh := s.NewRunHistory(now, cacheObj)
+	rh.Backends.Disabled = schedule.DisabledBackendReasons()
 	if _, err := s.CheckExpr(t, rh, a, a.Warn, models.StWarning, nil); err != nil {
 		return nil, err
 	}
@@ -243,7 +297,9 @@ func procRule(t miniprofiler.Timer, c *conf.Conf, a *conf.Alert, now time.Time,
 			} else if s_err != nil {
 				warning = append(warning, s_err.Error())
 			} else {
-				n.DoEmail(email_subject, email, schedule.Conf, string(primaryIncident.AlertKey), attachments...)
+				if err := n.DoEmail(email_subject, email, schedule.Conf, string(primaryIncident.AlertKey), attachments...); err != nil {
+					warning = append(warning, err.Error())
+				}
 			}
 		}
 		data = s.Data(rh, primaryIncident, a, false)
@@ -442,6 +498,12 @@ func Rule(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interfa
 	return &ret, nil
 }
 
+// ExprFuncs returns the expression functions of each backend, and whether
+// the backend is enabled, for expression editors.
+func ExprFuncs(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return schedule.Conf.FuncsByBackend(), nil
+}
+
 func buildConfig(r *http.Request) (c *conf.Conf, a *conf.Alert, hash string, err error) {
 	config, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -454,7 +516,7 @@ func buildConfig(r *http.Request) (c *conf.Conf, a *conf.Alert, hash string, err
 	}
 	c.StateFile = ""
 
-	hash, err = sched.DefaultSched.DataAccess.Configs().SaveTempConfig(string(config))
+	hash, err = sched.DefaultSched.SaveConfigText(string(config))
 	if err != nil {
 		return nil, nil, "", err
 	}
@@ -2,9 +2,12 @@ package web
 
 import (
 	"fmt"
+	"html/template"
 	"net/http"
+	"time"
 
 	"bosun.org/cmd/bosun/sched"
+	"bosun.org/models"
 
 	"github.com/MiniProfiler/go/miniprofiler"
 	"github.com/kylebrandt/boolq"
@@ -39,3 +42,44 @@ func ListOpenIncidents(t miniprofiler.Timer, w http.ResponseWriter, r *http.Requ
 	}
 	return summaries, nil
 }
+
+var signedAckPage = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<title>Acknowledge incident {{.Id}}</title>
+<p>Acknowledge {{.AlertKey}} (incident {{.Id}})?</p>
+<form method="post" action="{{.URL}}"><button type="submit">Acknowledge</button></form>
+`))
+
+// SignedAck acknowledges the incident of a link from conf.SignedAckLink
+// without a login. A GET shows a form that posts the link back, so that
+// link previews and mail scanners that fetch the link do not acknowledge
+// the incident.
+func SignedAck(w http.ResponseWriter, r *http.Request) {
+	id, err := schedule.Conf.VerifyAckLink(r.URL.Query(), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		st, err := schedule.DataAccess.State().GetIncidentState(id)
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+		if st == nil {
+			http.Error(w, fmt.Sprintf("no incident with id: %v", id), http.StatusNotFound)
+			return
+		}
+		signedAckPage.Execute(w, map[string]interface{}{
+			"Id":       id,
+			"AlertKey": st.AlertKey,
+			"URL":      r.URL.String(),
+		})
+		return
+	}
+	ak, err := schedule.ActionByIncidentId("signed-link", "acknowledged with a signed link", models.ActionAcknowledge, id)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "Acknowledged %s (incident %d).\n", ak, id)
+}
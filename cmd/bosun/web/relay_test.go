@@ -3,6 +3,7 @@ package web
 import (
 	"bytes"
 	"compress/gzip"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -14,6 +15,7 @@ import (
 	"bosun.org/cmd/bosun/conf"
 	"bosun.org/cmd/bosun/database"
 	"bosun.org/cmd/bosun/database/test"
+	"bosun.org/opentsdb"
 )
 
 var testData database.DataAccess
@@ -86,3 +88,57 @@ func TestRelay(t *testing.T) {
 		t.Errorf("bad tkbm: %v", m)
 	}
 }
+
+func TestRelayBatcher(t *testing.T) {
+	schedule.DataAccess = testData
+	schedule.Init(new(conf.Conf))
+	batches := make(chan int, 10)
+	rs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		batches <- len(decodeDataPoints(b))
+		w.WriteHeader(204)
+	}))
+	defer rs.Close()
+	rurl, err := url.Parse(rs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &conf.Conf{RelayBatchSize: 2, RelayFlushInterval: 100 * time.Millisecond, RelayQueueSize: 10}
+	ts := httptest.NewServer(newRelayBatcher(rurl.Host, c))
+	defer ts.Close()
+	body := []byte(`[
+		{"timestamp": 1, "metric": "m", "value": 1, "tags": {"host": "a"}},
+		{"timestamp": 1, "metric": "m", "value": 1, "tags": {"host": "b"}},
+		{"timestamp": 1, "metric": "m", "value": 1, "tags": {"host": "c"}}
+	]`)
+	resp, err := http.Post(ts.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	// A full batch is sent at once, and the rest at the flush interval.
+	for _, expect := range []int{2, 1} {
+		select {
+		case n := <-batches:
+			if n != expect {
+				t.Errorf("got batch of %d, expected %d", n, expect)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no batch of %d", expect)
+		}
+	}
+
+	// With the drop policy, data points that do not fit are dropped.
+	b := &relayBatcher{queue: make(chan *opentsdb.DataPoint, 1), drop: true}
+	req, err := http.NewRequest("POST", "/api/put", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent || len(b.queue) != 1 {
+		t.Errorf("got status %d and %d queued, expected 204 and 1", w.Code, len(b.queue))
+	}
+}
@@ -0,0 +1,127 @@
+package web
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"bosun.org/cmd/bosun/conf"
+	"bosun.org/collect"
+	"bosun.org/opentsdb"
+	"bosun.org/slog"
+)
+
+// relayBatcher relays the data points of puts to the TSDB in batches, through
+// a bounded queue, instead of proxying each put as it arrives.
+type relayBatcher struct {
+	url      string
+	queue    chan *opentsdb.DataPoint
+	size     int
+	interval time.Duration
+	drop     bool
+}
+
+func newRelayBatcher(dest string, c *conf.Conf) *relayBatcher {
+	b := &relayBatcher{
+		url:      (&url.URL{Scheme: "http", Host: dest, Path: "/api/put"}).String(),
+		queue:    make(chan *opentsdb.DataPoint, c.RelayQueueSize),
+		size:     c.RelayBatchSize,
+		interval: c.RelayFlushInterval,
+		drop:     c.RelayDropWhenFull,
+	}
+	go b.run()
+	return b
+}
+
+// ServeHTTP queues the data points of a put. If the queue is full, it waits
+// for room until the client goes away, or drops the points that do not fit if
+// b.drop. Either way the put succeeds once its points are queued or dropped.
+func (b *relayBatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	mdp := decodeDataPoints(body)
+	if len(mdp) == 0 {
+		http.Error(w, "no data points", http.StatusBadRequest)
+		return
+	}
+	indexDataPoints(r, mdp)
+	remote := opentsdb.MustReplace(strings.Split(r.RemoteAddr, ":")[0], "_")
+	var gone <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		gone = cn.CloseNotify()
+	}
+	dropped := 0
+	closed := false
+queue:
+	for i, dp := range mdp {
+		if b.drop {
+			select {
+			case b.queue <- dp:
+			default:
+				dropped++
+			}
+			continue
+		}
+		select {
+		case b.queue <- dp:
+		case <-gone:
+			dropped += len(mdp) - i
+			closed = true
+			break queue
+		}
+	}
+	if dropped > 0 {
+		collect.Add("relay.dropped", opentsdb.TagSet{"reason": "full", "remote": remote}, int64(dropped))
+	}
+	if closed {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// run sends queued data points once b.size of them are queued, or every
+// b.interval if fewer are.
+func (b *relayBatcher) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	batch := make([]*opentsdb.DataPoint, 0, b.size)
+	for {
+		select {
+		case dp := <-b.queue:
+			batch = append(batch, dp)
+			if len(batch) < b.size {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		b.send(batch)
+		batch = make([]*opentsdb.DataPoint, 0, b.size)
+	}
+}
+
+// send posts batch to the TSDB. A batch that fails is dropped, not retried,
+// so that a struggling TSDB is not sent it again.
+func (b *relayBatcher) send(batch []*opentsdb.DataPoint) {
+	collect.Add("relay.batches", nil, 1)
+	resp, err := collect.SendDataPoints(batch, b.url)
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			msg, _ := ioutil.ReadAll(resp.Body)
+			err = fmt.Errorf("%s: %s", resp.Status, msg)
+		}
+	}
+	if err != nil {
+		slog.Errorf("relaying %d data points: %v", len(batch), err)
+		collect.Add("relay.dropped", opentsdb.TagSet{"reason": "error"}, int64(len(batch)))
+	}
+}
@@ -15257,27 +15257,30 @@ NeZtQ48ZNx5cB0tkPLvkz/bBIAzIu+Vq0mH5U/wNAAD//wJxdrNjAwAA
 
 	"/partials/alertstate.html": {
 		local:   "web/static/partials/alertstate.html",
-		size:    3940,
+		size:    4594,
 		modtime: 0,
 		compressed: `
-H4sIAAAJbogA/7RWS2/jNhA+e38FqwViG61sJA0CNLAcbIsUDdpeuknvtDSWWFOkSlJJ1Kz+e4cUZUuO
-snl5D7GYeX7z4AwXCbslMadaR0FBBfAwA5owkQZEpGGX8Ys9T+JSKRDms6Gm1NPvx+FK3o+9LIs3UWBk
-mnKYTIPlh9EiO+3bNsxwsJzRgpJMwdoeRwuNXOJ4UXCdMU3gHtVyapgUhMX4o6BQoNGxJiajBn+AUA7K
-EJRmgqA+jQ27BTIRUoRCqpzyKdEIE2ZBCyLlVZFZe93gHsZbctjxG2qWivG5N4GiZtYETY6OBojfRWTc
-eB3XwXIxtyE9EVxeGnguqoxqsgIQRDMOIobkFUHcSl7mEMr1GuHHGePJ7LO38hy0f0vQLuk5VZsXZ74U
-cEt5iSlJfGbIJyuhCVXQ495lGBIlCRQgEkRUWSNN4V4RYIuyX6KbnZ+9MKm1Y7stCkApqX5j2khVXbgw
-oocHBCITmDRmHPJpXbsuHcrRmqkXlc8lJgHFK7xNxDmekUv70SSWOZC1kjnqIFcTzjaoi36QrkEx0CSh
-hq6oRl9al0CkQj621xqbDDOJOVDVK3JmUW/b4Uo7HHtpmtNOV6AVncm7KGiycpUEy48PD+0/dX3+qI9Q
-Y8VEEgW+5crVPxAb8uWLd+oS+ztUPac79XZOlJyHiqWZCXYYvIFUBsRorDq2cpfYMdgEsZhnp8sPiznO
-Nvw8mnArmVTOOsOOsB7crOqIqYbUo8WShzoPz5q+GJIelP/Rs0aLYrnQRkmRLl0mCKbCJrEhLeaFN9GA
-fsLaT1tr/ZT/d6cnguYwDch8307n9B7Qds7BwQA/GqAWOHGVJf7K6dDehp7oNRKCbxXg3wzu9DsC7EyZ
-eeYnzAaq3XxxBbKD5VfsceKHkG3YHx5baK/aXyWHG8Wtlj2Sy4Sh1hNKc7gv1IX9QacrI6kfaZdIcY7t
-AbTG0fmUBSwAw8FsLlgSda97sLzyHDL5OFhLnBDz5bQdIkPl2R2+zbXyS+5dJfSclREE/8IE1rTkxp3v
-ddBJlN/LF0mp3HMhOs6O2n3SWSR1fWRoqveXzDXSXEWOSSZLtc3a+yCcvAnCiYOgD4Th7E0Yzg6K4fht
-iTg+bCZOTt9WjtM9FAcfdJ9ii+89ow5ns5AGULE97Rg03jR0e9iRYy61V2iOOxa+aGLoCnQJPbEUTLu2
-UyXLon18R/j4LsVGyDsxDrY2ULqjXpRIaHjN8cXJ3X8L/YGrqMnh6/Ju9Uij+Pbct720AzG7rgqo6701
-Owx4doOPy2C5qsiAHcur687jbDTCR+3gNu56tzt52dN6DsSfuINoilrnQzA8t4/kK+tk+x0om3vgOQc/
-2zffE8vn+MRvn0zNn1tUKNtuvjAzOe/b38PkP/8HAAD//yGgRUJkDwAA
+H4sIAAAJbogA/7RXUW/jtg9/bj8F/zqgSfA/x2hXHLAidnHbOqy47WXX27tsM7ZWWfJJctss5+8+yJYd
+Jecgbdq91KwoUj/+SFHMImMPkHKqdUQqKpAHBdKMiZyAyANf8bOVp2mtFArz2VBT69n/J0EinyZuL0vv
+I2JknnOczkh8erIoLrd9G2Y4Ws3JgkKhcGnFk4WuqIBWF5G7gmnAp5TTkhomBbBUClBYKdQojAZTUAOm
+QKAclQGmgQmgAmhq2APCVEgRCKlKymegDTU4Jz2InK+qwvrzg1tPhuXAOzfQLBeTK+eCU23mXdBwdjay
++L8IJt2pk4bEi9CGtCe4sjZ4KKqCakgQBWjGUaSYvSCIB8nrEgO5XE6uIC0Yz+afnZdD0L7WqFvSS6ru
+n818LfCB8poazBwz8NHmRgNVuKV9LFAAhQwrFBmKdGXT1yXuBQH2KLdT9GVzzqEwORPPiU7XlY1dYwbJ
+CpjRHvA53PVbJ/26rdvWwDKYyppnIKSBBGFA9h60BGZAIDMFKlgyhRqEVJBL1FCLeyEfBdTCMN6C8ahK
+qdjyBTSnTLyANxv2UBK/DI4/D2Hu8EatH3tLI4JKSfUb00aq1XWb/mi9RpHKDKcd/W3GZ01D2qofId2G
+eoh0W/ZtQWWo+IqJHNqD53BjPxpSWSIslSzBFEzkNpP3CBQMKxE0KoYaMmpoQjUC07pGkAoolJQvpSox
+g681qtULOLOoB85udYtjh6aQemUm8kAX8jEiHSu3GYnfrdf9P01z5Vv2FgkTWUTcVa2TvzE18O2bO7Ql
+9hOutg7dmDvMVc15oFhemLa3dRicg1wSMDrQTKToL3oOuyAWYXEZny7CjD3Ep9+/DInMVq13toyIPcHm
+2t+muqWttVTyQJfBh1Yxunt0/w9OdbKo4oU2Soo8bpmAT7iyJHZLi7ByLjrQe7z9OHjbpvyfRz0VtMQZ
+gXDXjye9BrR9H/DNAH/38Fjg0GYW3JXTgb0NW1vvWInkBQHuVtBYryB7sY+xsPFwPBWbsyHBlNYavZ78
+jN7beZn6bS2kFQs3LTbcdPxDTa7tS/bWzJ7N6osI+4vho35F2fhBFq5v3+NqE1Bb9k1D4l9rzsG1dhvQ
+++899A3sz5rjF8WtlRXhJmNGqj1GoU3Itf0TrdeJkdRxePNUqfaduBkSts8DEynLUJhrlkV+EyXxrdPA
+9N3oDbnNSBjPFiHdZW2QNsJ/06zcyPWqFDpNYgQkRgQZLmnNTSs/aeIR5abE66xW7fAanRdnfQF7lds0
+Z4bmereq72iu24ycQyFrNbD2OggXR0G4aCHoN8Lw4SgMH94Uw/lxRJy/LRMXl0ehuLjcQbEpXk96zT35
+mFqWXtPqjA6ENBgvwl7aKGh6361bYbOccqmdQSduVEupUvQ3+Atb23I0/TCUK1lX/U/BKIKJG+QnZPCR
+o/HMq1rlzn8nHvE2d6n6nWrTcUj2cjXGu7WDzvB47tfrXRDzu1WFTbMzvIwDnn/RqEicrGDEj9U1jTfy
+npxQMz7jeFbtpOMPyodB/IFa0xxJfDUGw2m3kXjZ6aV+afiOpM1WSof4JztJ73l8zi/c61Oo8NBDdX5B
++pcvKEzJt/0PWNxAH2bsIT79dwDZbjJL8hEAAA==
 `,
 	},
 
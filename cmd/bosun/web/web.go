@@ -63,6 +63,10 @@ func init() {
 		"Bytes per second relayed from Bosun to the backend server.")
 	metadata.AddMetricMeta("bosun.relay.response", metadata.Counter, metadata.PerSecond,
 		"HTTP response codes from the backend server for request relayed through Bosun.")
+	metadata.AddMetricMeta("bosun.relay.batches", metadata.Counter, metadata.Request,
+		"The count of batches of relayed data points sent to the backend server.")
+	metadata.AddMetricMeta("bosun.relay.dropped", metadata.Counter, metadata.Item,
+		"The count of relayed data points dropped because the relay queue was full (reason=full) or the backend server rejected their batch (reason=error).")
 }
 
 func Listen(listenAddr string, devMode bool, tsdbHost string) error {
@@ -89,17 +93,43 @@ func Listen(listenAddr string, devMode bool, tsdbHost string) error {
 
 	if tsdbHost != "" {
 		router.HandleFunc("/api/index", IndexTSDB)
-		router.Handle("/api/put", Relay(tsdbHost))
+		if c := schedule.Conf; c != nil && c.RelayBatchSize > 0 {
+			router.Handle("/api/put", newRelayBatcher(tsdbHost, c))
+		} else {
+			router.Handle("/api/put", Relay(tsdbHost))
+		}
 	}
 
 	router.HandleFunc("/api/", APIRedirect)
 	router.Handle("/api/action", JSON(Action))
+	router.HandleFunc("/api/ack/signed", SignedAck)
 	router.Handle("/api/alerts", JSON(Alerts))
+	router.Handle("/api/alerts/owners", JSON(AlertOwners))
+	router.Handle("/api/alerts/enabled", JSON(AlertsSetEnabled))
+	router.Handle("/api/alerts/test", JSON(AlertTests))
 	router.Handle("/api/config", miniprofiler.NewHandler(Config))
 	router.Handle("/api/config_test", miniprofiler.NewHandler(ConfigTest))
+	router.Handle("/api/config/expand", JSON(ConfigExpand))
+	router.Handle("/api/config/lint", JSON(ConfigLint))
+	router.Handle("/api/config/import/prometheus", JSON(ConfigImportPrometheus))
+	router.Handle("/api/config/hash", JSON(ConfigAlertHash))
+	router.Handle("/api/config/diff", JSON(ConfigAlertDiff))
+	router.Handle("/api/config/effective", JSON(ConfigEffective))
+	router.Handle("/api/config/preview", JSON(ConfigPreview))
+	router.Handle("/api/config/reload", JSON(ConfigReload))
+	router.Handle("/api/config/save", JSON(ConfigSave))
+	router.Handle("/api/config/snapshots", JSON(ConfigSnapshots))
+	router.Handle("/api/config/snapshot", JSON(ConfigSnapshot))
+	router.Handle("/api/config/snapshot/restore", JSON(ConfigRestoreSnapshot))
 	router.Handle("/api/egraph/{bs}.{format:svg|png}", JSON(ExprGraph))
 	router.Handle("/api/errors", JSON(ErrorHistory))
+	router.Handle("/api/dependency/suppressed", JSON(DependencySuppressed))
+	router.Handle("/api/dependency/why", JSON(DependencyWhy))
+	router.Handle("/api/dependency/dependents", JSON(AlertDependents))
 	router.Handle("/api/expr", JSON(Expr))
+	router.Handle("/api/expr/eval", JSON(ExprEval))
+	router.Handle("/api/expr/diff", JSON(ExprDiff))
+	router.Handle("/api/expr/funcs", JSON(ExprFuncs))
 	router.Handle("/api/graph", JSON(Graph))
 	router.Handle("/api/health", JSON(HealthCheck))
 	router.Handle("/api/host", JSON(Host))
@@ -108,6 +138,13 @@ func Listen(listenAddr string, devMode bool, tsdbHost string) error {
 	router.Handle("/api/incidents", JSON(Incidents))
 	router.Handle("/api/incidents/open", JSON(ListOpenIncidents))
 	router.Handle("/api/incidents/events", JSON(IncidentEvents))
+	router.Handle("/api/backends", JSON(BackendsGet))
+	router.Handle("/api/backends/disable", JSON(BackendDisable))
+	router.Handle("/api/backends/enable", JSON(BackendEnable))
+	router.Handle("/api/maintenance", JSON(MaintenanceGet))
+	router.Handle("/api/maintenance/clear", JSON(MaintenanceClear))
+	router.Handle("/api/maintenance/set", JSON(MaintenanceSet))
+	router.Handle("/api/storm", JSON(StormGet))
 	router.Handle("/api/metadata/get", JSON(GetMetadata))
 	router.Handle("/api/metadata/metrics", JSON(MetadataMetrics))
 	router.Handle("/api/metadata/put", JSON(PutMetadata))
@@ -121,10 +158,13 @@ func Listen(listenAddr string, devMode bool, tsdbHost string) error {
 	router.Handle("/api/silence/get", JSON(SilenceGet))
 	router.Handle("/api/silence/set", JSON(SilenceSet))
 	router.Handle("/api/status", JSON(Status))
+	router.Handle("/api/testmode", JSON(TestMode))
 	router.Handle("/api/tagk/{metric}", JSON(TagKeysByMetric))
 	router.Handle("/api/tagv/{tagk}", JSON(TagValuesByTagKey))
 	router.Handle("/api/tagv/{tagk}/{metric}", JSON(TagValuesByMetricTagKey))
 	router.Handle("/api/tagsets/{metric}", JSON(FilteredTagsetsByMetric))
+	router.Handle("/api/notifications/deliveries", JSON(NotificationDeliveries))
+	router.Handle("/api/notifications/breakers", JSON(NotificationBreakers))
 	router.Handle("/api/opentsdb/version", JSON(OpenTSDBVersion))
 	router.Handle("/api/annotate", JSON(AnnotateEnabled))
 
@@ -205,10 +245,9 @@ func Relay(dest string) http.Handler {
 	})}
 }
 
-func indexTSDB(r *http.Request, body []byte) {
-	clean := func(s string) string {
-		return opentsdb.MustReplace(s, "_")
-	}
+// decodeDataPoints returns the data points of a put body, which may be
+// gzipped, or nil if it has none.
+func decodeDataPoints(body []byte) opentsdb.MultiDataPoint {
 	if r, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
 		body, _ = ioutil.ReadAll(r)
 		r.Close()
@@ -219,6 +258,17 @@ func indexTSDB(r *http.Request, body []byte) {
 	} else if err = json.Unmarshal(body, &dp); err == nil {
 		mdp = opentsdb.MultiDataPoint{&dp}
 	}
+	return mdp
+}
+
+func indexTSDB(r *http.Request, body []byte) {
+	indexDataPoints(r, decodeDataPoints(body))
+}
+
+func indexDataPoints(r *http.Request, mdp opentsdb.MultiDataPoint) {
+	clean := func(s string) string {
+		return opentsdb.MustReplace(s, "_")
+	}
 	if len(mdp) > 0 {
 		ra := strings.Split(r.RemoteAddr, ":")[0]
 		tags := opentsdb.TagSet{"remote": clean(ra)}
@@ -339,6 +389,8 @@ func Shorten(w http.ResponseWriter, r *http.Request) {
 type Health struct {
 	// RuleCheck is true if last check happened within the check frequency window.
 	RuleCheck bool
+	// DisabledBackends are the backends in maintenance, which are not queried.
+	DisabledBackends []*sched.BackendMaintenance
 }
 
 func Quiet(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
@@ -348,6 +400,7 @@ func Quiet(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interf
 func HealthCheck(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	var h Health
 	h.RuleCheck = schedule.LastCheck.After(time.Now().Add(-schedule.Conf.CheckFrequency))
+	h.DisabledBackends = schedule.DisabledBackends()
 	return h, nil
 }
 
@@ -697,6 +750,123 @@ func SilenceClear(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request)
 	return nil, schedule.ClearSilence(id)
 }
 
+// MaintenanceGet returns the active maintenance window, if any, and the recent
+// ones.
+func MaintenanceGet(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return struct {
+		Active  *sched.Maintenance
+		History []*sched.Maintenance
+	}{
+		schedule.ActiveMaintenance(),
+		schedule.MaintenanceHistory(),
+	}, nil
+}
+
+func MaintenanceSet(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var data map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	d, err := opentsdb.ParseDuration(data["duration"])
+	if err != nil {
+		return nil, err
+	}
+	return schedule.SetMaintenance(time.Duration(d), data["user"], data["message"])
+}
+
+func MaintenanceClear(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var data map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return nil, schedule.ClearMaintenance(data["user"])
+}
+
+// StormGet returns the alert storm in progress, if any, and the recent ones.
+func StormGet(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return struct {
+		Active  *sched.AlertStorm
+		History []*sched.AlertStorm
+	}{
+		schedule.ActiveStorm(),
+		schedule.StormHistory(),
+	}, nil
+}
+
+// BackendsGet returns the configured backends and those in maintenance.
+func BackendsGet(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return struct {
+		Enabled  []string
+		Disabled []*sched.BackendMaintenance
+	}{
+		schedule.Conf.EnabledBackends(),
+		schedule.DisabledBackends(),
+	}, nil
+}
+
+func BackendDisable(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var data map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return schedule.DisableBackend(data["backend"], data["user"], data["message"])
+}
+
+func BackendEnable(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var data map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return nil, schedule.EnableBackend(data["backend"], data["user"])
+}
+
+// ConfigSave writes the configuration text in the body back to where the
+// running configuration was read from.
+func ConfigSave(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if r.Method != "POST" {
+		return nil, fmt.Errorf("expected POST")
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return nil, schedule.SaveRules(string(b))
+}
+
+// ConfigSnapshots returns the saved configuration snapshots, most recent
+// first.
+func ConfigSnapshots(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return schedule.DataAccess.Configs().ListConfigSnapshots()
+}
+
+func ConfigSnapshot(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var data map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return schedule.SnapshotConfig(data["name"], data["user"])
+}
+
+// ConfigRestoreSnapshot saves a snapshot as the rule editor saves a
+// configuration, and returns the hash to open it with.
+func ConfigRestoreSnapshot(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var data map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	hash, err := schedule.RestoreSnapshot(data["name"])
+	if err != nil {
+		return nil, err
+	}
+	return struct{ Hash string }{hash}, nil
+}
+
+// ConfigReload returns the outcome of the last attempt to reload the
+// configuration, or null if it has not been reloaded.
+func ConfigReload(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return conf.ReloadStatus(), nil
+}
+
 func ConfigTest(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -713,6 +883,49 @@ func ConfigTest(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ConfigLint returns the diagnostics of the configuration in the request
+// body. Warnings are advisory; only errors make the configuration invalid.
+func ConfigLint(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty config")
+	}
+	diags := conf.LintConfig("test", string(b))
+	if diags == nil {
+		diags = []conf.Diagnostic{}
+	}
+	return diags, nil
+}
+
+// ConfigImportPrometheus translates the Prometheus alerting rules file in the
+// request body into configuration text. The text is not saved; Error is the
+// error, if any, of the current configuration with the text appended, so it
+// can be reviewed and saved like any other change.
+func ConfigImportPrometheus(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty rules")
+	}
+	imp, err := conf.ImportPrometheusRules(b)
+	if err != nil {
+		return nil, err
+	}
+	res := struct {
+		*conf.PromImport
+		Error string `json:",omitempty"`
+	}{PromImport: imp}
+	if _, err := conf.New("import", schedule.Conf.RawText+"\n"+imp.Config); err != nil {
+		res.Error = err.Error()
+	}
+	return res, nil
+}
+
 func Config(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) {
 	var text string
 	var err error
@@ -770,6 +983,179 @@ func ScheduleLockStatus(t miniprofiler.Timer, w http.ResponseWriter, r *http.Req
 	return data, nil
 }
 
+// DependencySuppressed returns the alerts currently held quiet because their
+// depends expression could not be evaluated. If alert is given, only that
+// alert's suppression (or null) is returned.
+func DependencySuppressed(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if alert := r.FormValue("alert"); alert != "" {
+		return schedule.DependencySuppressed(alert), nil
+	}
+	return schedule.DependencySuppressions(), nil
+}
+
+// DependencyWhy returns why the alert keys of alert, optionally only those
+// with tags, were held quiet by its depends expression.
+func DependencyWhy(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	alert := r.FormValue("alert")
+	if alert == "" {
+		return nil, fmt.Errorf("missing alert")
+	}
+	var tags opentsdb.TagSet
+	if v := r.FormValue("tags"); v != "" {
+		var err error
+		if tags, err = opentsdb.ParseTags(v); err != nil {
+			return nil, err
+		}
+	}
+	return schedule.DependencyExplanations(alert, tags), nil
+}
+
+// ConfigExpand returns the text of alert after macro and variable expansion,
+// annotated with where each line came from.
+func ConfigExpand(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return schedule.Conf.ExpandTrace(r.FormValue("alert"))
+}
+
+// ConfigAlertHash returns a hash of the definition of alert, which changes
+// only when the alert, its template or its notifications do.
+func ConfigAlertHash(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return schedule.Conf.AlertHash(r.FormValue("alert"))
+}
+
+// ConfigAlertDiff returns the unified diff of the alert in the alert
+// parameter between the running configuration and the one in the request
+// body.
+func ConfigAlertDiff(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	diff, err := schedule.Conf.AlertDiff(r.FormValue("alert"), string(b))
+	if err != nil {
+		return nil, err
+	}
+	return struct{ Diff string }{diff}, nil
+}
+
+// ConfigEffective returns the alerts that apply to the tag set in the tags
+// parameter, such as host=ny-web01,service=web, and the notifications each
+// would send for it.
+func ConfigEffective(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	tags := make(opentsdb.TagSet)
+	if v := r.FormValue("tags"); v != "" {
+		var err error
+		if tags, err = opentsdb.ParseTags(v); err != nil {
+			return nil, err
+		}
+	}
+	return schedule.Conf.GetEffectiveConfig(tags), nil
+}
+
+// ConfigPreview returns who the alert in the alert parameter would notify,
+// and when, for the tag set in the tags parameter once it becomes the status
+// parameter, warning or critical (the default).
+func ConfigPreview(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	tags := make(opentsdb.TagSet)
+	if v := r.FormValue("tags"); v != "" {
+		var err error
+		if tags, err = opentsdb.ParseTags(v); err != nil {
+			return nil, err
+		}
+	}
+	status := models.StCritical
+	switch v := r.FormValue("status"); v {
+	case "", "critical":
+	case "warning":
+		status = models.StWarning
+	default:
+		return nil, fmt.Errorf("unknown status: %q", v)
+	}
+	return schedule.Conf.PreviewNotifications(r.FormValue("alert"), tags, status)
+}
+
+// AlertsSetEnabled enables or disables the alerts matching a selector, and
+// returns how many changed and the hash to open the saved configuration with.
+func AlertsSetEnabled(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	var data struct {
+		Selector string
+		Enabled  bool
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	count, hash, err := schedule.BulkSetEnabled(data.Selector, data.Enabled)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Count int
+		Hash  string
+	}{count, hash}, nil
+}
+
+// AlertOwners returns the names of the alerts of each owner, or of only
+// owner if it is given. Alerts without an owner are under "".
+func AlertOwners(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	owners := schedule.Conf.AlertsByOwner()
+	owner := r.FormValue("owner")
+	if _, ok := r.Form["owner"]; ok {
+		names := owners[owner]
+		if names == nil {
+			names = []string{}
+		}
+		return names, nil
+	}
+	return owners, nil
+}
+
+// AlertDependents returns the names of the alerts whose expressions reference
+// alert, which must be removed or changed before alert can be deleted.
+func AlertDependents(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	alert := r.FormValue("alert")
+	if schedule.Conf.Alerts[alert] == nil {
+		return nil, fmt.Errorf("unknown alert: %q", alert)
+	}
+	deps := schedule.Conf.AlertDependents(alert)
+	if deps == nil {
+		deps = []string{}
+	}
+	return deps, nil
+}
+
+// NotificationBreakers returns the circuit breaker state of each post and get
+// notification target.
+func NotificationBreakers(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return conf.BreakerStates(), nil
+}
+
+// NotificationDeliveries returns the most recent delivery results by
+// notification name. The results may be limited to a single notification with
+// name, and to a single alert key with ak.
+func NotificationDeliveries(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	all := conf.AllRecentDeliveries()
+	if name := r.FormValue("name"); name != "" {
+		all = map[string][]*conf.DeliveryResult{name: all[name]}
+	}
+	if ak := r.FormValue("ak"); ak != "" {
+		for name, results := range all {
+			var filtered []*conf.DeliveryResult
+			for _, dr := range results {
+				if dr.AlertKey == ak {
+					filtered = append(filtered, dr)
+				}
+			}
+			all[name] = filtered
+		}
+	}
+	return all, nil
+}
+
+// TestMode returns, by alert name, how many notifications alerts with
+// testMode set would have sent since bosun started.
+func TestMode(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return schedule.WouldNotifyCounts(), nil
+}
+
 func ErrorHistory(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	if r.Method == "GET" {
 		data, err := schedule.DataAccess.Errors().GetFullErrorHistory()
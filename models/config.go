@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// ConfigSnapshot is a named copy of the configuration text, taken so that a
+// known-good configuration can be restored later.
+type ConfigSnapshot struct {
+	Name string
+	User string
+	Time time.Time
+	Text string
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"encoding/json"
+	"fmt"
 	"math"
 	"time"
 
@@ -38,12 +39,34 @@ type IncidentState struct {
 
 	LastAbnormalStatus Status
 	LastAbnormalTime   int64
+
+	// NotificationTags are extra tags computed by the alert's
+	// notificationTags expression on its most recent check.
+	NotificationTags opentsdb.TagSet `json:",omitempty"`
 }
 
 func (s *IncidentState) Group() opentsdb.TagSet {
 	return s.AlertKey.Group()
 }
 
+// NotificationGroup returns the group used to resolve notification lookups:
+// the alert key's group plus any NotificationTags it does not already have.
+func (s *IncidentState) NotificationGroup() opentsdb.TagSet {
+	g := s.Group()
+	if len(s.NotificationTags) == 0 {
+		return g
+	}
+	if g == nil {
+		g = make(opentsdb.TagSet)
+	}
+	for k, v := range s.NotificationTags {
+		if _, ok := g[k]; !ok {
+			g[k] = v
+		}
+	}
+	return g
+}
+
 func (s *IncidentState) Last() Event {
 	if len(s.Events) == 0 {
 		return Event{}
@@ -60,6 +83,11 @@ type Event struct {
 	Status      Status
 	Time        time.Time
 	Unevaluated bool
+
+	NotificationTags opentsdb.TagSet `json:",omitempty"`
+	// Escalated is whether Status is critical only because the alert key
+	// had been warning for the alert's warnToCritAfter.
+	Escalated bool `json:",omitempty"`
 }
 
 type EventsByTime []Event
@@ -256,3 +284,23 @@ type Attachment struct {
 	Filename    string
 	ContentType string
 }
+
+// NotificationJournalEntry is a notification owed for an incident, recorded
+// so that it can be sent after a restart if it was not sent before.
+type NotificationJournalEntry struct {
+	AlertKey     AlertKey
+	Notification string
+	IncidentId   int64
+	Status       Status
+	// Chain, if set, are the notifications of a first success chain
+	// starting with Notification, tried in order until one is delivered.
+	Chain []string `json:",omitempty"`
+	// Time is when the notification was queued.
+	Time time.Time
+}
+
+// Key identifies the notification of the entry: later entries of the same
+// notification for the same incident and status have the same key.
+func (e *NotificationJournalEntry) Key() string {
+	return fmt.Sprintf("%d:%s:%s:%s", e.IncidentId, e.Status, e.Notification, e.AlertKey)
+}
@@ -3,6 +3,7 @@ package opentsdb // import "bosun.org/opentsdb"
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,6 +17,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 	"unicode/utf8"
@@ -540,6 +542,29 @@ func ParseQuery(query string, version Version) (q *Query, err error) {
 	return
 }
 
+var downsampleRE = regexp.MustCompile(`^\d+(?:ms|s|m|h|d|w|n|y)-\w+(?:-(\w+))?$`)
+
+// ValidDownsample returns an error unless ds is a downsample specifier
+// OpenTSDB version accepts, such as 5m-avg, or, from 2.2, 5m-avg-zero with a
+// fill policy.
+func ValidDownsample(ds string, version Version) error {
+	m := downsampleRE.FindStringSubmatch(ds)
+	if m == nil {
+		return fmt.Errorf("opentsdb: bad downsample format: %s, expected interval-aggregator such as 5m-avg", ds)
+	}
+	if m[1] == "" {
+		return nil
+	}
+	if !version.FilterSupport() {
+		return fmt.Errorf("opentsdb: downsample fill policies require version 2.2: %s", ds)
+	}
+	switch m[1] {
+	case "none", "nan", "null", "zero":
+		return nil
+	}
+	return fmt.Errorf("opentsdb: bad downsample fill policy %s, must be none, nan, null or zero", m[1])
+}
+
 var filterValueRe = regexp.MustCompile(`([a-z_]+)\((.*)\)$`)
 
 // ParseFilters parses filters in the form of `tagk=filterFunc(...),...`
@@ -882,6 +907,13 @@ var DefaultClient = &http.Client{
 // QueryResponse performs a v2 OpenTSDB request to the given host. host should
 // be of the form hostname:port. A nil client uses DefaultClient.
 func (r *Request) QueryResponse(host string, client *http.Client) (*http.Response, error) {
+	return r.queryResponse(host, client, false)
+}
+
+// queryResponse performs the request, gzip compressing the request body if
+// compress is set. Responses are always accepted gzipped; the http client
+// requests and transparently decompresses them.
+func (r *Request) queryResponse(host string, client *http.Client, compress bool) (*http.Response, error) {
 	u := url.URL{
 		Scheme: "http",
 		Host:   host,
@@ -894,12 +926,32 @@ func (r *Request) QueryResponse(host string, client *http.Client) (*http.Respons
 	if client == nil {
 		client = DefaultClient
 	}
-	resp, err := client.Post(u.String(), "application/json", bytes.NewReader(b))
+	body := b
+	if compress {
+		buf := new(bytes.Buffer)
+		gz := gzip.NewWriter(buf)
+		if _, err := gz.Write(b); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		e := RequestError{Request: string(b)}
+		e := RequestError{Request: string(b), StatusCode: resp.StatusCode}
 		defer resp.Body.Close()
 		body, _ := ioutil.ReadAll(resp.Body)
 		if err := json.NewDecoder(bytes.NewBuffer(body)).Decode(&e); err == nil {
@@ -909,7 +961,7 @@ func (r *Request) QueryResponse(host string, client *http.Client) (*http.Respons
 		if len(body) > 0 {
 			s = fmt.Sprintf("%s: %s", s, body)
 		}
-		return nil, errors.New(s)
+		return nil, &RequestError{Request: string(b), StatusCode: resp.StatusCode, message: s}
 	}
 	return resp, nil
 }
@@ -922,9 +974,16 @@ type RequestError struct {
 		Message string `json:"message"`
 		Details string `json:"details"`
 	} `json:"error"`
+	// StatusCode is the HTTP status of the response.
+	StatusCode int `json:"-"`
+
+	message string
 }
 
 func (r *RequestError) Error() string {
+	if r.message != "" {
+		return r.message
+	}
 	return fmt.Sprintf("opentsdb: %s: %s", r.Request, r.Err.Message)
 }
 
@@ -966,8 +1025,18 @@ type LimitContext struct {
 	FilterTags bool
 	// Use the version to see if groupby and filters are supported
 	TSDBVersion Version
+	// Gzip compresses request bodies. If the server rejects a compressed
+	// request, the request is retried uncompressed and compression is no
+	// longer attempted for that host.
+	Gzip bool
 }
 
+// gzipUnsupported records hosts that rejected gzip compressed requests.
+var gzipUnsupported = struct {
+	sync.Mutex
+	hosts map[string]bool
+}{hosts: make(map[string]bool)}
+
 // NewLimitContext returns a new context for the given host with response sizes limited
 // to limit bytes.
 func NewLimitContext(host string, limit int64, version Version) *LimitContext {
@@ -986,7 +1055,7 @@ func (c *LimitContext) Version() Version {
 // Query returns the result of the request. r may be cached. The request is
 // byte-limited and filtered by c's properties.
 func (c *LimitContext) Query(r *Request) (tr ResponseSet, err error) {
-	resp, err := r.QueryResponse(c.Host, nil)
+	resp, err := c.queryResponse(r)
 	if err != nil {
 		return
 	}
@@ -1007,6 +1076,23 @@ func (c *LimitContext) Query(r *Request) (tr ResponseSet, err error) {
 	return
 }
 
+func (c *LimitContext) queryResponse(r *Request) (*http.Response, error) {
+	gzipUnsupported.Lock()
+	compress := c.Gzip && !gzipUnsupported.hosts[c.Host]
+	gzipUnsupported.Unlock()
+	resp, err := r.queryResponse(c.Host, nil, compress)
+	if re, ok := err.(*RequestError); ok && compress && (re.StatusCode == http.StatusBadRequest || re.StatusCode == http.StatusUnsupportedMediaType) {
+		resp, err = r.queryResponse(c.Host, nil, false)
+		if err == nil {
+			slog.Infof("opentsdb host %s does not accept gzip requests, disabling compression", c.Host)
+			gzipUnsupported.Lock()
+			gzipUnsupported.hosts[c.Host] = true
+			gzipUnsupported.Unlock()
+		}
+	}
+	return resp, err
+}
+
 // FilterTags removes tagks in tr not present in r. Does nothing in the event of
 // multiple queries in the request.
 func FilterTags(r *Request, tr ResponseSet) {
@@ -1,6 +1,11 @@
 package opentsdb
 
 import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 )
 
@@ -294,6 +299,33 @@ func TestQueryString(t *testing.T) {
 	}
 }
 
+func TestValidDownsample(t *testing.T) {
+	tests := []struct {
+		ds      string
+		version Version
+		error   bool
+	}{
+		{"5m-avg", Version2_1, false},
+		{"500ms-sum", Version2_1, false},
+		{"1h-max-zero", Version2_2, false},
+
+		{"", Version2_1, true},
+		{"avg", Version2_1, true},
+		{"5-avg", Version2_1, true},
+		{"5x-avg", Version2_1, true},
+		{"1h-max-zero", Version2_1, true},
+		{"1h-max-fill", Version2_2, true},
+	}
+	for _, test := range tests {
+		err := ValidDownsample(test.ds, test.version)
+		if err != nil && !test.error {
+			t.Errorf("got error: %s: %s", test.ds, err)
+		} else if err == nil && test.error {
+			t.Errorf("expected error: %s", test.ds)
+		}
+	}
+}
+
 func TestValidTSDBString(t *testing.T) {
 	tests := map[string]bool{
 		"abcXYZ012_./-": true,
@@ -334,3 +366,49 @@ func TestAllSubsets(t *testing.T) {
 		t.Fatal("Expect 15 subsets")
 	}
 }
+
+func TestLimitContextGzip(t *testing.T) {
+	for _, accept := range []bool{true, false} {
+		var gzipped, plain int
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req Request
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				gzipped++
+				if !accept {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.Body = gz
+			} else {
+				plain++
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Fatal(err)
+			}
+			json.NewEncoder(w).Encode(ResponseSet{{Metric: "m", DPS: map[string]Point{"0": 1}}})
+		}))
+		u, _ := url.Parse(ts.URL)
+		c := NewLimitContext(u.Host, 1<<20, Version2_1)
+		c.Gzip = true
+		for i := 0; i < 2; i++ {
+			rs, err := c.Query(&Request{Start: 0, Queries: []*Query{{Metric: "m", Aggregator: "sum"}}})
+			if err != nil {
+				t.Fatalf("accept=%v: %v", accept, err)
+			}
+			if len(rs) != 1 {
+				t.Fatalf("accept=%v: expected 1 response, got %d", accept, len(rs))
+			}
+		}
+		if accept && (gzipped != 2 || plain != 0) {
+			t.Errorf("expected 2 gzipped requests, got %d gzipped, %d plain", gzipped, plain)
+		}
+		if !accept && (gzipped != 1 || plain != 2) {
+			t.Errorf("expected 1 gzipped then 2 plain requests, got %d gzipped, %d plain", gzipped, plain)
+		}
+		ts.Close()
+	}
+}